@@ -17,10 +17,16 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/rancher-sandbox/elemental/cmd/config"
+	"github.com/rancher-sandbox/elemental/pkg/cloudinit"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
 	"k8s.io/mount-utils"
 
 	"github.com/mudler/yip/pkg/schema"
@@ -34,7 +40,7 @@ var cloudInit = &cobra.Command{
 	Short: "elemental cloud-init",
 	Args:  cobra.MinimumNArgs(1),
 	PreRun: func(cmd *cobra.Command, args []string) {
-		_ = viper.BindPFlags(cmd.Flags())
+		_ = config.BindFlags(cmd)
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), &mount.FakeMounter{})
@@ -63,8 +69,74 @@ var cloudInit = &cobra.Command{
 	},
 }
 
+// cloudInitValidate represents the cloud-init validate subcommand
+var cloudInitValidate = &cobra.Command{
+	Use:   "validate [FILE|DIR|URL...]",
+	Short: "validate cloud-init files without running them, defaults to the cloud-init paths",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), &mount.FakeMounter{})
+		if err != nil {
+			return err
+		}
+		cfg.SetContext(cmd.Context())
+		root, _ := cmd.Flags().GetString("root")
+		strict, _ := cmd.Flags().GetBool("strict")
+		stages, _ := cmd.Flags().GetStringSlice("stage-name")
+
+		explicit := len(args) > 0
+		if !explicit {
+			args = constants.GetCloudInitPaths()
+			if cfg.CloudInitPaths != "" {
+				args = append(args, strings.Split(cfg.CloudInitPaths, " ")...)
+			}
+		}
+
+		cmd.SilenceUsage = true
+		validator := cloudinit.NewValidator(cfg.Fs, root, stages...)
+		issues := []cloudinit.ValidationIssue{}
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+				tmpDir, err := utils.TempDir(cfg.Fs, "", "elemental-cloud-init")
+				if err != nil {
+					return err
+				}
+				file := filepath.Join(tmpDir, "cloud-init.yaml")
+				err = cfg.Client.GetURL(cfg.Context, cfg.Logger, arg, file)
+				if err == nil {
+					data, _ := cfg.Fs.ReadFile(file)
+					issues = append(issues, validator.Validate(arg, data)...)
+				} else {
+					issues = append(issues, cloudinit.ValidationIssue{File: arg, Message: err.Error()})
+				}
+				_ = cfg.Fs.RemoveAll(tmpDir)
+			} else if exists, _ := utils.Exists(cfg.Fs, arg); exists || explicit {
+				// Default cloud-init paths are not required to exist
+				issues = append(issues, validator.ValidatePath(arg)...)
+			}
+		}
+
+		errs, warns := 0, 0
+		for _, issue := range issues {
+			fmt.Fprintln(cmd.OutOrStdout(), issue)
+			if issue.Warning {
+				warns++
+			} else {
+				errs++
+			}
+		}
+		if errs > 0 || (strict && warns > 0) {
+			return fmt.Errorf("found %d errors and %d warnings", errs, warns)
+		}
+		return nil
+	},
+}
+
 func init() {
 	rootCmd.AddCommand(cloudInit)
+	cloudInit.AddCommand(cloudInitValidate)
+	cloudInitValidate.Flags().String("root", "/", "Root path used to check the files referenced by the cloud-init files")
+	cloudInitValidate.Flags().Bool("strict", false, "Fail on warnings too")
+	cloudInitValidate.Flags().StringSlice("stage-name", []string{}, "Extra stage names to consider valid")
 	cloudInit.PersistentFlags().StringP("stage", "s", "default", "Stage to apply")
 	cloudInit.PersistentFlags().BoolP("dotnotation", "d", false, "Parse input in dotnotation ( e.g. `stages.foo.name=..` ) ")
 }
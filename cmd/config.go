@@ -0,0 +1,101 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/rancher-sandbox/elemental/cmd/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "inspect the elemental configuration",
+	Args:  cobra.ExactArgs(0),
+}
+
+// configShowCmd represents the config show subcommand
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "show the effective configuration and the source of each value",
+	Args:  cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		command, _ := cmd.Flags().GetString("command")
+		cfg, provenance, err := config.ReadConfigRunWithProvenance(viper.GetString("config-dir"), command, &mount.FakeMounter{})
+		if err != nil {
+			cfg.Logger.Errorf("Error reading config: %s\n", err)
+		}
+
+		values := config.RunConfigValues(cfg)
+		keys := []string{}
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		all, _ := cmd.Flags().GetBool("all")
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+		for _, key := range keys {
+			source := provenance.Source(key)
+			if source == config.SourceDefault && !all {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%v\t%s\n", key, values[key], source)
+		}
+		return w.Flush()
+	},
+}
+
+// configValidateCmd represents the config validate subcommand
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "validate the configuration files for unknown keys, wrong types and conflicting options",
+	Args:  cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configDir := viper.GetString("config-dir")
+		cfg, err := config.ReadConfigRun(configDir, &mount.FakeMounter{})
+		if err != nil {
+			cfg.Logger.Errorf("Error reading config: %s\n", err)
+		}
+
+		cmd.SilenceUsage = true
+		errs := config.ValidateConfigFiles(configDir)
+		errs = append(errs, config.CheckConflicts(cfg)...)
+		for _, e := range errs {
+			fmt.Fprintln(cmd.OutOrStdout(), e)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("found %d configuration problems", len(errs))
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), "Configuration is valid")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd, configValidateCmd)
+	configShowCmd.Flags().Bool("all", false, "Show also the keys using default values")
+	configShowCmd.Flags().String("command", "", "Show the configuration for the given command (install, upgrade or reset) including its config section")
+}
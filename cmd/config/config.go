@@ -49,10 +49,29 @@ func ReadConfigBuild(configDir string) (*v1.BuildConfig, error) {
 	viper.AutomaticEnv() // read in environment variables that match
 	// unmarshal all the vars into the config object
 	_ = viper.Unmarshal(cfg)
-	return cfg, nil
+	err := setPlatform(&cfg.Config)
+	return cfg, err
 }
 
+// ReadConfigRun returns the RunConfig merging the configuration files, environment variables
+// and flags
 func ReadConfigRun(configDir string, mounter mount.Interface) (*v1.RunConfig, error) {
+	cfg, _, err := ReadConfigRunWithProvenance(configDir, "", mounter)
+	return cfg, err
+}
+
+// ReadConfigRunForCommand returns the RunConfig as ReadConfigRun does, including the values of
+// the given command section (install, upgrade or reset) which take precedence over the shared ones
+func ReadConfigRunForCommand(configDir string, command string, mounter mount.Interface) (*v1.RunConfig, error) {
+	cfg, _, err := ReadConfigRunWithProvenance(configDir, command, mounter)
+	return cfg, err
+}
+
+// ReadConfigRunWithProvenance returns the RunConfig as ReadConfigRunForCommand does and the
+// source that set each of the configuration keys. Command can be empty to ignore command sections.
+func ReadConfigRunWithProvenance(configDir string, command string, mounter mount.Interface) (*v1.RunConfig, Provenance, error) {
+	provenance := Provenance{}
+	sectionProvenance := Provenance{}
 	cfg := config.NewRunConfig(
 		config.WithLogger(v1.NewLogger()),
 		config.WithMounter(mounter),
@@ -104,6 +123,7 @@ func ReadConfigRun(configDir string, mounter mount.Interface) (*v1.RunConfig, er
 			viper.SetConfigFile(c)
 			viper.SetConfigType("env")
 			cobra.CheckErr(viper.MergeInConfig())
+			provenance.addFile(c, "env")
 		}
 	}
 
@@ -115,6 +135,9 @@ func ReadConfigRun(configDir string, mounter mount.Interface) (*v1.RunConfig, er
 		err = viper.MergeInConfig()
 		if err != nil {
 			cfg.Logger.Warnf("error merging config files: %s", err)
+		} else {
+			provenance.addFile(viper.ConfigFileUsed(), "yaml")
+			sectionProvenance.addSection(viper.ConfigFileUsed(), command)
 		}
 	}
 
@@ -126,11 +149,25 @@ func ReadConfigRun(configDir string, mounter mount.Interface) (*v1.RunConfig, er
 			if !d.IsDir() {
 				viper.SetConfigName(d.Name())
 				cobra.CheckErr(viper.MergeInConfig())
+				provenance.addFile(viper.ConfigFileUsed(), "yaml")
+				sectionProvenance.addSection(viper.ConfigFileUsed(), command)
 			}
 			return nil
 		})
 	}
 
+	// Merge the command section over the shared keys, it goes into the config files
+	// layer so env variables and flags still take precedence
+	if section, ok := viper.Get(command).(map[string]interface{}); command != "" && ok {
+		err := viper.MergeConfigMap(section)
+		if err != nil {
+			cfg.Logger.Warnf("error merging %s config section: %s", command, err)
+		}
+		for key, source := range sectionProvenance {
+			provenance[key] = source
+		}
+	}
+
 	// Set the prefix for vars so we get only the ones starting with ELEMENTAL
 	viper.SetEnvPrefix("ELEMENTAL")
 
@@ -142,15 +179,43 @@ func ReadConfigRun(configDir string, mounter mount.Interface) (*v1.RunConfig, er
 	// Manually bind public key env variable as it uses a different name in config files or flags.
 	_ = viper.BindEnv("CosingPubKey", "COSIGN_PUBLIC_KEY_LOCATION")
 
+	// Command specific env variables (e.g. ELEMENTAL_UPGRADE_DOCKER_IMAGE) take precedence
+	// over the shared ones (e.g. ELEMENTAL_DOCKER_IMAGE)
+	if command != "" {
+		for key := range RunConfigKeys() {
+			_ = viper.BindEnv(key, commandEnvVar(command, key, replacer), envVar(key, replacer))
+		}
+	}
+
 	viper.AutomaticEnv() // read in environment variables that match
+	provenance.addEnv(command, replacer)
+	provenance.addFlags()
 
 	// unmarshal all the vars into the config object
 	err := viper.Unmarshal(cfg)
 	if err != nil {
 		cfg.Logger.Warnf("error unmarshalling config: %s", err)
 	}
+	if err = setPlatform(&cfg.Config); err != nil {
+		return cfg, provenance, err
+	}
 
 	cfg.Logger.Debugf("Full config loaded: %+v", cfg)
 
-	return cfg, nil
+	return cfg, provenance, nil
+}
+
+// setPlatform sets the platform of the container images to pull from the platform
+// setting, if any
+func setPlatform(cfg *v1.Config) error {
+	value := viper.GetString("platform")
+	if value == "" {
+		return nil
+	}
+	platform, err := v1.NewPlatform(value)
+	if err != nil {
+		return err
+	}
+	cfg.Platform = platform
+	return nil
 }
@@ -19,10 +19,14 @@ package config
 import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/mount-utils"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -111,4 +115,128 @@ var _ = Describe("Config", func() {
 			Expect(cfg.Logger.GetLevel()).To(Equal(logrus.DebugLevel))
 		})
 	})
+	Describe("Provenance", Label("config", "provenance"), func() {
+		var mounter mount.Interface
+
+		BeforeEach(func() {
+			mounter = &mount.FakeMounter{}
+			_ = os.Unsetenv("ELEMENTAL_TARGET")
+		})
+		AfterEach(func() {
+			_ = os.Unsetenv("ELEMENTAL_TARGET")
+		})
+
+		It("tracks the source of each key", func() {
+			_, provenance, err := ReadConfigRunWithProvenance("config/", "", mounter)
+			Expect(err).To(BeNil())
+			// viper uses absolute paths for the config paths
+			extraFile, _ := filepath.Abs(filepath.Join("config", "config.d", "01_config.yaml"))
+			Expect(provenance.Source("target")).To(Equal(extraFile))
+			Expect(provenance.Source("reboot")).To(Equal(SourceDefault))
+
+			_ = os.Setenv("ELEMENTAL_TARGET", "environment")
+			_, provenance, err = ReadConfigRunWithProvenance("config/", "", mounter)
+			Expect(err).To(BeNil())
+			Expect(provenance.Source("target")).To(Equal("env:ELEMENTAL_TARGET"))
+		})
+		It("tracks the keys set by flags", func() {
+			defer func() {
+				boundCommands = nil
+				viper.Reset()
+			}()
+			cmd := &cobra.Command{}
+			cmd.Flags().String("target", "", "target device")
+			cmd.Flags().Bool("reboot", false, "reboot")
+			Expect(BindFlags(cmd)).To(BeNil())
+
+			// Flags not set in the command line keep their previous source
+			_, provenance, err := ReadConfigRunWithProvenance("config/", "", mounter)
+			Expect(err).To(BeNil())
+			Expect(provenance.Source("reboot")).To(Equal(SourceDefault))
+
+			_ = os.Setenv("ELEMENTAL_TARGET", "environment")
+			Expect(cmd.Flags().Set("target", "/dev/flag")).To(BeNil())
+			cfg, provenance, err := ReadConfigRunWithProvenance("config/", "", mounter)
+			Expect(err).To(BeNil())
+			Expect(cfg.Target).To(Equal("/dev/flag"))
+			Expect(provenance.Source("target")).To(Equal("flag:--target"))
+			Expect(provenance.Source("reboot")).To(Equal(SourceDefault))
+		})
+		It("finds unknown keys and type errors in config files", func() {
+			dir, err := os.MkdirTemp("", "elemental-config")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+
+			cfgFile := filepath.Join(dir, "config.yaml")
+			err = os.WriteFile(cfgFile, []byte("target: /dev/sda\nforce-efi: maybe\nunknown-key: value\n"), cnst.FilePerm)
+			Expect(err).To(BeNil())
+
+			errs := ValidateConfigFiles(dir)
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Error()).To(Equal(cfgFile + ": unknown key 'unknown-key'"))
+			Expect(errs[1].Error()).To(ContainSubstring("force-efi"))
+
+			Expect(ValidateConfigFiles("config/")).To(BeEmpty())
+		})
+		It("finds conflicting options", func() {
+			cfg := &v1.RunConfig{
+				Reboot:     true,
+				PowerOff:   true,
+				DockerImg:  "image",
+				Directory:  "/dir",
+				SecureBoot: true,
+				Bootloader: cnst.SystemdBootBootloader,
+			}
+			errs := CheckConflicts(cfg)
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[1].Error()).To(Equal("'directory', 'docker-image' are mutually exclusive options"))
+			Expect(CheckConflicts(&v1.RunConfig{})).To(BeEmpty())
+		})
+	})
+	Describe("Command sections", Label("config", "sections"), func() {
+		var mounter mount.Interface
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			mounter = &mount.FakeMounter{}
+			dir, err = os.MkdirTemp("", "elemental-config")
+			Expect(err).To(BeNil())
+			cfgFile := "docker-image: shared\ntarget: /dev/sda\nupgrade:\n  docker-image: upgrade-image\n  strict: true\n"
+			err = os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(cfgFile), cnst.FilePerm)
+			Expect(err).To(BeNil())
+		})
+		AfterEach(func() {
+			_ = os.Unsetenv("ELEMENTAL_UPGRADE_DOCKER_IMAGE")
+			_ = os.RemoveAll(dir)
+		})
+
+		It("merges the command section over the shared keys", func() {
+			cfg, provenance, err := ReadConfigRunWithProvenance(dir, cnst.ActionUpgrade, mounter)
+			Expect(err).To(BeNil())
+			Expect(cfg.DockerImg).To(Equal("upgrade-image"))
+			Expect(cfg.Strict).To(BeTrue())
+			Expect(cfg.Target).To(Equal("/dev/sda"))
+			Expect(provenance.Source("docker-image")).To(HaveSuffix("config.yaml [upgrade]"))
+
+			cfg, err = ReadConfigRunForCommand(dir, cnst.ActionInstall, mounter)
+			Expect(err).To(BeNil())
+			Expect(cfg.DockerImg).To(Equal("shared"))
+		})
+		It("uses command specific env variables", func() {
+			_ = os.Setenv("ELEMENTAL_UPGRADE_DOCKER_IMAGE", "env-image")
+			cfg, provenance, err := ReadConfigRunWithProvenance(dir, cnst.ActionUpgrade, mounter)
+			Expect(err).To(BeNil())
+			Expect(cfg.DockerImg).To(Equal("env-image"))
+			Expect(provenance.Source("docker-image")).To(Equal("env:ELEMENTAL_UPGRADE_DOCKER_IMAGE"))
+		})
+		It("validates the keys of command sections", func() {
+			Expect(ValidateConfigFiles(dir)).To(BeEmpty())
+			err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("reset:\n  docker-img: typo\n"), cnst.FilePerm)
+			Expect(err).To(BeNil())
+			errs := ValidateConfigFiles(dir)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Error()).To(HaveSuffix("unknown key 'reset.docker-img'"))
+		})
+	})
 })
@@ -0,0 +1,266 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/rancher-sandbox/elemental/pkg/config"
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// SourceDefault is the source of configuration keys not set by any file or env variable
+	SourceDefault = "default"
+	// SourceEnv is the prefix of the source of configuration keys set by env variables
+	SourceEnv = "env"
+	// SourceFlag is the prefix of the source of configuration keys set by command line flags
+	SourceFlag = "flag"
+)
+
+// boundCommands are the commands whose flags are bound into the configuration
+var boundCommands []*cobra.Command
+
+// BindFlags binds the flags of the given command into the configuration and keeps track
+// of them, so the keys set on the command line are reported in the provenance
+func BindFlags(cmd *cobra.Command) error {
+	boundCommands = append(boundCommands, cmd)
+	return viper.BindPFlags(cmd.Flags())
+}
+
+// Provenance maps each configuration key to the source that set it last, either a
+// configuration file path or an env variable
+type Provenance map[string]string
+
+// Source returns the source of the given configuration key
+func (p Provenance) Source(key string) string {
+	if src, ok := p[strings.ToLower(key)]; ok {
+		return src
+	}
+	return SourceDefault
+}
+
+// addFile records the keys defined in the given configuration file
+func (p Provenance) addFile(path string, configType string) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType(configType)
+	if err := v.ReadInConfig(); err != nil {
+		return
+	}
+	for _, key := range v.AllKeys() {
+		p[topLevelKey(key)] = path
+	}
+}
+
+// addSection records the keys defined in the given command section of the configuration file
+func (p Provenance) addSection(path string, command string) {
+	if command == "" {
+		return
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return
+	}
+	if section := v.Sub(command); section != nil {
+		for _, key := range section.AllKeys() {
+			p[topLevelKey(key)] = fmt.Sprintf("%s [%s]", path, command)
+		}
+	}
+}
+
+// addEnv records the RunConfig keys set by ELEMENTAL_ prefixed env variables, command
+// specific variables take precedence
+func (p Provenance) addEnv(command string, replacer *strings.Replacer) {
+	for key := range RunConfigKeys() {
+		envs := []string{envVar(key, replacer)}
+		if command != "" {
+			envs = append([]string{commandEnvVar(command, key, replacer)}, envs...)
+		}
+		for _, env := range envs {
+			if _, ok := os.LookupEnv(env); ok {
+				p[key] = fmt.Sprintf("%s:%s", SourceEnv, env)
+				break
+			}
+		}
+	}
+}
+
+// addFlags records the RunConfig keys set by flags of the bound commands, flags take
+// precedence over any other source
+func (p Provenance) addFlags() {
+	for key := range RunConfigKeys() {
+		for _, cmd := range boundCommands {
+			if cmd.Flags().Lookup(key) != nil && cmd.Flags().Changed(key) {
+				p[key] = fmt.Sprintf("%s:--%s", SourceFlag, key)
+				break
+			}
+		}
+	}
+}
+
+// envVar returns the env variable name of the given configuration key
+func envVar(key string, replacer *strings.Replacer) string {
+	return fmt.Sprintf("ELEMENTAL_%s", strings.ToUpper(replacer.Replace(key)))
+}
+
+// commandEnvVar returns the env variable name of the given configuration key for the given command
+func commandEnvVar(command string, key string, replacer *strings.Replacer) string {
+	return fmt.Sprintf("ELEMENTAL_%s_%s", strings.ToUpper(command), strings.ToUpper(replacer.Replace(key)))
+}
+
+// CommandSections returns the commands that can have their own section in the configuration files
+func CommandSections() []string {
+	return []string{cnst.ActionInstall, cnst.ActionUpgrade, cnst.ActionReset}
+}
+
+// RunConfigKeys returns the configuration keys of the RunConfig, in lower case as viper
+// handles them, mapped to their struct field names
+func RunConfigKeys() map[string]string {
+	keys := map[string]string{}
+	t := reflect.TypeOf(v1.RunConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("mapstructure"), ",")[0]
+		if tag == "" {
+			continue
+		}
+		keys[strings.ToLower(tag)] = t.Field(i).Name
+	}
+	return keys
+}
+
+// RunConfigValues returns the values of the given RunConfig for each configuration key
+func RunConfigValues(cfg *v1.RunConfig) map[string]interface{} {
+	values := map[string]interface{}{}
+	v := reflect.ValueOf(cfg).Elem()
+	for key, field := range RunConfigKeys() {
+		values[key] = v.FieldByName(field).Interface()
+	}
+	return values
+}
+
+// ValidateConfigFiles checks the yaml configuration files of the given configuration
+// directory for unknown keys and values of the wrong type
+func ValidateConfigFiles(configDir string) []error {
+	var errs []error
+
+	keys := RunConfigKeys()
+	for _, file := range yamlConfigFiles(configDir) {
+		v := viper.New()
+		v.SetConfigFile(file)
+		v.SetConfigType("yaml")
+		if err := v.ReadInConfig(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", file, err))
+			continue
+		}
+
+		unknown := map[string]bool{}
+		for _, key := range v.AllKeys() {
+			name := topLevelKey(key)
+			if parts := strings.SplitN(key, ".", 2); len(parts) == 2 && isCommandSection(parts[0]) {
+				// Keys of command sections are checked one level down
+				name = fmt.Sprintf("%s.%s", parts[0], topLevelKey(parts[1]))
+				if _, ok := keys[topLevelKey(parts[1])]; ok {
+					continue
+				}
+			} else if _, ok := keys[name]; ok {
+				continue
+			}
+			if !unknown[name] {
+				unknown[name] = true
+				errs = append(errs, fmt.Errorf("%s: unknown key '%s'", file, name))
+			}
+		}
+
+		errs = append(errs, decodeErrors(file, "", v)...)
+		for _, command := range CommandSections() {
+			if section := v.Sub(command); section != nil {
+				errs = append(errs, decodeErrors(file, command, section)...)
+			}
+		}
+	}
+	return errs
+}
+
+// decodeErrors returns the errors decoding the given viper instance into a RunConfig
+func decodeErrors(file string, section string, v *viper.Viper) []error {
+	var errs []error
+
+	if section != "" {
+		file = fmt.Sprintf("%s [%s]", file, section)
+	}
+	if err := v.Unmarshal(&v1.RunConfig{}); err != nil {
+		// Decoding errors are reported as a list of '* <error>' lines
+		for _, line := range strings.Split(err.Error(), "\n") {
+			if strings.HasPrefix(line, "* ") {
+				errs = append(errs, fmt.Errorf("%s: %s", file, strings.TrimPrefix(line, "* ")))
+			}
+		}
+	}
+	return errs
+}
+
+// isCommandSection checks if the given key is a command section
+func isCommandSection(key string) bool {
+	for _, command := range CommandSections() {
+		if key == command {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckConflicts returns an error for each set of conflicting options of the given RunConfig
+func CheckConflicts(cfg *v1.RunConfig) []error {
+	return config.CheckConflicts(cfg)
+}
+
+// yamlConfigFiles returns the yaml configuration files of the given configuration directory
+// in the order they are merged
+func yamlConfigFiles(configDir string) []string {
+	var files []string
+
+	configFile := filepath.Join(configDir, "config.yaml")
+	if _, err := os.Stat(configFile); err == nil {
+		files = append(files, configFile)
+	}
+	cfgExtra := filepath.Join(configDir, "config.d")
+	if _, err := os.Stat(cfgExtra); err == nil {
+		_ = filepath.WalkDir(cfgExtra, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+// topLevelKey returns the root key of a nested viper key
+func topLevelKey(key string) string {
+	return strings.SplitN(key, ".", 2)[0]
+}
@@ -40,13 +40,29 @@ func addPowerFlags(cmd *cobra.Command) {
 func addSharedInstallUpgradeFlags(cmd *cobra.Command) {
 	cmd.Flags().String("directory", "", "Use directory as source to install from")
 	cmd.Flags().StringP("docker-image", "d", "", "Install a specified container image")
-	cmd.Flags().BoolP("no-verify", "", false, "Disable mtree checksum verification (requires images manifests generated with mtree separately)")
+	cmd.Flags().BoolP("no-verify", "", false, "Disable the verification of container images against the mtree manifest shipped in them (/etc/elemental/rootfs.mtree)")
 	cmd.Flags().BoolP("strict", "", false, "Enable strict check of hooks (They need to exit with 0)")
+	cmd.Flags().Uint("hook-timeout", 0, "Timeout in seconds for each hook executable, 0 means no timeout")
+	cmd.Flags().Uint("wait", 0, "Seconds to wait for another running install, upgrade or reset to finish, 0 means fail right away")
 
+	addPlatformFlag(cmd)
 	addCosignFlags(cmd)
 	addPowerFlags(cmd)
 }
 
+func addPlatformFlag(cmd *cobra.Command) {
+	cmd.Flags().String("platform", "", "Platform of the container image to pull, as in linux/arm64 (default is the host platform)")
+}
+
+func validatePlatformFlag(log v1.Logger) error {
+	if platform := viper.GetString("platform"); platform != "" {
+		if _, err := v1.NewPlatform(platform); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func validateCosignFlags(log v1.Logger) error {
 	if viper.GetString("cosign-key") != "" && !viper.GetBool("cosign") {
 		return errors.New("'cosign-key' requires 'cosign' option to be enabled")
@@ -82,6 +98,9 @@ func validateInstallUpgradeFlags(log v1.Logger) error {
 	if err := validateCosignFlags(log); err != nil {
 		return err
 	}
+	if err := validatePlatformFlag(log); err != nil {
+		return err
+	}
 	if err := validatePowerFlags(log); err != nil {
 		return err
 	}
@@ -0,0 +1,95 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rancher-sandbox/elemental/cmd/config"
+	"github.com/rancher-sandbox/elemental/pkg/history"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "show the install, upgrade and reset operations recorded on the system",
+	Args:  cobra.ExactArgs(0),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		_ = config.BindFlags(cmd)
+		return CheckRoot()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := exec.LookPath("mount")
+		if err != nil {
+			return err
+		}
+		mounter := mount.New(path)
+
+		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), mounter)
+		if err != nil {
+			cfg.Logger.Errorf("Error reading config: %s\n", err)
+		}
+
+		cmd.SilenceUsage = true
+		entries, err := history.Read(cfg)
+		if err != nil {
+			cfg.Logger.Errorf("Could not read history: %s", err)
+			return err
+		}
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(entries)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIMESTAMP\tACTION\tRESULT\tSOURCE\tIMAGES\tVERSION\tERROR")
+		for _, e := range entries {
+			result := "success"
+			if !e.Success {
+				result = "failure"
+			}
+			source := e.Source
+			if e.Digest != "" {
+				source = fmt.Sprintf("%s@%s", source, e.Digest)
+			} else if e.SourceVersion != "" {
+				source = fmt.Sprintf("%s@%s", source, e.SourceVersion)
+			}
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.Timestamp.Format(time.RFC3339), e.Action, result, source,
+				strings.Join(e.Images, ","), e.Version, e.Error,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.Flags().Bool("json", false, "Print the history entries in JSON format")
+}
@@ -0,0 +1,136 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rancher-sandbox/elemental/cmd/config"
+	"github.com/rancher-sandbox/elemental/pkg/action"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+)
+
+// imageCmd groups the commands dealing with system images
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "manage system images",
+}
+
+// imageInspectCmd represents the image inspect command
+var imageInspectCmd = &cobra.Command{
+	Use:   "inspect SOURCE",
+	Short: "inspect a container image, an image file or an ISO before deploying it",
+	Long: "Reports the os-release, grub entry name, kernel and initrd of the system included in SOURCE.\n" +
+		"SOURCE is a local image file (active.img, passive.img, recovery.squashfs), an ISO or\n" +
+		"a container image reference. Nothing is modified, image files are mounted read-only.",
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		_ = config.BindFlags(cmd)
+		return CheckRoot()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := exec.LookPath("mount")
+		if err != nil {
+			return err
+		}
+		mounter := mount.New(path)
+
+		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), mounter)
+		if err != nil {
+			cfg.Logger.Errorf("Error reading config: %s\n", err)
+		}
+		cfg.SetContext(cmd.Context())
+
+		cmd.SilenceUsage = true
+		action.SetupLuet(cfg)
+		local, _ := cmd.Flags().GetBool("local")
+		info, err := action.InspectImage(cfg, args[0], local)
+		if err != nil {
+			cfg.Logger.Errorf("Could not inspect %s: %s", args[0], err)
+			return err
+		}
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(info)
+		}
+		return printImageInfo(info)
+	},
+}
+
+func printImageInfo(info *action.ImageInfo) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Source:\t%s\n", info.Source)
+	fmt.Fprintf(w, "Type:\t%s\n", info.Type)
+	fmt.Fprintf(w, "Size:\t%d MiB\n", info.Size/(1024*1024))
+	fmt.Fprintf(w, "Digest:\t%s\n", valueOrNone(info.Digest))
+	if info.Type != action.InspectDocker {
+		fmt.Fprintf(w, "Label:\t%s\n", valueOrNone(info.Label))
+	}
+	fmt.Fprintf(w, "Grub entry name:\t%s\n", valueOrNone(info.GrubEntryName))
+	for _, boot := range []struct {
+		name string
+		file *action.BootFile
+	}{{"Kernel", info.Kernel}, {"Initrd", info.Initrd}} {
+		if boot.file == nil {
+			fmt.Fprintf(w, "%s:\tnot found\n", boot.name)
+			continue
+		}
+		fmt.Fprintf(w, "%s:\t%s (version %s)\n", boot.name, boot.file.Path, valueOrNone(boot.file.Version))
+	}
+	printSortedMap(w, "Labels", info.Labels)
+	printSortedMap(w, "OS release", info.OSRelease)
+	return w.Flush()
+}
+
+func printSortedMap(w *tabwriter.Writer, title string, values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s:\t\n", title)
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s\t%s\n", k, strings.TrimSpace(values[k]))
+	}
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
+
+func init() {
+	rootCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageInspectCmd)
+	imageInspectCmd.Flags().Bool("local", false, "Look up container images in the local docker daemon")
+	imageInspectCmd.Flags().Bool("json", false, "Print the inspected data in JSON format")
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/rancher-sandbox/elemental/cmd/config"
 	"github.com/rancher-sandbox/elemental/pkg/action"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/mount-utils"
@@ -34,7 +35,7 @@ var installCmd = &cobra.Command{
 	Args:  cobra.MaximumNArgs(1),
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		_ = viper.BindEnv("target", "ELEMENTAL_TARGET")
-		_ = viper.BindPFlags(cmd.Flags())
+		_ = config.BindFlags(cmd)
 		return CheckRoot()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -44,10 +45,11 @@ var installCmd = &cobra.Command{
 		}
 		mounter := mount.New(path)
 
-		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), mounter)
+		cfg, err := config.ReadConfigRunForCommand(viper.GetString("config-dir"), constants.ActionInstall, mounter)
 		if err != nil {
 			cfg.Logger.Errorf("Error reading config: %s\n", err)
 		}
+		cfg.SetContext(cmd.Context())
 
 		if err := validateInstallUpgradeFlags(cfg.Logger); err != nil {
 			return err
@@ -90,5 +92,13 @@ func init() {
 	installCmd.Flags().BoolP("tty", "", false, "Add named tty to grub")
 	installCmd.Flags().BoolP("force", "", false, "Force install")
 	installCmd.Flags().BoolP("eject-cd", "", false, "Try to eject the cd on reboot, only valid if booting from iso")
+	installCmd.Flags().BoolP("secure-boot", "", false, "Require a UEFI Secure Boot setup using the signed shim and grub shipped in the OS image")
+	installCmd.Flags().String("bootloader", "", "Bootloader to install, 'grub' (default) or 'systemd-boot'")
+	installCmd.Flags().String("kernel-args", "", "Extra kernel arguments to add to the boot entries")
+	installCmd.Flags().Bool("lvm", false, "Create the persistent partition as an LVM logical volume")
+	installCmd.Flags().Bool("lvm-state", false, "Create the state partition as an LVM logical volume too, requires --lvm")
+	installCmd.Flags().String("lvm-volume-group", "", "Name of the LVM volume group (default \"cos\")")
+	installCmd.Flags().StringSlice("consoles", []string{}, "Consoles to add to the kernel command line, e.g. tty1,ttyS0,115200n8")
+	installCmd.Flags().Bool("resume", false, "Resume an interrupted installation from its first incomplete step, partitions are not created again")
 	addSharedInstallUpgradeFlags(installCmd)
 }
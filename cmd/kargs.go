@@ -0,0 +1,132 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+
+	"github.com/rancher-sandbox/elemental/cmd/config"
+	"github.com/rancher-sandbox/elemental/pkg/action"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+)
+
+// kargsCmd represents the kargs command
+var kargsCmd = &cobra.Command{
+	Use:   "kargs",
+	Short: "manage the extra kernel arguments of the installed system",
+	Args:  cobra.ExactArgs(0),
+}
+
+// kargsListCmd represents the kargs list subcommand
+var kargsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the extra kernel arguments",
+	Args:  cobra.ExactArgs(0),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return CheckRoot()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := readKargsConfig()
+		if err != nil {
+			return err
+		}
+		cmd.SilenceUsage = true
+		slot, _ := cmd.Flags().GetString("slot")
+		kargs, err := action.KargsList(cfg, slot)
+		if err != nil {
+			cfg.Logger.Errorf("Could not list kernel arguments: %s", err)
+			return err
+		}
+		keys := []string{}
+		for key := range kargs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s: %s\n", key, kargs[key])
+		}
+		return nil
+	},
+}
+
+// kargsAddCmd represents the kargs add subcommand
+var kargsAddCmd = &cobra.Command{
+	Use:   "add ARGS...",
+	Short: "add extra kernel arguments",
+	Args:  cobra.MinimumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return CheckRoot()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateKargs(cmd, args, nil)
+	},
+}
+
+// kargsRemoveCmd represents the kargs remove subcommand
+var kargsRemoveCmd = &cobra.Command{
+	Use:   "remove ARGS...",
+	Short: "remove extra kernel arguments, arguments given without value remove any value of that key",
+	Args:  cobra.MinimumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return CheckRoot()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateKargs(cmd, nil, args)
+	},
+}
+
+func updateKargs(cmd *cobra.Command, add, remove []string) error {
+	cfg, err := readKargsConfig()
+	if err != nil {
+		return err
+	}
+	cmd.SilenceUsage = true
+	slot, _ := cmd.Flags().GetString("slot")
+	nextBoot, _ := cmd.Flags().GetBool("next-boot")
+	err = action.KargsUpdate(cfg, slot, add, remove, nextBoot)
+	if err != nil {
+		cfg.Logger.Errorf("Could not update kernel arguments: %s", err)
+	}
+	return err
+}
+
+func readKargsConfig() (*v1.RunConfig, error) {
+	path, err := exec.LookPath("mount")
+	if err != nil {
+		return nil, err
+	}
+	mounter := mount.New(path)
+
+	cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), mounter)
+	if err != nil {
+		cfg.Logger.Errorf("Error reading config: %s\n", err)
+	}
+	return cfg, nil
+}
+
+func init() {
+	rootCmd.AddCommand(kargsCmd)
+	kargsCmd.AddCommand(kargsListCmd, kargsAddCmd, kargsRemoveCmd)
+	kargsCmd.PersistentFlags().String("slot", "", "Apply to the given slot only (active, passive or recovery), all slots if not set")
+	kargsAddCmd.Flags().Bool("next-boot", false, "Apply only to the next boot")
+	kargsRemoveCmd.Flags().Bool("next-boot", false, "Apply only to the next boot")
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher-sandbox/elemental/cmd/config"
+	"github.com/rancher-sandbox/elemental/pkg/action"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+)
+
+// mtreeCmd groups the commands dealing with mtree manifests
+var mtreeCmd = &cobra.Command{
+	Use:   "mtree",
+	Short: "generate and verify mtree manifests of root trees",
+	Long: "Generates and verifies mtree manifests of root trees. Container images shipping a manifest\n" +
+		"in " + constants.MtreeManifest + " are verified against it on install and upgrade unless\n" +
+		"--no-verify is set.",
+}
+
+// mtreeGenerateCmd represents the mtree generate command
+var mtreeGenerateCmd = &cobra.Command{
+	Use:   "generate SOURCE",
+	Short: "generate the mtree manifest of a directory, an image file or an ISO",
+	Args:  cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return config.BindFlags(cmd)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := mtreeConfig(cmd)
+		if err != nil {
+			return err
+		}
+		output, _ := cmd.Flags().GetString("output")
+		if output == "" {
+			// The manifest is shipped in the tree it describes, images are mounted read-only
+			if info, err := cfg.Fs.Stat(args[0]); err != nil || !info.IsDir() {
+				err = fmt.Errorf("an output file is required to generate the manifest of %s", args[0])
+				cfg.Logger.Error(err.Error())
+				return err
+			}
+			output = filepath.Join(args[0], constants.MtreeManifest)
+		}
+		excludes := mtreeExcludes(cmd)
+		if err = action.GenerateManifest(cfg, args[0], output, excludes...); err != nil {
+			cfg.Logger.Errorf("Could not generate the manifest of %s: %s", args[0], err)
+			return err
+		}
+		return nil
+	},
+}
+
+// mtreeVerifyCmd represents the mtree verify command
+var mtreeVerifyCmd = &cobra.Command{
+	Use:   "verify SOURCE MANIFEST",
+	Short: "verify a directory, an image file or an ISO against an mtree manifest",
+	Long: "Compares SOURCE against MANIFEST and reports missing, extra and modified files.\n" +
+		"Image files and ISOs are mounted read-only. Exits with a non zero code on differences.",
+	Args: cobra.ExactArgs(2),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return config.BindFlags(cmd)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := mtreeConfig(cmd)
+		if err != nil {
+			return err
+		}
+		excludes := mtreeExcludes(cmd)
+		report, err := action.VerifyManifest(cfg, args[0], args[1], excludes...)
+		if err != nil {
+			cfg.Logger.Errorf("Could not verify %s: %s", args[0], err)
+			return err
+		}
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err = enc.Encode(report); err != nil {
+				return err
+			}
+		} else {
+			fmt.Print(report)
+		}
+		if !report.Passed() {
+			return fmt.Errorf("%s does not match %s: %d missing, %d extra and %d modified files",
+				args[0], args[1], len(report.Missing), len(report.Extra), len(report.Modified))
+		}
+		cfg.Logger.Infof("%s matches %s", args[0], args[1])
+		return nil
+	},
+}
+
+// mtreeExcludes returns the default excludes extended with the ones given by flag, so the
+// manifest itself is always left out
+func mtreeExcludes(cmd *cobra.Command) []string {
+	excludes, _ := cmd.Flags().GetStringSlice("exclude")
+	return append(constants.GetMtreeExcludes(), excludes...)
+}
+
+// mtreeConfig reads the run configuration, image files and ISOs require mounting
+func mtreeConfig(cmd *cobra.Command) (*v1.RunConfig, error) {
+	path, err := exec.LookPath("mount")
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), mount.New(path))
+	if err != nil {
+		cfg.Logger.Errorf("Error reading config: %s\n", err)
+	}
+	cfg.SetContext(cmd.Context())
+	cmd.SilenceUsage = true
+	return cfg, nil
+}
+
+func init() {
+	rootCmd.AddCommand(mtreeCmd)
+	mtreeCmd.AddCommand(mtreeGenerateCmd, mtreeVerifyCmd)
+	for _, c := range []*cobra.Command{mtreeGenerateCmd, mtreeVerifyCmd} {
+		c.Flags().StringSlice("exclude", []string{}, "Paths relative to SOURCE left out of the manifest, besides "+strings.Join(constants.GetMtreeExcludes(), ","))
+	}
+	mtreeGenerateCmd.Flags().StringP("output", "o", "", "File to write the manifest to, SOURCE"+constants.MtreeManifest+" for directories by default")
+	mtreeVerifyCmd.Flags().Bool("json", false, "Print the report in JSON format")
+}
@@ -17,20 +17,24 @@ limitations under the License.
 package cmd
 
 import (
-	"context"
-	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
 
-	"github.com/hashicorp/go-getter"
 	"github.com/rancher-sandbox/elemental/cmd/config"
+	"github.com/rancher-sandbox/elemental/pkg/derivative"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/mount-utils"
 )
 
 var newDerivative = &cobra.Command{
-	Use:           "new FLAVOR",
-	Short:         "Create skeleton Dockerfile for a derivative",
+	Use:   "new FLAVOR",
+	Short: "Create skeleton Dockerfile for a derivative",
+	Long: "Renders the skeleton of a derivative for FLAVOR: a Dockerfile, a luet repository\n" +
+		"configuration, cloud-config files and grub settings. The default templates are embedded\n" +
+		"in the binary, --template-dir renders the templates of the given directory instead.",
 	Args:          cobra.ExactArgs(1),
 	SilenceUsage:  true, // Do not show usage on error
 	SilenceErrors: true, // Do not propagate errors down the line, we control them
@@ -42,27 +46,59 @@ var newDerivative = &cobra.Command{
 		}
 
 		flavor := args[0]
-		if flavor != "opensuse" && flavor != "ubuntu" && flavor != "fedora" {
-			cfg.Logger.Errorf("Unsupported flavor")
-			return errors.New("unsupported flavor")
+		arch, _ := cmd.Flags().GetString("arch")
+		if arch == "" {
+			arch = runtime.GOARCH
+		}
+		name, _ := cmd.Flags().GetString("name")
+		baseImage, _ := cmd.Flags().GetString("base-image")
+		templateDir, _ := cmd.Flags().GetString("template-dir")
+		output, _ := cmd.Flags().GetString("output")
+		if output == "" {
+			output = fmt.Sprintf("derivatives/%s", flavor)
 		}
 
-		client := &getter.Client{
-			Ctx:  context.Background(),
-			Dst:  fmt.Sprintf("derivatives/%s", flavor),
-			Dir:  true,
-			Src:  "github.com/rancher-sandbox/cOS-toolkit//examples/standard",
-			Mode: getter.ClientModeDir,
-			Detectors: []getter.Detector{
-				&getter.GitHubDetector{},
-			},
+		opts := []derivative.Option{
+			derivative.WithLabels(derivative.Labels{
+				Active:     cfg.ActiveLabel,
+				Passive:    cfg.PassiveLabel,
+				Recovery:   cfg.RecoveryLabel,
+				System:     cfg.SystemLabel,
+				State:      cfg.StateLabel,
+				Persistent: cfg.PersistentLabel,
+				OEM:        cfg.OEMLabel,
+			}),
+		}
+		if name != "" {
+			opts = append(opts, derivative.WithName(name))
+		}
+		if baseImage != "" {
+			opts = append(opts, derivative.WithBaseImage(baseImage))
+		}
+		data, err := derivative.NewData(flavor, arch, opts...)
+		if err != nil {
+			cfg.Logger.Errorf("Invalid derivative: %s", err)
+			return err
+		}
+		if templateDir == "" && data.InstallCmd == "" {
+			err = fmt.Errorf("the embedded templates do not support flavor %s, use --template-dir for custom flavors", flavor)
+			cfg.Logger.Errorf("Invalid derivative: %s", err)
+			return err
 		}
 
-		err = client.Get()
+		var templates fs.FS
+		if templateDir != "" {
+			templates = os.DirFS(templateDir)
+		} else {
+			templates = derivative.Templates()
+		}
+
+		err = derivative.Render(cfg.Fs, templates, output, data)
 		if err != nil {
-			cfg.Logger.Errorf("Unable to create derivative")
+			cfg.Logger.Errorf("Unable to create derivative: %s", err)
 			return err
 		}
+		cfg.Logger.Infof("Derivative %s for %s created in %s", flavor, data.Arch, output)
 
 		return nil
 	},
@@ -70,6 +106,9 @@ var newDerivative = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(newDerivative)
-	newDerivative.Flags().String("arch", "", "X86_64 or aarch64 architectures")
-
+	newDerivative.Flags().String("arch", "", "X86_64 or aarch64 architectures (default is the host architecture)")
+	newDerivative.Flags().String("base-image", "", "Base image of the derivative (default depends on the flavor)")
+	newDerivative.Flags().String("name", "", "Name of the derivative, used as the grub entry name")
+	newDerivative.Flags().String("template-dir", "", "Render the templates of this directory instead of the embedded ones")
+	newDerivative.Flags().StringP("output", "o", "", "Directory to write the derivative to (default is derivatives/FLAVOR)")
 }
@@ -17,10 +17,16 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
 	"path/filepath"
 
 	"github.com/docker/docker/api/types"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/rancher-sandbox/elemental/cmd/config"
+	"github.com/rancher-sandbox/elemental/pkg/action"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/elemental"
+	"github.com/rancher-sandbox/elemental/pkg/registry"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -41,6 +47,7 @@ var pullImage = &cobra.Command{
 		if err != nil {
 			cfg.Logger.Errorf("Error reading config: %s\n", err)
 		}
+		cfg.SetContext(cmd.Context())
 
 		image := args[0]
 		destination, err := filepath.Abs(args[1])
@@ -62,19 +69,78 @@ var pullImage = &cobra.Command{
 		identity, _ := cmd.Flags().GetString("auth-identity-token")
 		registryToken, _ := cmd.Flags().GetString("auth-registry-token")
 		plugins, _ := cmd.Flags().GetStringArray("plugin")
+		format, _ := cmd.Flags().GetString("format")
+		mtreeFile, _ := cmd.Flags().GetString("mtree")
+		if mtreeFile != "" && format != constants.PullFormatRootfs {
+			err = fmt.Errorf("mtree manifests can only be generated in %s format", constants.PullFormatRootfs)
+			cfg.Logger.Error(err.Error())
+			return err
+		}
+		platform, _ := cmd.Flags().GetString("platform")
+		if platform != "" {
+			cfg.Platform, err = v1.NewPlatform(platform)
+			if err != nil {
+				cfg.Logger.Error(err.Error())
+				return err
+			}
+		}
 
-		auth := &types.AuthConfig{
-			Username:      user,
-			Password:      pass,
-			ServerAddress: server,
-			Auth:          authType,
-			IdentityToken: identity,
-			RegistryToken: registryToken,
+		// Credentials from flags take precedence over the docker configuration ones
+		var auth *types.AuthConfig
+		if user != "" || pass != "" || authType != "" || identity != "" || registryToken != "" {
+			auth = &types.AuthConfig{
+				Username:      user,
+				Password:      pass,
+				ServerAddress: server,
+				Auth:          authType,
+				IdentityToken: identity,
+				RegistryToken: registryToken,
+			}
+			cfg.Registry = registry.NewRegistry(registry.WithAuth(&authn.AuthConfig{
+				Username:      user,
+				Password:      pass,
+				Auth:          authType,
+				IdentityToken: identity,
+				RegistryToken: registryToken,
+			}))
 		}
 
-		luet := v1.NewLuet(v1.WithLuetLogger(cfg.Logger), v1.WithLuetAuth(auth), v1.WithLuetPlugins(plugins...))
-		luet.VerifyImageUnpack = verify
-		err = luet.Unpack(destination, image, local)
+		switch format {
+		case constants.PullFormatRootfs:
+			if auth == nil && !local {
+				auth, err = cfg.Registry.Auth(image)
+				if err != nil {
+					cfg.Logger.Warnf("Could not read the credentials for %s from the docker configuration: %s", image, err)
+					auth = &types.AuthConfig{}
+				}
+			}
+			luet := v1.NewLuet(
+				v1.WithLuetLogger(cfg.Logger), v1.WithLuetAuth(auth), v1.WithLuetPlugins(plugins...),
+				v1.WithLuetContext(cfg.Context),
+			)
+			luet.VerifyImageUnpack = verify
+			cfg.Luet = luet
+			_, err = elemental.NewElemental(cfg).UnpackImage(destination, image, local)
+			if err == nil && mtreeFile != "" {
+				err = action.GenerateManifest(cfg, destination, mtreeFile, constants.GetMtreeExcludes()...)
+			}
+		case constants.PullFormatOCI, constants.PullFormatDockerArchive:
+			if local {
+				err = fmt.Errorf("local images can only be pulled in %s format", constants.PullFormatRootfs)
+				break
+			}
+			var saved *v1.SavedImage
+			saved, err = cfg.Registry.Save(cfg.Context, image, destination, format, cfg.Platform)
+			if err == nil {
+				cfg.Logger.Infof("Saved %s (%s) to %s", image, saved.Digest, destination)
+				if saved.Signature != "" {
+					cfg.Logger.Infof("Saved signature %s", saved.Signature)
+				}
+			}
+		default:
+			err = fmt.Errorf("invalid format %s, valid formats are %s, %s and %s", format,
+				constants.PullFormatRootfs, constants.PullFormatOCI, constants.PullFormatDockerArchive)
+		}
 
 		if err != nil {
 			cfg.Logger.Error(err.Error())
@@ -87,13 +153,17 @@ var pullImage = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(pullImage)
+	// Credentials are read from the docker configuration unless set by flags
 	pullImage.Flags().String("auth-username", "", "Username to authenticate to registry/notary")
 	pullImage.Flags().String("auth-password", "", "Password to authenticate to registry")
 	pullImage.Flags().String("auth-type", "", "Auth type")
 	pullImage.Flags().String("auth-server-address", "", "Authentication server address")
 	pullImage.Flags().String("auth-identity-token", "", "Authentication identity token")
 	pullImage.Flags().String("auth-registry-token", "", "Authentication registry token")
+	addPlatformFlag(pullImage)
 	pullImage.Flags().Bool("verify", false, "Verify signed images to notary before to pull")
 	pullImage.Flags().Bool("local", false, "Use local image")
+	pullImage.Flags().String("format", constants.PullFormatRootfs, "Output format: rootfs extracts the image into the DESTINATION directory, oci writes an OCI layout directory and docker-archive a 'docker save' compatible tarball")
+	pullImage.Flags().String("mtree", "", "Write the mtree manifest of the pulled rootfs to the given file")
 	pullImage.Flags().StringArray("plugin", []string{}, "A list of runtime plugins to load. Can be repeated to add more than one plugin")
 }
@@ -53,6 +53,21 @@ var _ = Describe("pull-image", Label("pull-image", "cmd", "root"), func() {
 			)
 			Expect(err).To(HaveOccurred())
 		})
+		It("fails with an invalid platform", Label("args"), func() {
+			d, err := os.MkdirTemp("", "elemental")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(d)
+
+			_, _, err = executeCommandC(
+				rootCmd,
+				"pull-image",
+				"--platform",
+				"linux/arm/v7/extra",
+				"alpine",
+				d,
+			)
+			Expect(err).To(HaveOccurred())
+		})
 
 	})
 })
@@ -21,6 +21,7 @@ import (
 
 	"github.com/rancher-sandbox/elemental/cmd/config"
 	"github.com/rancher-sandbox/elemental/pkg/action"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/mount-utils"
@@ -32,7 +33,7 @@ var resetCmd = &cobra.Command{
 	Short: "elemental reset OS",
 	Args:  cobra.ExactArgs(0),
 	PreRunE: func(cmd *cobra.Command, args []string) error {
-		_ = viper.BindPFlags(cmd.Flags())
+		_ = config.BindFlags(cmd)
 		return CheckRoot()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -42,11 +43,12 @@ var resetCmd = &cobra.Command{
 		}
 		mounter := mount.New(path)
 
-		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), mounter)
+		cfg, err := config.ReadConfigRunForCommand(viper.GetString("config-dir"), constants.ActionReset, mounter)
 
 		if err != nil {
 			cfg.Logger.Errorf("Error reading config: %s\n", err)
 		}
+		cfg.SetContext(cmd.Context())
 
 		if err := validateInstallUpgradeFlags(cfg.Logger); err != nil {
 			return err
@@ -68,5 +70,9 @@ func init() {
 	rootCmd.AddCommand(resetCmd)
 	resetCmd.Flags().BoolP("tty", "", false, "Add named tty to grub")
 	resetCmd.Flags().BoolP("reset-persistent", "", false, "Clear persistent partitions")
+	resetCmd.Flags().BoolP("secure-boot", "", false, "Require a UEFI Secure Boot setup using the signed shim and grub shipped in the OS image")
+	resetCmd.Flags().String("bootloader", "", "Bootloader to install, 'grub' (default) or 'systemd-boot'")
+	resetCmd.Flags().String("kernel-args", "", "Extra kernel arguments to add to the boot entries")
+	resetCmd.Flags().StringSlice("consoles", []string{}, "Consoles to add to the kernel command line, e.g. tty1,ttyS0,115200n8")
 	addSharedInstallUpgradeFlags(resetCmd)
 }
@@ -17,7 +17,12 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -31,13 +36,35 @@ var rootCmd = &cobra.Command{
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// Commands get a context that is cancelled on SIGINT or SIGTERM, so running actions can
+// stop and clean up before exiting. A second signal kills the process.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	var exit *exitCode
+	if errors.As(err, &exit) {
+		os.Exit(exit.code)
+	}
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
+// exitCode is returned by commands to exit with a specific code without it being
+// reported as an error
+type exitCode struct {
+	code int
+}
+
+func (e *exitCode) Error() string {
+	return fmt.Sprintf("exit code %d", e.code)
+}
+
 func init() {
 	rootCmd.PersistentFlags().Bool("debug", false, "enable debug output")
 	rootCmd.PersistentFlags().String("config-dir", "", "set config dir (default is empty)")
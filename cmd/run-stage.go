@@ -17,6 +17,11 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
 	"github.com/rancher-sandbox/elemental/cmd/config"
 	"github.com/rancher-sandbox/elemental/pkg/utils"
 	"github.com/spf13/cobra"
@@ -30,7 +35,7 @@ var runStage = &cobra.Command{
 	Short: "elemental run-stage",
 	Args:  cobra.MinimumNArgs(1),
 	PreRun: func(cmd *cobra.Command, args []string) {
-		_ = viper.BindPFlags(cmd.Flags())
+		_ = config.BindFlags(cmd)
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), &mount.FakeMounter{})
@@ -38,12 +43,52 @@ var runStage = &cobra.Command{
 		if err != nil {
 			cfg.Logger.Errorf("Error reading config: %s\n", err)
 		}
+		cfg.SetContext(cmd.Context())
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+		if list, _ := cmd.Flags().GetBool("list"); list {
+			fmt.Fprintln(w, "STAGE\tSOURCE\tSTEP")
+			for _, s := range utils.ListStage(args[0], cfg) {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", s.Stage, s.Source, stepName(s.Name))
+			}
+			return w.Flush()
+		}
 
-		return utils.RunStage(args[0], cfg)
+		done := len(cfg.CloudInitRunner.Results())
+		err = utils.RunStage(args[0], cfg)
+
+		results := cfg.CloudInitRunner.Results()[done:]
+		if len(results) > 0 {
+			fmt.Fprintln(w, "STAGE\tSOURCE\tSTEP\tDURATION\tRESULT\tERROR")
+			for _, r := range results {
+				result := "success"
+				errMsg := ""
+				if r.Error != nil {
+					result = "failure"
+					errMsg = r.Error.Error()
+				}
+				fmt.Fprintf(
+					w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					r.Stage, r.Source, stepName(r.Name), r.Duration.Round(time.Millisecond), result, errMsg,
+				)
+			}
+			_ = w.Flush()
+		}
+		return err
 	},
 }
 
+// stepName returns the name to display for a cloud-init step
+func stepName(name string) string {
+	if name == "" {
+		return "(unnamed)"
+	}
+	return name
+}
+
 func init() {
 	rootCmd.AddCommand(runStage)
 	runStage.Flags().Bool("strict", false, "Set strict checking for errors, i.e. fail if errors were found")
+	runStage.Flags().Bool("list", false, "List the files and steps that would run for the stage, in order, without running them")
 }
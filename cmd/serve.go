@@ -0,0 +1,86 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/rancher-sandbox/elemental/cmd/config"
+	conf "github.com/rancher-sandbox/elemental/pkg/config"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "serve an API on a Unix socket to run upgrades and resets and query the system",
+	Long: "Serves an HTTP/JSON API on a Unix socket. Upgrades and reset schedules are run in the\n" +
+		"background, one at a time, and their log can be streamed while they run. If booted from\n" +
+		"the recovery system a scheduled reset is run on start.\n\n" +
+		"Endpoints:\n" +
+		"  GET  /v1/status                  version, booted system and running operation\n" +
+		"  GET  /v1/history                 recorded install, upgrade and reset operations\n" +
+		"  POST /v1/upgrade                 start an upgrade\n" +
+		"  POST /v1/reset                   schedule a reset on the next boot\n" +
+		"  GET  /v1/operations              operations run by the server\n" +
+		"  GET  /v1/operations/<id>         operation state and result\n" +
+		"  GET  /v1/operations/<id>/log     operation log, streamed until it finishes\n" +
+		"  POST /v1/operations/<id>/cancel  cancel a running operation",
+	Args: cobra.ExactArgs(0),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		_ = config.BindFlags(cmd)
+		return CheckRoot()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := exec.LookPath("mount")
+		if err != nil {
+			return err
+		}
+		mounter := mount.New(path)
+
+		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), mounter)
+		if err != nil {
+			cfg.Logger.Errorf("Error reading config: %s\n", err)
+		}
+		cfg.SetContext(cmd.Context())
+
+		cmd.SilenceUsage = true
+		socket, _ := cmd.Flags().GetString("socket")
+		l, err := server.Listen(socket)
+		if err != nil {
+			cfg.Logger.Errorf("Could not listen on %s: %s", socket, err)
+			return err
+		}
+		defer os.Remove(socket)
+
+		opts := []server.Option{server.WithRuntime(conf.WithMounter(mounter))}
+		if !viper.GetBool("quiet") {
+			opts = append(opts, server.WithLogOutput(os.Stdout))
+		}
+		return server.New(cfg, opts...).Serve(l)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().String("socket", constants.ServeSocket, "Path of the Unix socket to serve on")
+}
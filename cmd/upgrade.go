@@ -17,10 +17,15 @@ limitations under the License.
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
 	"os/exec"
 
 	"github.com/rancher-sandbox/elemental/cmd/config"
 	"github.com/rancher-sandbox/elemental/pkg/action"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/mount-utils"
@@ -35,7 +40,7 @@ var upgradeCmd = &cobra.Command{
 		// We bind the --recovery flag into RecoveryUpgrade value to have a more explicit var in the config
 		_ = viper.BindPFlag("RecoveryUpgrade", cmd.Flags().Lookup("recovery"))
 		// bind the rest of the flags into their direct values as they are mapped 1to1
-		_ = viper.BindPFlags(cmd.Flags())
+		_ = config.BindFlags(cmd)
 		return CheckRoot()
 	},
 
@@ -46,11 +51,12 @@ var upgradeCmd = &cobra.Command{
 		}
 		mounter := mount.New(path)
 
-		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), mounter)
+		cfg, err := config.ReadConfigRunForCommand(viper.GetString("config-dir"), constants.ActionUpgrade, mounter)
 
 		if err != nil {
 			cfg.Logger.Errorf("Error reading config: %s\n", err)
 		}
+		cfg.SetContext(cmd.Context())
 
 		if err := validateInstallUpgradeFlags(cfg.Logger); err != nil {
 			return err
@@ -67,6 +73,11 @@ var upgradeCmd = &cobra.Command{
 
 		// Init luet
 		action.SetupLuet(cfg)
+
+		if check, _ := cmd.Flags().GetBool("check"); check {
+			return checkUpgrade(cmd, cfg)
+		}
+
 		upgrade := action.NewUpgradeAction(cfg)
 		err = upgrade.Run()
 		if err != nil {
@@ -76,8 +87,41 @@ var upgradeCmd = &cobra.Command{
 	},
 }
 
+// checkUpgrade prints the installed and the available versions of the upgrade source, it
+// exits with constants.UpgradeAvailableCode if they differ
+func checkUpgrade(cmd *cobra.Command, cfg *v1.RunConfig) error {
+	check, err := action.CheckUpgrade(cfg)
+	if err != nil {
+		cfg.Logger.Errorf("Failed checking for upgrades: %s", err)
+		return err
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(check); err != nil {
+			return err
+		}
+	} else {
+		current := check.Current
+		if current == "" {
+			current = "unknown"
+		}
+		fmt.Printf("Target:    %s\n", check.Target)
+		fmt.Printf("Source:    %s\n", check.Source)
+		fmt.Printf("Current:   %s\n", current)
+		fmt.Printf("Available: %s\n", check.Available)
+	}
+	if check.Upgrade {
+		return &exitCode{code: constants.UpgradeAvailableCode}
+	}
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(upgradeCmd)
 	upgradeCmd.Flags().Bool("recovery", false, "Upgrade the recovery")
+	upgradeCmd.Flags().Bool("check", false, fmt.Sprintf("Only check if an upgrade is available, exits with %d if there is one", constants.UpgradeAvailableCode))
+	upgradeCmd.Flags().Bool("json", false, "Print the upgrade check in JSON format")
 	addSharedInstallUpgradeFlags(upgradeCmd)
 }
@@ -18,12 +18,15 @@ package action_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/jaypipes/ghw/pkg/block"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	luetTypes "github.com/mudler/luet/pkg/api/core/types"
@@ -46,6 +49,9 @@ const printOutput = `BYT;
 const partTmpl = `
 %d:%ss:%ss:2048s:ext4::type=83;`
 
+// lastSector replaces the 100% end of partitions in the print output, as parted does
+const lastSector = "50593791"
+
 func TestElementalSuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Actions test suite")
@@ -89,6 +95,75 @@ var _ = Describe("Actions", func() {
 
 	AfterEach(func() { cleanup() })
 
+	Describe("Hooks", Label("hooks"), func() {
+		var first, second string
+		BeforeEach(func() {
+			first = "/usr/lib/elemental/hooks/before-install.d/10_first"
+			second = "/etc/elemental/hooks/before-install.d/20_second"
+			for _, f := range []string{first, second} {
+				Expect(utils.MkdirAll(fs, filepath.Dir(f), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(f, []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+			}
+			Expect(fs.WriteFile("/etc/elemental/hooks/before-install.d/30_data", []byte{}, 0644)).To(Succeed())
+		})
+		It("Exposes the hook context as environment variables and restores them", func() {
+			var booted string
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				switch cmd {
+				case "cat":
+					return []byte("root=LABEL=COS_PASSIVE"), nil
+				case first:
+					booted = os.Getenv("ELEMENTAL_HOOK_BOOTED_SLOT")
+				}
+				return []byte{}, nil
+			}
+			Expect(os.Setenv("ELEMENTAL_HOOK_NAME", "previous")).To(Succeed())
+			defer os.Unsetenv("ELEMENTAL_HOOK_NAME")
+
+			Expect(action.Hook(config, constants.ActionInstall, constants.BeforeInstallHook)).To(Succeed())
+			Expect(booted).To(Equal(constants.PassiveImgName))
+			Expect(os.Getenv("ELEMENTAL_HOOK_NAME")).To(Equal("previous"))
+			_, set := os.LookupEnv("ELEMENTAL_HOOK_BOOTED_SLOT")
+			Expect(set).To(BeFalse())
+		})
+		It("Runs yip stages and hook executables in lexical order", func() {
+			Expect(action.Hook(config, constants.ActionInstall, constants.BeforeInstallHook)).To(Succeed())
+			Expect(cloudInit.ExecStages).To(ContainElement(constants.BeforeInstallHook))
+			Expect(runner.MatchMilestones([][]string{{first}, {second}})).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"/etc/elemental/hooks/before-install.d/30_data"}})).NotTo(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("10_first: exit status 0"))
+		})
+		It("Runs hook executables with the configured timeout", func() {
+			config.HookTimeout = 10
+			config.HookTimeouts = map[string]uint{constants.BeforeInstallHook: 30}
+			Expect(action.Hook(config, constants.ActionInstall, constants.BeforeInstallHook)).To(Succeed())
+			Expect(runner.MatchMilestones([][]string{{"timeout", "30s", first}, {"timeout", "30s", second}})).To(Succeed())
+		})
+		It("Fails on hook executable errors only in strict mode", Label("strict"), func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == first {
+					return []byte{}, errors.New("hook failure")
+				}
+				return []byte{}, nil
+			}
+			Expect(action.Hook(config, constants.ActionInstall, constants.BeforeInstallHook)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{second}})).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("hook failure"))
+
+			runner.ClearCmds()
+			config.Strict = true
+			Expect(action.Hook(config, constants.ActionInstall, constants.BeforeInstallHook)).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{second}})).NotTo(Succeed())
+		})
+		It("Fails once cancelled even if strict is not set", Label("cancel"), func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			config.SetContext(ctx)
+			cancel()
+			Expect(action.Hook(config, constants.ActionInstall, constants.BeforeInstallHook)).To(MatchError(context.Canceled))
+			Expect(runner.IncludesCmds([][]string{{first}})).NotTo(Succeed())
+		})
+	})
+
 	Describe("Reset Setup", Label("resetsetup"), func() {
 		var bootedFrom, cmdFail string
 		BeforeEach(func() {
@@ -396,7 +471,7 @@ var _ = Describe("Actions", func() {
 					}
 					if idx > 0 {
 						partNum++
-						partedOut += fmt.Sprintf(partTmpl, partNum, args[idx+3], args[idx+4])
+						partedOut += fmt.Sprintf(partTmpl, partNum, args[idx+3], strings.Replace(args[idx+4], "100%", lastSector, 1))
 						_, _ = fs.Create(fmt.Sprintf("/some/device%d", partNum))
 					}
 					return []byte(partedOut), nil
@@ -589,6 +664,30 @@ var _ = Describe("Actions", func() {
 			Expect(action.InstallRun(config)).NotTo(BeNil())
 		})
 
+		It("Cleans up once cancelled", Label("cancel"), func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			config.SetContext(ctx)
+			config.Target = device
+			config.Reboot = true
+			sideEffect := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "grub2-install" {
+					cancel()
+					return []byte{}, ctx.Err()
+				}
+				return sideEffect(cmd, args...)
+			}
+			err := action.InstallRun(config)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(context.Canceled.Error()))
+			Expect(memLog.String()).To(ContainSubstring("Action cancelled, cleaning up"))
+			// Images and partitions are unmounted and the runner gets the cancelled context back
+			Expect(runner.IncludesCmds([][]string{{"losetup", "-d"}})).To(Succeed())
+			Expect(mounter.List()).To(BeEmpty())
+			Expect(runner.Context).To(Equal(ctx))
+			Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}})).NotTo(Succeed())
+		})
+
 		It("Fails to mount partitions", Label("disk", "mount"), func() {
 			config.Target = device
 			mounter.ErrorOnMount = true
@@ -637,6 +736,76 @@ var _ = Describe("Actions", func() {
 			Expect(action.InstallRun(config)).NotTo(BeNil())
 		})
 
+		It("Resumes an interrupted installation", Label("resume"), func() {
+			config.Target = device
+			cmdFail = "grub2-install"
+			Expect(action.InstallRun(config)).NotTo(BeNil())
+			journal := filepath.Join(config.Partitions.GetByName(constants.StatePartName).MountPoint, constants.InstallStepsFile)
+			data, err := fs.ReadFile(journal)
+			Expect(err).To(BeNil())
+			// The active image is only deployed once unmounted
+			Expect(string(data)).To(Equal(`{"steps":["partitioned","formatted"]}`))
+
+			cmdFail = ""
+			runner.ClearCmds()
+			config.Resume = true
+			Expect(action.InstallRun(config)).To(BeNil())
+			// Partitions are not created again, the interrupted active image is
+			Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2", "-L", config.ActiveLabel}})).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"grub2-install"}})).To(Succeed())
+			Expect(utils.Exists(fs, journal)).To(BeFalse())
+		})
+
+		It("Resumes an installation without deploying verified images again", Label("resume"), func() {
+			config.Target = device
+			cmdFail = "tune2fs"
+			Expect(action.InstallRun(config)).NotTo(BeNil())
+
+			cmdFail = ""
+			runner.ClearCmds()
+			config.Resume = true
+			Expect(action.InstallRun(config)).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"e2fsck", "-fn", config.Images.GetActive().File}})).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2", "-L", config.ActiveLabel}})).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"grub2-install"}})).NotTo(Succeed())
+		})
+
+		It("Deploys damaged images again on resume", Label("resume"), func() {
+			config.Target = device
+			cmdFail = "tune2fs"
+			Expect(action.InstallRun(config)).NotTo(BeNil())
+
+			cmdFail = "e2fsck"
+			runner.ClearCmds()
+			config.Resume = true
+			Expect(action.InstallRun(config)).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2", "-L", config.ActiveLabel}})).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("Could not verify install step active-deployed"))
+		})
+
+		It("Resumes from the first step that can't be verified", Label("resume"), func() {
+			config.Target = device
+			cmdFail = "tune2fs"
+			Expect(action.InstallRun(config)).NotTo(BeNil())
+			Expect(fs.RemoveAll(config.Images.GetActive().File)).To(Succeed())
+
+			cmdFail = ""
+			runner.ClearCmds()
+			config.Resume = true
+			Expect(action.InstallRun(config)).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2", "-L", config.ActiveLabel}})).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("Could not verify install step active-deployed"))
+		})
+
+		It("Fails to resume if there is no interrupted installation", Label("resume"), func() {
+			config.Target = device
+			config.Resume = true
+			Expect(action.InstallRun(config)).To(MatchError(ContainSubstring("no interrupted installation")))
+			Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(Succeed())
+		})
+
 		It("Fails copying Passive image", Label("copy", "active"), func() {
 			config.Target = device
 			cmdFail = "tune2fs"
@@ -660,6 +829,16 @@ var _ = Describe("Actions", func() {
 		transitionImgSquash := fmt.Sprintf("%s/cOS/%s", constants.UpgradeRecoveryDir, constants.TransitionSquashFile)
 		transitionImg := fmt.Sprintf("%s/cOS/%s", constants.RunningStateDir, constants.TransitionImgFile)
 		transitionImgRecovery := fmt.Sprintf("%s/cOS/%s", constants.UpgradeRecoveryDir, constants.TransitionImgFile)
+		var upgradeTempDir string
+
+		// Create a fake /etc/os-release once the upgraded system is in the temp dir, any
+		// earlier content is removed as a leftover of a previous upgrade
+		fakeOSRelease := func(command string, args ...string) {
+			if command == "chmod" && len(args) == 2 && args[1] == upgradeTempDir {
+				_ = utils.MkdirAll(fs, filepath.Join(upgradeTempDir, "etc"), constants.DirPerm)
+				_ = fs.WriteFile(filepath.Join(upgradeTempDir, "etc", "os-release"), []byte("GRUB_ENTRY_NAME=TESTOS"), constants.FilePerm)
+			}
+		}
 
 		BeforeEach(func() {
 			memLog = &bytes.Buffer{}
@@ -676,11 +855,7 @@ var _ = Describe("Actions", func() {
 			config.UpgradeImage = "system/cos-config"
 			config.RecoveryImage = "system/cos-config"
 			config.ImgSize = 10
-			// Create fake /etc/os-release
-			utils.MkdirAll(fs, filepath.Join(utils.GetUpgradeTempDir(config), "etc"), constants.DirPerm)
-
-			err := config.Fs.WriteFile(filepath.Join(utils.GetUpgradeTempDir(config), "etc", "os-release"), []byte("GRUB_ENTRY_NAME=TESTOS"), constants.FilePerm)
-			Expect(err).ShouldNot(HaveOccurred())
+			upgradeTempDir = utils.GetUpgradeTempDir(config)
 
 			// Create paths used by tests
 			utils.MkdirAll(fs, fmt.Sprintf("%s/cOS", constants.RunningStateDir), constants.DirPerm)
@@ -749,6 +924,7 @@ var _ = Describe("Actions", func() {
 		Describe(fmt.Sprintf("Booting from %s", constants.ActiveLabel), Label("active_label"), func() {
 			BeforeEach(func() {
 				runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+					fakeOSRelease(command, args...)
 					if command == "cat" && args[0] == "/proc/cmdline" {
 						return []byte(constants.ActiveLabel), nil
 					}
@@ -775,12 +951,63 @@ var _ = Describe("Actions", func() {
 				_ = fs.RemoveAll(activeImg)
 				_ = fs.RemoveAll(passiveImg)
 			})
+			It("Preserves the active kernel arguments for the passive system", Label("docker", "kargs"), func() {
+				grubEnv := filepath.Join(constants.RunningStateDir, constants.GrubEnv)
+				_ = fs.WriteFile(grubEnv, []byte("# GRUB Environment Block\nextra_active_cmdline=selinux=0\n"), constants.FilePerm)
+				config.DockerImg = "alpine"
+				upgrade = action.NewUpgradeAction(config)
+				Expect(upgrade.Run()).To(Succeed())
+				Expect(runner.IncludesCmds([][]string{
+					{"grub2-editenv", grubEnv, "set", "extra_passive_cmdline=selinux=0"},
+				})).To(BeNil())
+			})
+			It("Removes the leftovers of a previous upgrade", Label("docker"), func() {
+				staleFile := filepath.Join(upgradeTempDir, "stale")
+				Expect(utils.MkdirAll(fs, upgradeTempDir, constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(staleFile, []byte{}, constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(transitionImg, []byte("stale"), constants.FilePerm)).To(Succeed())
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+					if command == "losetup" && args[0] == "--associated" {
+						return []byte(fmt.Sprintf("/dev/loop7: [0042]:12 (%s)\n", args[1])), nil
+					}
+					return sideEffect(command, args...)
+				}
+				config.DockerImg = "alpine"
+				upgrade = action.NewUpgradeAction(config)
+				Expect(upgrade.Run()).To(Succeed())
+				Expect(runner.IncludesCmds([][]string{
+					{"losetup", "--associated", transitionImg},
+					{"losetup", "-d", "/dev/loop7"},
+				})).To(BeNil())
+				Expect(memLog).To(ContainSubstring("left by a previous upgrade"))
+				_, err := fs.Stat(staleFile)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Fails early if there is not enough space for the transition image", func() {
+				stateDir, err := fs.RawPath(filepath.Join(constants.RunningStateDir, "cOS"))
+				Expect(err).ToNot(HaveOccurred())
+				syscall.FreeSpace = map[string]uint64{stateDir: 5 * 1024 * 1024}
+				config.DockerImg = "alpine"
+				upgrade = action.NewUpgradeAction(config)
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("not enough free space"))
+				Expect(err.Error()).To(ContainSubstring("10 MiB required"))
+				_, err = fs.Stat(transitionImg)
+				Expect(err).To(HaveOccurred())
+			})
 			It("Successfully upgrades from docker image", Label("docker", "root"), func() {
 				config.DockerImg = "alpine"
 				upgrade = action.NewUpgradeAction(config)
 				err := upgrade.Run()
 				Expect(err).ToNot(HaveOccurred())
 
+				// The upgraded image is not left in the config
+				Expect(config.Images).To(BeEmpty())
+				Expect(upgrade.Upgraded().File).To(Equal(activeImg))
+				Expect(upgrade.Upgraded().Source.Value()).To(Equal("alpine"))
+
 				// Check that the rebrand worked with our os-release value
 				Expect(memLog).To(ContainSubstring("default_menu_entry=TESTOS"))
 
@@ -926,6 +1153,7 @@ var _ = Describe("Actions", func() {
 		Describe(fmt.Sprintf("Booting from %s", constants.PassiveLabel), Label("passive_label"), func() {
 			BeforeEach(func() {
 				runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+					fakeOSRelease(command, args...)
 					if command == "cat" && args[0] == "/proc/cmdline" {
 						return []byte(constants.PassiveLabel), nil
 					}
@@ -1034,6 +1262,7 @@ var _ = Describe("Actions", func() {
 			Describe("Using squashfs", Label("squashfs"), func() {
 				BeforeEach(func() {
 					runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+						fakeOSRelease(command, args...)
 						if command == "cat" && args[0] == "/proc/cmdline" {
 							return []byte(constants.RecoveryLabel), nil
 						}
@@ -1196,6 +1425,7 @@ var _ = Describe("Actions", func() {
 			Describe("Not using squashfs", Label("non-squashfs"), func() {
 				BeforeEach(func() {
 					runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+						fakeOSRelease(command, args...)
 						if command == "cat" && args[0] == "/proc/cmdline" {
 							return []byte(constants.RecoveryLabel), nil
 						}
@@ -1355,4 +1585,327 @@ var _ = Describe("Actions", func() {
 			})
 		})
 	})
+	Describe("Reset schedule", Label("reset", "schedule"), func() {
+		BeforeEach(func() {
+			ghwTest = v1mock.GhwMock{}
+			ghwTest.AddDisk(block.Disk{
+				Name: "device",
+				Partitions: []*block.Partition{
+					{Name: "device1", Label: constants.EfiLabel, Type: "vfat", MountPoint: constants.EfiDir},
+					{Name: "device2", Label: constants.StateLabel, Type: "ext4", MountPoint: constants.RunningStateDir},
+				},
+			})
+			ghwTest.CreateDevices()
+			Expect(utils.MkdirAll(fs, filepath.Join(constants.RunningStateDir, "grub2"), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(
+				filepath.Join(constants.RunningStateDir, "grub2/grub.cfg"),
+				[]byte("menuentry \"cOS\" --id cos {\n}\nmenuentry \"cOS recovery\" --id recovery {\n}\n"),
+				constants.FilePerm,
+			)).To(Succeed())
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("Schedules a reset booting the recovery once", func() {
+			schedule, err := action.PendingReset(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(schedule).To(BeNil())
+
+			config.ResetPersistent = true
+			Expect(action.ScheduleReset(config)).To(Succeed())
+			grubEnv := filepath.Join(constants.RunningStateDir, constants.GrubEnv)
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv", grubEnv, "set", "next_entry=recovery"}})).To(BeNil())
+
+			schedule, err = action.PendingReset(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(schedule.ResetPersistent).To(BeTrue())
+
+			Expect(action.ClearPendingReset(config)).To(Succeed())
+			schedule, err = action.PendingReset(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(schedule).To(BeNil())
+		})
+		It("Boots the recovery once with the installed boot loader", func() {
+			Expect(fs.WriteFile(filepath.Join(constants.RunningStateDir, constants.BootloaderFile), []byte(constants.SystemdBootBootloader), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, filepath.Join(constants.EfiDir, "loader/entries"), constants.DirPerm)).To(Succeed())
+			for _, name := range []string{constants.ActiveImgName, constants.RecoveryImgName} {
+				entry := filepath.Join(constants.EfiDir, "loader/entries", name+".conf")
+				Expect(fs.WriteFile(entry, []byte("title "+name+"\n"), constants.FilePerm)).To(Succeed())
+			}
+
+			Expect(action.ScheduleReset(config)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"bootctl", "set-oneshot", "recovery.conf"}})).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv"}})).NotTo(BeNil())
+		})
+	})
+	Describe("Upgrade check", Label("upgrade", "check"), func() {
+		var registry *v1mock.FakeRegistry
+		var luet *v1mock.FakeLuet
+		BeforeEach(func() {
+			ghwTest = v1mock.GhwMock{}
+			ghwTest.AddDisk(block.Disk{
+				Name: "device",
+				Partitions: []*block.Partition{
+					{Name: "device2", Label: constants.StateLabel, Type: "ext4", MountPoint: constants.RunningStateDir},
+				},
+			})
+			ghwTest.CreateDevices()
+			Expect(utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)).To(Succeed())
+			historyData := `{"action":"install","source":"registry.org/os:v1","digest":"sha256:aaa","images":["COS_ACTIVE","COS_PASSIVE","COS_SYSTEM"],"success":true}
+{"action":"upgrade","source":"system/cos","source-version":"0.8.1","images":["COS_ACTIVE"],"success":true}
+{"action":"upgrade","source":"system/cos","source-version":"0.8.2","images":["COS_ACTIVE"],"success":false}
+`
+			Expect(fs.WriteFile(filepath.Join(constants.RunningStateDir, constants.HistoryFile), []byte(historyData), constants.FilePerm)).To(Succeed())
+
+			registry = &v1mock.FakeRegistry{Digests: map[string]string{"registry.org/os:v1": "sha256:aaa"}}
+			luet = v1mock.NewFakeLuet()
+			config.Registry = registry
+			config.Luet = luet
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("Compares the channel package version with the installed one", func() {
+			config.ChannelUpgrades = true
+			config.UpgradeImage = "system/cos"
+			luet.ChannelVersionValue = "0.8.1"
+			check, err := action.CheckUpgrade(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(check.Current).To(Equal("0.8.1"))
+			Expect(check.Upgrade).To(BeFalse())
+
+			luet.ChannelVersionValue = "0.8.2"
+			check, err = action.CheckUpgrade(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(check.Available).To(Equal("0.8.2"))
+			Expect(check.Upgrade).To(BeTrue())
+		})
+		It("Compares the image digest with the installed one", func() {
+			config.ChannelUpgrades = false
+			config.RecoveryUpgrade = true
+			config.DockerImg = "registry.org/os:v1"
+			check, err := action.CheckUpgrade(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(check.Target).To(Equal(constants.UpgradeRecovery))
+			Expect(check.Current).To(Equal("sha256:aaa"))
+			Expect(check.Upgrade).To(BeFalse())
+
+			registry.Digests["registry.org/os:v1"] = "sha256:bbb"
+			check, err = action.CheckUpgrade(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(check.Upgrade).To(BeTrue())
+			Expect(registry.Calls).To(Equal([]string{
+				"registry.org/os:v1", "registry.org/os:v1@sha256:aaa", "registry.org/os:v1", "registry.org/os:v1@sha256:bbb",
+			}))
+		})
+		It("Compares the digest of the platform image of multi-arch images", func() {
+			config.ChannelUpgrades = false
+			config.RecoveryUpgrade = true
+			config.DockerImg = "registry.org/os:v1"
+			config.Platform = &v1.Platform{OS: "linux", Arch: "arm64"}
+			registry.Digests["registry.org/os:v1"] = "sha256:index"
+			registry.Platforms = map[string]map[string]string{
+				"registry.org/os:v1": {"linux/arm64": "registry.org/os@sha256:aaa", "linux/amd64": "registry.org/os@sha256:bbb"},
+			}
+			check, err := action.CheckUpgrade(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(check.Available).To(Equal("sha256:aaa"))
+			Expect(check.Upgrade).To(BeFalse())
+
+			config.Platform = &v1.Platform{OS: "linux", Arch: "amd64"}
+			check, err = action.CheckUpgrade(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(check.Available).To(Equal("sha256:bbb"))
+			Expect(check.Upgrade).To(BeTrue())
+		})
+		It("Fails if the source can't be resolved", func() {
+			config.ChannelUpgrades = false
+			config.DockerImg = "registry.org/os:v2"
+			_, err := action.CheckUpgrade(config)
+			Expect(err).To(HaveOccurred())
+
+			config.DockerImg = ""
+			config.Directory = "/some/dir"
+			_, err = action.CheckUpgrade(config)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("Inspect image", Label("inspect"), func() {
+		It("Inspects the system of a container image", func() {
+			luet := v1mock.NewFakeLuet()
+			luet.OnUnpack = func(target string) error {
+				Expect(utils.MkdirAll(fs, filepath.Join(target, "etc"), constants.DirPerm)).To(Succeed())
+				Expect(utils.MkdirAll(fs, filepath.Join(target, "boot"), constants.DirPerm)).To(Succeed())
+				Expect(utils.MkdirAll(fs, filepath.Join(target, "lib/modules/5.14.21-default"), constants.DirPerm)).To(Succeed())
+				osRelease := "NAME=\"cOS\"\nVERSION=0.8.1\nGRUB_ENTRY_NAME=\"My OS\"\n"
+				Expect(fs.WriteFile(filepath.Join(target, "etc/os-release"), []byte(osRelease), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(target, "boot/vmlinuz-5.14.21-default"), []byte("kernel"), constants.FilePerm)).To(Succeed())
+				Expect(fs.Symlink("vmlinuz-5.14.21-default", filepath.Join(target, "boot/vmlinuz"))).To(Succeed())
+				return fs.WriteFile(filepath.Join(target, "boot/initrd"), []byte("initrd"), constants.FilePerm)
+			}
+			config.Luet = luet
+			config.Registry = &v1mock.FakeRegistry{
+				ImageLabels: map[string]map[string]string{"registry.org/os:v1": {"org.opencontainers.image.version": "0.8.1"}},
+			}
+
+			info, err := action.InspectImage(config, "registry.org/os:v1", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Type).To(Equal(action.InspectDocker))
+			Expect(info.Digest).To(Equal("sha256:fakedigest"))
+			Expect(info.Labels).To(HaveKeyWithValue("org.opencontainers.image.version", "0.8.1"))
+			Expect(info.OSRelease).To(HaveKeyWithValue("VERSION", "0.8.1"))
+			Expect(info.GrubEntryName).To(Equal("My OS"))
+			Expect(*info.Kernel).To(Equal(action.BootFile{Path: "/boot/vmlinuz-5.14.21-default", Version: "5.14.21-default"}))
+			Expect(*info.Initrd).To(Equal(action.BootFile{Path: "/boot/initrd", Version: "5.14.21-default"}))
+		})
+		It("Inspects image files", func() {
+			Expect(fs.WriteFile("/images/active.img", []byte("image"), constants.FilePerm)).To(Succeed())
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				switch cmd {
+				case "blkid":
+					if args[len(args)-2] == "TYPE" {
+						return []byte("ext4\n"), nil
+					}
+					return []byte("COS_ACTIVE\n"), nil
+				case "losetup":
+					return []byte("/dev/loop0"), nil
+				default:
+					return []byte{}, nil
+				}
+			}
+
+			info, err := action.InspectImage(config, "/images/active.img", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Type).To(Equal(action.InspectFile))
+			Expect(info.Size).To(Equal(int64(5)))
+			Expect(info.Digest).To(Equal(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("image")))))
+			Expect(info.Label).To(Equal("COS_ACTIVE"))
+			Expect(info.Kernel).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{
+				{"blkid", "-o", "value", "-s", "TYPE", "/images/active.img"},
+				{"losetup", "--show", "-f", "-r", "/images/active.img"}, {"losetup", "-d", "/dev/loop0"},
+			})).To(Succeed())
+			mounts, _ := mounter.List()
+			Expect(mounts).To(BeEmpty())
+		})
+		It("Fails on directories", func() {
+			Expect(utils.MkdirAll(fs, "/some/dir", constants.DirPerm)).To(Succeed())
+			_, err := action.InspectImage(config, "/some/dir", false)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("Kargs", Label("kargs"), func() {
+		It("merges kernel arguments", func() {
+			current := []string{"quiet", "console=tty1", "console=ttyS0", "selinux=1"}
+			Expect(action.MergeKargs(current, []string{"selinux=0", "quiet"}, []string{"console", "selinux=1"})).To(
+				Equal([]string{"quiet", "selinux=0"}),
+			)
+			Expect(action.MergeKargs([]string{}, []string{"debug"}, nil)).To(Equal([]string{"debug"}))
+		})
+		It("fails on invalid slots", func() {
+			Expect(action.KargsUpdate(config, "other", []string{"quiet"}, nil, false)).NotTo(Succeed())
+			_, err := action.KargsList(config, "other")
+			Expect(err).To(HaveOccurred())
+			Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+		})
+		Describe("Next boot", Label("next-boot"), func() {
+			var grubEnv, grubCfg string
+			BeforeEach(func() {
+				ghwTest = v1mock.GhwMock{}
+				ghwTest.AddDisk(block.Disk{
+					Name: "device",
+					Partitions: []*block.Partition{
+						{
+							Name:       "device2",
+							Label:      constants.StateLabel,
+							Type:       "ext4",
+							MountPoint: constants.RunningStateDir,
+						},
+					},
+				})
+				ghwTest.CreateDevices()
+				grubEnv = filepath.Join(constants.RunningStateDir, constants.GrubEnv)
+				grubCfg = filepath.Join(constants.RunningStateDir, "grub2/grub.cfg")
+				Expect(utils.MkdirAll(fs, filepath.Dir(grubCfg), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(grubEnv, []byte("# GRUB Environment Block\nextra_cmdline=quiet console=tty1\n####"), constants.FilePerm)).To(Succeed())
+			})
+			AfterEach(func() {
+				ghwTest.Clean()
+			})
+			It("sets the next boot kernel arguments from the persistent ones", func() {
+				Expect(fs.WriteFile(grubCfg, []byte("# elemental: kernel arguments for the next boot only\n"), constants.FilePerm)).To(Succeed())
+				Expect(action.KargsUpdate(config, "", []string{"debug"}, []string{"quiet"}, true)).To(Succeed())
+				Expect(runner.IncludesCmds([][]string{
+					{"grub2-editenv", grubEnv, "set", "next_extra_cmdline=console=tty1 debug"},
+				})).To(BeNil())
+				Expect(runner.IncludesCmds([][]string{
+					{"grub2-editenv", grubEnv, "set", "extra_cmdline"},
+				})).NotTo(BeNil())
+			})
+			It("keeps pending next boot changes and lists them", func() {
+				Expect(fs.WriteFile(grubCfg, []byte("# elemental: kernel arguments for the next boot only\n"), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(grubEnv, []byte("# GRUB Environment Block\nextra_cmdline=quiet\nnext_extra_cmdline=quiet debug\n####"), constants.FilePerm)).To(Succeed())
+				kargs, err := action.KargsList(config, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(kargs).To(Equal(map[string]string{"extra_cmdline": "quiet", "next_extra_cmdline": "quiet debug"}))
+				Expect(action.KargsUpdate(config, "", []string{"selinux=0"}, nil, true)).To(Succeed())
+				Expect(runner.IncludesCmds([][]string{
+					{"grub2-editenv", grubEnv, "set", "next_extra_cmdline=quiet debug selinux=0"},
+				})).To(BeNil())
+			})
+			It("fails if the installed grub.cfg does not apply next boot arguments", func() {
+				Expect(fs.WriteFile(grubCfg, []byte("menuentry \"cOS\" {\n}\n"), constants.FilePerm)).To(Succeed())
+				Expect(action.KargsUpdate(config, "", []string{"debug"}, nil, true)).NotTo(Succeed())
+				Expect(runner.IncludesCmds([][]string{{"grub2-editenv"}})).NotTo(BeNil())
+			})
+		})
+	})
+	Describe("Rollback", Label("rollback"), func() {
+		var stateDir string
+		BeforeEach(func() {
+			ghwTest = v1mock.GhwMock{}
+			ghwTest.AddDisk(block.Disk{
+				Name: "device",
+				Partitions: []*block.Partition{
+					{
+						Name:       "device2",
+						Label:      constants.StateLabel,
+						Type:       "ext4",
+						MountPoint: constants.RunningStateDir,
+					},
+				},
+			})
+			ghwTest.CreateDevices()
+			stateDir = constants.RunningStateDir
+			grubCfg := "menuentry \"cOS\" --id cos {\n}\nmenuentry \"cOS (fallback)\" --id fallback {\n}\nmenuentry \"cOS recovery\" --id recovery {\n}\n"
+			Expect(utils.MkdirAll(fs, filepath.Join(stateDir, "grub2"), constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, filepath.Join(stateDir, "cOS"), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(stateDir, "grub2/grub.cfg"), []byte(grubCfg), constants.FilePerm)).To(Succeed())
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("boots the passive system by default and records it", func() {
+			Expect(fs.WriteFile(filepath.Join(stateDir, "cOS", constants.PassiveImgFile), []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(action.Rollback(config)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"grub2-editenv", filepath.Join(stateDir, constants.GrubEnv), "set", "saved_entry=fallback"},
+			})).To(BeNil())
+			// The state partition lock is released
+			data, err := fs.ReadFile(filepath.Join(stateDir, constants.StateLockFile))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(BeEmpty())
+			data, err = fs.ReadFile(filepath.Join(stateDir, constants.HistoryFile))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"action":"rollback"`))
+			Expect(string(data)).To(ContainSubstring(`"success":true`))
+		})
+		It("fails without a passive system", func() {
+			Expect(action.Rollback(config)).To(MatchError(ContainSubstring("no passive system")))
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv"}})).NotTo(BeNil())
+			data, err := fs.ReadFile(filepath.Join(stateDir, constants.HistoryFile))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"success":false`))
+		})
+	})
 })
@@ -17,45 +17,172 @@ limitations under the License.
 package action
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
 	"github.com/rancher-sandbox/elemental/pkg/constants"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/rancher-sandbox/elemental/pkg/utils"
 	"github.com/sirupsen/logrus"
 )
 
-// Hook is RunStage wrapper that only adds logic to ignore errors
+// Hook runs the yip stages and the hook executables of the given hook. The hook
+// context is exposed to both of them as ELEMENTAL_HOOK_* environment variables and
+// a report of each step duration and exit status is logged. Errors are ignored
 // in case v1.RunConfig.Strict is set to false
-func Hook(config *v1.RunConfig, hook string) error {
+func Hook(config *v1.RunConfig, action string, hook string) error {
+	var results []utils.HookResult
+	var errs error
+
+	if err := config.Context.Err(); err != nil {
+		return err
+	}
+
 	config.Logger.Infof("Running %s hook", hook)
+	env := hookEnv(config, action, hook)
+	defer setEnv(env)()
+
 	oldLevel := config.Logger.GetLevel()
 	config.Logger.SetLevel(logrus.ErrorLevel)
+	start := time.Now()
 	err := utils.RunStage(hook, config)
 	config.Logger.SetLevel(oldLevel)
+	stages := utils.HookResult{Name: fmt.Sprintf("%s yip stages", hook), Duration: time.Since(start), Err: err}
+	if err != nil {
+		stages.ExitCode = 1
+		errs = multierror.Append(errs, err)
+	}
+	results = append(results, stages)
+
+	timeout := hookTimeout(config, hook)
+	for _, exe := range utils.GetHookExecutables(config.Fs, hook) {
+		if errs != nil && config.Strict {
+			break
+		}
+		res := utils.RunHookExecutable(config.Runner, exe, env, timeout)
+		if res.Err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("hook executable %s failed: %w", exe, res.Err))
+		}
+		results = append(results, res)
+	}
+
+	for _, res := range results {
+		if res.Err != nil {
+			config.Logger.Warnf("Hook step %s", res)
+		} else {
+			config.Logger.Infof("Hook step %s", res)
+		}
+	}
+
+	// Errors caused by a cancellation are never ignored
+	if err := config.Context.Err(); err != nil {
+		return err
+	}
 	if !config.Strict {
-		err = nil
+		return nil
 	}
-	return err
+	return errs
 }
 
-// ChrootHook executes Hook inside a chroot environment
-func ChrootHook(config *v1.RunConfig, hook string, chrootDir string, bindMounts map[string]string) (err error) {
-	chroot := utils.NewChroot(chrootDir, config)
+// runCleanup runs the cleanup stack of an action. If the action was cancelled the cleanup
+// jobs run with a copy of the runner detached from the cancelled context, so mounts and
+// loop devices are released anyway. The original runner is not modified as it might be
+// shared with other running actions.
+func runCleanup(config *v1.RunConfig, cleanup *utils.CleanStack, err error) error {
+	if config.Context.Err() != nil {
+		config.Logger.Warnf("Action cancelled, cleaning up")
+		runner := config.Runner
+		config.Runner = runner.WithContext(context.Background())
+		defer func() { config.Runner = runner }()
+	}
+	return cleanup.Cleanup(err)
+}
+
+// ChrootHook executes Hook inside an isolated chroot environment, mounts done by the hook
+// are not visible from the host and are released once the hook returns
+func ChrootHook(config *v1.RunConfig, action string, hook string, chrootDir string, bindMounts map[string]string) (err error) {
+	chroot := utils.NewIsolatedChroot(chrootDir, config)
 	chroot.SetExtraMounts(bindMounts)
 	callback := func() error {
-		return Hook(config, hook)
+		return Hook(config, action, hook)
 	}
 	return chroot.RunCallback(callback)
 }
 
-// SetupLuet sets the Luet object with the appropriate plugins
-func SetupLuet(config *v1.RunConfig) {
-	var plugins []string
-	if config.DockerImg != "" {
-		if !config.NoVerify {
-			plugins = append(plugins, constants.LuetMtreePlugin)
+// hookEnv returns the environment variables describing the context of the
+// given hook. Image paths are always referred to the host root.
+func hookEnv(config *v1.RunConfig, action string, hook string) []string {
+	var source, active, passive, recovery string
+
+	if img := config.Images.GetActive(); img != nil {
+		active = img.File
+		source = img.Source.Value()
+	}
+	if img := config.Images.GetPassive(); img != nil {
+		passive = img.File
+	}
+	if img := config.Images.GetRecovery(); img != nil {
+		recovery = img.File
+	}
+
+	vars := [][]string{
+		{"NAME", hook},
+		{"ACTION", action},
+		{"TARGET", config.Target},
+		{"SOURCE", source},
+		{"ACTIVE_IMG", active},
+		{"PASSIVE_IMG", passive},
+		{"RECOVERY_IMG", recovery},
+		{"BOOTED_SLOT", utils.BootedSlot(config)},
+	}
+	env := []string{}
+	for _, v := range vars {
+		env = append(env, fmt.Sprintf("%s%s=%s", constants.HookEnvPrefix, v[0], v[1]))
+	}
+	return env
+}
+
+// setEnv sets the given KEY=VALUE variables in the process environment, yip stages
+// run in process. It returns a function restoring the previous values.
+func setEnv(env []string) func() {
+	type previous struct {
+		key, value string
+		set        bool
+	}
+	var saved []previous
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		value, set := os.LookupEnv(kv[0])
+		saved = append(saved, previous{kv[0], value, set})
+		_ = os.Setenv(kv[0], kv[1])
+	}
+	return func() {
+		for _, p := range saved {
+			if p.set {
+				_ = os.Setenv(p.key, p.value)
+			} else {
+				_ = os.Unsetenv(p.key)
+			}
 		}
 	}
-	config.Luet = v1.NewLuet(v1.WithLuetLogger(config.Logger), v1.WithLuetPlugins(plugins...))
+}
+
+// hookTimeout returns the timeout in seconds for the executables of the given hook
+func hookTimeout(config *v1.RunConfig, hook string) uint {
+	if timeout, ok := config.HookTimeouts[hook]; ok {
+		return timeout
+	}
+	return config.HookTimeout
+}
+
+// SetupLuet sets the Luet object. Container images are verified natively against their
+// mtree manifest after unpacking, so no luet plugins are required.
+func SetupLuet(config *v1.RunConfig) {
+	config.Luet = v1.NewLuet(v1.WithLuetLogger(config.Logger), v1.WithLuetContext(config.Context))
 }
 
 // SetPartitionsFromScratch initiates all defaults partitions in order is they
@@ -70,9 +197,14 @@ func SetPartitionsFromScratch(config *v1.RunConfig) {
 	if config.ForceEfi || efiExists {
 		config.PartTable = v1.GPT
 		config.BootFlag = v1.ESP
+		// systemd-boot keeps a kernel and an initrd for each image in the EFI partition
+		efiSize := constants.EfiSize
+		if config.Bootloader == constants.SystemdBootBootloader {
+			efiSize = constants.SystemdBootEfiSize
+		}
 		part = &v1.Partition{
 			Label:      constants.EfiLabel,
-			Size:       constants.EfiSize,
+			Size:       efiSize,
 			Name:       constants.EfiPartName,
 			FS:         constants.EfiFs,
 			MountPoint: constants.EfiDir,
@@ -115,6 +247,9 @@ func SetPartitionsFromScratch(config *v1.RunConfig) {
 		MountPoint: constants.StateDir,
 		Flags:      statePartFlags,
 	}
+	if config.LVM && config.LVMState {
+		part.VolumeGroup = config.LVMVolumeGroup
+	}
 	config.Partitions = append(config.Partitions, part)
 
 	part = &v1.Partition{
@@ -135,5 +270,69 @@ func SetPartitionsFromScratch(config *v1.RunConfig) {
 		MountPoint: constants.PersistentDir,
 		Flags:      []string{},
 	}
+	if config.LVM {
+		part.VolumeGroup = config.LVMVolumeGroup
+	}
 	config.Partitions = append(config.Partitions, part)
 }
+
+// withState runs the given function with the state partition, which is set as the only
+// partition of the configuration. The partition is mounted if not already mounted, or
+// remounted RW if write access is required and it is mounted RO, and it is left as it
+// was found afterwards.
+func withState(config *v1.RunConfig, rw bool, fn func(*v1.Partition) error) (err error) {
+	part, err := utils.GetFullDeviceByLabel(config.Runner, config.StateLabel, 2)
+	if err != nil {
+		return err
+	}
+
+	mode := "ro"
+	if rw {
+		mode = "rw"
+	}
+	if part.MountPoint == "" {
+		part.MountPoint = constants.StateDir
+		err = utils.MkdirAll(config.Fs, part.MountPoint, constants.DirPerm)
+		if err != nil {
+			return err
+		}
+		err = config.Mounter.Mount(part.Path, part.MountPoint, "auto", []string{mode})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			uErr := config.Mounter.Unmount(part.MountPoint)
+			if err == nil {
+				err = uErr
+			}
+		}()
+	} else if rw && utils.IsReadOnlyMount(config, part.MountPoint) {
+		err = config.Mounter.Mount(part.Path, part.MountPoint, "auto", []string{"remount", "rw"})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			rErr := config.Mounter.Mount(part.Path, part.MountPoint, "auto", []string{"remount", "ro"})
+			if err == nil {
+				err = rErr
+			}
+		}()
+	}
+
+	part.Name = constants.StatePartName
+	config.Partitions = v1.PartitionList{part}
+	return fn(part)
+}
+
+// withBootloaderState runs the given function with the boot loader recorded in the state
+// partition, see withState
+func withBootloaderState(config *v1.RunConfig, rw bool, fn func(v1.Bootloader, *v1.Partition) error) error {
+	return withState(config, rw, func(part *v1.Partition) error {
+		config.Bootloader = utils.DetectBootloader(config, part.MountPoint)
+		bootloader, err := utils.NewBootloader(config)
+		if err != nil {
+			return err
+		}
+		return fn(bootloader, part)
+	})
+}
@@ -0,0 +1,241 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/elemental"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+)
+
+// Inspected source types
+const (
+	InspectDocker = "docker"
+	InspectFile   = "file"
+	InspectISO    = "iso"
+)
+
+// ImageInfo describes the system included in an image source
+type ImageInfo struct {
+	Source string `json:"source"`
+	Type   string `json:"type"`
+	// Size is the size in bytes of the image file or of the container image layers
+	Size   int64  `json:"size"`
+	Digest string `json:"digest,omitempty"`
+	// Label is the filesystem label of image files and ISOs
+	Label string `json:"label,omitempty"`
+	// Labels are the labels of the container image configuration
+	Labels        map[string]string `json:"labels,omitempty"`
+	OSRelease     map[string]string `json:"os-release,omitempty"`
+	GrubEntryName string            `json:"grub-entry-name,omitempty"`
+	Kernel        *BootFile         `json:"kernel,omitempty"`
+	Initrd        *BootFile         `json:"initrd,omitempty"`
+}
+
+// BootFile is a kernel or an initrd found in the /boot directory of an image
+type BootFile struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+}
+
+// InspectImage reports the system included in the given source without changing it.
+// The source is a local image file (active.img, passive.img, recovery.squashfs), an ISO
+// or a container image reference, local sets the reference to be looked up in the local
+// docker daemon. Image files and ISOs are mounted read-only and container images are
+// unpacked in a temporary directory.
+func InspectImage(config *v1.RunConfig, source string, local bool) (info *ImageInfo, err error) {
+	e := elemental.NewElemental(config)
+	cleanup := utils.NewCleanStack()
+	defer func() { err = runCleanup(config, cleanup, err) }()
+
+	tmpDir, err := utils.TempDir(config.Fs, "", "elemental-inspect")
+	if err != nil {
+		return nil, err
+	}
+	cleanup.Push(func() error { return config.Fs.RemoveAll(tmpDir) })
+	root := filepath.Join(tmpDir, "root")
+
+	info = &ImageInfo{Source: source}
+	isFile, _ := utils.Exists(config.Fs, source)
+	if isDir, _ := utils.IsDir(config.Fs, source); isDir {
+		return nil, fmt.Errorf("%s is a directory, expected an image file, an ISO or a container image", source)
+	}
+
+	switch {
+	case isFile && isISO(source):
+		info.Type = InspectISO
+		if err = inspectFile(config, info); err != nil {
+			return nil, err
+		}
+		if err = mountImageFile(config, e, cleanup, source, tmpDir, root); err != nil {
+			return nil, err
+		}
+	case isFile:
+		info.Type = InspectFile
+		if err = inspectFile(config, info); err != nil {
+			return nil, err
+		}
+		if err = mountImageFile(config, e, cleanup, source, tmpDir, root); err != nil {
+			return nil, err
+		}
+	default:
+		info.Type = InspectDocker
+		config.Logger.Infof("Unpacking container image %s", source)
+		meta, err := e.UnpackImage(root, source, local)
+		if err != nil {
+			return nil, err
+		}
+		info.Digest = meta.Digest
+		info.Size = meta.Size
+		if !local {
+			info.Labels, err = config.Registry.Labels(config.Context, source)
+			if err != nil {
+				config.Logger.Warnf("Could not get the labels of %s: %s", source, err)
+			}
+		}
+	}
+
+	inspectRoot(config, root, info)
+	return info, nil
+}
+
+func isISO(source string) bool {
+	return strings.EqualFold(filepath.Ext(source), ".iso")
+}
+
+// mountImageFile mounts the image file or the rootfs of the ISO in source read-only
+// at root. ISOs are mounted in a directory of tmpDir. Unmounts are pushed to cleanup.
+func mountImageFile(config *v1.RunConfig, e *elemental.Elemental, cleanup *utils.CleanStack, source, tmpDir, root string) error {
+	img := &v1.Image{File: source, MountPoint: root}
+	if isISO(source) {
+		isoMnt := filepath.Join(tmpDir, "iso")
+		if err := utils.MkdirAll(config.Fs, isoMnt, cnst.DirPerm); err != nil {
+			return err
+		}
+		config.Logger.Infof("Mounting iso %s", source)
+		if err := config.Mounter.Mount(source, isoMnt, "auto", []string{"loop", "ro"}); err != nil {
+			return err
+		}
+		cleanup.Push(func() error { return config.Mounter.Unmount(isoMnt) })
+		img.File = filepath.Join(isoMnt, cnst.IsoRootFile)
+	} else {
+		config.Logger.Infof("Mounting image %s", source)
+	}
+	// Journaled filesystems replay their journal even if mounted read only
+	opts := []string{"ro"}
+	out, err := config.Runner.Run("blkid", "-o", "value", "-s", "TYPE", img.File)
+	if fs := strings.TrimSpace(string(out)); err == nil && (fs == "ext3" || fs == "ext4") {
+		opts = append(opts, "noload")
+	}
+	if err = e.MountImage(img, opts...); err != nil {
+		return err
+	}
+	cleanup.Push(func() error { return e.UnmountImage(img) })
+	return nil
+}
+
+// inspectFile sets the size, digest and filesystem label of an image file
+func inspectFile(config *v1.RunConfig, info *ImageInfo) error {
+	stat, err := config.Fs.Stat(info.Source)
+	if err != nil {
+		return err
+	}
+	info.Size = stat.Size()
+
+	f, err := config.Fs.Open(info.Source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return err
+	}
+	info.Digest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+
+	// Squashfs images have no label, blkid fails for them
+	out, err := config.Runner.Run("blkid", "-o", "value", "-s", "LABEL", info.Source)
+	if err == nil {
+		info.Label = strings.TrimSpace(string(out))
+	}
+	return nil
+}
+
+// inspectRoot sets the os-release, kernel and initrd data of the system in root
+func inspectRoot(config *v1.RunConfig, root string, info *ImageInfo) {
+	osRelease, err := utils.LoadEnvFile(config.Fs, filepath.Join(root, "etc", "os-release"))
+	if err != nil {
+		config.Logger.Warnf("Could not read os-release of %s: %s", info.Source, err)
+	} else {
+		info.OSRelease = osRelease
+		info.GrubEntryName = osRelease["GRUB_ENTRY_NAME"]
+	}
+
+	info.Kernel = findBootFile(config, root, "vmlinuz", "Image")
+	info.Initrd = findBootFile(config, root, "initrd", "initramfs")
+	if info.Kernel != nil && info.Kernel.Version == "" {
+		info.Kernel.Version = modulesVersion(config, root)
+	}
+	if info.Initrd != nil && info.Initrd.Version == "" && info.Kernel != nil {
+		info.Initrd.Version = info.Kernel.Version
+	}
+}
+
+// findBootFile returns the first of the given files found in /boot of root. Versions
+// are taken from the name of the file they link to, as in vmlinuz -> vmlinuz-<version>.
+func findBootFile(config *v1.RunConfig, root string, names ...string) *BootFile {
+	for _, name := range names {
+		path := filepath.Join("/boot", name)
+		if exists, _ := utils.Exists(config.Fs, filepath.Join(root, path)); !exists {
+			continue
+		}
+		file := &BootFile{Path: path}
+		if target, err := config.Fs.Readlink(filepath.Join(root, path)); err == nil {
+			if !filepath.IsAbs(target) {
+				target = filepath.Join("/boot", target)
+			}
+			file.Path = target
+			file.Version = strings.TrimPrefix(filepath.Base(target), name+"-")
+			if file.Version == filepath.Base(target) {
+				file.Version = ""
+			}
+		}
+		return file
+	}
+	return nil
+}
+
+// modulesVersion returns the kernel version from /lib/modules of root, only if there
+// is a single one
+func modulesVersion(config *v1.RunConfig, root string) string {
+	modules, err := config.Fs.RawPath(filepath.Join(root, "lib", "modules"))
+	if err != nil {
+		return ""
+	}
+	versions, _ := filepath.Glob(filepath.Join(modules, "*"))
+	if len(versions) != 1 {
+		return ""
+	}
+	return filepath.Base(versions[0])
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// Steps of an installation recorded in the install step journal
+const (
+	installStepPartitioned = "partitioned"
+	installStepFormatted   = "formatted"
+	installStepActive      = "active-deployed"
+	installStepBootloader  = "grub-installed"
+	installStepRecovery    = "recovery-deployed"
+	installStepPassive     = "passive-deployed"
+)
+
+// installSteps lists the steps of an installation in the order they are run
+var installSteps = []string{
+	installStepPartitioned,
+	installStepFormatted,
+	installStepActive,
+	installStepBootloader,
+	installStepRecovery,
+	installStepPassive,
+}
+
+// installJournal tracks the completed steps of an installation in a file of the state
+// partition, so an interrupted installation can be resumed from the first incomplete step
+type installJournal struct {
+	config *v1.RunConfig
+	Steps  []string `json:"steps"`
+}
+
+func newInstallJournal(config *v1.RunConfig) *installJournal {
+	return &installJournal{config: config, Steps: []string{}}
+}
+
+// path returns the path of the journal file, the state partition is expected to be mounted
+func (j installJournal) path() (string, error) {
+	state := j.config.Partitions.GetByName(cnst.StatePartName)
+	if state == nil || state.MountPoint == "" {
+		return "", errors.New("state partition not configured")
+	}
+	return filepath.Join(state.MountPoint, cnst.InstallStepsFile), nil
+}
+
+// completed checks if the given step is already completed
+func (j installJournal) completed(step string) bool {
+	for _, s := range j.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// done records the given steps as completed. Failures to record are only logged as they
+// should never break the installation itself.
+func (j *installJournal) done(steps ...string) {
+	for _, step := range steps {
+		if !j.completed(step) {
+			j.Steps = append(j.Steps, step)
+		}
+	}
+	path, err := j.path()
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(j)
+		if err == nil {
+			err = j.config.Fs.WriteFile(path, data, cnst.FilePerm)
+		}
+	}
+	if err != nil {
+		j.config.Logger.Warnf("Could not record install steps %s: %s", strings.Join(steps, ", "), err)
+	}
+}
+
+// load reads the journal of an interrupted installation and verifies its completed steps
+// with the given function. Steps are kept in order up to the first one that can't be verified.
+func (j *installJournal) load(verify func(step string) error) error {
+	path, err := j.path()
+	if err != nil {
+		return err
+	}
+	data, err := j.config.Fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errors.New("no interrupted installation found to resume")
+	} else if err != nil {
+		return err
+	}
+	recorded := installJournal{}
+	if err = json.Unmarshal(data, &recorded); err != nil {
+		return fmt.Errorf("invalid install step journal %s: %w", path, err)
+	}
+
+	j.Steps = []string{}
+	for _, step := range installSteps {
+		if !recorded.completed(step) {
+			break
+		}
+		if err = verify(step); err != nil {
+			j.config.Logger.Warnf("Could not verify install step %s, resuming from it: %s", step, err)
+			break
+		}
+		j.Steps = append(j.Steps, step)
+	}
+	j.config.Logger.Infof("Resuming installation, completed steps: %s", strings.Join(j.Steps, ", "))
+	return nil
+}
+
+// finish removes the journal once the installation is completed
+func (j installJournal) finish() {
+	path, err := j.path()
+	if err == nil {
+		err = j.config.Fs.RemoveAll(path)
+	}
+	if err != nil {
+		j.config.Logger.Warnf("Could not remove the install step journal: %s", err)
+	}
+}
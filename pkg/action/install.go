@@ -23,6 +23,7 @@ import (
 
 	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
 	"github.com/rancher-sandbox/elemental/pkg/elemental"
+	"github.com/rancher-sandbox/elemental/pkg/history"
 	"github.com/rancher-sandbox/elemental/pkg/partitioner"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/rancher-sandbox/elemental/pkg/utils"
@@ -39,9 +40,9 @@ func installHook(config *v1.RunConfig, hook string, chroot bool) error {
 		if oem != nil {
 			extraMounts[oem.MountPoint] = "/oem" //nolint:goconst
 		}
-		return ChrootHook(config, hook, config.Images.GetActive().MountPoint, extraMounts)
+		return ChrootHook(config, cnst.ActionInstall, hook, config.Images.GetActive().MountPoint, extraMounts)
 	}
-	return Hook(config, hook)
+	return Hook(config, cnst.ActionInstall, hook)
 }
 
 // InstallImagesSetup defines the parameters of active, passive and recovery
@@ -136,9 +137,17 @@ func InstallSetup(config *v1.RunConfig) error {
 
 // InstallRun will install the system from a given configuration
 func InstallRun(config *v1.RunConfig) (err error) { //nolint:gocyclo
+	lock, err := utils.AcquireLock(config, cnst.ActionInstall)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	newElemental := elemental.NewElemental(config)
+	journal := history.NewJournal(config, cnst.ActionInstall)
+	defer func() { journal.Record(err) }()
 	cleanup := utils.NewCleanStack()
-	defer func() { err = cleanup.Cleanup(err) }()
+	defer func() { err = runCleanup(config, cleanup, err) }()
 
 	disk := partitioner.NewDisk(
 		config.Target,
@@ -169,8 +178,10 @@ func InstallRun(config *v1.RunConfig) (err error) { //nolint:gocyclo
 		return fmt.Errorf("disk %s does not exist", config.Target)
 	}
 
-	// Check no-format flag
-	if config.NoFormat {
+	// Check resume and no-format flags
+	if config.Resume {
+		config.Logger.Infof("Resuming installation on existing partitions")
+	} else if config.NoFormat {
 		// Check force flag against current device
 		err = newElemental.CheckNoFormat()
 		if err != nil {
@@ -190,8 +201,27 @@ func InstallRun(config *v1.RunConfig) (err error) { //nolint:gocyclo
 	}
 	cleanup.Push(func() error { return newElemental.UnmountPartitions() })
 
+	err = lock.LockState(config.Partitions.GetByName(cnst.StatePartName).MountPoint)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(lock.ReleaseState)
+
+	steps := newInstallJournal(config)
+	if config.Resume {
+		err = steps.load(func(step string) error { return verifyInstallStep(config, step) })
+		if err != nil {
+			return err
+		}
+	}
+	steps.done(installStepPartitioned, installStepFormatted)
+
 	// Deploy active image
-	err = newElemental.DeployImage(config.Images.GetActive(), true)
+	if steps.completed(installStepActive) {
+		err = newElemental.MountImage(config.Images.GetActive(), "rw")
+	} else {
+		err = newElemental.DeployImage(config.Images.GetActive(), true)
+	}
 	if err != nil {
 		return err
 	}
@@ -202,11 +232,13 @@ func InstallRun(config *v1.RunConfig) (err error) { //nolint:gocyclo
 	if err != nil {
 		return err
 	}
-	// Install grub
-	grub := utils.NewGrub(config)
-	err = grub.Install()
-	if err != nil {
-		return err
+	// Install bootloader
+	if !steps.completed(installStepBootloader) {
+		err = utils.InstallBootloader(config)
+		if err != nil {
+			return err
+		}
+		steps.done(installStepBootloader)
 	}
 	// Relabel SELinux
 	_ = newElemental.SelinuxRelabel(cnst.ActiveDir, false)
@@ -216,20 +248,27 @@ func InstallRun(config *v1.RunConfig) (err error) { //nolint:gocyclo
 		return err
 	}
 
-	// Unmount active image
+	// Unmount active image, it is only complete once synced and unmounted
 	err = newElemental.UnmountImage(config.Images.GetActive())
 	if err != nil {
 		return err
 	}
+	steps.done(installStepActive)
 	// Install Recovery
-	err = newElemental.DeployImage(config.Images.GetRecovery(), false)
-	if err != nil {
-		return err
+	if !steps.completed(installStepRecovery) {
+		err = newElemental.DeployImage(config.Images.GetRecovery(), false)
+		if err != nil {
+			return err
+		}
+		steps.done(installStepRecovery)
 	}
 	// Install Passive
-	err = newElemental.DeployImage(config.Images.GetPassive(), false)
-	if err != nil {
-		return err
+	if !steps.completed(installStepPassive) {
+		err = newElemental.DeployImage(config.Images.GetPassive(), false)
+		if err != nil {
+			return err
+		}
+		steps.done(installStepPassive)
 	}
 
 	err = installHook(config, cnst.AfterInstallHook, false)
@@ -242,9 +281,11 @@ func InstallRun(config *v1.RunConfig) (err error) { //nolint:gocyclo
 	if err != nil {
 		return err
 	}
+	steps.finish()
 
 	// Do not reboot/poweroff on cleanup errors
-	err = cleanup.Cleanup(err)
+	err = runCleanup(config, cleanup, err)
+	journal.Record(err)
 	if err != nil {
 		return err
 	}
@@ -268,3 +309,57 @@ func InstallRun(config *v1.RunConfig) (err error) { //nolint:gocyclo
 	}
 	return err
 }
+
+// verifyInstallStep checks that the given completed step of an interrupted installation
+// left the expected result on the target
+func verifyInstallStep(config *v1.RunConfig, step string) error {
+	var img *v1.Image
+
+	switch step {
+	case installStepPartitioned, installStepFormatted:
+		// Partitions were already found by label and mounted
+		return nil
+	case installStepActive:
+		img = config.Images.GetActive()
+	case installStepRecovery:
+		img = config.Images.GetRecovery()
+	case installStepPassive:
+		img = config.Images.GetPassive()
+	case installStepBootloader:
+		bootloader, err := utils.NewBootloader(config)
+		if err != nil {
+			return err
+		}
+		entries, err := bootloader.ListEntries()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return errors.New("no boot entries found")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown install step %s", step)
+	}
+	return verifyImage(config, img)
+}
+
+// verifyImage checks the filesystem of the given image file, so an image which was not
+// completely written is not taken as deployed
+func verifyImage(config *v1.RunConfig, img *v1.Image) error {
+	if exists, _ := utils.Exists(config.Fs, img.File); !exists {
+		return fmt.Errorf("image file %s not found", img.File)
+	}
+	var out []byte
+	var err error
+	if img.FS == cnst.SquashFs {
+		out, err = config.Runner.Run("unsquashfs", "-l", img.File)
+	} else {
+		out, err = config.Runner.Run("e2fsck", "-fn", img.File)
+	}
+	if err != nil {
+		config.Logger.Debugf("Image check output: %s", out)
+		return fmt.Errorf("image file %s is damaged: %w", img.File, err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"strings"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+)
+
+// KargsList returns the extra kernel arguments stored in the grub environment of the
+// state partition for the given slot, or for all slots if empty, including the ones set
+// for the next boot only. The result maps each grub variable to its arguments, variables
+// without arguments are not included.
+func KargsList(config *v1.RunConfig, slot string) (map[string]string, error) {
+	slots, err := kargsSlots(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	kargs := map[string]string{}
+	err = withGrubState(config, false, func(grub *utils.Grub) error {
+		for _, s := range slots {
+			args, err := grub.GetKernelArgs(s)
+			if err != nil {
+				return err
+			}
+			if args != "" {
+				kargs[utils.GrubKernelArgsVar(s)] = args
+			}
+			args, err = grub.GetNextBootKernelArgs(s)
+			if err != nil {
+				return err
+			}
+			if args != "" {
+				kargs[utils.GrubNextBootKernelArgsVar(s)] = args
+			}
+		}
+		return nil
+	})
+	return kargs, err
+}
+
+// KargsUpdate adds and removes extra kernel arguments of the given slot, or of all
+// slots if empty. Arguments to remove without a value remove any argument with that
+// key. If nextBoot is set the changes only apply to the next boot, grub uses the resulting
+// arguments instead of the persistent ones once.
+func KargsUpdate(config *v1.RunConfig, slot string, add, remove []string, nextBoot bool) error {
+	if _, err := kargsSlots(slot); err != nil {
+		return err
+	}
+
+	return withGrubState(config, true, func(grub *utils.Grub) error {
+		current, err := grub.GetKernelArgs(slot)
+		if err != nil {
+			return err
+		}
+		if !nextBoot {
+			args := strings.Join(MergeKargs(strings.Fields(current), add, remove), " ")
+			config.Logger.Infof("Setting %s to '%s'", utils.GrubKernelArgsVar(slot), args)
+			return grub.SetKernelArgs(slot, args)
+		}
+
+		// Pending next boot changes are kept, otherwise start from the persistent ones
+		next, err := grub.GetNextBootKernelArgs(slot)
+		if err != nil {
+			return err
+		}
+		if next != "" {
+			current = next
+		}
+		args := strings.Join(MergeKargs(strings.Fields(current), add, remove), " ")
+		config.Logger.Infof("Setting %s to '%s'", utils.GrubNextBootKernelArgsVar(slot), args)
+		return grub.SetNextBootKernelArgs(slot, args)
+	})
+}
+
+// MergeKargs returns the current kernel arguments without the ones to remove and
+// including the ones to add which were not already present
+func MergeKargs(current, add, remove []string) []string {
+	result := []string{}
+	for _, arg := range current {
+		removed := false
+		for _, r := range remove {
+			if arg == r || (!strings.Contains(r, "=") && strings.HasPrefix(arg, r+"=")) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			result = append(result, arg)
+		}
+	}
+	for _, arg := range add {
+		found := false
+		for _, r := range result {
+			if r == arg {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, arg)
+		}
+	}
+	return result
+}
+
+// kargsSlots returns the slots to consider for the given slot, all of them if empty
+func kargsSlots(slot string) ([]string, error) {
+	switch slot {
+	case "":
+		return []string{"", cnst.ActiveImgName, cnst.PassiveImgName, cnst.RecoveryImgName}, nil
+	case cnst.ActiveImgName, cnst.PassiveImgName, cnst.RecoveryImgName:
+		return []string{slot}, nil
+	default:
+		return nil, fmt.Errorf("invalid slot '%s', valid slots are %s, %s and %s", slot, cnst.ActiveImgName, cnst.PassiveImgName, cnst.RecoveryImgName)
+	}
+}
+
+// withGrubState runs the given function with a Grub helper for the state partition, see
+// withState. It fails if the installed boot loader is not grub.
+func withGrubState(config *v1.RunConfig, rw bool, fn func(*utils.Grub) error) error {
+	return withState(config, rw, func(part *v1.Partition) error {
+		if bootloader := utils.DetectBootloader(config, part.MountPoint); bootloader != cnst.GrubBootloader {
+			return fmt.Errorf("kernel arguments are only managed for grub, the installed boot loader is %s", bootloader)
+		}
+		return fn(utils.NewGrub(config))
+	})
+}
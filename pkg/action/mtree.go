@@ -0,0 +1,100 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/elemental"
+	"github.com/rancher-sandbox/elemental/pkg/mtree"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+)
+
+// GenerateManifest writes the mtree manifest of source to output. The source is a
+// directory, an image file or an ISO, image files and ISOs are mounted read-only.
+func GenerateManifest(config *v1.RunConfig, source, output string, excludes ...string) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = runCleanup(config, cleanup, err) }()
+
+	root, err := manifestRoot(config, cleanup, source)
+	if err != nil {
+		return err
+	}
+	config.Logger.Infof("Generating mtree manifest of %s", source)
+	manifest, err := mtree.Generate(config.Fs, root, excludes...)
+	if err != nil {
+		return err
+	}
+
+	if err = utils.MkdirAll(config.Fs, filepath.Dir(output), cnst.DirPerm); err != nil {
+		return err
+	}
+	f, err := config.Fs.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = manifest.WriteTo(f)
+	return err
+}
+
+// VerifyManifest compares source against the mtree manifest in manifestFile and
+// returns the report of missing, extra and modified files. The source is a directory,
+// an image file or an ISO, image files and ISOs are mounted read-only.
+func VerifyManifest(config *v1.RunConfig, source, manifestFile string, excludes ...string) (report *mtree.Report, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = runCleanup(config, cleanup, err) }()
+
+	f, err := config.Fs.Open(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	manifest, err := mtree.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", manifestFile, err)
+	}
+
+	root, err := manifestRoot(config, cleanup, source)
+	if err != nil {
+		return nil, err
+	}
+	config.Logger.Infof("Verifying %s against %s", source, manifestFile)
+	return mtree.Verify(config.Fs, root, manifest, excludes...)
+}
+
+// manifestRoot returns the root tree of source, mounting image files and ISOs
+func manifestRoot(config *v1.RunConfig, cleanup *utils.CleanStack, source string) (string, error) {
+	if isDir, _ := utils.IsDir(config.Fs, source); isDir {
+		return source, nil
+	}
+	if exists, _ := utils.Exists(config.Fs, source); !exists {
+		return "", fmt.Errorf("%s not found, expected a directory, an image file or an ISO", source)
+	}
+
+	tmpDir, err := utils.TempDir(config.Fs, "", "elemental-mtree")
+	if err != nil {
+		return "", err
+	}
+	cleanup.Push(func() error { return config.Fs.RemoveAll(tmpDir) })
+	root := filepath.Join(tmpDir, "root")
+	err = mountImageFile(config, elemental.NewElemental(config), cleanup, source, tmpDir, root)
+	return root, err
+}
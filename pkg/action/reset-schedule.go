@@ -0,0 +1,88 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// ResetSchedule is a reset to run once the recovery system boots, it is stored in the
+// state partition
+type ResetSchedule struct {
+	ResetPersistent bool      `json:"reset-persistent"`
+	Scheduled       time.Time `json:"scheduled"`
+}
+
+// ScheduleReset schedules a reset for the next boot, which boots the recovery system once.
+// The reset clears the persistent partitions if config.ResetPersistent is set.
+func ScheduleReset(config *v1.RunConfig) error {
+	schedule := ResetSchedule{ResetPersistent: config.ResetPersistent, Scheduled: time.Now().UTC()}
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	return withBootloaderState(config, true, func(bootloader v1.Bootloader, _ *v1.Partition) error {
+		entry, err := slotEntry(config, bootloader, cnst.RecoveryImgName)
+		if err != nil {
+			return err
+		}
+		err = config.Fs.WriteFile(resetSchedulePath(config), data, cnst.FilePerm)
+		if err != nil {
+			return err
+		}
+		config.Logger.Infof("Reset scheduled, booting %s once", cnst.RecoveryImgName)
+		return bootloader.SetOneShotEntry(entry)
+	})
+}
+
+// PendingReset returns the scheduled reset, nil if there is none
+func PendingReset(config *v1.RunConfig) (*ResetSchedule, error) {
+	var schedule *ResetSchedule
+	err := withState(config, false, func(*v1.Partition) error {
+		data, err := config.Fs.ReadFile(resetSchedulePath(config))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		schedule = &ResetSchedule{}
+		return json.Unmarshal(data, schedule)
+	})
+	return schedule, err
+}
+
+// ClearPendingReset removes the scheduled reset, if any
+func ClearPendingReset(config *v1.RunConfig) error {
+	return withState(config, true, func(*v1.Partition) error {
+		err := config.Fs.Remove(resetSchedulePath(config))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// resetSchedulePath returns the path of the reset schedule file, only valid within withState
+func resetSchedulePath(config *v1.RunConfig) string {
+	return filepath.Join(config.Partitions.GetByName(cnst.StatePartName).MountPoint, cnst.ResetScheduleFile)
+}
@@ -22,6 +22,7 @@ import (
 
 	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
 	"github.com/rancher-sandbox/elemental/pkg/elemental"
+	"github.com/rancher-sandbox/elemental/pkg/history"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/rancher-sandbox/elemental/pkg/utils"
 )
@@ -37,9 +38,9 @@ func resetHook(config *v1.RunConfig, hook string, chroot bool) error {
 		if oem != nil {
 			extraMounts[oem.MountPoint] = "/oem"
 		}
-		return ChrootHook(config, hook, config.Images.GetActive().MountPoint, extraMounts)
+		return ChrootHook(config, cnst.ActionReset, hook, config.Images.GetActive().MountPoint, extraMounts)
 	}
-	return Hook(config, hook)
+	return Hook(config, cnst.ActionReset, hook)
 }
 
 // ResetSetup will set installation parameters according to
@@ -152,9 +153,17 @@ func ResetImagesSetup(config *v1.RunConfig) error {
 
 // ResetRun will reset the cos system to by following several steps
 func ResetRun(config *v1.RunConfig) (err error) { // nolint:gocyclo
+	lock, err := utils.AcquireLock(config, cnst.ActionReset)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	ele := elemental.NewElemental(config)
+	journal := history.NewJournal(config, cnst.ActionReset)
+	defer func() { journal.Record(err) }()
 	cleanup := utils.NewCleanStack()
-	defer func() { err = cleanup.Cleanup(err) }()
+	defer func() { err = runCleanup(config, cleanup, err) }()
 
 	err = resetHook(config, cnst.BeforeResetHook, false)
 	if err != nil {
@@ -197,6 +206,12 @@ func ResetRun(config *v1.RunConfig) (err error) { // nolint:gocyclo
 	}
 	cleanup.Push(func() error { return ele.UnmountPartitions() })
 
+	err = lock.LockState(config.Partitions.GetByName(cnst.StatePartName).MountPoint)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(lock.ReleaseState)
+
 	// Deploy active image
 	err = ele.DeployImage(config.Images.GetActive(), true)
 	if err != nil {
@@ -204,9 +219,8 @@ func ResetRun(config *v1.RunConfig) (err error) { // nolint:gocyclo
 	}
 	cleanup.Push(func() error { return ele.UnmountImage(config.Images.GetActive()) })
 
-	// install grub
-	grub := utils.NewGrub(config)
-	err = grub.Install()
+	// Install bootloader
+	err = utils.InstallBootloader(config)
 	if err != nil {
 		return err
 	}
@@ -242,7 +256,8 @@ func ResetRun(config *v1.RunConfig) (err error) { // nolint:gocyclo
 	}
 
 	// Do not reboot/poweroff on cleanup errors
-	err = cleanup.Cleanup(err)
+	err = runCleanup(config, cleanup, err)
+	journal.Record(err)
 	if err != nil {
 		return err
 	}
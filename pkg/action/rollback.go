@@ -0,0 +1,89 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/history"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+)
+
+// Rollback makes the passive system, the one which was active before the last upgrade,
+// the system booted by default. It takes effect on the next reboot.
+func Rollback(config *v1.RunConfig) (err error) {
+	lock, err := utils.AcquireLock(config, cnst.ActionRollback)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	journal := history.NewJournal(config, cnst.ActionRollback)
+	defer func() { journal.Record(err) }()
+
+	return withBootloaderState(config, true, func(bootloader v1.Bootloader, state *v1.Partition) error {
+		err := lock.LockState(state.MountPoint)
+		if err != nil {
+			return err
+		}
+		defer lock.ReleaseState()
+
+		passive := filepath.Join(state.MountPoint, "cOS", cnst.PassiveImgFile)
+		if exists, _ := utils.Exists(config.Fs, passive); !exists {
+			return fmt.Errorf("there is no passive system to roll back to, %s not found", passive)
+		}
+		entry, err := slotEntry(config, bootloader, cnst.PassiveImgName)
+		if err != nil {
+			return err
+		}
+		config.Logger.Infof("Setting %s boot entry '%s' as the default one", cnst.PassiveImgName, entry)
+		return bootloader.SetDefaultEntry(entry)
+	})
+}
+
+// slotEntryIDs are the known boot entry IDs of each slot, besides the slot name. The
+// grub.cfg of cOS names them after the role of each system.
+var slotEntryIDs = map[string][]string{
+	cnst.ActiveImgName:   {"cos"},
+	cnst.PassiveImgName:  {"fallback"},
+	cnst.RecoveryImgName: {"recovery"},
+}
+
+// slotEntry returns the ID of the boot entry of the given slot, found by ID or by the
+// title of the slot
+func slotEntry(config *v1.RunConfig, bootloader v1.Bootloader, slot string) (string, error) {
+	entries, err := bootloader.ListEntries()
+	if err != nil {
+		return "", err
+	}
+	ids := append([]string{slot}, slotEntryIDs[slot]...)
+	title := utils.BootEntryTitles(config)[slot]
+	for _, entry := range entries {
+		if entry.Title == title {
+			return entry.ID, nil
+		}
+		for _, id := range ids {
+			if entry.ID == id {
+				return entry.ID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no boot entry found for the %s system", slot)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/history"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// UpgradeCheck is the result of comparing the installed image against the
+// configured upgrade source. Versions are image digests for docker sources and
+// package versions for channel sources.
+type UpgradeCheck struct {
+	Target    string `json:"target"`
+	Source    string `json:"source"`
+	Current   string `json:"current,omitempty"`
+	Available string `json:"available"`
+	Upgrade   bool   `json:"upgrade"`
+}
+
+// CheckUpgrade resolves the configured upgrade source and compares it with the image
+// recorded in the history journal for the upgrade target. Nothing is changed on the
+// system. If the installed image is unknown an upgrade is reported as available.
+func CheckUpgrade(config *v1.RunConfig) (*UpgradeCheck, error) {
+	target, source := NewUpgradeAction(config).getTargetAndSource()
+	check := &UpgradeCheck{Target: target, Source: source.Value()}
+
+	var err error
+	switch {
+	case source.IsDocker():
+		check.Available, err = platformDigest(config, source.Value())
+	case source.IsChannel():
+		check.Available, err = config.Luet.ChannelVersion(source.Value())
+	default:
+		return nil, fmt.Errorf("can't check for upgrades from %s, only docker and channel sources are supported", source.Value())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed resolving %s: %w", source.Value(), err)
+	}
+
+	label := config.ActiveLabel
+	if target == cnst.UpgradeRecovery {
+		label = config.SystemLabel
+	}
+	entries, err := history.Read(config)
+	if err != nil {
+		return nil, err
+	}
+	current := installedEntry(entries, label)
+	if current == nil {
+		config.Logger.Warnf("No record of the installed %s image found", target)
+		check.Upgrade = true
+		return check, nil
+	}
+
+	if source.IsDocker() {
+		check.Current = current.Digest
+	} else {
+		check.Current = current.SourceVersion
+		if current.Source != source.Value() {
+			// A different package is always an upgrade, whatever its version
+			check.Current = fmt.Sprintf("%s@%s", current.Source, current.SourceVersion)
+		}
+	}
+	check.Upgrade = check.Current != check.Available
+	return check, nil
+}
+
+// platformDigest returns the digest of the manifest for the configured platform, or the
+// host one, the given image reference points to. This is the digest recorded for deployed
+// images, tags of multi-arch images point to the digest of the index instead.
+func platformDigest(config *v1.RunConfig, ref string) (string, error) {
+	platform := config.Platform
+	if platform == nil {
+		platform = v1.NewHostPlatform()
+	}
+	resolved, err := config.Registry.ResolvePlatform(config.Context, ref, *platform)
+	if err != nil {
+		return "", err
+	}
+	return config.Registry.Digest(config.Context, resolved)
+}
+
+// installedEntry returns the last successful history entry which deployed the image
+// with the given label
+func installedEntry(entries []history.Entry, label string) *history.Entry {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].Success {
+			continue
+		}
+		for _, l := range entries[i].Images {
+			if l == label {
+				return &entries[i]
+			}
+		}
+	}
+	return nil
+}
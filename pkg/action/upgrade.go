@@ -19,16 +19,19 @@ package action
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/rancher-sandbox/elemental/pkg/constants"
 	"github.com/rancher-sandbox/elemental/pkg/elemental"
+	"github.com/rancher-sandbox/elemental/pkg/history"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/rancher-sandbox/elemental/pkg/utils"
 )
 
 // UpgradeAction represents the struct that will run the upgrade from start to finish
 type UpgradeAction struct {
-	Config *v1.RunConfig
+	Config   *v1.RunConfig
+	upgraded *v1.Image
 }
 
 func NewUpgradeAction(config *v1.RunConfig) *UpgradeAction {
@@ -61,15 +64,35 @@ func upgradeHook(config *v1.RunConfig, hook string, chroot bool) error {
 			mountPoints[persistentDevice.MountPoint] = "/usr/local"
 		}
 
-		return ChrootHook(config, hook, config.Images[constants.ActiveImgName].MountPoint, mountPoints)
+		return ChrootHook(config, constants.ActionUpgrade, hook, config.Images[constants.ActiveImgName].MountPoint, mountPoints)
 	}
-	return Hook(config, hook)
+	return Hook(config, constants.ActionUpgrade, hook)
 }
 
 func (u *UpgradeAction) Run() (err error) { // nolint:gocyclo
 	var transitionImg string
 	var isSquashRecovery bool
 	var upgradeStateDir string
+
+	// The upgraded image is only set in the config images while running, so the
+	// config is left as it was given once done
+	images := u.Config.Images
+	u.Config.Images = v1.ImageMap{}
+	for name, img := range images {
+		u.Config.Images[name] = img
+	}
+	defer func() { u.Config.Images = images }()
+	u.upgraded = nil
+
+	lock, err := utils.AcquireLock(u.Config, constants.ActionUpgrade)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	journal := history.NewJournal(u.Config, constants.ActionUpgrade)
+	defer func() { journal.Record(err) }()
+
 	// When booting from recovery the label can be the recovery or the system, depending on the recovery img type (squash/non-squash)
 	bootedFromRecovery := utils.BootedFrom(u.Config.Runner, u.Config.RecoveryLabel) || utils.BootedFrom(u.Config.Runner, u.Config.SystemLabel)
 	u.Debug("Booted from recovery: %v", bootedFromRecovery)
@@ -107,7 +130,7 @@ func (u *UpgradeAction) Run() (err error) { // nolint:gocyclo
 	u.Debug("Is squash recovery: %v", isSquashRecovery)
 
 	cleanup := utils.NewCleanStack()
-	defer func() { err = cleanup.Cleanup(err) }()
+	defer func() { err = runCleanup(u.Config, cleanup, err) }()
 
 	// Work out the paths and current system to mount the upgrade state dir
 	// We booted from recovery
@@ -181,6 +204,15 @@ func (u *UpgradeAction) Run() (err error) { // nolint:gocyclo
 	// Some debug info just in case
 	u.Debug("Upgrade state dir: %s", upgradeStateDir)
 
+	if !u.Config.RecoveryUpgrade {
+		err = lock.LockState(upgradeStateDir)
+		if err != nil {
+			u.Error("Error locking the state partition: %s", err)
+			return err
+		}
+		cleanup.Push(lock.ReleaseState)
+	}
+
 	upgradeTarget, upgradeSource := u.getTargetAndSource()
 
 	u.Config.Logger.Infof("Upgrading %s partition", upgradeTarget)
@@ -210,12 +242,24 @@ func (u *UpgradeAction) Run() (err error) { // nolint:gocyclo
 
 	u.Debug("Using transition img: %s", transitionImg)
 
-	cleanup.Push(func() error { return u.remove(transitionImg) })
-
 	// Get the upgradeTempDir here, so we use the persistent partition if mounted
 	upgradeTempDir := utils.GetUpgradeTempDir(u.Config)
 	u.Debug("Upgrade temp dir: %s", upgradeTempDir)
 
+	err = u.removeStaleArtifacts(upgradeStateDir, upgradeTempDir)
+	if err != nil {
+		u.Error("Error removing leftovers of a previous upgrade: %s", err)
+		return err
+	}
+
+	err = u.checkFreeSpace(transitionImg, upgradeTempDir, isSquashRecovery && u.Config.RecoveryUpgrade)
+	if err != nil {
+		u.Error("Can't upgrade: %s", err)
+		return err
+	}
+
+	cleanup.Push(func() error { return u.remove(transitionImg) })
+
 	err = utils.MkdirAll(u.Config.Fs, upgradeTempDir, constants.DirPerm)
 	if err != nil {
 		u.Error("Error creating target dir %s: %s", upgradeTempDir, err)
@@ -305,11 +349,33 @@ func (u *UpgradeAction) Run() (err error) { // nolint:gocyclo
 			}
 		}
 	}
+	// Manage the boot loader recorded on install, not the configured default
+	stateDir := constants.StateDir
+	if statePartForRecovery != nil && statePartForRecovery.MountPoint != "" {
+		stateDir = statePartForRecovery.MountPoint
+	}
+	u.Config.Bootloader = utils.DetectBootloader(u.Config, stateDir)
+
+	// Recovery upgrades only write to the state partition from here on
+	if u.Config.RecoveryUpgrade && statePartForRecovery != nil {
+		err = lock.LockState(stateDir)
+		if err != nil {
+			u.Error("Error locking the state partition: %s", err)
+			return err
+		}
+		cleanup.Push(lock.ReleaseState)
+	}
+
 	// Load the os-release file from the new upgraded system
 	osRelease, err := utils.LoadEnvFile(u.Config.Fs, filepath.Join(upgradeTempDir, "etc", "os-release"))
 	// override grub vars with the new system vars
 	u.Config.GrubDefEntry = osRelease["GRUB_ENTRY_NAME"]
 
+	// The running system becomes the passive one, keep its extra kernel arguments
+	if !u.Config.RecoveryUpgrade {
+		u.preserveKernelArgs()
+	}
+
 	err = ele.Rebrand()
 
 	if err != nil {
@@ -323,6 +389,19 @@ func (u *UpgradeAction) Run() (err error) { // nolint:gocyclo
 		return err
 	}
 
+	// systemd-boot boots the kernel and initrd copied to the EFI partition, stage the
+	// upgraded ones now and only commit them once the image is in place
+	var systemdBoot *utils.SystemdBoot
+	if u.Config.Bootloader == constants.SystemdBootBootloader {
+		systemdBoot = utils.NewSystemdBoot(u.Config)
+		err = systemdBoot.StageKernel(upgradeTarget, upgradeTempDir)
+		if err != nil {
+			u.Error("Error staging the upgraded kernel: %s", err)
+			return err
+		}
+		cleanup.Push(func() error { return systemdBoot.DiscardKernel(upgradeTarget) })
+	}
+
 	if u.Config.RecoveryUpgrade && isSquashRecovery {
 		u.Debug("Upgrading recovery+squash, not umounting image file")
 	} else {
@@ -378,12 +457,25 @@ func (u *UpgradeAction) Run() (err error) { // nolint:gocyclo
 	}
 	u.Info("Finished moving %s to %s", transitionImg, finalDestination)
 
+	if systemdBoot != nil {
+		err = systemdBoot.CommitKernel(upgradeTarget)
+		if err != nil {
+			u.Error("Error updating the kernel of the %s entry: %s", upgradeTarget, err)
+			return err
+		}
+	}
+
 	_, _ = u.Config.Runner.Run("sync")
 
+	upgraded := img
+	upgraded.File = finalDestination
+	u.upgraded = &upgraded
+
 	u.Info("Upgrade completed")
 
 	// Do not reboot/poweroff on cleanup errors
-	err = cleanup.Cleanup(err)
+	err = runCleanup(u.Config, cleanup, err)
+	journal.Record(err)
 	if err != nil {
 		return err
 	}
@@ -397,6 +489,11 @@ func (u *UpgradeAction) Run() (err error) { // nolint:gocyclo
 	return err
 }
 
+// Upgraded returns the image deployed by the last Run, nil if it did not get to deploy it
+func (u *UpgradeAction) Upgraded() *v1.Image {
+	return u.upgraded
+}
+
 // unmount attempts to unmount the given path. Does nothing if not mounted
 func (u *UpgradeAction) unmount(path string) error {
 	if notMounted, _ := u.Config.Mounter.IsLikelyNotMountPoint(path); !notMounted {
@@ -406,6 +503,24 @@ func (u *UpgradeAction) unmount(path string) error {
 	return nil
 }
 
+// preserveKernelArgs sets the extra kernel arguments of the active slot to the passive
+// slot, as the current active image is moved to the passive slot on upgrade
+func (u *UpgradeAction) preserveKernelArgs() {
+	if u.Config.Bootloader != "" && u.Config.Bootloader != constants.GrubBootloader {
+		return
+	}
+	grub := utils.NewGrub(u.Config)
+	args, err := grub.GetKernelArgs(constants.ActiveImgName)
+	if err != nil {
+		u.Debug("Could not read the active kernel arguments: %s", err)
+		return
+	}
+	err = grub.SetKernelArgs(constants.PassiveImgName, args)
+	if err != nil {
+		u.Config.Logger.Warnf("Could not preserve the kernel arguments for the passive system: %s", err)
+	}
+}
+
 // remove attempts to remove the given path. Does nothing if it doesn't exist
 func (u *UpgradeAction) remove(path string) error {
 	if exists, _ := utils.Exists(u.Config.Fs, path); exists {
@@ -415,6 +530,63 @@ func (u *UpgradeAction) remove(path string) error {
 	return nil
 }
 
+// removeStaleArtifacts removes the temp dir and transition images left behind by a previous
+// upgrade that did not complete
+func (u *UpgradeAction) removeStaleArtifacts(stateDir, tempDir string) error {
+	if exists, _ := utils.Exists(u.Config.Fs, tempDir); exists {
+		u.Config.Logger.Warnf("Removing upgrade temp dir %s left by a previous upgrade", tempDir)
+		err := u.unmount(tempDir)
+		if err != nil {
+			return err
+		}
+		err = u.Config.Fs.RemoveAll(tempDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{constants.TransitionImgFile, constants.TransitionSquashFile} {
+		img := filepath.Join(stateDir, "cOS", name)
+		if exists, _ := utils.Exists(u.Config.Fs, img); !exists {
+			continue
+		}
+		u.Config.Logger.Warnf("Removing transition image %s left by a previous upgrade", img)
+		// The image might still be attached to a loop device
+		out, err := u.Config.Runner.Run("losetup", "--associated", img)
+		if err == nil {
+			for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+				if dev := strings.SplitN(line, ":", 2)[0]; dev != "" {
+					_, _ = u.Config.Runner.Run("losetup", "-d", dev)
+				}
+			}
+		}
+		err = u.Config.Fs.RemoveAll(img)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFreeSpace checks there is enough room for the transition image and, when upgrading a
+// squashed recovery, for the tree it is built from. The size of a squashfs image is not known
+// in advance, so it is expected to be at most the size of the tree.
+func (u *UpgradeAction) checkFreeSpace(transitionImg, tempDir string, squash bool) error {
+	reqs := []utils.SpaceRequirement{{
+		Path:   filepath.Dir(transitionImg),
+		Size:   u.Config.ImgSize,
+		Reason: "the transition image",
+	}}
+	if squash {
+		reqs = append(reqs, utils.SpaceRequirement{
+			Path:   tempDir,
+			Size:   u.Config.ImgSize,
+			Reason: "the upgrade tree",
+		})
+	}
+	return utils.CheckFreeSpace(u.Config, reqs...)
+}
+
 // getTargetAndSource finds our the target and source for the upgrade
 func (u *UpgradeAction) getTargetAndSource() (string, v1.ImageSource) {
 	upgradeSource := v1.NewChannelSrc(constants.ChannelSource)
@@ -28,18 +28,20 @@ type YipCloudInitRunner struct {
 	exec    executor.Executor
 	fs      vfs.FS
 	console plugins.Console
+	steps   *stepIndex
 }
 
 // NewYipCloudInitRunner returns a default yip cloud init executor with the Elemental plugin set.
 // It accepts a logger which is used inside the runner.
 func NewYipCloudInitRunner(l v1.Logger, r v1.Runner, fs vfs.FS) *YipCloudInitRunner {
+	steps := &stepIndex{}
 	exec := executor.NewExecutor(
 		executor.WithConditionals(
 			plugins.NodeConditional,
 			plugins.IfConditional,
 		),
 		executor.WithLogger(l),
-		executor.WithPlugins(
+		executor.WithPlugins(steps.track(
 			// Note, the plugin execution order depends on the order passed here
 			plugins.DNS,
 			plugins.Download,
@@ -59,21 +61,39 @@ func NewYipCloudInitRunner(l v1.Logger, r v1.Runner, fs vfs.FS) *YipCloudInitRun
 			plugins.Environment,
 			plugins.SystemdFirstboot,
 			plugins.DataSources,
-			layoutPlugin,
-		),
+			steps.layoutPlugin,
+		)...),
 	)
 	return &YipCloudInitRunner{
 		exec: exec, fs: fs,
 		console: newCloudInitConsole(l, r),
+		steps:   steps,
 	}
 }
 
 func (ci YipCloudInitRunner) Run(stage string, args ...string) error {
+	ci.steps.load(ci.fs, stage, args...)
 	return ci.exec.Run(stage, ci.fs, ci.console, args...)
 }
 
 func (ci *YipCloudInitRunner) SetModifier(m schema.Modifier) {
 	ci.exec.Modifier(m)
+	ci.steps.modifier = m
+}
+
+// Steps returns the steps the given stage runs from the given sources, in order.
+// Steps of remote sources are not listed.
+func (ci YipCloudInitRunner) Steps(stage string, args ...string) []v1.CloudInitStep {
+	steps := []v1.CloudInitStep{}
+	for _, step := range ci.steps.parseSources(ci.fs, stage, args...) {
+		steps = append(steps, step.CloudInitStep)
+	}
+	return steps
+}
+
+// Results returns the outcome of all the steps run so far, in order
+func (ci YipCloudInitRunner) Results() []v1.CloudInitStepResult {
+	return ci.steps.results
 }
 
 // Useful for testing purposes
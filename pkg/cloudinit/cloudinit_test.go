@@ -20,13 +20,18 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jaypipes/ghw/pkg/block"
+	"github.com/mudler/yip/pkg/schema"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	. "github.com/rancher-sandbox/elemental/pkg/cloudinit"
 	"github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/partitioner"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/rancher-sandbox/elemental/pkg/utils"
 	v1mock "github.com/rancher-sandbox/elemental/tests/mocks"
@@ -43,6 +48,44 @@ const printOutput = `BYT;
 2:98304s:29394943s:29296640s:ext4::boot, type=83;
 3:29394944s:45019135s:15624192s:ext4::type=83;`
 
+// fakeParted applies the partitions removed and created by the given parted arguments
+// to the given print output. New partitions take the lowest free number as parted does.
+func fakeParted(table string, args []string) string {
+	lines := strings.Split(table, "\n")
+	parts := map[int]string{}
+	for _, line := range lines[2:] {
+		num, _ := strconv.Atoi(strings.SplitN(line, ":", 2)[0])
+		parts[num] = line
+	}
+	for i, arg := range args {
+		switch arg {
+		case "rm":
+			num, _ := strconv.Atoi(args[i+1])
+			delete(parts, num)
+		case "mkpart":
+			num := 1
+			for parts[num] != "" {
+				num++
+			}
+			end := strings.TrimSuffix(args[i+4], "100%") + "s"
+			if end == "s" {
+				end = "50593791s"
+			}
+			parts[num] = fmt.Sprintf("%d:%ss:%s:2048s:%s::type=83;", num, args[i+3], end, args[i+2])
+		}
+	}
+	nums := []int{}
+	for num := range parts {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	out := lines[:2]
+	for _, num := range nums {
+		out = append(out, parts[num])
+	}
+	return strings.Join(out, "\n")
+}
+
 var _ = Describe("CloudRunner", Label("CloudRunner", "types", "cloud-init"), func() {
 	// unit test stolen from yip
 	Describe("loading yaml files", func() {
@@ -106,6 +149,7 @@ stages:
 		logger := logrus.New()
 		logger.SetOutput(ioutil.Discard)
 		BeforeEach(func() {
+			cmdFail = ""
 			afs, cleanup, _ = vfst.NewTestFS(nil)
 			err := utils.MkdirAll(afs, "/some/yip", constants.DirPerm)
 			Expect(err).To(BeNil())
@@ -116,13 +160,15 @@ stages:
 
 			runner = v1mock.NewFakeRunner()
 
+			table := printOutput
 			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
 				if cmd == cmdFail {
 					return []byte{}, errors.New("command error")
 				}
 				switch cmd {
 				case "parted":
-					return []byte(printOutput), nil
+					table = fakeParted(table, args)
+					return []byte(table), nil
 				default:
 					return []byte{}, nil
 				}
@@ -254,6 +300,88 @@ stages:
 			cloudRunner := NewYipCloudInitRunner(logger, runner, afs)
 			Expect(cloudRunner.Run("test", "/some/yip")).NotTo(BeNil())
 		})
+		It("Deletes a partition and adds a new one at a given offset", func() {
+			_, err := afs.Create(fmt.Sprintf("%s2", device))
+			Expect(err).To(BeNil())
+			err = afs.WriteFile("/some/yip/layout.yaml", []byte(fmt.Sprintf(`
+stages:
+  test:
+  - name: Reshaping layout
+    layout:
+      device:
+        path: %s
+      delete_partitions:
+      - number: 2
+      add_partitions:
+      - fsLabel: DATA
+        pLabel: data
+        size: 16
+        offset: 22000
+        guidType: 0fc63daf-8483-4772-8e79-3d69d8477de4
+`, device)), constants.FilePerm)
+			Expect(err).To(BeNil())
+			cloudRunner := NewYipCloudInitRunner(logger, runner, afs)
+			Expect(cloudRunner.Run("test", "/some/yip")).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"lsblk", "--pairs", "--noheadings", "--nodeps", "--output", "LABEL,FSTYPE,PARTTYPE", "/dev/device2"},
+				{"parted", "--script", "--machine", "--", device, "unit", "s", "rm", "2"},
+				{"parted", "--script", "--machine", "--", device, "unit", "s", "mkpart", "primary", "ext4", "45056000", "45088767"},
+				{"sgdisk", "--typecode=2:0fc63daf-8483-4772-8e79-3d69d8477de4", device},
+				{"mkfs.ext4", "-L", "DATA", "/dev/device2"},
+			})).To(BeNil())
+		})
+		It("Fails to resize a partition that does not exist", func() {
+			err := afs.WriteFile("/some/yip/layout.yaml", []byte(fmt.Sprintf(`
+stages:
+  test:
+  - name: Resizing a missing partition
+    layout:
+      device:
+        path: %s
+      resize_partitions:
+      - pLabel: missing
+        size: 1024
+`, device)), constants.FilePerm)
+			Expect(err).To(BeNil())
+			cloudRunner := NewYipCloudInitRunner(logger, runner, afs)
+			Expect(cloudRunner.Run("test", "/some/yip")).NotTo(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"parted", "--script", "--machine", "--", device, "unit", "s", "rm"}})).NotTo(BeNil())
+		})
+		It("Creates logical volumes in an existing volume group", func() {
+			err := afs.WriteFile("/some/yip/layout.yaml", []byte(fmt.Sprintf(`
+stages:
+  test:
+  - name: Logical volumes
+    layout:
+      device:
+        path: %s
+      lvm:
+        volumeGroup: cos
+        volumes:
+        - name: state
+          fsLabel: COS_STATE
+          size: 1024
+        - name: persistent
+          fsLabel: COS_PERSISTENT
+          filesystem: xfs
+        expand_volume:
+          size: 2048
+`, device)), constants.FilePerm)
+			Expect(err).To(BeNil())
+			cloudRunner := NewYipCloudInitRunner(logger, runner, afs)
+			Expect(cloudRunner.Run("test", "/some/yip")).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"vgs", "cos"},
+				{"vgchange", "--activate", "y", "cos"},
+				{"lvs", "--noheadings", "--options", "lv_name", "cos"},
+				{"lvcreate", "--yes", "--name", "state", "--size", "1024M", "cos"},
+				{"mkfs.ext4", "-L", "COS_STATE", "/dev/cos/state"},
+				{"lvcreate", "--yes", "--name", "persistent", "--extents", "100%FREE", "cos"},
+				{"mkfs.xfs", "-L", "COS_PERSISTENT", "/dev/cos/persistent"},
+				{"lvextend", "--resizefs", "--size", "2048M", "/dev/cos/persistent"},
+			})).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"pvcreate"}})).NotTo(BeNil())
+		})
 		It("Fails to find device by path", func() {
 			err := afs.WriteFile("/some/yip/layout.yaml", []byte(`
 stages:
@@ -281,4 +409,209 @@ stages:
 			Expect(cloudRunner.Run("test", "/some/yip")).NotTo(BeNil())
 		})
 	})
+	Describe("listing and reporting steps", Label("steps"), func() {
+		var runner *v1mock.FakeRunner
+		var afs *vfst.TestFS
+		var cleanup func()
+		var ci *YipCloudInitRunner
+		logger := logrus.New()
+		logger.SetOutput(ioutil.Discard)
+		BeforeEach(func() {
+			afs, cleanup, _ = vfst.NewTestFS(map[string]interface{}{
+				"/some/yip/01_first.yaml": `
+stages:
+  test:
+  - name: first
+    commands:
+    - echo first
+  - commands:
+    - echo unnamed
+  other:
+  - name: other
+    commands:
+    - echo other
+`,
+				"/some/yip/02_second.yaml": `
+stages:
+  test:
+  - name: second
+    commands:
+    - exit 1
+`,
+			})
+			runner = v1mock.NewFakeRunner()
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if len(args) > 1 && args[1] == "exit 1" {
+					return []byte{}, errors.New("command error")
+				}
+				return []byte{}, nil
+			}
+			ci = NewYipCloudInitRunner(logger, runner, afs)
+		})
+		AfterEach(func() {
+			cleanup()
+		})
+		It("lists the steps of a stage in order", func() {
+			Expect(ci.Steps("test", "/some/yip")).To(Equal([]v1.CloudInitStep{
+				{Source: "/some/yip/01_first.yaml", Stage: "test", Name: "first"},
+				{Source: "/some/yip/01_first.yaml", Stage: "test", Name: ""},
+				{Source: "/some/yip/02_second.yaml", Stage: "test", Name: "second"},
+			}))
+			Expect(ci.Steps("missing", "/some/yip")).To(BeEmpty())
+			Expect(ci.Results()).To(BeEmpty())
+		})
+		It("lists steps of inline yaml", func() {
+			Expect(ci.Steps("test", "stages:\n  test:\n  - name: inline\n")).To(Equal([]v1.CloudInitStep{
+				{Source: "inline", Stage: "test", Name: "inline"},
+			}))
+		})
+		It("reports the outcome of every step run", func() {
+			Expect(ci.Run("test", "/some/yip")).NotTo(BeNil())
+			results := ci.Results()
+			Expect(len(results)).To(Equal(3))
+			Expect(results[0].CloudInitStep).To(Equal(v1.CloudInitStep{Source: "/some/yip/01_first.yaml", Stage: "test", Name: "first"}))
+			Expect(results[0].Error).To(BeNil())
+			Expect(results[1].Source).To(Equal("/some/yip/01_first.yaml"))
+			Expect(results[1].Error).To(BeNil())
+			Expect(results[2].Source).To(Equal("/some/yip/02_second.yaml"))
+			Expect(results[2].Name).To(Equal("second"))
+			Expect(results[2].Error).NotTo(BeNil())
+
+			Expect(ci.Run("other", "/some/yip")).To(BeNil())
+			Expect(len(ci.Results())).To(Equal(4))
+			Expect(ci.Results()[3].Stage).To(Equal("other"))
+		})
+	})
+	Describe("planning layouts", Label("layout"), func() {
+		var parts []DiskPartition
+		labelExists := func(label string) bool { return label == "COS_OEM" }
+		BeforeEach(func() {
+			parts = []DiskPartition{
+				{Partition: partitioner.Partition{Number: 1, PLabel: "efi"}, PartitionDetails: partitioner.PartitionDetails{GUIDType: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"}, Size: 64},
+				{Partition: partitioner.Partition{Number: 2, PLabel: "persistent"}, PartitionDetails: partitioner.PartitionDetails{FSLabel: "COS_PERSISTENT"}, Size: 1024},
+				{Partition: partitioner.Partition{Number: 3, PLabel: "old"}, Size: 100},
+			}
+		})
+		It("reports the changes to apply", func() {
+			changes, err := PlanLayout(parts, Layout{
+				Delete: []LayoutPartition{{PLabel: "old"}, {PLabel: "gone"}},
+				Resize: []LayoutPartition{{FSLabel: "COS_PERSISTENT", Size: 2048}},
+				Parts: []LayoutPartition{
+					{PLabel: "esp", GUIDType: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b", MatchBy: MatchByGUIDType},
+					{FSLabel: "COS_OEM"},
+					{FSLabel: "DATA", Size: 10, Offset: 4096},
+				},
+			}, labelExists)
+			Expect(err).To(BeNil())
+			report := []string{}
+			for _, change := range changes {
+				report = append(report, change.String())
+			}
+			Expect(report).To(Equal([]string{
+				"- delete partition 3 (pLabel: old), 100 MiB",
+				"~ resize partition 2 (fsLabel: COS_PERSISTENT) from 1024 MiB to 2048 MiB",
+				"= keep existing partition (pLabel: esp, guidType: c12a7328-f81f-11d2-ba4b-00a0c93ec93b) matched by guidType",
+				"= keep existing partition (fsLabel: COS_OEM) matched by fsLabel",
+				"+ add partition (fsLabel: DATA) of 10 MiB at 4096 MiB",
+			}))
+		})
+		It("fails on invalid layouts", func() {
+			_, err := PlanLayout(parts, Layout{Resize: []LayoutPartition{{Number: 2, Size: 512}}}, labelExists)
+			Expect(err).NotTo(BeNil())
+			_, err = PlanLayout(parts, Layout{Delete: []LayoutPartition{{Size: 64}}}, labelExists)
+			Expect(err).NotTo(BeNil())
+			_, err = PlanLayout(parts, Layout{Parts: []LayoutPartition{{PLabel: "data", MatchBy: "uuid"}}}, labelExists)
+			Expect(err).NotTo(BeNil())
+			parts[2].PLabel = "persistent"
+			_, err = PlanLayout(parts, Layout{Delete: []LayoutPartition{{PLabel: "persistent"}}}, labelExists)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+	Describe("planning LVM layouts", Label("layout", "lvm"), func() {
+		It("reports the changes to apply", func() {
+			lvm := LayoutLVM{
+				VolumeGroup: "cos",
+				Volumes: []LogicalVolume{
+					{Name: "state", FSLabel: "COS_STATE", Size: 1024},
+					{Name: "persistent", FSLabel: "COS_PERSISTENT"},
+				},
+				Expand: &schema.Expand{},
+			}
+			changes, err := PlanLVM(lvm, false, nil)
+			Expect(err).To(BeNil())
+			report := []string{}
+			for _, change := range changes {
+				report = append(report, change.String())
+			}
+			Expect(report).To(Equal([]string{
+				"+ add volume group cos on a new partition of all available space",
+				"+ add logical volume cos/state (fsLabel: COS_STATE) of 1024 MiB",
+				"+ add logical volume cos/persistent (fsLabel: COS_PERSISTENT) of all available space",
+				"~ expand logical volume cos/persistent to all available space",
+			}))
+			changes, err = PlanLVM(lvm, true, []string{"state"})
+			Expect(err).To(BeNil())
+			Expect(changes[0].String()).To(Equal("= keep existing logical volume cos/state"))
+		})
+		It("fails on invalid LVM layouts", func() {
+			_, err := PlanLVM(LayoutLVM{}, false, nil)
+			Expect(err).NotTo(BeNil())
+			_, err = PlanLVM(LayoutLVM{VolumeGroup: "cos", Volumes: []LogicalVolume{{Name: "a"}, {Name: "b", Size: 10}}}, false, nil)
+			Expect(err).NotTo(BeNil())
+			_, err = PlanLVM(LayoutLVM{VolumeGroup: "cos", Expand: &schema.Expand{}}, false, nil)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+	Describe("validating yaml files", Label("validate"), func() {
+		It("reports errors and warnings with file and line", func() {
+			fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+				"/some/yip/01_valid.yaml": `
+name: valid
+stages:
+  boot:
+  - name: step
+    commands:
+    - /usr/bin/true
+`,
+				"/some/yip/02_invalid.yaml": `
+stages:
+  boot.before:
+  - name: step
+    comands:
+    - echo typo
+  custom:
+  - commands: echo not a list
+    files:
+    - path: /etc/file
+      permissions: notanumber
+    - /missing/script.sh
+`,
+				"/some/yip/03_broken.yml": "stages:\n  boot: [\n",
+				"/some/yip/README":        "not a yaml file",
+				"/usr/bin/true":           "",
+			})
+			Expect(err).Should(BeNil())
+			defer cleanup()
+
+			issues := NewValidator(fs, "/").ValidatePath("/some/yip")
+			messages := []string{}
+			for _, issue := range issues {
+				messages = append(messages, issue.String())
+			}
+			Expect(messages).To(ContainElements(
+				"/some/yip/02_invalid.yaml:5: error: unknown key 'stages.boot.before[0].comands'",
+				"/some/yip/02_invalid.yaml:8: error: 'stages.custom[0].commands' must be a list",
+				"/some/yip/02_invalid.yaml:11: error: invalid value 'notanumber' for 'stages.custom[0].files[0].permissions', expected a uint32 value",
+				"/some/yip/02_invalid.yaml:7: warning: unknown stage name 'custom'",
+			))
+			Expect(messages).To(ContainElement(HavePrefix("/some/yip/03_broken.yml:")))
+			for _, msg := range messages {
+				Expect(msg).NotTo(HavePrefix("/some/yip/01_valid.yaml"))
+			}
+
+			issues = NewValidator(fs, "/", "custom").Validate("inline", []byte("stages:\n  custom:\n  - commands:\n    - /missing/script.sh\n"))
+			Expect(issues).To(HaveLen(1))
+			Expect(issues[0].String()).To(Equal("inline:4: warning: command '/missing/script.sh' not found in /"))
+		})
+	})
 })
@@ -0,0 +1,360 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/rancher-sandbox/elemental/pkg/partitioner"
+)
+
+// Values of the 'matchBy' key of a partition to add
+const (
+	MatchByFSLabel  = "fsLabel"
+	MatchByPLabel   = "pLabel"
+	MatchByGUIDType = "guidType"
+)
+
+// Layout is the elemental extension of the yip layout schema. On top of adding
+// partitions and expanding the last one it can delete and resize existing
+// partitions and create partitions at a given offset.
+type Layout struct {
+	Device *schema.Device    `yaml:"device,omitempty"`
+	Expand *schema.Expand    `yaml:"expand_partition,omitempty"`
+	Parts  []LayoutPartition `yaml:"add_partitions,omitempty"`
+	Resize []LayoutPartition `yaml:"resize_partitions,omitempty"`
+	Delete []LayoutPartition `yaml:"delete_partitions,omitempty"`
+	LVM    *LayoutLVM        `yaml:"lvm,omitempty"`
+}
+
+// LayoutPartition describes a partition of the layout, sizes and offsets are in MiB.
+// Partitions to add are considered to already exist if there is a partition matching
+// the 'matchBy' field, which is the filesystem label by default. Partitions to resize
+// or delete are selected by the number, labels and GUID type given, all must match.
+type LayoutPartition struct {
+	FSLabel    string `yaml:"fsLabel,omitempty"`
+	Size       uint   `yaml:"size,omitempty"`
+	PLabel     string `yaml:"pLabel,omitempty"`
+	FileSystem string `yaml:"filesystem,omitempty"`
+	Offset     uint   `yaml:"offset,omitempty"`
+	GUIDType   string `yaml:"guidType,omitempty"`
+	MatchBy    string `yaml:"matchBy,omitempty"`
+	Number     int    `yaml:"number,omitempty"`
+}
+
+// LayoutLVM describes an LVM volume group and its logical volumes. If the volume group
+// does not exist a new partition is created as its physical volume, sizes and offsets
+// are in MiB. A zero size takes all the available space.
+type LayoutLVM struct {
+	VolumeGroup string          `yaml:"volumeGroup"`
+	Size        uint            `yaml:"size,omitempty"`
+	PLabel      string          `yaml:"pLabel,omitempty"`
+	Offset      uint            `yaml:"offset,omitempty"`
+	Volumes     []LogicalVolume `yaml:"volumes,omitempty"`
+	// Expands the last logical volume of the list and its filesystem
+	Expand *schema.Expand `yaml:"expand_volume,omitempty"`
+}
+
+// LogicalVolume describes a logical volume of the layout, logical volumes are
+// matched to the existing ones by name
+type LogicalVolume struct {
+	Name       string `yaml:"name"`
+	FSLabel    string `yaml:"fsLabel,omitempty"`
+	Size       uint   `yaml:"size,omitempty"`
+	FileSystem string `yaml:"filesystem,omitempty"`
+}
+
+// newLayout returns the extended layout equivalent to the given yip layout
+func newLayout(l schema.Layout) Layout {
+	layout := Layout{Device: l.Device, Expand: l.Expand}
+	for _, part := range l.Parts {
+		layout.Parts = append(layout.Parts, LayoutPartition{
+			FSLabel:    part.FSLabel,
+			Size:       part.Size,
+			PLabel:     part.PLabel,
+			FileSystem: part.FileSystem,
+		})
+	}
+	return layout
+}
+
+// matches checks the yip fields of the layout are the same as in the given yip layout
+func (l Layout) matches(s schema.Layout) bool {
+	if s.Device == nil || l.Device == nil || *s.Device != *l.Device {
+		return false
+	}
+	if (s.Expand == nil) != (l.Expand == nil) || (s.Expand != nil && *s.Expand != *l.Expand) {
+		return false
+	}
+	if len(s.Parts) != len(l.Parts) {
+		return false
+	}
+	for i, part := range s.Parts {
+		if part.FSLabel != l.Parts[i].FSLabel || part.PLabel != l.Parts[i].PLabel ||
+			part.Size != l.Parts[i].Size || part.FileSystem != l.Parts[i].FileSystem {
+			return false
+		}
+	}
+	return true
+}
+
+// isEmpty checks if the layout has no changes to apply
+func (l Layout) isEmpty() bool {
+	return l.Expand == nil && len(l.Parts) == 0 && len(l.Resize) == 0 && len(l.Delete) == 0 && l.LVM == nil
+}
+
+// describe returns a short human readable description of the partition
+func (p LayoutPartition) describe() string {
+	var fields []string
+	if p.Number > 0 {
+		fields = append(fields, fmt.Sprintf("number: %d", p.Number))
+	}
+	if p.FSLabel != "" {
+		fields = append(fields, fmt.Sprintf("fsLabel: %s", p.FSLabel))
+	}
+	if p.PLabel != "" {
+		fields = append(fields, fmt.Sprintf("pLabel: %s", p.PLabel))
+	}
+	if p.GUIDType != "" {
+		fields = append(fields, fmt.Sprintf("guidType: %s", p.GUIDType))
+	}
+	return strings.Join(fields, ", ")
+}
+
+// DiskPartition is an existing partition of the disk a layout is applied to
+type DiskPartition struct {
+	partitioner.Partition
+	partitioner.PartitionDetails
+	// Size in MiB
+	Size uint
+}
+
+// selects checks if the given partition matches all the selection fields
+func (p LayoutPartition) selects(part DiskPartition) bool {
+	if p.Number == 0 && p.FSLabel == "" && p.PLabel == "" && p.GUIDType == "" {
+		return false
+	}
+	return (p.Number == 0 || p.Number == part.Number) &&
+		(p.FSLabel == "" || p.FSLabel == part.FSLabel) &&
+		(p.PLabel == "" || p.PLabel == part.PLabel) &&
+		(p.GUIDType == "" || strings.EqualFold(p.GUIDType, part.GUIDType))
+}
+
+// Kinds of layout changes
+const (
+	LayoutDelete = "delete"
+	LayoutResize = "resize"
+	LayoutExpand = "expand"
+	LayoutAdd    = "add"
+	LayoutKeep   = "keep"
+	// LVM changes
+	LayoutAddVG    = "add-vg"
+	LayoutAddLV    = "add-lv"
+	LayoutExpandLV = "expand-lv"
+	LayoutKeepLV   = "keep-lv"
+)
+
+// LayoutChange is a single change required to apply a layout to a disk
+type LayoutChange struct {
+	Kind string
+	// Existing partition the change applies to, if any
+	Current *DiskPartition
+	// Intended partition
+	Target LayoutPartition
+	// Intended logical volume, only for LVM changes
+	Volume LogicalVolume
+	// Volume group of the LVM changes
+	VolumeGroup string
+}
+
+func (c LayoutChange) String() string {
+	switch c.Kind {
+	case LayoutDelete:
+		return fmt.Sprintf("- delete partition %d (%s), %d MiB", c.Current.Number, c.Target.describe(), c.Current.Size)
+	case LayoutResize:
+		return fmt.Sprintf("~ resize partition %d (%s) from %d MiB to %s", c.Current.Number, c.Target.describe(), c.Current.Size, sizeString(c.Target.Size))
+	case LayoutExpand:
+		return fmt.Sprintf("~ expand last partition %d from %d MiB to %s", c.Current.Number, c.Current.Size, sizeString(c.Target.Size))
+	case LayoutAdd:
+		at := "after the last partition"
+		if c.Target.Offset > 0 {
+			at = fmt.Sprintf("at %d MiB", c.Target.Offset)
+		}
+		return fmt.Sprintf("+ add partition (%s) of %s %s", c.Target.describe(), sizeString(c.Target.Size), at)
+	case LayoutAddVG:
+		return fmt.Sprintf("+ add volume group %s on a new partition of %s", c.VolumeGroup, sizeString(c.Target.Size))
+	case LayoutAddLV:
+		return fmt.Sprintf("+ add logical volume %s/%s (fsLabel: %s) of %s", c.VolumeGroup, c.Volume.Name, c.Volume.FSLabel, sizeString(c.Volume.Size))
+	case LayoutExpandLV:
+		return fmt.Sprintf("~ expand logical volume %s/%s to %s", c.VolumeGroup, c.Volume.Name, sizeString(c.Volume.Size))
+	case LayoutKeepLV:
+		return fmt.Sprintf("= keep existing logical volume %s/%s", c.VolumeGroup, c.Volume.Name)
+	default:
+		matchBy := c.Target.MatchBy
+		if matchBy == "" {
+			matchBy = MatchByFSLabel
+		}
+		return fmt.Sprintf("= keep existing partition (%s) matched by %s", c.Target.describe(), matchBy)
+	}
+}
+
+func sizeString(size uint) string {
+	if size == 0 {
+		return "all available space"
+	}
+	return fmt.Sprintf("%d MiB", size)
+}
+
+// PlanLayout computes the changes required to apply the given layout to a disk including the given
+// partitions. Deletions come first, then resizes, the expansion of the last partition and
+// finally the new partitions. labelExists reports if a filesystem label is already in use
+// in any device, it is used to match partitions to add by their filesystem label.
+func PlanLayout(parts []DiskPartition, layout Layout, labelExists func(string) bool) ([]LayoutChange, error) {
+	var changes []LayoutChange
+
+	selectOne := func(p LayoutPartition) (*DiskPartition, error) {
+		var found *DiskPartition
+		for i := range parts {
+			if p.selects(parts[i]) {
+				if found != nil {
+					return nil, fmt.Errorf("more than one partition matches (%s)", p.describe())
+				}
+				found = &parts[i]
+			}
+		}
+		return found, nil
+	}
+
+	deleted := map[int]bool{}
+	for _, p := range layout.Delete {
+		if p.Number == 0 && p.FSLabel == "" && p.PLabel == "" && p.GUIDType == "" {
+			return nil, fmt.Errorf("partitions to delete must define a number, a label or a GUID type")
+		}
+		part, err := selectOne(p)
+		if err != nil {
+			return nil, err
+		}
+		// Already deleted partitions are just ignored
+		if part != nil && !deleted[part.Number] {
+			deleted[part.Number] = true
+			changes = append(changes, LayoutChange{Kind: LayoutDelete, Current: part, Target: p})
+		}
+	}
+
+	for _, p := range layout.Resize {
+		part, err := selectOne(p)
+		if err != nil {
+			return nil, err
+		}
+		if part == nil || deleted[part.Number] {
+			return nil, fmt.Errorf("no partition found to resize matching (%s)", p.describe())
+		}
+		if p.Size > 0 && p.Size < part.Size {
+			return nil, fmt.Errorf("partition %d can only be expanded, not shrunk", part.Number)
+		}
+		if p.Size == part.Size {
+			continue
+		}
+		changes = append(changes, LayoutChange{Kind: LayoutResize, Current: part, Target: p})
+	}
+
+	if layout.Expand != nil {
+		var last *DiskPartition
+		for i := range parts {
+			if !deleted[parts[i].Number] {
+				last = &parts[i]
+			}
+		}
+		if last == nil {
+			return nil, fmt.Errorf("there is no partition to expand")
+		}
+		changes = append(changes, LayoutChange{Kind: LayoutExpand, Current: last, Target: LayoutPartition{Size: layout.Expand.Size}})
+	}
+
+	for _, p := range layout.Parts {
+		exists := false
+		switch p.MatchBy {
+		case "", MatchByFSLabel:
+			exists = p.FSLabel != "" && labelExists(p.FSLabel)
+		case MatchByPLabel, MatchByGUIDType:
+			if p.MatchBy == MatchByPLabel && p.PLabel == "" || p.MatchBy == MatchByGUIDType && p.GUIDType == "" {
+				return nil, fmt.Errorf("partition (%s) is matched by %s but does not define it", p.describe(), p.MatchBy)
+			}
+			for _, part := range parts {
+				if deleted[part.Number] {
+					continue
+				}
+				if p.MatchBy == MatchByPLabel && part.PLabel == p.PLabel ||
+					p.MatchBy == MatchByGUIDType && strings.EqualFold(part.GUIDType, p.GUIDType) {
+					exists = true
+					break
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown matchBy value '%s'", p.MatchBy)
+		}
+		kind := LayoutAdd
+		if exists {
+			kind = LayoutKeep
+		}
+		changes = append(changes, LayoutChange{Kind: kind, Target: p})
+	}
+	return changes, nil
+}
+
+// PlanLVM computes the changes required to apply the given LVM layout. exists tells if the
+// volume group already exists and volumes are the names of its current logical volumes.
+func PlanLVM(lvm LayoutLVM, exists bool, volumes []string) ([]LayoutChange, error) {
+	var changes []LayoutChange
+
+	if lvm.VolumeGroup == "" {
+		return nil, fmt.Errorf("LVM layouts must define a volume group")
+	}
+	if !exists {
+		changes = append(changes, LayoutChange{
+			Kind: LayoutAddVG, VolumeGroup: lvm.VolumeGroup,
+			Target: LayoutPartition{PLabel: lvm.PLabel, Size: lvm.Size, Offset: lvm.Offset},
+		})
+	}
+	for i, lv := range lvm.Volumes {
+		if lv.Name == "" {
+			return nil, fmt.Errorf("logical volumes of %s must define a name", lvm.VolumeGroup)
+		}
+		if lv.Size == 0 && i < len(lvm.Volumes)-1 {
+			return nil, fmt.Errorf("only the last logical volume of %s can take all the free space", lvm.VolumeGroup)
+		}
+		kind := LayoutAddLV
+		for _, name := range volumes {
+			if name == lv.Name {
+				kind = LayoutKeepLV
+				break
+			}
+		}
+		changes = append(changes, LayoutChange{Kind: kind, Volume: lv, VolumeGroup: lvm.VolumeGroup})
+	}
+	if lvm.Expand != nil {
+		if len(lvm.Volumes) == 0 {
+			return nil, fmt.Errorf("there is no logical volume to expand in %s", lvm.VolumeGroup)
+		}
+		lv := lvm.Volumes[len(lvm.Volumes)-1]
+		lv.Size = lvm.Expand.Size
+		changes = append(changes, LayoutChange{Kind: LayoutExpandLV, Volume: lv, VolumeGroup: lvm.VolumeGroup})
+	}
+	return changes, nil
+}
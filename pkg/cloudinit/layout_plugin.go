@@ -32,11 +32,13 @@ import (
 )
 
 // layoutPlugin is the elemental's implementation of Layout yip's plugin based
-// on partitioner package
-func layoutPlugin(l logger.Interface, s schema.Stage, fs vfs.FS, console plugins.Console) (err error) {
+// on partitioner package. It applies the extended layout of the step, if any, and
+// reports the planned changes before acting.
+func (i *stepIndex) layoutPlugin(l logger.Interface, s schema.Stage, fs vfs.FS, console plugins.Console) (err error) {
 	if s.Layout.Device == nil {
 		return nil
 	}
+	layout := i.layout(s)
 
 	var dev *partitioner.Disk
 	elemConsole, ok := console.(*cloudInitConsole)
@@ -78,36 +80,202 @@ func layoutPlugin(l logger.Interface, s schema.Stage, fs vfs.FS, console plugins
 		return errors.New("Target disk not found")
 	}
 
-	if s.Layout.Expand != nil {
-		l.Infof("Extending last partition up to %d MiB", s.Layout.Expand.Size)
-		out, err := dev.ExpandLastPartition(s.Layout.Expand.Size)
+	if layout.isEmpty() {
+		return nil
+	}
+
+	parts, err := diskPartitions(dev)
+	if err != nil {
+		return err
+	}
+	changes, err := PlanLayout(parts, layout, func(label string) bool {
+		_, err := utils.GetFullDeviceByLabel(runner, label, 1)
+		return err == nil
+	})
+	if err != nil {
+		return fmt.Errorf("Invalid layout for %s: %w", dev, err)
+	}
+	var vg *partitioner.VolumeGroup
+	if layout.LVM != nil {
+		vg = partitioner.NewVolumeGroup(layout.LVM.VolumeGroup, runner)
+		lvmChanges, err := planVolumeGroup(vg, *layout.LVM)
 		if err != nil {
-			l.Error(out)
-			return err
+			return fmt.Errorf("Invalid LVM layout for %s: %w", dev, err)
 		}
+		changes = append(changes, lvmChanges...)
 	}
+	report := []string{}
+	for _, change := range changes {
+		report = append(report, change.String())
+	}
+	l.Infof("Layout changes for %s:\n%s", dev, strings.Join(report, "\n"))
 
-	for _, part := range s.Layout.Parts {
-		_, err := utils.GetFullDeviceByLabel(runner, part.FSLabel, 1)
-		if err == nil {
-			l.Warnf("Partition with FSLabel: %s already exists, ignoring", part.FSLabel)
-			continue
+	for _, change := range changes {
+		switch change.Kind {
+		case LayoutDelete:
+			l.Infof("Deleting partition %d", change.Current.Number)
+			out, err := dev.DeletePartition(change.Current.Number)
+			if err != nil {
+				l.Error(out)
+				return fmt.Errorf("Failed deleting partition: %w", err)
+			}
+		case LayoutResize:
+			l.Infof("Resizing partition %d up to %d MiB", change.Current.Number, change.Target.Size)
+			out, err := dev.ResizePartition(change.Current.Number, change.Target.Size)
+			if err != nil {
+				l.Error(out)
+				return fmt.Errorf("Failed resizing partition: %w", err)
+			}
+		case LayoutExpand:
+			l.Infof("Extending last partition up to %d MiB", change.Target.Size)
+			out, err := dev.ExpandLastPartition(change.Target.Size)
+			if err != nil {
+				l.Error(out)
+				return err
+			}
+		case LayoutAdd:
+			if err := addPartition(l, dev, change.Target); err != nil {
+				return err
+			}
+		case LayoutKeep:
+			l.Warnf("Partition (%s) already exists, ignoring", change.Target.describe())
+		case LayoutAddVG:
+			if err := addVolumeGroup(l, dev, vg, change.Target); err != nil {
+				return err
+			}
+		case LayoutAddLV:
+			if err := addLogicalVolume(l, runner, vg, change.Volume); err != nil {
+				return err
+			}
+		case LayoutExpandLV:
+			l.Infof("Extending logical volume %s up to %d MiB", change.Volume.Name, change.Volume.Size)
+			out, err := vg.ExtendLogicalVolume(change.Volume.Name, change.Volume.Size)
+			if err != nil {
+				l.Error(out)
+				return fmt.Errorf("Failed extending logical volume: %w", err)
+			}
+		case LayoutKeepLV:
+			l.Warnf("Logical volume %s/%s already exists, ignoring", vg, change.Volume.Name)
 		}
+	}
+	return nil
+}
+
+// addPartition creates and formats the given partition
+func addPartition(l logger.Interface, dev *partitioner.Disk, part LayoutPartition) error {
+	var partNum int
+	var err error
 
-		// Set default filesystem
-		if part.FileSystem == "" {
-			part.FileSystem = constants.LinuxFs
+	// Set default filesystem
+	if part.FileSystem == "" {
+		part.FileSystem = constants.LinuxFs
+	}
+
+	l.Infof("Creating %s partition", part.FSLabel)
+	if part.Offset > 0 {
+		partNum, err = dev.AddPartitionAt(part.Offset, part.Size, part.FileSystem, part.PLabel)
+	} else {
+		partNum, err = dev.AddPartition(part.Size, part.FileSystem, part.PLabel)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed creating partitions: %w", err)
+	}
+	if part.GUIDType != "" {
+		if err = dev.SetPartitionType(partNum, part.GUIDType); err != nil {
+			return fmt.Errorf("Failed setting partition type: %w", err)
 		}
+	}
+	out, err := dev.FormatPartition(partNum, part.FileSystem, part.FSLabel)
+	if err != nil {
+		return fmt.Errorf("Formatting partition failed: %s\nError: %w", out, err)
+	}
+	return nil
+}
 
-		l.Infof("Creating %s partition", part.FSLabel)
-		partNum, err := dev.AddPartition(part.Size, part.FileSystem, part.PLabel)
+// planVolumeGroup activates the given volume group, if it already exists, and computes
+// the changes required to apply the given LVM layout
+func planVolumeGroup(vg *partitioner.VolumeGroup, lvm LayoutLVM) ([]LayoutChange, error) {
+	var volumes []string
+
+	if lvm.VolumeGroup == "" {
+		return nil, errors.New("LVM layouts must define a volume group")
+	}
+	exists := vg.Exists()
+	if exists {
+		out, err := vg.Activate()
 		if err != nil {
-			return fmt.Errorf("Failed creating partitions: %w", err)
+			return nil, fmt.Errorf("failed activating volume group %s: %s", vg, out)
 		}
-		out, err := dev.FormatPartition(partNum, part.FileSystem, part.FSLabel)
+		volumes, err = vg.GetLogicalVolumes()
 		if err != nil {
-			return fmt.Errorf("Formatting partition failed: %s\nError: %w", out, err)
+			return nil, err
 		}
 	}
+	return PlanLVM(lvm, exists, volumes)
+}
+
+// addVolumeGroup creates a new partition as physical volume of the given volume group
+func addVolumeGroup(l logger.Interface, dev *partitioner.Disk, vg *partitioner.VolumeGroup, pv LayoutPartition) error {
+	var partNum int
+	var err error
+
+	l.Infof("Creating volume group %s", vg)
+	if pv.Offset > 0 {
+		partNum, err = dev.AddPartitionAt(pv.Offset, pv.Size, "", pv.PLabel, v1.LVM)
+	} else {
+		partNum, err = dev.AddPartition(pv.Size, "", pv.PLabel, v1.LVM)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed creating LVM partition: %w", err)
+	}
+	pvDev, err := dev.FindPartitionDevice(partNum)
+	if err != nil {
+		return err
+	}
+	out, err := vg.Create(pvDev)
+	if err != nil {
+		return fmt.Errorf("Failed creating volume group: %s\nError: %w", out, err)
+	}
 	return nil
 }
+
+// addLogicalVolume creates and formats the given logical volume
+func addLogicalVolume(l logger.Interface, runner v1.Runner, vg *partitioner.VolumeGroup, lv LogicalVolume) error {
+	// Set default filesystem
+	if lv.FileSystem == "" {
+		lv.FileSystem = constants.LinuxFs
+	}
+
+	l.Infof("Creating %s logical volume", lv.Name)
+	lvDev, err := vg.CreateLogicalVolume(lv.Name, lv.Size)
+	if err != nil {
+		return fmt.Errorf("Failed creating logical volume: %s\nError: %w", lvDev, err)
+	}
+	err = partitioner.FormatDevice(runner, lvDev, lv.FileSystem, lv.FSLabel)
+	if err != nil {
+		return fmt.Errorf("Formatting logical volume failed: %w", err)
+	}
+	return nil
+}
+
+// diskPartitions returns the current partitions of the given disk including the
+// details not reported by the partition table
+func diskPartitions(dev *partitioner.Disk) ([]DiskPartition, error) {
+	parts, err := dev.GetPartitions()
+	if err != nil {
+		return nil, err
+	}
+	diskParts := []DiskPartition{}
+	for _, part := range parts {
+		details, err := dev.GetPartitionDetails(part.Number)
+		if err != nil {
+			return nil, err
+		}
+		diskParts = append(diskParts, DiskPartition{
+			Partition:        part,
+			PartitionDetails: details,
+			Size:             part.SizeS * dev.GetSectorSize() / 1048576,
+		})
+	}
+	return diskParts, nil
+}
@@ -0,0 +1,203 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mudler/yip/pkg/executor"
+	"github.com/mudler/yip/pkg/logger"
+	"github.com/mudler/yip/pkg/plugins"
+	"github.com/mudler/yip/pkg/schema"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/twpayne/go-vfs"
+	"gopkg.in/yaml.v3"
+)
+
+// inlineSource is the source name of steps given as inline yaml
+const inlineSource = "inline"
+
+// indexedStep is a step found in the yip sources of a stage
+type indexedStep struct {
+	v1.CloudInitStep
+	// Extended layout of the step, yip parses it with its own schema
+	// dropping any elemental specific field
+	layout *Layout
+}
+
+// stepIndex tracks the steps of the stage being run. The yip sources are parsed
+// up front, in the same order yip runs them, so every step run by yip can be
+// related to its source file and to the elemental extensions of its schema.
+// Only local files, directories and inline yaml are parsed, steps coming from
+// URLs are run and reported without a source.
+type stepIndex struct {
+	modifier schema.Modifier
+	stage    string
+	pending  []indexedStep
+	current  *indexedStep
+	result   *v1.CloudInitStepResult
+	start    time.Time
+	results  []v1.CloudInitStepResult
+}
+
+// load sets the steps of the given stage to be run from the given sources
+func (i *stepIndex) load(fs v1.FS, stage string, sources ...string) {
+	i.stage = stage
+	i.pending = i.parseSources(fs, stage, sources...)
+	i.current = nil
+}
+
+// parseSources returns the steps of the given stage defined in the given sources, in order
+func (i stepIndex) parseSources(fs v1.FS, stage string, sources ...string) []indexedStep {
+	steps := []indexedStep{}
+	for _, source := range sources {
+		info, err := fs.Stat(source)
+		switch {
+		case err == nil && info.IsDir():
+			steps = append(steps, i.parseDir(fs, stage, source)...)
+		case err == nil:
+			if data, err := fs.ReadFile(source); err == nil {
+				steps = append(steps, i.parse(stage, source, data)...)
+			}
+		case strings.Contains(source, "://"):
+			// Remote sources are not fetched twice
+		default:
+			steps = append(steps, i.parse(stage, inlineSource, []byte(source))...)
+		}
+	}
+	return steps
+}
+
+func (i stepIndex) parseDir(fs v1.FS, stage string, dir string) []indexedStep {
+	steps := []indexedStep{}
+	f, err := fs.Open(dir)
+	if err != nil {
+		return steps
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return steps
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() {
+			steps = append(steps, i.parseDir(fs, stage, path)...)
+		} else if ext == ".yaml" || ext == ".yml" {
+			if data, err := fs.ReadFile(path); err == nil {
+				steps = append(steps, i.parse(stage, path, data)...)
+			}
+		}
+	}
+	return steps
+}
+
+// parse returns the steps of the given stage in the given yip data. Parsing errors are
+// ignored here, yip reports them when running the stage.
+func (i stepIndex) parse(stage string, source string, data []byte) []indexedStep {
+	var config struct {
+		Stages map[string][]struct {
+			Name   string  `yaml:"name"`
+			Layout *Layout `yaml:"layout"`
+		} `yaml:"stages"`
+	}
+	steps := []indexedStep{}
+
+	if i.modifier != nil {
+		modified, err := i.modifier(data)
+		if err != nil {
+			return steps
+		}
+		data = modified
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		if _, partial := err.(*yaml.TypeError); !partial {
+			return steps
+		}
+	}
+	for _, step := range config.Stages[stage] {
+		steps = append(steps, indexedStep{
+			CloudInitStep: v1.CloudInitStep{Source: source, Stage: stage, Name: step.Name},
+			layout:        step.Layout,
+		})
+	}
+	return steps
+}
+
+// track wraps the given plugins to record the duration and the outcome of every step.
+// yip runs all the plugins for each step, so the first plugin starts the step and the
+// last one ends it.
+func (i *stepIndex) track(list ...executor.Plugin) []executor.Plugin {
+	wrapped := make([]executor.Plugin, len(list))
+	for n, plugin := range list {
+		n, plugin := n, plugin
+		wrapped[n] = func(l logger.Interface, s schema.Stage, fs vfs.FS, console plugins.Console) error {
+			if n == 0 {
+				i.startStep(s)
+			}
+			err := plugin(l, s, fs, console)
+			if err != nil && i.result.Error == nil {
+				i.result.Error = err
+			}
+			if n == len(list)-1 {
+				i.endStep()
+			}
+			return err
+		}
+	}
+	return wrapped
+}
+
+// startStep relates the given yip step to the next pending step with the same name.
+// Pending steps before it were skipped by yip conditionals.
+func (i *stepIndex) startStep(s schema.Stage) {
+	i.current = nil
+	for n := range i.pending {
+		if i.pending[n].Name == s.Name {
+			step := i.pending[n]
+			i.current = &step
+			i.pending = i.pending[n+1:]
+			break
+		}
+	}
+	i.result = &v1.CloudInitStepResult{CloudInitStep: v1.CloudInitStep{Stage: i.stage, Name: s.Name}}
+	if i.current != nil {
+		i.result.Source = i.current.Source
+	}
+	i.start = time.Now()
+}
+
+// endStep records the result of the running step
+func (i *stepIndex) endStep() {
+	i.result.Duration = time.Since(i.start)
+	i.results = append(i.results, *i.result)
+}
+
+// layout returns the extended layout of the running step. If the step has no known
+// extended layout the yip layout is converted to the extended schema.
+func (i stepIndex) layout(s schema.Stage) Layout {
+	if i.current != nil && i.current.layout != nil && i.current.layout.matches(s.Layout) {
+		return *i.current.layout
+	}
+	return newLayout(s.Layout)
+}
@@ -0,0 +1,316 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationIssue is a problem found in a cloud-init file
+type ValidationIssue struct {
+	File    string
+	Line    int
+	Message string
+	// Warnings are issues that do not prevent the file from being run
+	Warning bool
+}
+
+func (i ValidationIssue) String() string {
+	level := "error"
+	if i.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", i.File, i.Line, level, i.Message)
+}
+
+// Validator checks yip cloud-init files without running them
+type Validator struct {
+	fs     v1.FS
+	root   string
+	stages []string
+}
+
+// NewValidator returns a Validator using the given root path to check the files referenced
+// in the cloud-init files. Extra stage names can be given on top of the elemental ones.
+func NewValidator(fs v1.FS, root string, extraStages ...string) *Validator {
+	return &Validator{
+		fs:     fs,
+		root:   root,
+		stages: append(constants.GetCloudInitStages(), extraStages...),
+	}
+}
+
+// ValidatePath validates the given file or all the yaml files within the given directory
+func (v Validator) ValidatePath(path string) []ValidationIssue {
+	info, err := v.fs.Stat(path)
+	if err != nil {
+		return []ValidationIssue{{File: path, Message: err.Error()}}
+	}
+	if !info.IsDir() {
+		return v.validateFile(path)
+	}
+
+	f, err := v.fs.Open(path)
+	if err != nil {
+		return []ValidationIssue{{File: path, Message: err.Error()}}
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return []ValidationIssue{{File: path, Message: err.Error()}}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	issues := []ValidationIssue{}
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() {
+			issues = append(issues, v.ValidatePath(entryPath)...)
+		} else if ext == ".yaml" || ext == ".yml" {
+			issues = append(issues, v.validateFile(entryPath)...)
+		}
+	}
+	return issues
+}
+
+// Validate validates the given cloud-init data, name is used to report the issues
+func (v Validator) Validate(name string, data []byte) []ValidationIssue {
+	var doc yaml.Node
+
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []ValidationIssue{{File: name, Line: yamlErrorLine(err), Message: err.Error()}}
+	}
+	if len(doc.Content) == 0 {
+		return []ValidationIssue{}
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "#cloud-config") {
+		// cloud-config files are converted by yip, only the YAML syntax is checked
+		return []ValidationIssue{}
+	}
+
+	root := doc.Content[0]
+	issues := v.walk(name, root, reflect.TypeOf(schema.YipConfig{}), "")
+	issues = append(issues, v.checkStages(name, root)...)
+	return issues
+}
+
+func (v Validator) validateFile(path string) []ValidationIssue {
+	data, err := v.fs.ReadFile(path)
+	if err != nil {
+		return []ValidationIssue{{File: path, Message: err.Error()}}
+	}
+	return v.Validate(path, data)
+}
+
+// walk checks the given node matches the given type, reporting unknown keys and wrong types
+func (v Validator) walk(file string, node *yaml.Node, t reflect.Type, path string) []ValidationIssue {
+	issues := []ValidationIssue{}
+	issue := func(n *yaml.Node, format string, args ...interface{}) {
+		issues = append(issues, ValidationIssue{File: file, Line: n.Line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(schema.Layout{}) {
+		// Layouts are applied with the elemental extended schema
+		t = reflect.TypeOf(Layout{})
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return issues
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			issue(node, "'%s' must be a mapping", path)
+			return issues
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				issue(key, "unknown key '%s'", joinPath(path, key.Value))
+				continue
+			}
+			issues = append(issues, v.walk(file, value, field, joinPath(path, key.Value))...)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			issue(node, "'%s' must be a mapping", path)
+			return issues
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			issues = append(issues, v.walk(file, node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))...)
+		}
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			issue(node, "'%s' must be a list", path)
+			return issues
+		}
+		for i, item := range node.Content {
+			issues = append(issues, v.walk(file, item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Interface:
+		// Any value is accepted
+	default:
+		if node.Kind != yaml.ScalarNode {
+			issue(node, "'%s' must be a %s value", path, t.Kind())
+			return issues
+		}
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			issue(node, "invalid value '%s' for '%s', expected a %s value", node.Value, path, t.Kind())
+		}
+	}
+	return issues
+}
+
+// checkStages checks the stage names are known and the files referenced by the stages exist
+func (v Validator) checkStages(file string, root *yaml.Node) []ValidationIssue {
+	issues := []ValidationIssue{}
+	warn := func(n *yaml.Node, format string, args ...interface{}) {
+		issues = append(issues, ValidationIssue{File: file, Line: n.Line, Message: fmt.Sprintf(format, args...), Warning: true})
+	}
+
+	stages := mappingValue(root, "stages")
+	if stages == nil || stages.Kind != yaml.MappingNode {
+		return issues
+	}
+	for i := 0; i+1 < len(stages.Content); i += 2 {
+		name, steps := stages.Content[i], stages.Content[i+1]
+		stage := strings.TrimSuffix(strings.TrimSuffix(name.Value, ".before"), ".after")
+		if !contains(v.stages, stage) {
+			warn(name, "unknown stage name '%s'", name.Value)
+		}
+		if steps.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, step := range steps.Content {
+			if commands := mappingValue(step, "commands"); commands != nil && commands.Kind == yaml.SequenceNode {
+				for _, cmd := range commands.Content {
+					fields := strings.Fields(cmd.Value)
+					if len(fields) > 0 && filepath.IsAbs(fields[0]) && !v.exists(fields[0]) {
+						warn(cmd, "command '%s' not found in %s", fields[0], v.root)
+					}
+				}
+			}
+			if downloads := mappingValue(step, "downloads"); downloads != nil && downloads.Kind == yaml.SequenceNode {
+				for _, download := range downloads.Content {
+					url := mappingValue(download, "url")
+					if url != nil && strings.HasPrefix(url.Value, "file://") && !v.exists(strings.TrimPrefix(url.Value, "file://")) {
+						warn(url, "file '%s' not found in %s", strings.TrimPrefix(url.Value, "file://"), v.root)
+					}
+				}
+			}
+		}
+	}
+	return issues
+}
+
+// exists checks if the given path exists within the validator root
+func (v Validator) exists(path string) bool {
+	_, err := v.fs.Stat(filepath.Join(v.root, path))
+	return err == nil
+}
+
+// yamlFields returns the yaml keys of the given struct type mapped to their types
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if len(tag) > 1 && tag[1] == "inline" {
+			ft := field.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			for name, inlined := range yamlFields(ft) {
+				fields[name] = inlined
+			}
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// mappingValue returns the value node of the given key in a mapping node, nil if not found
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+var yamlLineRegexp = regexp.MustCompile(`line (\d+)`)
+
+// yamlErrorLine returns the line number reported in a yaml parsing error, 0 if none
+func yamlErrorLine(err error) int {
+	match := yamlLineRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(match[1])
+	return line
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return fmt.Sprintf("%s.%s", path, key)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
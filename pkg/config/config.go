@@ -17,9 +17,16 @@ limitations under the License.
 package config
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/rancher-sandbox/elemental/pkg/cloudinit"
 	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
 	"github.com/rancher-sandbox/elemental/pkg/http"
+	"github.com/rancher-sandbox/elemental/pkg/registry"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/twpayne/go-vfs"
 	"k8s.io/mount-utils"
@@ -83,13 +90,39 @@ func WithLuet(luet v1.LuetInterface) func(r *v1.Config) error {
 	}
 }
 
+func WithRegistry(registry v1.Registry) func(r *v1.Config) error {
+	return func(r *v1.Config) error {
+		r.Registry = registry
+		return nil
+	}
+}
+
+// WithPlatform sets the platform of the container images to pull
+func WithPlatform(platform *v1.Platform) func(r *v1.Config) error {
+	return func(r *v1.Config) error {
+		r.Platform = platform
+		return nil
+	}
+}
+
+// WithContext sets the context of the runtime, once it is done running commands are killed
+// and downloads and image unpacking are aborted
+func WithContext(ctx context.Context) func(r *v1.Config) error {
+	return func(r *v1.Config) error {
+		r.Context = ctx
+		return nil
+	}
+}
+
 func NewConfig(opts ...GenericOptions) *v1.Config {
 	log := v1.NewLogger()
 	c := &v1.Config{
-		Fs:      vfs.OSFS,
-		Logger:  log,
-		Syscall: &v1.RealSyscall{},
-		Client:  http.NewClient(),
+		Fs:       vfs.OSFS,
+		Logger:   log,
+		Syscall:  &v1.RealSyscall{},
+		Client:   http.NewClient(),
+		Registry: registry.NewRegistry(),
+		Context:  context.Background(),
 	}
 	for _, o := range opts {
 		err := o(c)
@@ -108,6 +141,7 @@ func NewConfig(opts ...GenericOptions) *v1.Config {
 	if c.Runner.GetLogger() == nil {
 		c.Runner.SetLogger(c.Logger)
 	}
+	c.Runner.SetContext(c.Context)
 
 	// Delay the yip runner creation, so we set the proper logger instead of blindly setting it to the logger we create
 	// at the start of NewRunConfig, as WithLogger can be passed on init, and that would result in 2 different logger
@@ -169,6 +203,14 @@ func NewRunConfig(opts ...GenericOptions) *v1.RunConfig {
 	if r.ImgSize == 0 {
 		r.ImgSize = cnst.ImgSize
 	}
+
+	if r.Bootloader == "" {
+		r.Bootloader = cnst.GrubBootloader
+	}
+
+	if r.LVMVolumeGroup == "" {
+		r.LVMVolumeGroup = cnst.LVMVolumeGroup
+	}
 	return r
 }
 
@@ -178,3 +220,41 @@ func NewBuildConfig(opts ...GenericOptions) *v1.BuildConfig {
 	}
 	return b
 }
+
+// CheckConflicts returns an error for each set of conflicting options of the given RunConfig
+func CheckConflicts(cfg *v1.RunConfig) []error {
+	var errs []error
+
+	if cfg.Reboot && cfg.PowerOff {
+		errs = append(errs, errors.New("'reboot' and 'poweroff' are mutually exclusive options"))
+	}
+	sources := []string{}
+	for key, value := range map[string]string{"docker-image": cfg.DockerImg, "directory": cfg.Directory, "iso": cfg.Iso} {
+		if value != "" {
+			sources = append(sources, key)
+		}
+	}
+	if len(sources) > 1 {
+		sort.Strings(sources)
+		errs = append(errs, fmt.Errorf("'%s' are mutually exclusive options", strings.Join(sources, "', '")))
+	}
+	if cfg.CosignPubKey != "" && !cfg.Cosign {
+		errs = append(errs, errors.New("'cosign-key' requires 'cosign' option to be enabled"))
+	}
+	if cfg.Resume && cfg.NoFormat {
+		errs = append(errs, errors.New("'resume' and 'no-format' are mutually exclusive options"))
+	}
+	if cfg.LVMState && !cfg.LVM {
+		errs = append(errs, errors.New("'lvm-state' requires 'lvm' option to be enabled"))
+	}
+	switch cfg.Bootloader {
+	case "", cnst.GrubBootloader:
+	case cnst.SystemdBootBootloader:
+		if cfg.SecureBoot {
+			errs = append(errs, errors.New("'secure-boot' is only supported with the grub bootloader"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported bootloader '%s'", cfg.Bootloader))
+	}
+	return errs
+}
@@ -24,6 +24,9 @@ import (
 const (
 	GrubConf               = "/etc/cos/grub.cfg"
 	GrubOEMEnv             = "grub_oem_env"
+	GrubEnv                = "grubenv"
+	GrubBootloader         = "grub"
+	SystemdBootBootloader  = "systemd-boot"
 	GrubDefEntry           = "cOs"
 	BiosPartName           = "p.bios"
 	EfiLabel               = "COS_GRUB"
@@ -39,6 +42,8 @@ const (
 	PersistentPartName     = "p.persistent"
 	OEMLabel               = "COS_OEM"
 	OEMPartName            = "p.oem"
+	LVMPartName            = "p.lvm"
+	LVMVolumeGroup         = "cos"
 	MountBinary            = "/usr/bin/mount"
 	EfiDevice              = "/sys/firmware/efi"
 	LinuxFs                = "ext4"
@@ -47,6 +52,7 @@ const (
 	EfiFs                  = "vfat"
 	BiosFs                 = ""
 	EfiSize                = uint(64)
+	SystemdBootEfiSize     = uint(512)
 	OEMSize                = uint(64)
 	StateSize              = uint(15360)
 	RecoverySize           = uint(8192)
@@ -76,7 +82,6 @@ const (
 	AfterResetHook         = "after-reset"
 	BeforeResetHook        = "before-reset"
 	LuetCosignPlugin       = "luet-cosign"
-	LuetMtreePlugin        = "luet-mtree"
 	UpgradeActive          = "active"
 	UpgradeRecovery        = "recovery"
 	ChannelSource          = "system/cos"
@@ -88,6 +93,20 @@ const (
 	PassiveImgName         = "passive"
 	RecoveryImgName        = "recovery"
 	GPT                    = "gpt"
+	ActionInstall          = "install"
+	ActionUpgrade          = "upgrade"
+	ActionReset            = "reset"
+	ActionRollback         = "rollback"
+	HookEnvPrefix          = "ELEMENTAL_HOOK_"
+	HookTimeoutExitCode    = 124
+	HistoryFile            = "elemental-history.jsonl"
+	InstallStepsFile       = "elemental-install-steps.json"
+	BootloaderFile         = "elemental-bootloader"
+	RunLockFile            = "/run/elemental.lock"
+	StateLockFile          = "elemental.lock"
+	ResetScheduleFile      = "elemental-reset.json"
+	ServeSocket            = "/run/elemental.sock"
+	UpgradeAvailableCode   = 100
 
 	// Default directory and file fileModes
 	DirPerm  = os.ModeDir | os.ModePerm
@@ -97,10 +116,46 @@ const (
 	EjectScript = "#!/bin/sh\n/usr/bin/eject -rmF"
 )
 
+// Formats of pulled images
+const (
+	PullFormatRootfs        = "rootfs"
+	PullFormatOCI           = "oci"
+	PullFormatDockerArchive = "docker-archive"
+)
+
+// MtreeManifest is the path of the mtree manifest of the rootfs in system images
+const MtreeManifest = "/etc/elemental/rootfs.mtree"
+
 func GetCloudInitPaths() []string {
 	return []string{"/system/oem", "/oem/", "/usr/local/cloud-config/"}
 }
 
+// GetCloudInitStages returns the stage names run by elemental and at boot. Stages can
+// also be run before or after any of them with the '.before' and '.after' suffixes.
+func GetCloudInitStages() []string {
+	return []string{
+		"rootfs", "initramfs", "boot", "fs", "network", "reconcile", PartStage,
+		BeforeInstallHook, AfterInstallChrootHook, AfterInstallHook,
+		"before-upgrade", "after-upgrade-chroot", "after-upgrade",
+		BeforeResetHook, AfterResetChrootHook, AfterResetHook,
+	}
+}
+
+// GetHookPaths returns the directories where hook executables are looked for.
+// Each hook has its own '<hook>.d' subdirectory in any of these paths.
+func GetHookPaths() []string {
+	return []string{"/usr/lib/elemental/hooks", "/etc/elemental/hooks", "/oem/elemental/hooks"}
+}
+
+// GetMtreeExcludes returns the paths left out of mtree manifests: pseudo filesystems,
+// files bind mounted or created by container runtimes and the manifest shipped in the image itself
+func GetMtreeExcludes() []string {
+	return []string{
+		"/proc", "/sys", "/dev", "/run", "/tmp", "/lost+found",
+		"/etc/hostname", "/etc/hosts", "/etc/resolv.conf", "/.dockerenv", MtreeManifest,
+	}
+}
+
 // GetDefaultSquashfsOptions returns the default options to use when creating a squashfs
 func GetDefaultSquashfsOptions() []string {
 	options := []string{"-b", "1024k", "-comp", "xz", "-Xbcj"}
@@ -0,0 +1,257 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package derivative renders the skeleton of a derivative system: a Dockerfile,
+// a luet repository configuration, cloud-config files and grub settings. The default
+// templates are embedded in the binary, so no network access is required.
+package derivative
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+)
+
+// TemplateSuffix is the suffix of the files rendered as templates, any other file
+// is copied as is
+const TemplateSuffix = ".tmpl"
+
+//go:embed templates
+var embedded embed.FS
+
+// flavor holds the distribution specific values of a derivative
+type flavor struct {
+	baseImage  string
+	installCmd string
+}
+
+var flavors = map[string]flavor{
+	"opensuse": {
+		baseImage:  "registry.opensuse.org/opensuse/leap:15.4",
+		installCmd: "zypper --non-interactive install -y kernel-default systemd dracut grub2 squashfs rsync e2fsprogs dosfstools && zypper clean --all",
+	},
+	"ubuntu": {
+		baseImage:  "ubuntu:20.04",
+		installCmd: "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y linux-image-generic systemd dracut grub2-common squashfs-tools rsync e2fsprogs dosfstools && apt-get clean",
+	},
+	"fedora": {
+		baseImage:  "fedora:36",
+		installCmd: "dnf install -y kernel systemd dracut grub2 squashfs-tools rsync e2fsprogs dosfstools && dnf clean all",
+	},
+}
+
+// Labels are the filesystem labels of the derivative partitions and images
+type Labels struct {
+	Active     string
+	Passive    string
+	Recovery   string
+	System     string
+	State      string
+	Persistent string
+	OEM        string
+}
+
+// Data holds the values available to the derivative templates
+type Data struct {
+	Name      string
+	Flavor    string
+	Arch      string
+	Platform  string
+	BaseImage string
+	// InstallCmd installs the base packages of the flavor, empty for unknown flavors
+	InstallCmd string
+	// KernelFile is the name of the kernel files in /boot, without version
+	KernelFile string
+	// Repository is the cOS toolkit luet repository for Arch
+	Repository string
+	// Console is the serial console for Arch
+	Console string
+	Labels  Labels
+}
+
+type Option func(d *Data) error
+
+// WithName sets the name of the derivative, used as the grub entry name
+func WithName(name string) Option {
+	return func(d *Data) error {
+		d.Name = name
+		return nil
+	}
+}
+
+// WithBaseImage overrides the base image of the flavor
+func WithBaseImage(image string) Option {
+	return func(d *Data) error {
+		d.BaseImage = image
+		return nil
+	}
+}
+
+// WithLabels sets the filesystem labels, empty labels keep their defaults
+func WithLabels(labels Labels) Option {
+	return func(d *Data) error {
+		for _, l := range []struct {
+			dst   *string
+			value string
+		}{
+			{&d.Labels.Active, labels.Active},
+			{&d.Labels.Passive, labels.Passive},
+			{&d.Labels.Recovery, labels.Recovery},
+			{&d.Labels.System, labels.System},
+			{&d.Labels.State, labels.State},
+			{&d.Labels.Persistent, labels.Persistent},
+			{&d.Labels.OEM, labels.OEM},
+		} {
+			if l.value != "" {
+				*l.dst = l.value
+			}
+		}
+		return nil
+	}
+}
+
+// Flavors returns the names of the flavors known to the embedded templates
+func Flavors() []string {
+	var names []string
+	for name := range flavors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewData returns the template data for the given flavor and architecture. Unknown
+// flavors are only accepted together with a base image, for custom templates.
+func NewData(flavorName, arch string, opts ...Option) (*Data, error) {
+	d := &Data{
+		Name:   "Elemental",
+		Flavor: flavorName,
+		Labels: Labels{
+			Active:     cnst.ActiveLabel,
+			Passive:    cnst.PassiveLabel,
+			Recovery:   cnst.RecoveryLabel,
+			System:     cnst.SystemLabel,
+			State:      cnst.StateLabel,
+			Persistent: cnst.PersistentLabel,
+			OEM:        cnst.OEMLabel,
+		},
+		KernelFile: "vmlinuz",
+	}
+
+	switch arch {
+	case "x86_64", "amd64":
+		d.Arch = "x86_64"
+		d.Platform = "linux/amd64"
+		d.Repository = "quay.io/costoolkit/releases-green"
+		d.Console = "ttyS0"
+	case "aarch64", "arm64":
+		d.Arch = "aarch64"
+		d.Platform = "linux/arm64"
+		d.Repository = "quay.io/costoolkit/releases-green-arm64"
+		d.Console = "ttyAMA0"
+		if flavorName == "opensuse" {
+			d.KernelFile = "Image"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported architecture %s, supported architectures are x86_64 and aarch64", arch)
+	}
+
+	if f, ok := flavors[flavorName]; ok {
+		d.BaseImage = f.baseImage
+		d.InstallCmd = f.installCmd
+	}
+
+	for _, o := range opts {
+		if err := o(d); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.BaseImage == "" {
+		return nil, fmt.Errorf("unsupported flavor %s, supported flavors are %s", flavorName, strings.Join(Flavors(), ", "))
+	}
+	return d, nil
+}
+
+// Templates returns the templates embedded in the binary
+func Templates() fs.FS {
+	templates, _ := fs.Sub(embedded, "templates")
+	return templates
+}
+
+// Render renders all the files of templates into the dst directory. Files with the
+// TemplateSuffix are executed with the given data and written without the suffix, any
+// other file is copied as is. Existing files are never overwritten.
+func Render(vfs v1.FS, templates fs.FS, dst string, data *Data) error {
+	var files []string
+	err := fs.WalkDir(templates, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		target := filepath.Join(dst, strings.TrimSuffix(path, TemplateSuffix))
+		if exists, _ := utils.Exists(vfs, target); exists {
+			return fmt.Errorf("%s already exists", target)
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no templates found")
+	}
+
+	for _, path := range files {
+		content, err := fs.ReadFile(templates, path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, TemplateSuffix) {
+			tmpl, err := template.New(path).Option("missingkey=error").Parse(string(content))
+			if err != nil {
+				return fmt.Errorf("failed parsing template %s: %w", path, err)
+			}
+			var buf bytes.Buffer
+			if err = tmpl.Execute(&buf, data); err != nil {
+				return fmt.Errorf("failed rendering template %s: %w", path, err)
+			}
+			content = buf.Bytes()
+		}
+
+		target := filepath.Join(dst, strings.TrimSuffix(path, TemplateSuffix))
+		if err = utils.MkdirAll(vfs, filepath.Dir(target), cnst.DirPerm); err != nil {
+			return err
+		}
+		if err = vfs.WriteFile(target, content, cnst.FilePerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package derivative_test
+
+import (
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rancher-sandbox/elemental/pkg/derivative"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Derivative", Label("derivative"), func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(nil)
+		Expect(err).To(BeNil())
+	})
+	AfterEach(func() { cleanup() })
+
+	Describe("NewData", func() {
+		It("Sets the flavor and architecture defaults", func() {
+			data, err := derivative.NewData("opensuse", "arm64", derivative.WithLabels(derivative.Labels{OEM: "MY_OEM"}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data.Arch).To(Equal("aarch64"))
+			Expect(data.Platform).To(Equal("linux/arm64"))
+			Expect(data.KernelFile).To(Equal("Image"))
+			Expect(data.BaseImage).To(ContainSubstring("opensuse/leap"))
+			Expect(data.Labels.OEM).To(Equal("MY_OEM"))
+			Expect(data.Labels.Active).To(Equal("COS_ACTIVE"))
+		})
+		It("Fails on unknown flavors and architectures", func() {
+			_, err := derivative.NewData("gentoo", "x86_64")
+			Expect(err).To(HaveOccurred())
+			_, err = derivative.NewData("ubuntu", "riscv64")
+			Expect(err).To(HaveOccurred())
+		})
+		It("Accepts unknown flavors with a base image", func() {
+			data, err := derivative.NewData("gentoo", "x86_64", derivative.WithBaseImage("gentoo/stage3"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data.InstallCmd).To(BeEmpty())
+		})
+	})
+	Describe("Render", func() {
+		It("Renders the embedded templates for every flavor", func() {
+			for _, flavor := range derivative.Flavors() {
+				data, err := derivative.NewData(flavor, "x86_64", derivative.WithName("My OS"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(derivative.Render(fs, derivative.Templates(), "/derivatives/"+flavor, data)).To(Succeed())
+
+				dockerfile, err := fs.ReadFile("/derivatives/" + flavor + "/Dockerfile")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(dockerfile)).To(ContainSubstring("FROM --platform=linux/amd64 quay.io/luet/base:latest AS luet"))
+				Expect(string(dockerfile)).To(ContainSubstring("FROM --platform=linux/amd64 " + data.BaseImage))
+				Expect(string(dockerfile)).To(ContainSubstring(`GRUB_ENTRY_NAME="My OS"`))
+
+				for _, file := range []string{"luet.yaml", "files/etc/cos/bootargs.cfg", "files/etc/cos/config", "files/system/oem/01_defaults.yaml"} {
+					_, err := fs.Stat("/derivatives/" + flavor + "/" + file)
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}
+			config, err := fs.ReadFile("/derivatives/ubuntu/files/etc/cos/config")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(config)).To(ContainSubstring("OEM_LABEL=COS_OEM"))
+		})
+		It("Renders custom templates and copies other files", func() {
+			templates := fstest.MapFS{
+				"Dockerfile.tmpl": {Data: []byte("FROM {{ .BaseImage }}\n")},
+				"files/motd":      {Data: []byte("{{ not a template }}")},
+			}
+			data, err := derivative.NewData("gentoo", "amd64", derivative.WithBaseImage("gentoo/stage3"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(derivative.Render(fs, templates, "/custom", data)).To(Succeed())
+
+			dockerfile, err := fs.ReadFile("/custom/Dockerfile")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dockerfile)).To(Equal("FROM gentoo/stage3\n"))
+			motd, err := fs.ReadFile("/custom/files/motd")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(motd)).To(Equal("{{ not a template }}"))
+		})
+		It("Does not overwrite existing files", func() {
+			data, err := derivative.NewData("fedora", "x86_64")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(derivative.Render(fs, derivative.Templates(), "/derivative", data)).To(Succeed())
+			Expect(fs.WriteFile("/derivative/Dockerfile", []byte("custom"), 0644)).To(Succeed())
+			Expect(derivative.Render(fs, derivative.Templates(), "/derivative", data)).NotTo(Succeed())
+
+			dockerfile, err := fs.ReadFile("/derivative/Dockerfile")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dockerfile)).To(Equal("custom"))
+		})
+		It("Fails on invalid templates", func() {
+			templates := fstest.MapFS{"Dockerfile.tmpl": {Data: []byte("FROM {{ .Missing }}\n")}}
+			data, err := derivative.NewData("fedora", "x86_64")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(derivative.Render(fs, templates, "/derivative", data)).NotTo(Succeed())
+		})
+	})
+})
@@ -23,6 +23,7 @@ import (
 	"strings"
 
 	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/mtree"
 	"github.com/rancher-sandbox/elemental/pkg/partitioner"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/rancher-sandbox/elemental/pkg/utils"
@@ -113,7 +114,7 @@ func (c *Elemental) createAndFormatPartition(disk *partitioner.Disk, part *v1.Pa
 }
 
 func (c *Elemental) createDataPartitions(disk *partitioner.Disk) error {
-	var dataParts []*v1.Partition
+	var dataParts, lvParts []*v1.Partition
 	// Skip the creation of EFI or BIOS partitions on GPT
 	if c.config.PartTable == v1.GPT {
 		dataParts = c.config.Partitions[1:]
@@ -121,14 +122,76 @@ func (c *Elemental) createDataPartitions(disk *partitioner.Disk) error {
 		dataParts = c.config.Partitions
 	}
 	for _, part := range dataParts {
+		// Logical volumes are created once all regular partitions are in place
+		if part.VolumeGroup != "" {
+			lvParts = append(lvParts, part)
+			continue
+		}
 		err := c.createAndFormatPartition(disk, part)
 		if err != nil {
 			return err
 		}
 	}
+	if len(lvParts) > 0 {
+		return c.createLogicalVolumes(disk, lvParts)
+	}
 	return nil
 }
 
+// createLogicalVolumes creates a physical volume partition using all the remaining
+// space of the disk and the given partitions as logical volumes on top of it, in
+// the given order. A zero size logical volume takes all the free space left.
+func (c *Elemental) createLogicalVolumes(disk *partitioner.Disk, parts []*v1.Partition) error {
+	vgName := parts[0].VolumeGroup
+	flags := []string{v1.LVM}
+	for _, part := range parts {
+		if part.VolumeGroup != vgName {
+			return fmt.Errorf("partition %s is in volume group %s, only a single volume group is supported", part.Name, part.VolumeGroup)
+		}
+		flags = append(flags, part.Flags...)
+	}
+
+	c.config.Logger.Debugf("Adding LVM partition for volume group %s", vgName)
+	num, err := disk.AddPartition(0, "", cnst.LVMPartName, flags...)
+	if err != nil {
+		c.config.Logger.Errorf("Failed creating LVM partition")
+		return err
+	}
+	pvDev, err := disk.FindPartitionDevice(num)
+	if err != nil {
+		return err
+	}
+	vg := partitioner.NewVolumeGroup(vgName, c.config.Runner)
+	out, err := vg.Create(pvDev)
+	if err != nil {
+		c.config.Logger.Errorf("Failed creating volume group %s: %s", vgName, out)
+		return err
+	}
+
+	for _, part := range parts {
+		c.config.Logger.Debugf("Adding logical volume %s", part.Name)
+		lvDev, err := vg.CreateLogicalVolume(LogicalVolumeName(part), part.Size)
+		if err != nil {
+			c.config.Logger.Errorf("Failed creating logical volume for %s: %s", part.Name, lvDev)
+			return err
+		}
+		c.config.Logger.Debugf("Formatting logical volume with label %s", part.Label)
+		err = partitioner.FormatDevice(c.config.Runner, lvDev, part.FS, part.Label)
+		if err != nil {
+			c.config.Logger.Errorf("Failed formatting logical volume %s", lvDev)
+			return err
+		}
+		part.Path = lvDev
+	}
+	return nil
+}
+
+// LogicalVolumeName returns the logical volume name of the given partition, which
+// is the partition name without the 'p.' prefix
+func LogicalVolumeName(part *v1.Partition) string {
+	return strings.TrimPrefix(part.Name, "p.")
+}
+
 // MountPartitions mounts configured partitions. Partitions with an unset mountpoint are not mounted.
 // Note umounts must be handled by caller logic.
 func (c Elemental) MountPartitions() error {
@@ -181,6 +244,10 @@ func (c Elemental) MountPartition(part *v1.Partition, opts ...string) error {
 	if part.Path == "" {
 		// Lets error out only after 10 attempts to find the device
 		device, err := utils.GetDeviceByLabel(c.config.Runner, part.Label, 10)
+		if err != nil {
+			// Logical volumes created by custom partition layouts are not listed as partitions
+			device, err = utils.FindDeviceByLabel(c.config.Runner, part.Label)
+		}
 		if err != nil {
 			c.config.Logger.Errorf("Could not find a device with label %s", part.Label)
 			return err
@@ -207,14 +274,22 @@ func (c Elemental) UnmountPartition(part *v1.Partition) error {
 	return c.config.Mounter.Unmount(part.MountPoint)
 }
 
-// MountImage mounts an image with the given mount options
+// MountImage mounts an image with the given mount options, images mounted read only
+// are attached to a read only loop device
 func (c Elemental) MountImage(img *v1.Image, opts ...string) error {
 	c.config.Logger.Debugf("Mounting image %s", img.Label)
 	err := utils.MkdirAll(c.config.Fs, img.MountPoint, cnst.DirPerm)
 	if err != nil {
 		return err
 	}
-	out, err := c.config.Runner.Run("losetup", "--show", "-f", img.File)
+	args := []string{"--show", "-f"}
+	for _, opt := range opts {
+		if opt == "ro" {
+			args = append(args, "-r")
+			break
+		}
+	}
+	out, err := c.config.Runner.Run("losetup", append(args, img.File)...)
 	if err != nil {
 		return err
 	}
@@ -317,6 +392,64 @@ func (c *Elemental) DeployImage(img *v1.Image, leaveMounted bool) error {
 	return nil
 }
 
+// UnpackImage unpacks the given container image into target. If a platform is configured
+// the image for that platform is pulled from multi-arch indexes and the architecture of
+// the unpacked system is checked, local images are only checked.
+func (c *Elemental) UnpackImage(target, ref string, local bool) (*v1.DockerImageMeta, error) {
+	platform := c.config.Platform
+	if platform != nil && !local {
+		resolved, err := c.config.Registry.ResolvePlatform(c.config.Context, ref, *platform)
+		if err != nil {
+			return nil, err
+		}
+		c.config.Logger.Infof("Using %s for platform %s", resolved, platform)
+		ref = resolved
+	}
+	meta, err := c.config.Luet.Unpack(target, ref, local)
+	if err != nil {
+		return nil, err
+	}
+	if platform != nil {
+		if err = utils.CheckRootArch(c.config.Fs, target, platform); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// VerifyManifest checks the tree in root against the mtree manifest shipped in it, if
+// any. Trees without a manifest are not verified.
+func (c *Elemental) VerifyManifest(root string) error {
+	manifestFile := filepath.Join(root, cnst.MtreeManifest)
+	if exists, _ := utils.Exists(c.config.Fs, manifestFile); !exists {
+		c.config.Logger.Warnf("No mtree manifest found in %s, skipping verification", root)
+		return nil
+	}
+	f, err := c.config.Fs.Open(manifestFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	manifest, err := mtree.Parse(f)
+	if err != nil {
+		return fmt.Errorf("failed parsing %s: %w", cnst.MtreeManifest, err)
+	}
+
+	c.config.Logger.Infof("Verifying %s against %s", root, cnst.MtreeManifest)
+	report, err := mtree.Verify(c.config.Fs, root, manifest, cnst.GetMtreeExcludes()...)
+	if err != nil {
+		return err
+	}
+	if !report.Passed() {
+		c.config.Logger.Errorf("mtree verification failed:\n%s", report)
+		return fmt.Errorf(
+			"%s does not match its mtree manifest: %d missing, %d extra and %d modified files",
+			root, len(report.Missing), len(report.Extra), len(report.Modified),
+		)
+	}
+	return nil
+}
+
 // CopyImage sets the image data according to the image source type
 func (c *Elemental) CopyImage(img *v1.Image) error { // nolint:gocyclo
 	c.config.Logger.Infof("Copying %s image...", img.Label)
@@ -334,10 +467,16 @@ func (c *Elemental) CopyImage(img *v1.Image) error { // nolint:gocyclo
 				return err
 			}
 		}
-		err = c.config.Luet.Unpack(img.MountPoint, img.Source.Value(), false)
+		meta, err := c.UnpackImage(img.MountPoint, img.Source.Value(), false)
 		if err != nil {
 			return err
 		}
+		img.Source.SetDigest(meta.Digest)
+		if !c.config.NoVerify {
+			if err = c.VerifyManifest(img.MountPoint); err != nil {
+				return err
+			}
+		}
 	} else if img.Source.IsDir() {
 		excludes := []string{"mnt", "proc", "sys", "dev", "tmp", "host", "run"}
 		err = utils.SyncData(c.config.Fs, img.Source.Value(), img.MountPoint, excludes...)
@@ -345,10 +484,11 @@ func (c *Elemental) CopyImage(img *v1.Image) error { // nolint:gocyclo
 			return err
 		}
 	} else if img.Source.IsChannel() {
-		err = c.config.Luet.UnpackFromChannel(img.MountPoint, img.Source.Value())
+		meta, err := c.config.Luet.UnpackFromChannel(img.MountPoint, img.Source.Value())
 		if err != nil {
 			return err
 		}
+		img.Source.SetVersion(meta.Version)
 	}
 
 	if img.Source.IsFile() {
@@ -514,28 +654,19 @@ func (c *Elemental) GetIso() (tmpDir string, err error) {
 	return tmpDir, nil
 }
 
-// Sets the default_meny_entry value in RunConfig.GrubOEMEnv file at in
-// State partition mountpoint.
+// Sets the default boot entry name to RunConfig.GrubDefEntry using the configured
+// bootloader. For grub this is the default_menu_entry value in GrubOEMEnv file
+// at State partition mountpoint. For systemd-boot the entries are renamed after it,
+// the active entry stays the default one.
 func (c Elemental) SetDefaultGrubEntry() error {
-	var part *v1.Partition
-
-	part = c.config.Partitions.GetByName(cnst.StatePartName)
-	if part == nil {
-		// Try to fall back to get it via StateLabel
-		p, err := utils.GetFullDeviceByLabel(c.config.Runner, c.config.StateLabel, 5)
-		if err != nil {
-			return errors.New("state partition not found. Cannot set grub env file")
-		} else if p.MountPoint == "" {
-			return errors.New("state partition not mounted. Cannot set grub env file")
-		} else {
-			part = p
-		}
+	switch c.config.Bootloader {
+	case "", cnst.GrubBootloader:
+		return utils.NewGrub(c.config).SetEntryTitles()
+	case cnst.SystemdBootBootloader:
+		return utils.NewSystemdBoot(c.config).SetEntryTitles()
+	default:
+		return fmt.Errorf("unsupported bootloader '%s'", c.config.Bootloader)
 	}
-	grub := utils.NewGrub(c.config)
-	return grub.SetPersistentVariables(
-		filepath.Join(part.MountPoint, cnst.GrubOEMEnv),
-		map[string]string{"default_menu_entry": c.config.GrubDefEntry},
-	)
 }
 
 // Runs rebranding procedure. Note this assumes all required partitions and
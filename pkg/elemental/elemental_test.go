@@ -17,10 +17,12 @@
 package elemental_test
 
 import (
+	"debug/elf"
 	"errors"
 	"fmt"
 	"github.com/jaypipes/ghw/pkg/block"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -29,6 +31,7 @@ import (
 	conf "github.com/rancher-sandbox/elemental/pkg/config"
 	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
 	"github.com/rancher-sandbox/elemental/pkg/elemental"
+	"github.com/rancher-sandbox/elemental/pkg/mtree"
 	part "github.com/rancher-sandbox/elemental/pkg/partitioner"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 	"github.com/rancher-sandbox/elemental/pkg/utils"
@@ -43,6 +46,9 @@ const printOutput = `BYT;
 const partTmpl = `
 %d:%ss:%ss:2048s:ext4::type=83;`
 
+// lastSector replaces the 100% end of partitions in the print output, as parted does
+const lastSector = "50593791"
+
 func TestElementalSuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Elemental test suite")
@@ -287,7 +293,10 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 						"mklabel", "gpt",
 					}, {
 						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
-						"mkpart", "p.grub", "fat32", "2048", "133119", "set", "1", "esp", "on",
+						"mkpart", "p.grub", "fat32", "2048", "133119",
+					}, {
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"set", "1", "esp", "on",
 					}, {"mkfs.vfat", "-n", "COS_GRUB", "/some/device1"},
 				}
 				biosPartCmds = [][]string{
@@ -296,7 +305,10 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 						"mklabel", "gpt",
 					}, {
 						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
-						"mkpart", "p.bios", "", "2048", "4095", "set", "1", "bios_grub", "on",
+						"mkpart", "p.bios", "", "2048", "4095",
+					}, {
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"set", "1", "bios_grub", "on",
 					}, {"wipefs", "--all", "/some/device1"},
 				}
 				// These commands are only valid for EFI case
@@ -328,7 +340,7 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 						}
 						if idx > 0 {
 							partNum++
-							printOut += fmt.Sprintf(partTmpl, partNum, args[idx+3], args[idx+4])
+							printOut += fmt.Sprintf(partTmpl, partNum, args[idx+3], strings.Replace(args[idx+4], "100%", lastSector, 1))
 							_, _ = fs.Create(fmt.Sprintf("/some/device%d", partNum))
 						}
 						return []byte(printOut), nil
@@ -354,6 +366,29 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 				Expect(runner.MatchMilestones(biosPartCmds)).To(BeNil())
 			})
 
+			It("Successfully creates partitions with persistent as a logical volume", func() {
+				config.LVM = true
+				action.InstallSetup(config)
+				Expect(el.PartitionAndFormatDevice(dev)).To(BeNil())
+				Expect(runner.MatchMilestones(append(efiPartCmds, [][]string{
+					{
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"mkpart", "p.recovery", "ext4", "31721472", "48498687",
+					}, {
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"mkpart", "p.lvm", "", "48498688", "100%",
+					}, {
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"set", "5", "lvm", "on",
+					},
+					{"pvcreate", "-ff", "-y", "/some/device5"},
+					{"vgcreate", "cos", "/some/device5"},
+					{"lvcreate", "--yes", "--name", "persistent", "--extents", "100%FREE", "cos"},
+					{"mkfs.ext4", "-L", "COS_PERSISTENT", "/dev/cos/persistent"},
+				}...))).To(BeNil())
+				Expect(config.Partitions.GetByName(cnst.PersistentPartName).Path).To(Equal("/dev/cos/persistent"))
+			})
+
 			It("Successfully creates boot partitions and runs 'partitioning' stage", func() {
 				action.InstallSetup(config)
 				config.PartLayout = "partitioning.yaml"
@@ -383,7 +418,7 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 						}
 						if idx > 0 {
 							partNum++
-							printOut += fmt.Sprintf(partTmpl, partNum, args[idx+3], args[idx+4])
+							printOut += fmt.Sprintf(partTmpl, partNum, args[idx+3], strings.Replace(args[idx+4], "100%", lastSector, 1))
 							if errPart == partNum {
 								return []byte{}, errors.New("Failure")
 							}
@@ -569,6 +604,59 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(luet.UnpackCalled()).To(BeTrue())
 			Expect(runner.CmdsMatch([][]string{{"cosign", "verify", "docker/image:latest"}}))
 		})
+		It("Unpacks the docker image for the configured platform", Label("docker", "platform"), func() {
+			luet := v1mock.NewFakeLuet()
+			luet.OnUnpack = func(target string) error {
+				Expect(utils.MkdirAll(fs, filepath.Join(target, "bin"), cnst.DirPerm)).To(Succeed())
+				return fs.WriteFile(filepath.Join(target, "bin/sh"), v1mock.FakeELF(elf.EM_AARCH64), cnst.FilePerm)
+			}
+			config.Luet = luet
+			config.Platform = &v1.Platform{OS: "linux", Arch: "arm64"}
+			config.Registry = &v1mock.FakeRegistry{
+				Platforms: map[string]map[string]string{
+					"docker/image:latest": {"linux/arm64": "docker/image@sha256:arm64", "linux/amd64": "docker/image@sha256:amd64"},
+				},
+			}
+			img.MountPoint = "/target"
+			img.Source = v1.NewDockerSrc("docker/image:latest")
+			c := elemental.NewElemental(config)
+			Expect(c.CopyImage(img)).To(Succeed())
+			Expect(luet.UnpackedImages).To(Equal([]string{"docker/image@sha256:arm64"}))
+
+			config.Platform = &v1.Platform{OS: "linux", Arch: "amd64"}
+			Expect(c.CopyImage(img)).NotTo(Succeed())
+			config.Platform = &v1.Platform{OS: "linux", Arch: "s390x"}
+			Expect(c.CopyImage(img)).NotTo(Succeed())
+			Expect(luet.UnpackedImages).To(HaveLen(2))
+		})
+		It("Verifies the unpacked docker image against its mtree manifest", Label("docker", "mtree"), func() {
+			release := "NAME=elemental\n"
+			luet := v1mock.NewFakeLuet()
+			luet.OnUnpack = func(target string) error {
+				Expect(utils.MkdirAll(fs, filepath.Join(target, "etc/elemental"), cnst.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(target, "etc/os-release"), []byte("NAME=elemental\n"), cnst.FilePerm)).To(Succeed())
+				manifest, err := mtree.Generate(fs, target, cnst.GetMtreeExcludes()...)
+				Expect(err).ToNot(HaveOccurred())
+				f, err := fs.Create(filepath.Join(target, cnst.MtreeManifest))
+				Expect(err).ToNot(HaveOccurred())
+				defer f.Close()
+				_, err = manifest.WriteTo(f)
+				Expect(err).ToNot(HaveOccurred())
+				// Left by container runtimes on the built image, not part of the manifest
+				Expect(fs.WriteFile(filepath.Join(target, ".dockerenv"), []byte{}, cnst.FilePerm)).To(Succeed())
+				return fs.WriteFile(filepath.Join(target, "etc/os-release"), []byte(release), cnst.FilePerm)
+			}
+			config.Luet = luet
+			img.MountPoint = "/target"
+			img.Source = v1.NewDockerSrc("docker/image:latest")
+			c := elemental.NewElemental(config)
+			Expect(c.CopyImage(img)).To(Succeed())
+
+			release = "NAME=tampered\n"
+			Expect(c.CopyImage(img)).NotTo(Succeed())
+			config.NoVerify = true
+			Expect(c.CopyImage(img)).To(Succeed())
+		})
 		It("Fails cosign validation", Label("cosign"), func() {
 			runner.ReturnError = errors.New("cosign error")
 			config.Cosign = true
@@ -0,0 +1,210 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rancher-sandbox/elemental/internal/version"
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+)
+
+// Entry represents a single lifecycle operation recorded in the history journal
+type Entry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Source    string    `json:"source,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	// SourceVersion is the version of the package installed from a channel source
+	SourceVersion string   `json:"source-version,omitempty"`
+	Images        []string `json:"images,omitempty"`
+	Version       string   `json:"version"`
+	Success       bool     `json:"success"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// Journal records the outcome of an action into the history file stored
+// in the state partition
+type Journal struct {
+	config   *v1.RunConfig
+	entry    Entry
+	recorded bool
+}
+
+// NewJournal returns a Journal for the given action, the entry timestamp is
+// set to the current time
+func NewJournal(config *v1.RunConfig, action string) *Journal {
+	return &Journal{
+		config: config,
+		entry: Entry{
+			Timestamp: time.Now().UTC(),
+			Action:    action,
+			Version:   version.Get().Version,
+		},
+	}
+}
+
+// Record appends the journal entry to the history file including the given
+// action result. Only the first call records the entry, further calls are no-ops,
+// so it can be called before rebooting and deferred for error paths. Failures
+// to record are only logged as they should never break the action itself.
+func (j *Journal) Record(actionErr error) {
+	if j.recorded {
+		return
+	}
+	j.recorded = true
+
+	j.entry.Success = actionErr == nil
+	if actionErr != nil {
+		j.entry.Error = actionErr.Error()
+	}
+	if img := j.config.Images.GetActive(); img != nil {
+		j.entry.Source = img.Source.Value()
+		j.entry.Digest = img.Source.GetDigest()
+		j.entry.SourceVersion = img.Source.GetVersion()
+	}
+	j.entry.Images = imageLabels(j.config.Images)
+
+	err := withStateDir(j.config, "rw", func(stateDir string) error {
+		data, err := json.Marshal(j.entry)
+		if err != nil {
+			return err
+		}
+		f, err := j.config.Fs.OpenFile(
+			filepath.Join(stateDir, cnst.HistoryFile),
+			os.O_APPEND|os.O_CREATE|os.O_WRONLY, cnst.FilePerm,
+		)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		j.config.Logger.Warnf("Could not record %s action in history: %s", j.entry.Action, err)
+	}
+}
+
+// Read returns all the entries of the history journal in the state partition
+func Read(config *v1.RunConfig) ([]Entry, error) {
+	var entries []Entry
+
+	err := withStateDir(config, "ro", func(stateDir string) error {
+		data, err := config.Fs.ReadFile(filepath.Join(stateDir, cnst.HistoryFile))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entries, err = Parse(data)
+		return err
+	})
+	return entries, err
+}
+
+// Parse parses the content of a history journal. Every line is expected to
+// be a JSON encoded Entry, empty lines are ignored.
+func Parse(data []byte) ([]Entry, error) {
+	entries := []Entry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		entry := Entry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// imageLabels returns the labels of the configured images sorted by image name
+func imageLabels(images v1.ImageMap) []string {
+	var names, labels []string
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if img := images[name]; img != nil && img.Label != "" {
+			labels = append(labels, img.Label)
+		}
+	}
+	return labels
+}
+
+// withStateDir runs the given function with the path where the state partition is
+// mounted. If the state partition is configured (install, reset) it is used as is,
+// otherwise the partition is looked up by label (upgrade). If not already mounted
+// the partition is mounted in a temporary directory with the given mode.
+func withStateDir(config *v1.RunConfig, mode string, fn func(string) error) (err error) {
+	var device string
+
+	part := config.Partitions.GetByName(cnst.StatePartName)
+	if part != nil {
+		if part.MountPoint != "" {
+			if notMnt, _ := config.Mounter.IsLikelyNotMountPoint(part.MountPoint); !notMnt {
+				return fn(part.MountPoint)
+			}
+		}
+		if part.Path == "" {
+			return errors.New("state partition device is unknown")
+		}
+		device = part.Path
+	} else {
+		p, err := utils.GetFullDeviceByLabel(config.Runner, config.StateLabel, 2)
+		if err != nil {
+			return err
+		}
+		if p.MountPoint != "" {
+			return fn(p.MountPoint)
+		}
+		device = p.Path
+	}
+
+	tmpDir, err := utils.TempDir(config.Fs, "", "elemental-history")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = config.Fs.RemoveAll(tmpDir)
+	}()
+	err = config.Mounter.Mount(device, tmpDir, "auto", []string{mode})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		uErr := config.Mounter.Unmount(tmpDir)
+		if err == nil {
+			err = uErr
+		}
+	}()
+	return fn(tmpDir)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package history_test
+
+import (
+	"errors"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	conf "github.com/rancher-sandbox/elemental/pkg/config"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/history"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+	v1mock "github.com/rancher-sandbox/elemental/tests/mocks"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("History", Label("history"), func() {
+	var config *v1.RunConfig
+	var runner *v1mock.FakeRunner
+	var mounter *v1mock.ErrorMounter
+	var fs vfs.FS
+	var cleanup func()
+	var statePart *v1.Partition
+
+	BeforeEach(func() {
+		var err error
+		runner = v1mock.NewFakeRunner()
+		mounter = v1mock.NewErrorMounter()
+		fs, cleanup, err = vfst.NewTestFS(nil)
+		Expect(err).To(BeNil())
+		Expect(utils.MkdirAll(fs, "/tmp", constants.DirPerm)).To(Succeed())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(v1.NewNullLogger()),
+			conf.WithMounter(mounter),
+		)
+		statePart = &v1.Partition{
+			Name:       constants.StatePartName,
+			Label:      constants.StateLabel,
+			Path:       "/dev/device2",
+			MountPoint: constants.StateDir,
+		}
+		config.Partitions = append(config.Partitions, statePart)
+		config.Images.SetActive(&v1.Image{Label: constants.ActiveLabel, Source: v1.NewDockerSrc("some/image:latest")})
+		config.Images.SetPassive(&v1.Image{Label: constants.PassiveLabel})
+	})
+	AfterEach(func() { cleanup() })
+
+	It("Appends entries to the journal of a mounted state partition", func() {
+		Expect(utils.MkdirAll(fs, constants.StateDir, constants.DirPerm)).To(Succeed())
+		Expect(mounter.Mount(statePart.Path, constants.StateDir, "auto", []string{})).To(Succeed())
+
+		history.NewJournal(config, constants.ActionInstall).Record(nil)
+		journal := history.NewJournal(config, constants.ActionUpgrade)
+		journal.Record(errors.New("upgrade failure"))
+		// Second calls are no-ops
+		journal.Record(nil)
+
+		data, err := fs.ReadFile(filepath.Join(constants.StateDir, constants.HistoryFile))
+		Expect(err).To(BeNil())
+		entries, err := history.Parse(data)
+		Expect(err).To(BeNil())
+		Expect(len(entries)).To(Equal(2))
+		Expect(entries[0].Action).To(Equal(constants.ActionInstall))
+		Expect(entries[0].Success).To(BeTrue())
+		Expect(entries[0].Source).To(Equal("some/image:latest"))
+		Expect(entries[0].Images).To(Equal([]string{constants.ActiveLabel, constants.PassiveLabel}))
+		Expect(entries[1].Action).To(Equal(constants.ActionUpgrade))
+		Expect(entries[1].Success).To(BeFalse())
+		Expect(entries[1].Error).To(Equal("upgrade failure"))
+
+		read, err := history.Read(config)
+		Expect(err).To(BeNil())
+		Expect(read).To(Equal(entries))
+	})
+	It("Mounts and unmounts the state partition if not mounted", func() {
+		history.NewJournal(config, constants.ActionReset).Record(nil)
+		Expect(mounter.List()).To(BeEmpty())
+		mounter.ErrorOnUnmount = true
+		history.NewJournal(config, constants.ActionReset).Record(nil)
+		mnts, _ := mounter.List()
+		Expect(len(mnts)).To(Equal(1))
+	})
+	It("Does not record anything if the state partition device is unknown", func() {
+		statePart.Path = ""
+		history.NewJournal(config, constants.ActionInstall).Record(nil)
+		Expect(mounter.List()).To(BeEmpty())
+	})
+	It("Fails to parse a corrupted journal", func() {
+		_, err := history.Parse([]byte("{\"action\": \"install\"}\nnot json\n"))
+		Expect(err).NotTo(BeNil())
+	})
+})
@@ -17,6 +17,7 @@ limitations under the License.
 package http
 
 import (
+	"context"
 	"net/http"
 	"time"
 
@@ -35,13 +36,15 @@ func NewClient() *Client {
 	return &Client{client: client}
 }
 
-// GetURL attempts to download the contents of the given URL to the given destination
-func (c Client) GetURL(log v1.Logger, url string, destination string) error { // nolint:revive
+// GetURL attempts to download the contents of the given URL to the given destination.
+// The download is aborted once the given context is done.
+func (c Client) GetURL(ctx context.Context, log v1.Logger, url string, destination string) error { // nolint:revive
 	req, err := grab.NewRequest(destination, url)
 	if err != nil {
 		log.Errorf("Failed creating a request to '%s'", url)
 		return err
 	}
+	req = req.WithContext(ctx)
 
 	// start download
 	log.Infof("Downloading %v...\n", req.URL())
@@ -17,6 +17,7 @@ limitations under the License.
 package http_test
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 
@@ -33,7 +34,9 @@ var _ = Describe("HTTPClient", Label("http"), func() {
 	var client *http.Client
 	var log v1.Logger
 	var destDir string
+	var ctx context.Context
 	BeforeEach(func() {
+		ctx = context.Background()
 		client = http.NewClient()
 		log = v1.NewNullLogger()
 		destDir, _ = os.MkdirTemp("", "elemental-test")
@@ -45,7 +48,7 @@ var _ = Describe("HTTPClient", Label("http"), func() {
 		// Download a public elemental release
 		_, err := os.Stat(filepath.Join(destDir, "elemental-v0.0.13-Linux-x86_64.tar.gz"))
 		Expect(err).NotTo(BeNil())
-		Expect(client.GetURL(log, source, destDir)).To(BeNil())
+		Expect(client.GetURL(ctx, log, source, destDir)).To(BeNil())
 		_, err = os.Stat(filepath.Join(destDir, "elemental-v0.0.13-Linux-x86_64.tar.gz"))
 		Expect(err).To(BeNil())
 	})
@@ -53,12 +56,19 @@ var _ = Describe("HTTPClient", Label("http"), func() {
 		// Download a public elemental release
 		_, err := os.Stat(filepath.Join(destDir, "testfile"))
 		Expect(err).NotTo(BeNil())
-		Expect(client.GetURL(log, source, filepath.Join(destDir, "testfile"))).To(BeNil())
+		Expect(client.GetURL(ctx, log, source, filepath.Join(destDir, "testfile"))).To(BeNil())
 		_, err = os.Stat(filepath.Join(destDir, "testfile"))
 		Expect(err).To(BeNil())
 	})
 	It("Fails to download a non existing url", func() {
 		source := "http://nonexisting.stuff"
-		Expect(client.GetURL(log, source, destDir)).NotTo(BeNil())
+		Expect(client.GetURL(ctx, log, source, destDir)).NotTo(BeNil())
+	})
+	It("Does not download if the context is done", func() {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		Expect(client.GetURL(cancelled, log, source, destDir)).To(MatchError(context.Canceled))
+		_, err := os.Stat(filepath.Join(destDir, "elemental-v0.0.13-Linux-x86_64.tar.gz"))
+		Expect(err).NotTo(BeNil())
 	})
 })
@@ -0,0 +1,283 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lifecycle is the API to run the install, upgrade, rollback and reset actions from other
+// Go programs. Actions are configured only through the given options, they do not read
+// any configuration file nor environment variable, and do not keep any state between calls,
+// so they can be called from long running processes.
+//
+// Failures are returned as *Error, which wraps the underlying error. Cancelling the given
+// context aborts the action and cleans up whatever was mounted or created.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rancher-sandbox/elemental/pkg/action"
+	"github.com/rancher-sandbox/elemental/pkg/config"
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+)
+
+// Result describes a completed action
+type Result struct {
+	Action string
+	// Target is the installed device on install, the upgraded system (active or recovery)
+	// on upgrade, the system booted by default on rollback and the disk holding the state
+	// partition on reset
+	Target   string
+	Images   []ImageResult
+	Started  time.Time
+	Finished time.Time
+}
+
+// ImageResult describes an image deployed by an action
+type ImageResult struct {
+	// Name is the image role, active, passive or recovery
+	Name   string
+	File   string
+	Label  string
+	Source string
+	// Digest is only known for container image sources
+	Digest string
+}
+
+// Error is returned when an action fails, it can be unwrapped to the underlying error,
+// e.g. a utils.LockedError if another action is running or context.Canceled
+type Error struct {
+	Action string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Action, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Install installs the system on the given target device
+func Install(ctx context.Context, target string, opts ...Option) (*Result, error) {
+	return run(ctx, cnst.ActionInstall, opts, func(cfg *v1.RunConfig) (*Result, error) {
+		if target == "" {
+			return nil, errors.New("a target device must be supplied")
+		}
+		cfg.Target = target
+		err := action.InstallSetup(cfg)
+		if err != nil {
+			return nil, err
+		}
+		err = action.InstallRun(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Target: target, Images: imageResults(cfg.Images)}, nil
+	})
+}
+
+// Upgrade upgrades the active system, or the recovery one if WithRecovery is given.
+// The new system is the one booted by default after the next reboot.
+func Upgrade(ctx context.Context, opts ...Option) (*Result, error) {
+	return run(ctx, cnst.ActionUpgrade, opts, func(cfg *v1.RunConfig) (*Result, error) {
+		action.SetupLuet(cfg)
+		upgrade := action.NewUpgradeAction(cfg)
+		err := upgrade.Run()
+		if err != nil {
+			return nil, err
+		}
+		target := cnst.UpgradeActive
+		if cfg.RecoveryUpgrade {
+			target = cnst.UpgradeRecovery
+		}
+		images := v1.ImageMap{}
+		if img := upgrade.Upgraded(); img != nil {
+			images[target] = img
+		}
+		return &Result{Target: target, Images: imageResults(images)}, nil
+	})
+}
+
+// Rollback makes the passive system, the one active before the last upgrade, the one
+// booted by default after the next reboot
+func Rollback(ctx context.Context, opts ...Option) (*Result, error) {
+	return run(ctx, cnst.ActionRollback, opts, func(cfg *v1.RunConfig) (*Result, error) {
+		err := action.Rollback(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Reboot {
+			cfg.Logger.Infof("Rebooting in 5 seconds")
+			err = utils.Reboot(cfg.Runner, 5)
+		}
+		return &Result{Target: cnst.PassiveImgName, Images: []ImageResult{}}, err
+	})
+}
+
+// Reset resets the system to the recovery image, it can only run from the recovery system
+func Reset(ctx context.Context, opts ...Option) (*Result, error) {
+	return run(ctx, cnst.ActionReset, opts, func(cfg *v1.RunConfig) (*Result, error) {
+		err := action.ResetSetup(cfg)
+		if err != nil {
+			return nil, err
+		}
+		err = action.ResetRun(cfg)
+		if err != nil {
+			return nil, err
+		}
+		result := &Result{Images: imageResults(cfg.Images)}
+		if state := cfg.Partitions.GetByName(cnst.StatePartName); state != nil {
+			result.Target = state.Disk
+		}
+		return result, nil
+	})
+}
+
+// ResetSchedule is a reset to run once the recovery system boots
+type ResetSchedule = action.ResetSchedule
+
+// ScheduleReset schedules a reset for the next boot, which boots the recovery system once
+// where RunPendingReset is expected to run it. It takes the same options as Reset.
+func ScheduleReset(ctx context.Context, opts ...Option) (*Result, error) {
+	return run(ctx, cnst.ActionReset, opts, func(cfg *v1.RunConfig) (*Result, error) {
+		err := action.ScheduleReset(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Reboot {
+			cfg.Logger.Infof("Rebooting in 5 seconds")
+			err = utils.Reboot(cfg.Runner, 5)
+		} else if cfg.PowerOff {
+			cfg.Logger.Infof("Shutting down in 5 seconds")
+			err = utils.Shutdown(cfg.Runner, 5)
+		}
+		return &Result{Images: []ImageResult{}}, err
+	})
+}
+
+// PendingReset returns the scheduled reset, nil if there is none
+func PendingReset(ctx context.Context, opts ...Option) (*ResetSchedule, error) {
+	var schedule *ResetSchedule
+	_, err := run(ctx, cnst.ActionReset, opts, func(cfg *v1.RunConfig) (*Result, error) {
+		var err error
+		schedule, err = action.PendingReset(cfg)
+		return &Result{}, err
+	})
+	return schedule, err
+}
+
+// RunPendingReset runs the scheduled reset, if any, and reboots into the reset system. The
+// schedule is cleared before running it, so a failing reset is not retried on every boot.
+// It returns a nil result if there is no scheduled reset.
+func RunPendingReset(ctx context.Context, opts ...Option) (*Result, error) {
+	schedule, err := PendingReset(ctx, opts...)
+	if err != nil || schedule == nil {
+		return nil, err
+	}
+	_, err = run(ctx, cnst.ActionReset, opts, func(cfg *v1.RunConfig) (*Result, error) {
+		return &Result{}, action.ClearPendingReset(cfg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, WithReboot())
+	if schedule.ResetPersistent {
+		opts = append(opts, WithResetPersistent())
+	}
+	return Reset(ctx, opts...)
+}
+
+// run creates the configuration of the given action from the options and calls fn with it
+func run(ctx context.Context, name string, opts []Option, fn func(*v1.RunConfig) (*Result, error)) (*Result, error) {
+	started := time.Now().UTC()
+
+	cfg, err := newRunConfig(name, opts)
+	if err != nil {
+		return nil, &Error{Action: name, Err: err}
+	}
+	cfg.SetContext(ctx)
+
+	result, err := fn(cfg)
+	if err != nil {
+		// Actions might fail on a side effect of the cancellation, report the cancellation
+		if ctxErr := cfg.Context.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+			err = fmt.Errorf("%w: %s", ctxErr, err)
+		}
+		return nil, &Error{Action: name, Err: err}
+	}
+	result.Action = name
+	result.Started = started
+	result.Finished = time.Now().UTC()
+	return result, nil
+}
+
+// newRunConfig returns the RunConfig of the given action set by the given options
+func newRunConfig(name string, opts []Option) (*v1.RunConfig, error) {
+	o := &options{action: name}
+	for _, opt := range opts {
+		err := opt(o)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := config.NewRunConfig(o.runtime...)
+	if cfg == nil {
+		return nil, errors.New("invalid runtime options")
+	}
+	for _, set := range o.settings {
+		set(cfg)
+	}
+
+	var errs error
+	for _, e := range config.CheckConflicts(cfg) {
+		errs = multierror.Append(errs, e)
+	}
+	if cfg.ChannelUpgrades && (cfg.DockerImg != "" || cfg.Directory != "") {
+		errs = multierror.Append(errs, errors.New("a channel image can't be combined with other sources"))
+	}
+	return cfg, errs
+}
+
+// imageResults returns the results of the given images sorted by name
+func imageResults(images v1.ImageMap) []ImageResult {
+	var names []string
+	for name, img := range images {
+		if img != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	results := []ImageResult{}
+	for _, name := range names {
+		img := images[name]
+		results = append(results, ImageResult{
+			Name:   name,
+			File:   img.File,
+			Label:  img.Label,
+			Source: img.Source.Value(),
+			Digest: img.Source.GetDigest(),
+		})
+	}
+	return results
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lifecycle_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	conf "github.com/rancher-sandbox/elemental/pkg/config"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/lifecycle"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	v1mock "github.com/rancher-sandbox/elemental/tests/mocks"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Lifecycle", Label("lifecycle"), func() {
+	var runner *v1mock.FakeRunner
+	var runtime lifecycle.Option
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		runner = v1mock.NewFakeRunner()
+		fs, cleanup, err = vfst.NewTestFS(nil)
+		Expect(err).To(BeNil())
+		runtime = lifecycle.WithRuntime(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(v1.NewNullLogger()),
+			conf.WithMounter(v1mock.NewErrorMounter()),
+			conf.WithSyscall(&v1mock.FakeSyscall{}),
+			conf.WithCloudInitRunner(&v1mock.FakeCloudInitRunner{}),
+		)
+	})
+	AfterEach(func() { cleanup() })
+
+	It("Fails on options not valid for the action", func() {
+		_, err := lifecycle.Upgrade(context.Background(), runtime, lifecycle.WithResume())
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("upgrade failed: option WithResume is not valid for upgrade"))
+		Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+	})
+	It("Fails on conflicting options", func() {
+		_, err := lifecycle.Install(
+			context.Background(), "/dev/device", runtime,
+			lifecycle.WithDockerImage("some/image"), lifecycle.WithDirectory("/some/dir"), lifecycle.WithPowerOff(), lifecycle.WithReboot(),
+		)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("'directory', 'docker-image' are mutually exclusive options"))
+		Expect(err.Error()).To(ContainSubstring("'reboot' and 'poweroff' are mutually exclusive options"))
+		Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+	})
+	It("Fails to install without a target", func() {
+		_, err := lifecycle.Install(context.Background(), "", runtime)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("a target device must be supplied"))
+	})
+	It("Returns errors wrapped in an Error", func() {
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			if command == "cat" && args[0] == "/proc/cmdline" {
+				return []byte(constants.ActiveLabel), nil
+			}
+			return []byte{}, nil
+		}
+		_, err := lifecycle.Reset(context.Background(), runtime, lifecycle.WithResetPersistent())
+		Expect(err).To(HaveOccurred())
+		var actionErr *lifecycle.Error
+		Expect(errors.As(err, &actionErr)).To(BeTrue())
+		Expect(actionErr.Action).To(Equal(constants.ActionReset))
+		Expect(actionErr.Unwrap().Error()).To(Equal("reset can only be called from the recovery system"))
+	})
+	It("Sets the given configuration and keeps the runtime", func() {
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			if command == "cat" && args[0] == "/proc/cmdline" {
+				return []byte("root=LABEL=CUSTOM_SYSTEM"), nil
+			}
+			return []byte{}, nil
+		}
+		memLog := &bytes.Buffer{}
+		system := conf.NewRunConfig()
+		system.SystemLabel = "CUSTOM_SYSTEM"
+		system.StateLabel = "CUSTOM_STATE"
+		_, err := lifecycle.Reset(
+			context.Background(), runtime, lifecycle.WithRuntime(conf.WithLogger(v1.NewBufferLogger(memLog))),
+			lifecycle.WithConfig(system), lifecycle.WithLabels(lifecycle.Labels{State: "OTHER_STATE"}),
+		)
+		Expect(err).To(HaveOccurred())
+		// Booted from the configured system label, the state label is overridden by the later option
+		Expect(err.Error()).NotTo(ContainSubstring("recovery system"))
+		Expect(memLog.String()).To(ContainSubstring("State partition 'OTHER_STATE' not found"))
+		Expect(runner.IncludesCmds([][]string{{"cat", "/proc/cmdline"}})).To(Succeed())
+	})
+})
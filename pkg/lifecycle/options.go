@@ -0,0 +1,282 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lifecycle
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rancher-sandbox/elemental/pkg/config"
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// Option configures an action. Options only valid for some actions fail for the others.
+type Option func(o *options) error
+
+type options struct {
+	action   string
+	runtime  []config.GenericOptions
+	settings []func(cfg *v1.RunConfig)
+}
+
+// set returns an Option applying fn to the configuration of any action
+func set(fn func(cfg *v1.RunConfig)) Option {
+	return func(o *options) error {
+		o.settings = append(o.settings, fn)
+		return nil
+	}
+}
+
+// setFor returns an Option applying fn to the configuration of the given actions only
+func setFor(name string, actions []string, fn func(cfg *v1.RunConfig)) Option {
+	return func(o *options) error {
+		for _, a := range actions {
+			if a == o.action {
+				o.settings = append(o.settings, fn)
+				return nil
+			}
+		}
+		return fmt.Errorf("option %s is not valid for %s", name, o.action)
+	}
+}
+
+// WithRuntime sets the runtime dependencies, e.g. config.WithLogger or config.WithMounter.
+// Defaults to the real system ones.
+func WithRuntime(opts ...config.GenericOptions) Option {
+	return func(o *options) error {
+		o.runtime = append(o.runtime, opts...)
+		return nil
+	}
+}
+
+// WithConfig sets all the configuration values of the given configuration, e.g. the system
+// one read by config.ReadConfigRun. Runtime dependencies, partitions and images are not
+// set from it. Options given after it override its values.
+func WithConfig(config *v1.RunConfig) Option {
+	return set(func(cfg *v1.RunConfig) {
+		runtime, partitions, images := cfg.Config, cfg.Partitions, cfg.Images
+		*cfg = *config
+		cfg.Config, cfg.Partitions, cfg.Images = runtime, partitions, images
+	})
+}
+
+// Labels are the filesystem labels of the partitions and system images, empty ones
+// keep their default value
+type Labels struct {
+	State      string
+	Recovery   string
+	Persistent string
+	OEM        string
+	Active     string
+	Passive    string
+	System     string
+}
+
+// WithLabels sets the filesystem labels of the partitions and system images
+func WithLabels(labels Labels) Option {
+	return set(func(cfg *v1.RunConfig) {
+		for _, l := range []struct {
+			value string
+			field *string
+		}{
+			{labels.State, &cfg.StateLabel},
+			{labels.Recovery, &cfg.RecoveryLabel},
+			{labels.Persistent, &cfg.PersistentLabel},
+			{labels.OEM, &cfg.OEMLabel},
+			{labels.Active, &cfg.ActiveLabel},
+			{labels.Passive, &cfg.PassiveLabel},
+			{labels.System, &cfg.SystemLabel},
+		} {
+			if l.value != "" {
+				*l.field = l.value
+			}
+		}
+	})
+}
+
+// WithDockerImage sets the container image to deploy
+func WithDockerImage(image string) Option {
+	return set(func(cfg *v1.RunConfig) { cfg.DockerImg = image })
+}
+
+// WithDirectory sets the directory to deploy
+func WithDirectory(dir string) Option {
+	return set(func(cfg *v1.RunConfig) { cfg.Directory = dir })
+}
+
+// WithChannelImage sets the package of the configured luet repositories to upgrade to
+func WithChannelImage(image string) Option {
+	return setFor("WithChannelImage", []string{cnst.ActionUpgrade}, func(cfg *v1.RunConfig) {
+		cfg.ChannelUpgrades = true
+		cfg.UpgradeImage = image
+		cfg.RecoveryImage = image
+	})
+}
+
+// WithISO sets the ISO to install from, local path or URL
+func WithISO(iso string) Option {
+	return setFor("WithISO", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) { cfg.Iso = iso })
+}
+
+// WithCosign enables cosign verification of container images with the given public key,
+// keyless verification if empty
+func WithCosign(pubKey string) Option {
+	return set(func(cfg *v1.RunConfig) {
+		cfg.Cosign = true
+		cfg.CosignPubKey = pubKey
+	})
+}
+
+// WithNoVerify disables the mtree verification of container images
+func WithNoVerify() Option {
+	return set(func(cfg *v1.RunConfig) { cfg.NoVerify = true })
+}
+
+// WithStrict makes hook failures fail the action
+func WithStrict() Option {
+	return set(func(cfg *v1.RunConfig) { cfg.Strict = true })
+}
+
+// WithHookTimeout sets the timeout of each hook executable, rounded down to seconds
+func WithHookTimeout(timeout time.Duration) Option {
+	return set(func(cfg *v1.RunConfig) { cfg.HookTimeout = uint(timeout / time.Second) })
+}
+
+// WithLockWait sets the time to wait for another running action to finish, rounded down
+// to seconds. By default the action fails right away.
+func WithLockWait(wait time.Duration) Option {
+	return set(func(cfg *v1.RunConfig) { cfg.LockWait = uint(wait / time.Second) })
+}
+
+// WithImageSize sets the size in MiB of the system images
+func WithImageSize(size uint) Option {
+	return set(func(cfg *v1.RunConfig) { cfg.ImgSize = size })
+}
+
+// WithReboot reboots the system once the action succeeds
+func WithReboot() Option {
+	return set(func(cfg *v1.RunConfig) { cfg.Reboot = true })
+}
+
+// WithPowerOff shuts down the system once the action succeeds
+func WithPowerOff() Option {
+	return set(func(cfg *v1.RunConfig) { cfg.PowerOff = true })
+}
+
+// WithCloudInit sets the cloud-init configuration to copy into the OEM partition
+func WithCloudInit(path string) Option {
+	return setFor("WithCloudInit", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) { cfg.CloudInit = path })
+}
+
+// WithBootloader sets the bootloader to install, grub (default) or systemd-boot
+func WithBootloader(bootloader string) Option {
+	return setFor("WithBootloader", []string{cnst.ActionInstall, cnst.ActionReset}, func(cfg *v1.RunConfig) {
+		cfg.Bootloader = bootloader
+	})
+}
+
+// WithSecureBoot requires a UEFI Secure Boot setup
+func WithSecureBoot() Option {
+	return setFor("WithSecureBoot", []string{cnst.ActionInstall, cnst.ActionReset}, func(cfg *v1.RunConfig) {
+		cfg.SecureBoot = true
+	})
+}
+
+// WithKernelArgs sets extra kernel arguments for the boot entries
+func WithKernelArgs(args string) Option {
+	return setFor("WithKernelArgs", []string{cnst.ActionInstall, cnst.ActionReset}, func(cfg *v1.RunConfig) {
+		cfg.KernelArgs = args
+	})
+}
+
+// WithConsoles sets the consoles of the kernel command line, e.g. tty1 or ttyS0,115200n8
+func WithConsoles(consoles ...string) Option {
+	return setFor("WithConsoles", []string{cnst.ActionInstall, cnst.ActionReset}, func(cfg *v1.RunConfig) {
+		cfg.Consoles = consoles
+	})
+}
+
+// WithTTY adds the given tty to grub
+func WithTTY(tty string) Option {
+	return setFor("WithTTY", []string{cnst.ActionInstall, cnst.ActionReset}, func(cfg *v1.RunConfig) {
+		cfg.Tty = tty
+	})
+}
+
+// WithPartitionLayout sets the partitioning layout file
+func WithPartitionLayout(path string) Option {
+	return setFor("WithPartitionLayout", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) {
+		cfg.PartLayout = path
+	})
+}
+
+// WithForceEFI forces an EFI installation
+func WithForceEFI() Option {
+	return setFor("WithForceEFI", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) { cfg.ForceEfi = true })
+}
+
+// WithForceGPT forces a GPT partition table
+func WithForceGPT() Option {
+	return setFor("WithForceGPT", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) { cfg.ForceGpt = true })
+}
+
+// WithForce installs even if the target already has an installation
+func WithForce() Option {
+	return setFor("WithForce", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) { cfg.Force = true })
+}
+
+// WithNoFormat installs on the existing partitions without formatting them
+func WithNoFormat() Option {
+	return setFor("WithNoFormat", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) { cfg.NoFormat = true })
+}
+
+// WithEjectCD ejects the installation media on reboot
+func WithEjectCD() Option {
+	return setFor("WithEjectCD", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) { cfg.EjectCD = true })
+}
+
+// WithResume resumes an interrupted installation from its first incomplete step
+func WithResume() Option {
+	return setFor("WithResume", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) { cfg.Resume = true })
+}
+
+// WithLVM creates the persistent partition, and the state one if state is true, as logical
+// volumes of the given volume group, the default one if empty
+func WithLVM(volumeGroup string, state bool) Option {
+	return setFor("WithLVM", []string{cnst.ActionInstall}, func(cfg *v1.RunConfig) {
+		cfg.LVM = true
+		cfg.LVMState = state
+		if volumeGroup != "" {
+			cfg.LVMVolumeGroup = volumeGroup
+		}
+	})
+}
+
+// WithRecovery upgrades the recovery system instead of the active one
+func WithRecovery() Option {
+	return setFor("WithRecovery", []string{cnst.ActionUpgrade}, func(cfg *v1.RunConfig) {
+		cfg.RecoveryUpgrade = true
+	})
+}
+
+// WithResetPersistent also clears the persistent and OEM partitions
+func WithResetPersistent() Option {
+	return setFor("WithResetPersistent", []string{cnst.ActionReset}, func(cfg *v1.RunConfig) {
+		cfg.ResetPersistent = true
+	})
+}
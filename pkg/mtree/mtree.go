@@ -0,0 +1,433 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mtree generates and verifies mtree-style manifests of a root tree. Manifests
+// use the full path format of mtree(5), one entry per line with the type, mode,
+// ownership, size, sha256 digest and link target keywords. Modification times are not
+// recorded, as they are not preserved when unpacking container images.
+package mtree
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// Header is the first line of the generated manifests
+const Header = "#mtree v2.0"
+
+// Entry types
+const (
+	TypeFile   = "file"
+	TypeDir    = "dir"
+	TypeLink   = "link"
+	TypeChar   = "char"
+	TypeBlock  = "block"
+	TypeFifo   = "fifo"
+	TypeSocket = "socket"
+)
+
+// Entry is a single path of a manifest. Paths are relative to the root of the tree
+// and start with "."
+type Entry struct {
+	Path   string
+	Type   string
+	Mode   uint32
+	UID    int
+	GID    int
+	Size   int64
+	Digest string
+	Link   string
+}
+
+// Manifest is the ordered list of entries of a tree
+type Manifest struct {
+	Entries []Entry
+}
+
+// Difference is a keyword of an entry which does not match the manifest
+type Difference struct {
+	Path     string `json:"path"`
+	Keyword  string `json:"keyword"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// Report is the result of verifying a tree against a manifest
+type Report struct {
+	Missing  []string     `json:"missing"`
+	Extra    []string     `json:"extra"`
+	Modified []Difference `json:"modified"`
+}
+
+// Passed returns true if the tree matches the manifest
+func (r Report) Passed() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Modified) == 0
+}
+
+// String returns a line per missing, extra and modified path
+func (r Report) String() string {
+	var b strings.Builder
+	for _, p := range r.Missing {
+		fmt.Fprintf(&b, "missing: %s\n", p)
+	}
+	for _, p := range r.Extra {
+		fmt.Fprintf(&b, "extra: %s\n", p)
+	}
+	for _, d := range r.Modified {
+		fmt.Fprintf(&b, "modified: %s (%s expected %s, got %s)\n", d.Path, d.Keyword, d.Expected, d.Actual)
+	}
+	return b.String()
+}
+
+// Generate walks the root tree and returns its manifest. Excludes are paths relative
+// to root, as in /proc, which are skipped together with their contents.
+func Generate(fs v1.FS, root string, excludes ...string) (*Manifest, error) {
+	rawRoot, err := fs.RawPath(root)
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	for _, e := range excludes {
+		skip["."+filepath.Clean("/"+e)] = true
+	}
+
+	m := &Manifest{}
+	err = filepath.Walk(rawRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rawRoot, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			rel = "./" + filepath.ToSlash(rel)
+		}
+		if skip[rel] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry, err := newEntry(path, rel, info)
+		if err != nil {
+			return err
+		}
+		m.Entries = append(m.Entries, *entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newEntry returns the manifest entry of the file at the real path
+func newEntry(path, rel string, info os.FileInfo) (*Entry, error) {
+	entry := &Entry{Path: rel, Mode: unixMode(info.Mode())}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.UID = int(stat.Uid)
+		entry.GID = int(stat.Gid)
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		entry.Type = TypeFile
+		entry.Size = info.Size()
+		digest, err := fileDigest(path)
+		if err != nil {
+			return nil, err
+		}
+		entry.Digest = digest
+	case mode.IsDir():
+		entry.Type = TypeDir
+	case mode&os.ModeSymlink != 0:
+		entry.Type = TypeLink
+		// Symlink permissions are meaningless on Linux
+		entry.Mode = 0
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		entry.Link = target
+	case mode&os.ModeCharDevice != 0:
+		entry.Type = TypeChar
+	case mode&os.ModeDevice != 0:
+		entry.Type = TypeBlock
+	case mode&os.ModeNamedPipe != 0:
+		entry.Type = TypeFifo
+	case mode&os.ModeSocket != 0:
+		entry.Type = TypeSocket
+	}
+	return entry, nil
+}
+
+// unixMode returns the permission bits of mode including setuid, setgid and sticky
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// keywords returns the keywords of the entry in manifest order
+func (e Entry) keywords() [][2]string {
+	kw := [][2]string{{"type", e.Type}}
+	if e.Type != TypeLink {
+		kw = append(kw, [2]string{"mode", fmt.Sprintf("%04o", e.Mode)})
+	}
+	kw = append(kw, [2]string{"uid", strconv.Itoa(e.UID)}, [2]string{"gid", strconv.Itoa(e.GID)})
+	switch e.Type {
+	case TypeFile:
+		kw = append(kw, [2]string{"size", strconv.FormatInt(e.Size, 10)}, [2]string{"sha256digest", e.Digest})
+	case TypeLink:
+		kw = append(kw, [2]string{"link", encode(e.Link)})
+	}
+	return kw
+}
+
+// WriteTo writes the manifest in mtree format
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	n, err := fmt.Fprintln(w, Header)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	for _, e := range m.Entries {
+		var b strings.Builder
+		b.WriteString(encode(e.Path))
+		for _, kw := range e.keywords() {
+			fmt.Fprintf(&b, " %s=%s", kw[0], kw[1])
+		}
+		n, err = fmt.Fprintln(w, b.String())
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Parse reads a full path manifest. Comments and blank lines are ignored, /set and
+// hierarchical manifests are not supported.
+func Parse(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if strings.HasPrefix(fields[0], "/") || fields[0] == ".." {
+			return nil, fmt.Errorf("line %d: unsupported manifest entry %s, only full path manifests are supported", line, fields[0])
+		}
+		path, err := decode(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if path != "." && !strings.HasPrefix(path, "./") {
+			return nil, fmt.Errorf("line %d: path %s is not a full path", line, fields[0])
+		}
+		entry := Entry{Path: path}
+		for _, kw := range fields[1:] {
+			if err = entry.set(kw); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		if entry.Type == "" {
+			return nil, fmt.Errorf("line %d: missing type of %s", line, path)
+		}
+		m.Entries = append(m.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// set parses a keyword=value pair into the entry, unknown keywords are ignored
+func (e *Entry) set(kw string) error {
+	key, value, found := cut(kw, "=")
+	if !found {
+		return fmt.Errorf("invalid keyword %s", kw)
+	}
+	var err error
+	switch key {
+	case "type":
+		e.Type = value
+	case "mode":
+		var mode uint64
+		mode, err = strconv.ParseUint(value, 8, 32)
+		e.Mode = uint32(mode)
+	case "uid":
+		e.UID, err = strconv.Atoi(value)
+	case "gid":
+		e.GID, err = strconv.Atoi(value)
+	case "size":
+		e.Size, err = strconv.ParseInt(value, 10, 64)
+	case "sha256digest", "sha256":
+		e.Digest = value
+	case "link":
+		e.Link, err = decode(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid keyword %s: %w", kw, err)
+	}
+	return nil
+}
+
+// Verify compares the root tree against the manifest. Excludes are skipped in the
+// tree as in Generate, manifest entries under them are not reported as missing.
+func Verify(fs v1.FS, root string, m *Manifest, excludes ...string) (*Report, error) {
+	current, err := Generate(fs, root, excludes...)
+	if err != nil {
+		return nil, err
+	}
+	actual := map[string]Entry{}
+	for _, e := range current.Entries {
+		actual[e.Path] = e
+	}
+
+	report := &Report{}
+	expected := map[string]bool{}
+	for _, want := range m.Entries {
+		expected[want.Path] = true
+		if excluded(want.Path, excludes) {
+			continue
+		}
+		got, ok := actual[want.Path]
+		if !ok {
+			report.Missing = append(report.Missing, want.Path)
+			continue
+		}
+		report.Modified = append(report.Modified, compare(want, got)...)
+	}
+	for _, e := range current.Entries {
+		if !expected[e.Path] {
+			report.Extra = append(report.Extra, e.Path)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+	return report, nil
+}
+
+// compare returns the keywords of got which differ from want
+func compare(want, got Entry) []Difference {
+	if want.Type != got.Type {
+		return []Difference{{Path: want.Path, Keyword: "type", Expected: want.Type, Actual: got.Type}}
+	}
+	var diffs []Difference
+	gotKeywords := map[string]string{}
+	for _, kw := range got.keywords() {
+		gotKeywords[kw[0]] = kw[1]
+	}
+	for _, kw := range want.keywords() {
+		if gotKeywords[kw[0]] != kw[1] {
+			diffs = append(diffs, Difference{Path: want.Path, Keyword: kw[0], Expected: kw[1], Actual: gotKeywords[kw[0]]})
+		}
+	}
+	return diffs
+}
+
+func excluded(path string, excludes []string) bool {
+	for _, e := range excludes {
+		prefix := "." + filepath.Clean("/"+e)
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// encode escapes whitespace, non printable characters, '#' and '\' as octal
+// sequences, as mtree does
+func encode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '\\' || c == '#' {
+			fmt.Fprintf(&b, "\\%03o", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// decode reverts encode
+func decode(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+4 > len(s) {
+			return "", fmt.Errorf("invalid escape sequence in %s", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %s", s)
+		}
+		b.WriteByte(byte(c))
+		i += 3
+	}
+	return b.String(), nil
+}
+
+// cut is strings.Cut, not available with go 1.16
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
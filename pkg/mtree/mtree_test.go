@@ -0,0 +1,127 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mtree_test
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rancher-sandbox/elemental/pkg/mtree"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("mtree", Label("mtree"), func() {
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/root/etc/os-release":   "NAME=elemental\n",
+			"/root/etc/my file#1":    "escaped",
+			"/root/usr/bin/tool":     &vfst.File{Contents: []byte("#!/bin/sh\n"), Perm: 0755},
+			"/root/usr/bin/sh":       &vfst.Symlink{Target: "tool"},
+			"/root/proc/cpuinfo":     "excluded",
+			"/root/var/lib/empty":    &vfst.Dir{Perm: 0700},
+			"/root/etc/elemental/id": "",
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+
+	generate := func() *mtree.Manifest {
+		m, err := mtree.Generate(fs, "/root", "/proc")
+		Expect(err).ToNot(HaveOccurred())
+		return m
+	}
+
+	It("Generates a full path manifest", func() {
+		var buf bytes.Buffer
+		_, err := generate().WriteTo(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		manifest := buf.String()
+
+		Expect(manifest).To(HavePrefix(mtree.Header + "\n"))
+		Expect(manifest).To(ContainSubstring("\n. type=dir mode="))
+		Expect(manifest).To(MatchRegexp(`\./etc/os-release type=file mode=0\d{3} uid=\d+ gid=\d+ size=15 sha256digest=[0-9a-f]{64}\n`))
+		Expect(manifest).To(MatchRegexp(`\./usr/bin/tool type=file mode=0755 `))
+		Expect(manifest).To(MatchRegexp(`\./usr/bin/sh type=link uid=\d+ gid=\d+ link=tool\n`))
+		Expect(manifest).To(MatchRegexp(`\./var/lib/empty type=dir mode=0700 `))
+		Expect(manifest).To(ContainSubstring(`./etc/my\040file\0431 type=file`))
+		Expect(manifest).NotTo(ContainSubstring("./proc"))
+	})
+	It("Parses generated manifests", func() {
+		m := generate()
+		var buf bytes.Buffer
+		_, err := m.WriteTo(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		parsed, err := mtree.Parse(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed.Entries).To(Equal(m.Entries))
+	})
+	It("Fails parsing unsupported manifests", func() {
+		_, err := mtree.Parse(strings.NewReader("/set type=file\n"))
+		Expect(err).To(HaveOccurred())
+		_, err = mtree.Parse(strings.NewReader("etc type=dir\n"))
+		Expect(err).To(HaveOccurred())
+		_, err = mtree.Parse(strings.NewReader("./etc mode=0755\n"))
+		Expect(err).To(HaveOccurred())
+		_, err = mtree.Parse(strings.NewReader("./etc type=dir mode=0999\n"))
+		Expect(err).To(HaveOccurred())
+		_, err = mtree.Parse(strings.NewReader("./etc\\04 type=dir\n"))
+		Expect(err).To(HaveOccurred())
+	})
+	It("Verifies an unchanged tree", func() {
+		report, err := mtree.Verify(fs, "/root", generate(), "/proc")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Passed()).To(BeTrue())
+		Expect(report.String()).To(BeEmpty())
+	})
+	It("Reports missing, extra and modified files", func() {
+		m := generate()
+		Expect(fs.Remove("/root/etc/elemental/id")).To(Succeed())
+		Expect(fs.WriteFile("/root/etc/extra", []byte("extra"), 0644)).To(Succeed())
+		Expect(fs.WriteFile("/root/etc/os-release", []byte("NAME=tampered\n"), 0644)).To(Succeed())
+		Expect(fs.Chmod("/root/usr/bin/tool", 0700)).To(Succeed())
+		Expect(fs.Remove("/root/usr/bin/sh")).To(Succeed())
+		Expect(fs.Symlink("/bin/bash", "/root/usr/bin/sh")).To(Succeed())
+		Expect(fs.WriteFile("/root/proc/version", []byte("excluded"), 0644)).To(Succeed())
+
+		report, err := mtree.Verify(fs, "/root", m, "/proc")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Passed()).To(BeFalse())
+		Expect(report.Missing).To(Equal([]string{"./etc/elemental/id"}))
+		Expect(report.Extra).To(Equal([]string{"./etc/extra"}))
+
+		modified := map[string][]string{}
+		for _, d := range report.Modified {
+			modified[d.Path] = append(modified[d.Path], d.Keyword)
+		}
+		Expect(modified).To(Equal(map[string][]string{
+			"./etc/os-release": {"size", "sha256digest"},
+			"./usr/bin/tool":   {"mode"},
+			"./usr/bin/sh":     {"link"},
+		}))
+		Expect(report.String()).To(ContainSubstring("missing: ./etc/elemental/id\n"))
+		Expect(report.String()).To(ContainSubstring("modified: ./usr/bin/tool (mode expected 0755, got 0700)\n"))
+	})
+})
@@ -36,6 +36,16 @@ const (
 )
 
 var unallocatedRegexp = regexp.MustCompile(partedWarn)
+var partDeviceRegexp = regexp.MustCompile(`.*\d+$`)
+var lsblkPairRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// PartitionDetails holds the partition data not included in the partition table
+type PartitionDetails struct {
+	Device     string
+	FSLabel    string
+	FileSystem string
+	GUIDType   string
+}
 
 type Disk struct {
 	device  string
@@ -227,8 +237,6 @@ func (dev *Disk) NewPartitionTable(label string) (string, error) {
 
 //Size is expressed in MiB here
 func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags ...string) (int, error) {
-	pc := NewPartedCall(dev.String(), dev.runner)
-
 	//Check we have loaded partition table data
 	if dev.sectorS == 0 {
 		err := dev.Reload()
@@ -238,13 +246,9 @@ func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags
 		}
 	}
 
-	pc.SetPartitionTableLabel(dev.label)
-
-	var partNum int
 	var startS uint
 	if len(dev.parts) > 0 {
 		lastP := len(dev.parts) - 1
-		partNum = dev.parts[lastP].Number
 		startS = dev.parts[lastP].StartS + dev.parts[lastP].SizeS
 	} else {
 		//First partition is aligned at 1MiB
@@ -257,20 +261,24 @@ func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags
 		return 0, fmt.Errorf("not enough free space in disk. Required: %d sectors; Available %d sectors", size, freeS)
 	}
 
-	partNum++
 	var part = Partition{
-		Number:     partNum,
 		StartS:     startS,
 		SizeS:      size,
 		PLabel:     pLabel,
 		FileSystem: fileSystem,
 	}
+	return dev.createPartition(&part, flags)
+}
 
-	pc.CreatePartition(&part)
-	for _, flag := range flags {
-		pc.SetPartitionFlag(partNum, flag, true)
-	}
+// createPartition writes the given partition into the partition table and sets its flags.
+// parted takes the lowest free partition number, which is not the highest one plus one
+// once a partition was deleted, so the new partition is found by its start sector.
+func (dev *Disk) createPartition(part *Partition, flags []string) (int, error) {
+	pc := NewPartedCall(dev.String(), dev.runner)
+	pc.SetPartitionTableLabel(dev.label)
 
+	part.Number = dev.freePartitionNumber()
+	pc.CreatePartition(part)
 	out, err := pc.WriteChanges()
 	dev.logger.Debugf("partitioner output: %s", out)
 	if err != nil {
@@ -284,9 +292,42 @@ func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags
 		dev.logger.Errorf("Failed analyzing disk: %v\n", err)
 		return 0, err
 	}
+	partNum := 0
+	for _, p := range dev.parts {
+		if p.StartS == part.StartS {
+			partNum = p.Number
+			break
+		}
+	}
+	if partNum == 0 {
+		return 0, fmt.Errorf("created partition starting at sector %d not found", part.StartS)
+	}
+
+	if len(flags) > 0 {
+		pc = NewPartedCall(dev.String(), dev.runner)
+		pc.SetPartitionTableLabel(dev.label)
+		for _, flag := range flags {
+			pc.SetPartitionFlag(partNum, flag, true)
+		}
+		out, err = pc.WriteChanges()
+		dev.logger.Debugf("partitioner output: %s", out)
+		if err != nil {
+			dev.logger.Errorf("Failed setting partition %d flags: %v", partNum, err)
+			return 0, err
+		}
+	}
 	return partNum, nil
 }
 
+// freePartitionNumber returns the lowest partition number not in use
+func (dev Disk) freePartitionNumber() int {
+	num := 1
+	for dev.getPartition(num) != nil {
+		num++
+	}
+	return num
+}
+
 func (dev Disk) FormatPartition(partNum int, fileSystem string, label string) (string, error) {
 	pDev, err := dev.FindPartitionDevice(partNum)
 	if err != nil {
@@ -303,14 +344,7 @@ func (dev Disk) WipeFsOnPartition(device string) error {
 }
 
 func (dev Disk) FindPartitionDevice(partNum int) (string, error) {
-	re := regexp.MustCompile(`.*\d+$`)
-	var device string
-
-	if match := re.Match([]byte(dev.device)); match {
-		device = fmt.Sprintf("%sp%d", dev.device, partNum)
-	} else {
-		device = fmt.Sprintf("%s%d", dev.device, partNum)
-	}
+	device := dev.partitionDevice(partNum)
 
 	for tries := 0; tries <= partitionTries; tries++ {
 		dev.logger.Debugf("Trying to find the partition device %d of device %s (try number %d)", partNum, dev, tries+1)
@@ -425,3 +459,201 @@ func (dev Disk) expandFilesystem(device string) (string, error) {
 
 	return "", nil
 }
+
+// GetPartitions returns the current partitions of the disk
+func (dev *Disk) GetPartitions() ([]Partition, error) {
+	//Check we have loaded partition table data
+	if dev.sectorS == 0 {
+		err := dev.Reload()
+		if err != nil {
+			dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+			return nil, err
+		}
+	}
+	parts := make([]Partition, len(dev.parts))
+	copy(parts, dev.parts)
+	return parts, nil
+}
+
+// AddPartitionAt creates a new partition starting at the given offset from the
+// beginning of the disk. Offset and size are expressed in MiB, a zero size takes
+// all the space up to the next partition or the end of the disk.
+func (dev *Disk) AddPartitionAt(offset uint, size uint, fileSystem string, pLabel string, flags ...string) (int, error) {
+	//Check we have loaded partition table data
+	if dev.sectorS == 0 {
+		err := dev.Reload()
+		if err != nil {
+			dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+			return 0, err
+		}
+	}
+
+	startS := MiBToSectors(offset, dev.sectorS)
+	if startS == 0 || startS > dev.lastS {
+		return 0, fmt.Errorf("invalid partition offset %d MiB", offset)
+	}
+	for _, part := range dev.parts {
+		if startS >= part.StartS && startS < part.StartS+part.SizeS {
+			return 0, fmt.Errorf("offset of %d MiB overlaps with partition %d", offset, part.Number)
+		}
+	}
+
+	endS := dev.nextPartitionStart(startS)
+	sizeS := MiBToSectors(size, dev.sectorS)
+	if sizeS == 0 && endS <= dev.lastS {
+		sizeS = endS - startS
+	} else if sizeS > endS-startS {
+		return 0, fmt.Errorf("not enough free space at offset %d MiB. Required: %d sectors; Available %d sectors", offset, sizeS, endS-startS)
+	}
+
+	var part = Partition{
+		StartS:     startS,
+		SizeS:      sizeS,
+		PLabel:     pLabel,
+		FileSystem: fileSystem,
+	}
+	return dev.createPartition(&part, flags)
+}
+
+// DeletePartition removes the given partition from the partition table
+func (dev *Disk) DeletePartition(partNum int) (string, error) {
+	pc := NewPartedCall(dev.String(), dev.runner)
+
+	//Check we have loaded partition table data
+	if dev.sectorS == 0 {
+		err := dev.Reload()
+		if err != nil {
+			dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+			return "", err
+		}
+	}
+
+	if dev.getPartition(partNum) == nil {
+		return "", fmt.Errorf("partition %d not found in %s", partNum, dev)
+	}
+
+	pc.SetPartitionTableLabel(dev.label)
+	pc.DeletePartition(partNum)
+	out, err := pc.WriteChanges()
+	if err != nil {
+		return out, err
+	}
+	return "", dev.Reload()
+}
+
+// ResizePartition grows the given partition up to the given size in MiB, a zero size
+// takes all the space up to the next partition or the end of the disk. The filesystem
+// is expanded too. Partitions can't be shrunk.
+func (dev *Disk) ResizePartition(partNum int, size uint) (string, error) {
+	pc := NewPartedCall(dev.String(), dev.runner)
+
+	//Check we have loaded partition table data
+	if dev.sectorS == 0 {
+		err := dev.Reload()
+		if err != nil {
+			dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+			return "", err
+		}
+	}
+
+	pc.SetPartitionTableLabel(dev.label)
+
+	current := dev.getPartition(partNum)
+	if current == nil {
+		return "", fmt.Errorf("partition %d not found in %s", partNum, dev)
+	}
+	part := *current
+
+	endS := dev.nextPartitionStart(part.StartS)
+	sizeS := MiBToSectors(size, dev.sectorS)
+	switch {
+	case sizeS == 0 && endS <= dev.lastS:
+		sizeS = endS - part.StartS
+	case sizeS == 0:
+		// Size set to zero on the last partition is interpreted as all space available
+	case sizeS < part.SizeS:
+		return "", fmt.Errorf("partition %d can only be expanded, not shrunk", partNum)
+	case sizeS > endS-part.StartS:
+		return "", fmt.Errorf("not enough free space to expand partition %d up to %d sectors", partNum, sizeS)
+	}
+	part.SizeS = sizeS
+
+	pc.DeletePartition(part.Number)
+	pc.CreatePartition(&part)
+	out, err := pc.WriteChanges()
+	if err != nil {
+		return out, err
+	}
+	err = dev.Reload()
+	if err != nil {
+		return "", err
+	}
+	pDev, err := dev.FindPartitionDevice(part.Number)
+	if err != nil {
+		return "", err
+	}
+	return dev.expandFilesystem(pDev)
+}
+
+// SetPartitionType sets the GPT partition type GUID of the given partition
+func (dev Disk) SetPartitionType(partNum int, guid string) error {
+	out, err := dev.runner.Run("sgdisk", fmt.Sprintf("--typecode=%d:%s", partNum, guid), dev.device)
+	if err != nil {
+		dev.logger.Errorf("Failed setting partition type: %s", out)
+	}
+	return err
+}
+
+// GetPartitionDetails returns the details of the given partition not reported by
+// parted, such as the filesystem label or the partition type GUID
+func (dev Disk) GetPartitionDetails(partNum int) (PartitionDetails, error) {
+	details := PartitionDetails{Device: dev.partitionDevice(partNum)}
+	out, err := dev.runner.Run(
+		"lsblk", "--pairs", "--noheadings", "--nodeps", "--output",
+		"LABEL,FSTYPE,PARTTYPE", details.Device,
+	)
+	if err != nil {
+		return details, fmt.Errorf("failed getting details of %s: %s", details.Device, out)
+	}
+	for _, match := range lsblkPairRegexp.FindAllStringSubmatch(string(out), -1) {
+		switch match[1] {
+		case "LABEL":
+			details.FSLabel = match[2]
+		case "FSTYPE":
+			details.FileSystem = match[2]
+		case "PARTTYPE":
+			details.GUIDType = match[2]
+		}
+	}
+	return details, nil
+}
+
+// getPartition returns the partition with the given number, nil if not found
+func (dev Disk) getPartition(partNum int) *Partition {
+	for i := range dev.parts {
+		if dev.parts[i].Number == partNum {
+			return &dev.parts[i]
+		}
+	}
+	return nil
+}
+
+// nextPartitionStart returns the first sector of the partition following the given
+// sector, if there is no following partition the sector after the end of the disk
+func (dev Disk) nextPartitionStart(sector uint) uint {
+	next := dev.lastS + 1
+	for _, part := range dev.parts {
+		if part.StartS > sector && part.StartS < next {
+			next = part.StartS
+		}
+	}
+	return next
+}
+
+// partitionDevice returns the device path of the given partition number
+func (dev Disk) partitionDevice(partNum int) string {
+	if partDeviceRegexp.MatchString(dev.device) {
+		return fmt.Sprintf("%sp%d", dev.device, partNum)
+	}
+	return fmt.Sprintf("%s%d", dev.device, partNum)
+}
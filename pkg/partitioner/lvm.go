@@ -0,0 +1,124 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// VolumeGroup is a wrapper around the LVM tools to manage a volume group and its
+// logical volumes. Sizes are expressed in MiB.
+type VolumeGroup struct {
+	name   string
+	runner v1.Runner
+}
+
+func NewVolumeGroup(name string, runner v1.Runner) *VolumeGroup {
+	return &VolumeGroup{name: name, runner: runner}
+}
+
+func (vg VolumeGroup) String() string {
+	return vg.name
+}
+
+// Exists checks if the volume group is known to LVM
+func (vg VolumeGroup) Exists() bool {
+	_, err := vg.runner.Run("vgs", vg.name)
+	return err == nil
+}
+
+// Create initializes the given devices as physical volumes and creates the volume group on them
+func (vg VolumeGroup) Create(devices ...string) (string, error) {
+	args := append([]string{"-ff", "-y"}, devices...)
+	out, err := vg.runner.Run("pvcreate", args...)
+	if err != nil {
+		return string(out), err
+	}
+	out, err = vg.runner.Run("vgcreate", append([]string{vg.name}, devices...)...)
+	return string(out), err
+}
+
+// Activate activates all the logical volumes of the volume group
+func (vg VolumeGroup) Activate() (string, error) {
+	out, err := vg.runner.Run("vgchange", "--activate", "y", vg.name)
+	return string(out), err
+}
+
+// GetLogicalVolumes returns the names of the logical volumes of the volume group
+func (vg VolumeGroup) GetLogicalVolumes() ([]string, error) {
+	out, err := vg.runner.Run("lvs", "--noheadings", "--options", "lv_name", vg.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing logical volumes of %s: %s", vg.name, out)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// GetFreeExtents returns the number of free physical extents of the volume group
+func (vg VolumeGroup) GetFreeExtents() (uint, error) {
+	out, err := vg.runner.Run("vgs", "--noheadings", "--options", "vg_free_count", vg.name)
+	if err != nil {
+		return 0, fmt.Errorf("failed getting free extents of %s: %s", vg.name, out)
+	}
+	free, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 0)
+	return uint(free), err
+}
+
+// CreateLogicalVolume creates a logical volume of the given size, a zero size takes all
+// the free space of the volume group. Returns the device of the new logical volume.
+func (vg VolumeGroup) CreateLogicalVolume(name string, size uint) (string, error) {
+	args := []string{"--yes", "--name", name}
+	if size == 0 {
+		args = append(args, "--extents", "100%FREE")
+	} else {
+		args = append(args, "--size", fmt.Sprintf("%dM", size))
+	}
+	out, err := vg.runner.Run("lvcreate", append(args, vg.name)...)
+	if err != nil {
+		return string(out), err
+	}
+	return vg.LogicalVolumeDevice(name), nil
+}
+
+// ExtendLogicalVolume grows the given logical volume and its filesystem up to the given
+// size, a zero size takes all the free space of the volume group. Logical volumes can't
+// be shrunk.
+func (vg VolumeGroup) ExtendLogicalVolume(name string, size uint) (string, error) {
+	args := []string{"--resizefs"}
+	if size == 0 {
+		free, err := vg.GetFreeExtents()
+		if err != nil {
+			return "", err
+		}
+		if free == 0 {
+			return "", nil
+		}
+		args = append(args, "--extents", "+100%FREE")
+	} else {
+		args = append(args, "--size", fmt.Sprintf("%dM", size))
+	}
+	out, err := vg.runner.Run("lvextend", append(args, vg.LogicalVolumeDevice(name))...)
+	return string(out), err
+}
+
+// LogicalVolumeDevice returns the device path of the given logical volume
+func (vg VolumeGroup) LogicalVolumeDevice(name string) string {
+	return fmt.Sprintf("/dev/%s/%s", vg.name, name)
+}
@@ -38,6 +38,20 @@ const printOutput = `BYT;
 3:29394944s:45019135s:15624192s:ext4::type=83;
 4:45019136s:50331647s:5312512s:ext4::type=83;`
 
+// partedSideEffect returns printOutput for parted calls until a partition is created
+// and the given output afterwards
+func partedSideEffect(created string) func(cmd string, args ...string) ([]byte, error) {
+	out := printOutput
+	return func(cmd string, args ...string) ([]byte, error) {
+		for _, arg := range args {
+			if arg == "mkpart" {
+				out = created
+			}
+		}
+		return []byte(out), nil
+	}
+}
+
 func TestElementalSuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Partitioner test suite")
@@ -179,6 +193,48 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 			Expect(parts[1].StartS).To(Equal(uint(98304)))
 		})
 	})
+	Describe("LVM tests", Label("lvm"), func() {
+		var vg *part.VolumeGroup
+		BeforeEach(func() {
+			vg = part.NewVolumeGroup("cos", runner)
+		})
+		It("Creates a volume group and its logical volumes", func() {
+			_, err := vg.Create("/dev/device3")
+			Expect(err).To(BeNil())
+			Expect(vg.CreateLogicalVolume("state", 1024)).To(Equal("/dev/cos/state"))
+			Expect(vg.CreateLogicalVolume("persistent", 0)).To(Equal("/dev/cos/persistent"))
+			Expect(runner.CmdsMatch([][]string{
+				{"pvcreate", "-ff", "-y", "/dev/device3"},
+				{"vgcreate", "cos", "/dev/device3"},
+				{"lvcreate", "--yes", "--name", "state", "--size", "1024M", "cos"},
+				{"lvcreate", "--yes", "--name", "persistent", "--extents", "100%FREE", "cos"},
+			})).To(BeNil())
+		})
+		It("Lists logical volumes", func() {
+			runner.ReturnValue = []byte("  persistent\n  state\n")
+			Expect(vg.GetLogicalVolumes()).To(Equal([]string{"persistent", "state"}))
+		})
+		It("Expands a logical volume", func() {
+			_, err := vg.ExtendLogicalVolume("persistent", 2048)
+			Expect(err).To(BeNil())
+			runner.ReturnValue = []byte("  25\n")
+			_, err = vg.ExtendLogicalVolume("persistent", 0)
+			Expect(err).To(BeNil())
+			Expect(runner.CmdsMatch([][]string{
+				{"lvextend", "--resizefs", "--size", "2048M", "/dev/cos/persistent"},
+				{"vgs", "--noheadings", "--options", "vg_free_count", "cos"},
+				{"lvextend", "--resizefs", "--extents", "+100%FREE", "/dev/cos/persistent"},
+			})).To(BeNil())
+		})
+		It("Does not expand a logical volume without free space", func() {
+			runner.ReturnValue = []byte("  0\n")
+			_, err := vg.ExtendLogicalVolume("persistent", 0)
+			Expect(err).To(BeNil())
+			Expect(runner.CmdsMatch([][]string{
+				{"vgs", "--noheadings", "--options", "vg_free_count", "cos"},
+			})).To(BeNil())
+		})
+	})
 	Describe("Mkfs tests", Label("mkfs", "filesystem"), func() {
 		It("Successfully formats a partition with xfs", func() {
 			mkfs := part.NewMkfsCall("/dev/device", "xfs", "OEM", runner)
@@ -290,9 +346,11 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 				cmds = [][]string{printCmd, {
 					"parted", "--script", "--machine", "--", "/dev/device",
 					"unit", "s", "mkpart", "primary", "ext4", "50331648", "100%",
-					"set", "5", "boot", "on",
-				}, printCmd}
-				runner.ReturnValue = []byte(printOutput)
+				}, printCmd, {
+					"parted", "--script", "--machine", "--", "/dev/device",
+					"unit", "s", "set", "5", "boot", "on",
+				}}
+				runner.SideEffect = partedSideEffect(printOutput + "\n5:50331648s:50593791s:262144s:ext4::type=83;")
 				num, err := dev.AddPartition(0, "ext4", "ignored", "boot")
 				Expect(err).To(BeNil())
 				Expect(num).To(Equal(5))
@@ -305,6 +363,97 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 				Expect(err).NotTo(BeNil())
 				Expect(runner.CmdsMatch(cmds)).To(BeNil())
 			})
+			It("Adds a new partition at a given offset", func() {
+				cmds = [][]string{printCmd, {
+					"parted", "--script", "--machine", "--", "/dev/device",
+					"unit", "s", "mkpart", "primary", "ext4", "50331648", "50593791",
+				}, printCmd}
+				runner.SideEffect = partedSideEffect(printOutput + "\n5:50331648s:50593791s:262144s:ext4::type=83;")
+				num, err := dev.AddPartitionAt(24576, 128, "ext4", "ignored")
+				Expect(err).To(BeNil())
+				Expect(num).To(Equal(5))
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
+			It("Adds a partition at a given offset after deleting one", func() {
+				withoutThird := `BYT;
+/dev/loop0:50593792s:loopback:512:512:msdos:Loopback device:;
+1:2048s:98303s:96256s:ext4::type=83;
+2:98304s:29394943s:29296640s:ext4::boot, type=83;
+4:45019136s:50331647s:5312512s:ext4::type=83;`
+				withNewThird := `BYT;
+/dev/loop0:50593792s:loopback:512:512:msdos:Loopback device:;
+1:2048s:98303s:96256s:ext4::type=83;
+2:98304s:29394943s:29296640s:ext4::boot, type=83;
+3:29491200s:29753343s:262144s:ext4::type=83;
+4:45019136s:50331647s:5312512s:ext4::type=83;`
+				out := printOutput
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					for _, arg := range args {
+						switch arg {
+						case "rm":
+							out = withoutThird
+						case "mkpart":
+							out = withNewThird
+						}
+					}
+					return []byte(out), nil
+				}
+				cmds = [][]string{printCmd, {
+					"parted", "--script", "--machine", "--", "/dev/device",
+					"unit", "s", "rm", "3",
+				}, printCmd, {
+					"parted", "--script", "--machine", "--", "/dev/device",
+					"unit", "s", "mkpart", "primary", "ext4", "29491200", "29753343",
+				}, printCmd, {
+					"parted", "--script", "--machine", "--", "/dev/device",
+					"unit", "s", "set", "3", "boot", "on",
+				}}
+				_, err := dev.DeletePartition(3)
+				Expect(err).To(BeNil())
+				num, err := dev.AddPartitionAt(14400, 128, "ext4", "ignored", "boot")
+				Expect(err).To(BeNil())
+				Expect(num).To(Equal(3))
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
+			It("Fails to add a partition overlapping an existing one", func() {
+				runner.ReturnValue = []byte(printOutput)
+				_, err := dev.AddPartitionAt(100, 0, "ext4", "ignored")
+				Expect(err).NotTo(BeNil())
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
+			It("Deletes a partition", func() {
+				cmds = [][]string{printCmd, {
+					"parted", "--script", "--machine", "--", "/dev/device",
+					"unit", "s", "rm", "3",
+				}, printCmd}
+				runner.ReturnValue = []byte(printOutput)
+				_, err := dev.DeletePartition(3)
+				Expect(err).To(BeNil())
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+				_, err = dev.DeletePartition(7)
+				Expect(err).NotTo(BeNil())
+			})
+			It("Fails to shrink a partition", func() {
+				runner.ReturnValue = []byte(printOutput)
+				_, err := dev.ResizePartition(2, 10)
+				Expect(err).NotTo(BeNil())
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
+			It("Sets the partition type", func() {
+				Expect(dev.SetPartitionType(2, "0fc63daf-8483-4772-8e79-3d69d8477de4")).To(BeNil())
+				Expect(runner.CmdsMatch([][]string{
+					{"sgdisk", "--typecode=2:0fc63daf-8483-4772-8e79-3d69d8477de4", "/dev/device"},
+				})).To(BeNil())
+			})
+			It("Gets partition details", func() {
+				runner.ReturnValue = []byte(`LABEL="COS_OEM" FSTYPE="ext4" PARTTYPE="0fc63daf-8483-4772-8e79-3d69d8477de4"`)
+				details, err := dev.GetPartitionDetails(2)
+				Expect(err).To(BeNil())
+				Expect(details).To(Equal(part.PartitionDetails{
+					Device: "/dev/device2", FSLabel: "COS_OEM", FileSystem: "ext4",
+					GUIDType: "0fc63daf-8483-4772-8e79-3d69d8477de4",
+				}))
+			})
 			It("Finds device for a given partition number", func() {
 				_, err := fs.Create("/dev/device4")
 				Expect(err).To(BeNil())
@@ -377,6 +526,29 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 					Expect(err).To(BeNil())
 					Expect(runner.CmdsMatch(append(cmds, extCmds...))).To(BeNil())
 				})
+				It("Resizes a partition in the middle of the disk", func() {
+					_, err := fs.Create("/dev/device2")
+					Expect(err).To(BeNil())
+					ghwTest := mocks.GhwMock{}
+					disk := block.Disk{Name: "device", Partitions: []*block.Partition{
+						{
+							Name: "device2",
+							Type: "ext4",
+						},
+					}}
+					ghwTest.AddDisk(disk)
+					ghwTest.CreateDevices()
+					defer ghwTest.Clean()
+					_, err = dev.ResizePartition(2, 0)
+					Expect(err).To(BeNil())
+					Expect(runner.CmdsMatch([][]string{
+						printCmd, {
+							"parted", "--script", "--machine", "--", "/dev/device",
+							"unit", "s", "rm", "2", "mkpart", "primary", "", "98304", "29394943",
+						}, printCmd, {"udevadm", "settle"},
+						{"e2fsck", "-fy", "/dev/device2"}, {"resize2fs", "/dev/device2"},
+					})).To(BeNil())
+				})
 				It("Expands xfs partition", func() {
 					_, err := fs.Create("/dev/device4")
 					Expect(err).To(BeNil())
@@ -0,0 +1,181 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	dockTypes "github.com/docker/docker/api/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// Registry queries container image registries using the credentials of the
+// docker configuration, if any, unless explicit credentials are set
+type Registry struct {
+	auth *authn.AuthConfig
+}
+
+type Option func(r *Registry) error
+
+// WithAuth sets the credentials used for all registries instead of the ones of the
+// docker configuration
+func WithAuth(auth *authn.AuthConfig) Option {
+	return func(r *Registry) error {
+		r.auth = auth
+		return nil
+	}
+}
+
+func NewRegistry(opts ...Option) *Registry {
+	r := &Registry{}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil
+		}
+	}
+	return r
+}
+
+// Auth returns the credentials for the registry of the given image reference, empty
+// credentials are returned for anonymous access
+func (r Registry) Auth(ref string) (*dockTypes.AuthConfig, error) {
+	reference, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	auth := r.auth
+	if auth == nil {
+		authenticator, err := authn.DefaultKeychain.Resolve(reference.Context())
+		if err != nil {
+			return nil, err
+		}
+		auth, err = authenticator.Authorization()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &dockTypes.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		Auth:          auth.Auth,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+		ServerAddress: reference.Context().RegistryStr(),
+	}, nil
+}
+
+// remoteOptions returns the options to reach remote registries with the configured
+// credentials
+func (r Registry) remoteOptions(ctx context.Context) []remote.Option {
+	opts := []remote.Option{remote.WithContext(ctx)}
+	if r.auth != nil {
+		return append(opts, remote.WithAuth(authn.FromConfig(*r.auth)))
+	}
+	return append(opts, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+// Digest returns the digest of the manifest the given image reference points to.
+// References by digest are not looked up.
+func (r Registry) Digest(ctx context.Context, ref string) (string, error) {
+	reference, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	if digest, ok := reference.(name.Digest); ok {
+		return digest.DigestStr(), nil
+	}
+	desc, err := remote.Head(reference, r.remoteOptions(ctx)...)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
+
+// Labels returns the labels set in the configuration of the image the given reference
+// points to. Only the manifest and the configuration are fetched, not the layers.
+func (r Registry) Labels(ctx context.Context, ref string) (map[string]string, error) {
+	reference, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(reference, r.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Config.Labels, nil
+}
+
+// ResolvePlatform returns a reference by digest to the manifest for the given platform.
+// Multi-arch indexes are looked up for a matching manifest, the platform of single
+// images is checked in their configuration.
+func (r Registry) ResolvePlatform(ctx context.Context, ref string, platform v1.Platform) (string, error) {
+	reference, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	desc, err := remote.Get(reference, r.remoteOptions(ctx)...)
+	if err != nil {
+		return "", err
+	}
+
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return "", err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return "", err
+		}
+		for _, m := range manifest.Manifests {
+			if m.Platform != nil && matchPlatform(platform, m.Platform.OS, m.Platform.Architecture, m.Platform.Variant) {
+				return reference.Context().Digest(m.Digest.String()).String(), nil
+			}
+		}
+		return "", fmt.Errorf("no image for platform %s found in %s", platform, ref)
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return "", err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return "", err
+	}
+	if !matchPlatform(platform, cfg.OS, cfg.Architecture, cfg.Variant) {
+		return "", fmt.Errorf("image %s is for platform %s/%s, not %s", ref, cfg.OS, cfg.Architecture, platform)
+	}
+	return reference.Context().Digest(desc.Digest.String()).String(), nil
+}
+
+// matchPlatform checks the given OS, architecture and variant match the platform,
+// the variant is only compared if the platform sets one
+func matchPlatform(platform v1.Platform, os, arch, variant string) bool {
+	if platform.OS != os || platform.Arch != arch {
+		return false
+	}
+	return platform.Variant == "" || platform.Variant == variant
+}
@@ -0,0 +1,212 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	ggcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/registry"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// platformImage returns a random image with the given architecture in its configuration
+func platformImage(arch string) ggcrv1.Image {
+	img, err := random.Image(1024, 1)
+	Expect(err).ToNot(HaveOccurred())
+	cfg, err := img.ConfigFile()
+	Expect(err).ToNot(HaveOccurred())
+	cfg = cfg.DeepCopy()
+	cfg.OS = "linux"
+	cfg.Architecture = arch
+	cfg.Config.Labels = map[string]string{"arch": arch}
+	img, err = mutate.ConfigFile(img, cfg)
+	Expect(err).ToNot(HaveOccurred())
+	return img
+}
+
+func digestOf(img ggcrv1.Image) string {
+	digest, err := img.Digest()
+	Expect(err).ToNot(HaveOccurred())
+	return digest.String()
+}
+
+var _ = Describe("Registry", Label("registry"), func() {
+	var server *httptest.Server
+	var reg *registry.Registry
+	var ctx context.Context
+	var amd64, arm64 ggcrv1.Image
+	var index, single string
+	var tmpDir string
+	var denySignatures bool
+
+	BeforeEach(func() {
+		var err error
+		denySignatures = false
+		handler := ggcrregistry.New()
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if denySignatures && strings.HasSuffix(req.URL.Path, ".sig") {
+				http.Error(w, "denied", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, req)
+		}))
+		host := strings.TrimPrefix(server.URL, "http://")
+		reg = registry.NewRegistry()
+		ctx = context.Background()
+
+		amd64 = platformImage("amd64")
+		arm64 = platformImage("arm64")
+		idx := mutate.AppendManifests(empty.Index,
+			mutate.IndexAddendum{Add: amd64, Descriptor: ggcrv1.Descriptor{Platform: &ggcrv1.Platform{OS: "linux", Architecture: "amd64"}}},
+			mutate.IndexAddendum{Add: arm64, Descriptor: ggcrv1.Descriptor{Platform: &ggcrv1.Platform{OS: "linux", Architecture: "arm64"}}},
+		)
+		index = host + "/elemental/os:multi"
+		ref, err := name.ParseReference(index)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.WriteIndex(ref, idx)).To(Succeed())
+
+		// Sign the index with a fake cosign signature
+		idxDigest, err := idx.Digest()
+		Expect(err).ToNot(HaveOccurred())
+		sigRef := ref.Context().Tag(strings.Replace(idxDigest.String(), ":", "-", 1) + ".sig")
+		sig, err := random.Image(128, 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.Write(sigRef, sig)).To(Succeed())
+
+		single = host + "/elemental/os:single"
+		ref, err = name.ParseReference(single)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.Write(ref, arm64)).To(Succeed())
+
+		tmpDir, err = os.MkdirTemp("", "elemental-registry")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		server.Close()
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("Gets the digest and labels of images", func() {
+		digest, err := reg.Digest(ctx, single)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(digest).To(Equal(digestOf(arm64)))
+
+		labels, err := reg.Labels(ctx, single)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(labels).To(HaveKeyWithValue("arch", "arm64"))
+	})
+	It("Gets the digest of the platform image of an index", func() {
+		digest, err := reg.Digest(ctx, index)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(digest).NotTo(Equal(digestOf(arm64)))
+
+		resolved, err := reg.ResolvePlatform(ctx, index, v1.Platform{OS: "linux", Arch: "arm64"})
+		Expect(err).ToNot(HaveOccurred())
+		digest, err = reg.Digest(ctx, resolved)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(digest).To(Equal(digestOf(arm64)))
+	})
+	It("Resolves the image for a platform", func() {
+		resolved, err := reg.ResolvePlatform(ctx, index, v1.Platform{OS: "linux", Arch: "arm64"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolved).To(HaveSuffix("@" + digestOf(arm64)))
+
+		_, err = reg.ResolvePlatform(ctx, index, v1.Platform{OS: "linux", Arch: "s390x"})
+		Expect(err).To(HaveOccurred())
+
+		resolved, err = reg.ResolvePlatform(ctx, single, v1.Platform{OS: "linux", Arch: "arm64"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolved).To(HaveSuffix("@" + digestOf(arm64)))
+		_, err = reg.ResolvePlatform(ctx, single, v1.Platform{OS: "linux", Arch: "amd64"})
+		Expect(err).To(HaveOccurred())
+	})
+	It("Saves multi-arch images and their signatures to an OCI layout", func() {
+		dst := filepath.Join(tmpDir, "layout")
+		saved, err := reg.Save(ctx, index, dst, cnst.PullFormatOCI, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(saved.Signature).To(HaveSuffix(".sig"))
+
+		path, err := layout.FromPath(dst)
+		Expect(err).ToNot(HaveOccurred())
+		idx, err := path.ImageIndex()
+		Expect(err).ToNot(HaveOccurred())
+		manifest, err := idx.IndexManifest()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Manifests).To(HaveLen(2))
+		Expect(manifest.Manifests[0].MediaType.IsIndex()).To(BeTrue())
+		Expect(manifest.Manifests[0].Digest.String()).To(Equal(saved.Digest))
+
+		// Saving again appends to the existing layout
+		saved, err = reg.Save(ctx, single, dst, cnst.PullFormatOCI, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(saved.Signature).To(BeEmpty())
+		idx, err = path.ImageIndex()
+		Expect(err).ToNot(HaveOccurred())
+		manifest, err = idx.IndexManifest()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Manifests).To(HaveLen(3))
+	})
+	It("Saves the image for a platform to a docker archive", func() {
+		dst := filepath.Join(tmpDir, "image.tar")
+		saved, err := reg.Save(ctx, index, dst, cnst.PullFormatDockerArchive, &v1.Platform{OS: "linux", Arch: "arm64"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(saved.Digest).To(Equal(digestOf(arm64)))
+		Expect(saved.Signature).ToNot(BeEmpty())
+
+		tag, err := name.NewTag(index)
+		Expect(err).ToNot(HaveOccurred())
+		img, err := tarball.ImageFromPath(dst, &tag)
+		Expect(err).ToNot(HaveOccurred())
+		cfg, err := img.ConfigFile()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Architecture).To(Equal("arm64"))
+
+		_, err = reg.Save(ctx, index, dst, "raw", nil)
+		Expect(err).To(HaveOccurred())
+	})
+	It("Fails to save images if their signature can't be looked up", func() {
+		denySignatures = true
+		_, err := reg.Save(ctx, single, filepath.Join(tmpDir, "layout"), cnst.PullFormatOCI, nil)
+		Expect(err).To(MatchError(ContainSubstring("signature")))
+		_, err = reg.Save(ctx, index, filepath.Join(tmpDir, "image.tar"), cnst.PullFormatDockerArchive, nil)
+		Expect(err).To(HaveOccurred())
+	})
+	It("Uses the configured credentials", func() {
+		auth, err := registry.NewRegistry(registry.WithAuth(&authn.AuthConfig{Username: "user", Password: "pass"})).Auth(single)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auth.Username).To(Equal("user"))
+		Expect(auth.ServerAddress).To(Equal(strings.TrimPrefix(server.URL, "http://")))
+	})
+})
@@ -0,0 +1,188 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// refNameAnnotation is the OCI annotation holding the reference of an image in a layout
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Save writes the given image reference to dst in the given format, an OCI layout
+// directory or a docker save compatible tarball, together with its cosign signature
+// if there is one. OCI layouts keep multi-arch indexes unless a platform is given,
+// tarballs only hold the image for the given platform, the host one by default.
+func (r Registry) Save(ctx context.Context, ref string, dst string, format string, platform *v1.Platform) (*v1.SavedImage, error) {
+	reference, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	opts := r.remoteOptions(ctx)
+	desc, err := remote.Get(reference, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case cnst.PullFormatOCI:
+		return r.saveLayout(ctx, reference, desc, dst, platform)
+	case cnst.PullFormatDockerArchive:
+		return r.saveTarball(ctx, reference, desc, dst, platform)
+	default:
+		return nil, fmt.Errorf("unsupported format %s", format)
+	}
+}
+
+func (r Registry) saveLayout(ctx context.Context, reference name.Reference, desc *remote.Descriptor, dst string, platform *v1.Platform) (*v1.SavedImage, error) {
+	path, err := layout.FromPath(dst)
+	if err != nil {
+		path, err = layout.Write(dst, empty.Index)
+		if err != nil {
+			return nil, err
+		}
+	}
+	annotations := layout.WithAnnotations(map[string]string{refNameAnnotation: reference.Name()})
+
+	saved := &v1.SavedImage{}
+	if desc.MediaType.IsIndex() && platform == nil {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		if err = path.AppendIndex(index, annotations); err != nil {
+			return nil, err
+		}
+		saved.Digest = desc.Digest.String()
+	} else {
+		img, err := r.platformImage(ctx, reference, desc, platform)
+		if err != nil {
+			return nil, err
+		}
+		if err = path.AppendImage(img, annotations); err != nil {
+			return nil, err
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		saved.Digest = digest.String()
+	}
+
+	// Signatures are looked up by the digest the reference points to, for multi-arch
+	// images that is the index one even if only the image for a platform is saved
+	sigRef, sigImg, err := r.signature(ctx, reference, desc.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	if sigImg != nil {
+		err = path.AppendImage(sigImg, layout.WithAnnotations(map[string]string{refNameAnnotation: sigRef.Name()}))
+		if err != nil {
+			return nil, err
+		}
+		saved.Signature = sigRef.Name()
+	}
+	return saved, nil
+}
+
+func (r Registry) saveTarball(ctx context.Context, reference name.Reference, desc *remote.Descriptor, dst string, platform *v1.Platform) (*v1.SavedImage, error) {
+	if platform == nil {
+		platform = v1.NewHostPlatform()
+	}
+	img, err := r.platformImage(ctx, reference, desc, platform)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	saved := &v1.SavedImage{Digest: digest.String()}
+	images := map[name.Reference]ggcrv1.Image{reference: img}
+
+	sigRef, sigImg, err := r.signature(ctx, reference, desc.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	if sigImg != nil {
+		images[sigRef] = sigImg
+		saved.Signature = sigRef.Name()
+	}
+	if err = tarball.MultiRefWriteToFile(dst, images); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// platformImage returns the image of the descriptor for the given platform, a nil
+// platform takes the host one for multi-arch indexes
+func (r Registry) platformImage(ctx context.Context, reference name.Reference, desc *remote.Descriptor, platform *v1.Platform) (ggcrv1.Image, error) {
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil || platform == nil {
+			return img, err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		if !matchPlatform(*platform, cfg.OS, cfg.Architecture, cfg.Variant) {
+			return nil, fmt.Errorf("image %s is for platform %s/%s, not %s", reference, cfg.OS, cfg.Architecture, platform)
+		}
+		return img, nil
+	}
+	if platform == nil {
+		platform = v1.NewHostPlatform()
+	}
+	resolved, err := r.ResolvePlatform(ctx, reference.String(), *platform)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := name.NewDigest(resolved)
+	if err != nil {
+		return nil, err
+	}
+	return remote.Image(digest, r.remoteOptions(ctx)...)
+}
+
+// signature returns the cosign signature of the manifest with the given digest, nil
+// if the image is not signed. Any failure other than a missing signature is returned.
+func (r Registry) signature(ctx context.Context, reference name.Reference, digest string) (name.Tag, ggcrv1.Image, error) {
+	sigRef := reference.Context().Tag(strings.Replace(digest, ":", "-", 1) + ".sig")
+	img, err := remote.Image(sigRef, r.remoteOptions(ctx)...)
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return sigRef, nil, nil
+	} else if err != nil {
+		return sigRef, nil, fmt.Errorf("failed looking up the signature %s: %w", sigRef, err)
+	}
+	return sigRef, img, nil
+}
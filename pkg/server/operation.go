@@ -0,0 +1,138 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/elemental/pkg/lifecycle"
+)
+
+const (
+	// StateRunning is the state of an operation which did not finish yet
+	StateRunning = "running"
+	// StateSucceeded is the state of an operation which finished successfully
+	StateSucceeded = "succeeded"
+	// StateFailed is the state of an operation which finished with an error
+	StateFailed = "failed"
+)
+
+// Operation describes an operation run by the server
+type Operation struct {
+	ID       string            `json:"id"`
+	Action   string            `json:"action"`
+	State    string            `json:"state"`
+	Started  time.Time         `json:"started"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Result   *lifecycle.Result `json:"result,omitempty"`
+}
+
+// operation is a running or finished operation and its log, it is safe for concurrent use
+type operation struct {
+	mu      sync.Mutex
+	info    Operation
+	lines   []string
+	partial []byte
+	updated chan struct{}
+	cancel  context.CancelFunc
+}
+
+func newOperation(id, action string, cancel context.CancelFunc) *operation {
+	return &operation{
+		info:    Operation{ID: id, Action: action, State: StateRunning, Started: time.Now().UTC()},
+		updated: make(chan struct{}),
+		cancel:  cancel,
+	}
+}
+
+// Write appends the given data to the operation log, so it can be used as the
+// output of a logger. Lines are only visible once complete.
+func (o *operation) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	data := append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		o.lines = append(o.lines, string(data[:i]))
+		data = data[i+1:]
+	}
+	o.partial = append([]byte{}, data...)
+	o.notify()
+	return len(p), nil
+}
+
+// finish sets the outcome of the operation
+func (o *operation) finish(result *lifecycle.Result, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.partial) > 0 {
+		o.lines = append(o.lines, string(o.partial))
+		o.partial = nil
+	}
+	finished := time.Now().UTC()
+	o.info.Finished = &finished
+	o.info.Result = result
+	if err != nil {
+		o.info.State = StateFailed
+		o.info.Error = err.Error()
+	} else {
+		o.info.State = StateSucceeded
+	}
+	o.notify()
+}
+
+// notify wakes up the log readers, it must be called with the lock held
+func (o *operation) notify() {
+	close(o.updated)
+	o.updated = make(chan struct{})
+}
+
+// Info returns the current description of the operation
+func (o *operation) Info() Operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.info
+}
+
+// done checks if the operation finished
+func (o *operation) done() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.info.Finished != nil
+}
+
+// logFrom returns the log lines from the given index, whether the operation finished
+// and a channel closed on the next update of the operation
+func (o *operation) logFrom(index int) ([]string, bool, <-chan struct{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var lines []string
+	if index < len(o.lines) {
+		lines = append(lines, o.lines[index:]...)
+	}
+	return lines, o.info.Finished != nil, o.updated
+}
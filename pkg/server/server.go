@@ -0,0 +1,510 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package server implements the daemon run by 'elemental serve'. It runs lifecycle
+// operations requested through an HTTP/JSON API, usually served on a Unix socket.
+// Operations run asynchronously, one at a time, and their log can be streamed while
+// they run.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/elemental/internal/version"
+	conf "github.com/rancher-sandbox/elemental/pkg/config"
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/history"
+	"github.com/rancher-sandbox/elemental/pkg/lifecycle"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	"github.com/rancher-sandbox/elemental/pkg/utils"
+)
+
+const (
+	// maxOperations is the number of operations kept, older finished ones are dropped
+	maxOperations = 20
+	// scheduleResetAction is the action name of operations scheduling a reset
+	scheduleResetAction = "schedule-reset"
+	// shutdownTimeout is the time given to clients to disconnect once the server stops
+	shutdownTimeout = 5 * time.Second
+)
+
+var errBusy = errors.New("another operation is running")
+
+// Status describes the system and the running operation, if any
+type Status struct {
+	Version   string     `json:"version"`
+	Booted    string     `json:"booted,omitempty"`
+	Operation *Operation `json:"operation,omitempty"`
+}
+
+// UpgradeRequest are the parameters of an upgrade operation. If no source is given the
+// source of the system configuration is used. Any other setting always comes from the
+// system configuration.
+type UpgradeRequest struct {
+	DockerImage  string `json:"docker-image,omitempty"`
+	Directory    string `json:"directory,omitempty"`
+	ChannelImage string `json:"channel-image,omitempty"`
+	Recovery     bool   `json:"recovery,omitempty"`
+	Reboot       bool   `json:"reboot,omitempty"`
+	PowerOff     bool   `json:"poweroff,omitempty"`
+}
+
+// RollbackRequest are the parameters of a rollback operation
+type RollbackRequest struct {
+	Reboot bool `json:"reboot,omitempty"`
+}
+
+// ResetRequest are the parameters of a reset scheduling operation
+type ResetRequest struct {
+	ResetPersistent bool `json:"reset-persistent,omitempty"`
+	Reboot          bool `json:"reboot,omitempty"`
+}
+
+// Server runs the lifecycle operations requested through its API
+type Server struct {
+	config    *v1.RunConfig
+	runtime   []conf.GenericOptions
+	logOutput io.Writer
+
+	mu         sync.Mutex
+	wg         sync.WaitGroup
+	lastID     int
+	current    *operation
+	operations map[string]*operation
+	order      []string
+}
+
+// Option configures a Server
+type Option func(s *Server)
+
+// WithRuntime sets the runtime dependencies of the operations, the logger is
+// always the operation one
+func WithRuntime(opts ...conf.GenericOptions) Option {
+	return func(s *Server) {
+		s.runtime = append(s.runtime, opts...)
+	}
+}
+
+// WithLogOutput sets where the log of the operations is copied to, besides their own log
+func WithLogOutput(w io.Writer) Option {
+	return func(s *Server) {
+		s.logOutput = w
+	}
+}
+
+// New returns a Server using the given configuration as the system configuration.
+// Operations are cancelled once config.Context is done.
+func New(config *v1.RunConfig, opts ...Option) *Server {
+	s := &Server{
+		config:     config,
+		logOutput:  ioutil.Discard,
+		operations: map[string]*operation{},
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Listen listens on the given Unix socket, only accessible by the owner. A socket left
+// by a previous server is replaced, it fails if there is a server listening on it.
+func Listen(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve serves the API on the given listener until config.Context is done, then it
+// waits for the running operation to be cancelled. If booted from the recovery system
+// a scheduled reset is started right away.
+func (s *Server) Serve(l net.Listener) error {
+	ctx := s.config.Context
+	srv := &http.Server{Handler: s.Handler()}
+
+	if utils.BootedSlot(s.config) == cnst.RecoveryImgName {
+		s.startPendingReset()
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	s.config.Logger.Infof("Serving on %s", l.Addr())
+	err := srv.Serve(l)
+	s.wg.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Handler returns the handler of the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", s.handleStatus)
+	mux.HandleFunc("/v1/history", s.handleHistory)
+	mux.HandleFunc("/v1/upgrade", s.handleUpgrade)
+	mux.HandleFunc("/v1/rollback", s.handleRollback)
+	mux.HandleFunc("/v1/reset", s.handleReset)
+	mux.HandleFunc("/v1/operations", s.handleOperations)
+	mux.HandleFunc("/v1/operations/", s.handleOperation)
+	return mux
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := Status{Version: version.Get().Version, Booted: utils.BootedSlot(s.config)}
+	s.mu.Lock()
+	if s.current != nil && !s.current.done() {
+		info := s.current.Info()
+		status.Operation = &info
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	entries, err := history.Read(s.config)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (s *Server) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	req := UpgradeRequest{}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	op, err := s.start(cnst.ActionUpgrade, s.upgradeConfig(req), func(ctx context.Context, opts []lifecycle.Option) (*lifecycle.Result, error) {
+		return lifecycle.Upgrade(ctx, append(opts, upgradeOptions(req)...)...)
+	})
+	s.respond(w, op, err)
+}
+
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	req := RollbackRequest{}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	op, err := s.start(cnst.ActionRollback, s.config, func(ctx context.Context, opts []lifecycle.Option) (*lifecycle.Result, error) {
+		if req.Reboot {
+			opts = append(opts, lifecycle.WithReboot())
+		}
+		return lifecycle.Rollback(ctx, opts...)
+	})
+	s.respond(w, op, err)
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	req := ResetRequest{}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	op, err := s.start(scheduleResetAction, s.config, func(ctx context.Context, opts []lifecycle.Option) (*lifecycle.Result, error) {
+		if req.ResetPersistent {
+			opts = append(opts, lifecycle.WithResetPersistent())
+		}
+		if req.Reboot {
+			opts = append(opts, lifecycle.WithReboot())
+		}
+		return lifecycle.ScheduleReset(ctx, opts...)
+	})
+	s.respond(w, op, err)
+}
+
+func (s *Server) handleOperations(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	s.mu.Lock()
+	ops := []Operation{}
+	for _, id := range s.order {
+		ops = append(ops, s.operations[id].Info())
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, ops)
+}
+
+// handleOperation serves /v1/operations/<id>, /v1/operations/<id>/log and /v1/operations/<id>/cancel
+func (s *Server) handleOperation(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/operations/"), "/")
+	s.mu.Lock()
+	op, ok := s.operations[parts[0]]
+	s.mu.Unlock()
+	if !ok || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("operation %s not found", parts[0]))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, op.Info())
+		}
+	case parts[1] == "log":
+		if allowMethod(w, r, http.MethodGet) {
+			streamLog(w, r, op)
+		}
+	case parts[1] == "cancel":
+		if allowMethod(w, r, http.MethodPost) {
+			op.cancel()
+			writeJSON(w, http.StatusAccepted, op.Info())
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+	}
+}
+
+// startPendingReset starts an operation running the scheduled reset, if any
+func (s *Server) startPendingReset() {
+	schedule, err := lifecycle.PendingReset(s.config.Context, s.options(s.config.Logger, s.config)...)
+	if err != nil {
+		s.config.Logger.Warnf("Could not check for a scheduled reset: %s", err)
+		return
+	}
+	if schedule == nil {
+		return
+	}
+	s.config.Logger.Infof("Running the reset scheduled on %s", schedule.Scheduled.Format(time.RFC3339))
+	_, err = s.start(cnst.ActionReset, s.config, func(ctx context.Context, opts []lifecycle.Option) (*lifecycle.Result, error) {
+		return lifecycle.RunPendingReset(ctx, opts...)
+	})
+	if err != nil {
+		s.config.Logger.Errorf("Could not start the scheduled reset: %s", err)
+	}
+}
+
+// start runs fn in the background as a new operation of the given action, with the options
+// setting the given system configuration. It fails if another operation is running.
+func (s *Server) start(action string, config *v1.RunConfig, fn func(context.Context, []lifecycle.Option) (*lifecycle.Result, error)) (*operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && !s.current.done() {
+		return nil, errBusy
+	}
+
+	s.lastID++
+	ctx, cancel := context.WithCancel(s.config.Context)
+	op := newOperation(strconv.Itoa(s.lastID), action, cancel)
+	s.operations[op.info.ID] = op
+	s.order = append(s.order, op.info.ID)
+	s.current = op
+	s.prune()
+
+	logger := v1.NewLogger()
+	logger.SetLevel(s.config.Logger.GetLevel())
+	logger.SetOutput(io.MultiWriter(op, s.logOutput))
+	opts := s.options(logger, config)
+
+	s.config.Logger.Infof("Starting %s operation %s", action, op.info.ID)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		result, err := fn(ctx, opts)
+		op.finish(result, err)
+		if err != nil {
+			s.config.Logger.Errorf("Operation %s failed: %s", op.info.ID, err)
+		} else {
+			s.config.Logger.Infof("Operation %s succeeded", op.info.ID)
+		}
+	}()
+	return op, nil
+}
+
+// prune drops the oldest finished operations beyond maxOperations, it must be called
+// with the lock held
+func (s *Server) prune() {
+	for i := 0; len(s.order) > maxOperations && i < len(s.order); {
+		id := s.order[i]
+		if !s.operations[id].done() {
+			i++
+			continue
+		}
+		delete(s.operations, id)
+		s.order = append(s.order[:i], s.order[i+1:]...)
+	}
+}
+
+// options returns the lifecycle options setting the runtime and the given configuration
+func (s *Server) options(logger v1.Logger, config *v1.RunConfig) []lifecycle.Option {
+	runtime := append([]conf.GenericOptions{}, s.runtime...)
+	return []lifecycle.Option{
+		lifecycle.WithRuntime(append(runtime, conf.WithLogger(logger))...),
+		lifecycle.WithConfig(config),
+	}
+}
+
+// upgradeConfig returns the system configuration for the given upgrade request. Sources
+// given in the request replace the ones of the system configuration, channel upgrades
+// included, as the upgrade command does with its flags.
+func (s *Server) upgradeConfig(req UpgradeRequest) *v1.RunConfig {
+	if req.DockerImage == "" && req.Directory == "" && req.ChannelImage == "" {
+		return s.config
+	}
+	cfg := *s.config
+	cfg.ChannelUpgrades = false
+	cfg.DockerImg = ""
+	cfg.Directory = ""
+	return &cfg
+}
+
+// upgradeOptions returns the lifecycle options of the given upgrade request
+func upgradeOptions(req UpgradeRequest) []lifecycle.Option {
+	var opts []lifecycle.Option
+
+	if req.DockerImage != "" {
+		opts = append(opts, lifecycle.WithDockerImage(req.DockerImage))
+	}
+	if req.Directory != "" {
+		opts = append(opts, lifecycle.WithDirectory(req.Directory))
+	}
+	if req.ChannelImage != "" {
+		opts = append(opts, lifecycle.WithChannelImage(req.ChannelImage))
+	}
+	if req.Recovery {
+		opts = append(opts, lifecycle.WithRecovery())
+	}
+	if req.Reboot {
+		opts = append(opts, lifecycle.WithReboot())
+	}
+	if req.PowerOff {
+		opts = append(opts, lifecycle.WithPowerOff())
+	}
+	return opts
+}
+
+// respond writes the operation started by start, or the error if it did not start
+func (s *Server) respond(w http.ResponseWriter, op *operation, err error) {
+	if errors.Is(err, errBusy) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v1/operations/%s", op.info.ID))
+	writeJSON(w, http.StatusAccepted, op.Info())
+}
+
+// streamLog writes the log of the operation as it is written until it finishes
+func streamLog(w http.ResponseWriter, r *http.Request, op *operation) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	index := 0
+	for {
+		lines, done, updated := op.logFrom(index)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		index += len(lines)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// allowMethod checks the request uses the given method, otherwise it writes an error
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+// readJSON decodes the request body into v, an empty body keeps v as is
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
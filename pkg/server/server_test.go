@@ -0,0 +1,188 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	conf "github.com/rancher-sandbox/elemental/pkg/config"
+	"github.com/rancher-sandbox/elemental/pkg/constants"
+	"github.com/rancher-sandbox/elemental/pkg/server"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+	v1mock "github.com/rancher-sandbox/elemental/tests/mocks"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Server", Label("server"), func() {
+	var runner *v1mock.FakeRunner
+	var srv *httptest.Server
+	var cleanup func()
+	var release chan struct{}
+	var system *v1.RunConfig
+
+	post := func(path, body string) (*http.Response, map[string]interface{}) {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		data := map[string]interface{}{}
+		Expect(json.NewDecoder(resp.Body).Decode(&data)).To(Succeed())
+		return resp, data
+	}
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(srv.URL + path)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp, string(data)
+	}
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		release = make(chan struct{})
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			if command == "cat" && args[0] == "/proc/cmdline" {
+				return []byte(constants.ActiveLabel), nil
+			}
+			if command == "udevadm" {
+				// Hold operations until released by the test
+				<-release
+			}
+			return []byte{}, nil
+		}
+		fs, fsCleanup, err := vfst.NewTestFS(map[string]interface{}{"/tmp": &vfst.Dir{Perm: 0777}})
+		Expect(err).ToNot(HaveOccurred())
+		runtime := []conf.GenericOptions{
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(v1.NewNullLogger()),
+			conf.WithMounter(v1mock.NewErrorMounter()),
+			conf.WithSyscall(&v1mock.FakeSyscall{}),
+			conf.WithCloudInitRunner(&v1mock.FakeCloudInitRunner{}),
+		}
+		// The system configuration gets its own runner as operations run concurrently
+		system = conf.NewRunConfig(append(runtime, conf.WithRunner(&v1mock.FakeRunner{SideEffect: runner.SideEffect}))...)
+		srv = httptest.NewServer(server.New(system, server.WithRuntime(runtime...)).Handler())
+		cleanup = func() {
+			srv.Close()
+			fsCleanup()
+		}
+	})
+	AfterEach(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+		cleanup()
+	})
+
+	It("Reports the status of the system", func() {
+		resp, body := get("/v1/status")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		status := server.Status{}
+		Expect(json.Unmarshal([]byte(body), &status)).To(Succeed())
+		Expect(status.Booted).To(Equal(constants.ActiveImgName))
+		Expect(status.Operation).To(BeNil())
+	})
+	It("Rejects invalid requests", func() {
+		resp, _ := get("/v1/upgrade")
+		Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+		resp, data := post("/v1/upgrade", `{"image": "alpine"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(data["error"]).To(ContainSubstring("unknown field"))
+		resp, _ = get("/v1/operations/42")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		resp, data = post("/v1/rollback", `{"recovery": true}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(data["error"]).To(ContainSubstring("unknown field"))
+	})
+	It("Runs rollbacks as operations", func() {
+		resp, data := post("/v1/rollback", `{"reboot": true}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		Expect(data["action"]).To(Equal(constants.ActionRollback))
+		Expect(data["state"]).To(Equal(server.StateRunning))
+		close(release)
+
+		get("/v1/operations/1/log")
+		op := server.Operation{}
+		_, body := get("/v1/operations/1")
+		Expect(json.Unmarshal([]byte(body), &op)).To(Succeed())
+		// There is no state partition to roll back
+		Expect(op.State).To(Equal(server.StateFailed))
+		Expect(op.Error).To(ContainSubstring("rollback failed"))
+		Expect(runner.IncludesCmds([][]string{{"reboot"}})).NotTo(Succeed())
+	})
+	It("Runs one operation at a time and streams its log", func() {
+		resp, data := post("/v1/upgrade", `{"docker-image": "alpine"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		Expect(resp.Header.Get("Location")).To(Equal("/v1/operations/1"))
+		Expect(data["state"]).To(Equal(server.StateRunning))
+
+		resp, _ = post("/v1/reset", `{"reset-persistent": true}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+		_, body := get("/v1/status")
+		Expect(body).To(ContainSubstring(`"action":"upgrade"`))
+
+		close(release)
+		_, log := get("/v1/operations/1/log")
+		Expect(log).To(ContainSubstring("Could not find device for COS_RECOVERY label"))
+
+		op := server.Operation{}
+		_, body = get("/v1/operations/1")
+		Expect(json.Unmarshal([]byte(body), &op)).To(Succeed())
+		Expect(op.State).To(Equal(server.StateFailed))
+		Expect(op.Error).To(ContainSubstring("upgrade failed"))
+		Expect(op.Finished).ToNot(BeNil())
+	})
+	It("Runs operations with the system configuration", func() {
+		system.ChannelUpgrades = true
+		system.UpgradeImage = "system/cos"
+		system.RecoveryLabel = "CUSTOM_RECOVERY"
+		resp, _ := post("/v1/upgrade", `{"docker-image": "alpine"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		close(release)
+
+		_, log := get("/v1/operations/1/log")
+		// The requested image replaces the channel upgrades of the system configuration
+		Expect(log).To(ContainSubstring("Could not find device for CUSTOM_RECOVERY label"))
+		op := server.Operation{}
+		_, body := get("/v1/operations/1")
+		Expect(json.Unmarshal([]byte(body), &op)).To(Succeed())
+		Expect(op.Error).NotTo(ContainSubstring("can't be combined"))
+	})
+	It("Cancels running operations", func() {
+		resp, _ := post("/v1/upgrade", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		resp, _ = post("/v1/operations/1/cancel", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		close(release)
+
+		get("/v1/operations/1/log")
+		op := server.Operation{}
+		_, body := get("/v1/operations/1")
+		Expect(json.Unmarshal([]byte(body), &op)).To(Succeed())
+		Expect(op.State).To(Equal(server.StateFailed))
+		Expect(op.Error).To(ContainSubstring("context canceled"))
+	})
+})
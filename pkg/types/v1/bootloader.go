@@ -0,0 +1,38 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+// BootEntry represents an entry of the boot menu
+type BootEntry struct {
+	ID      string
+	Title   string
+	Default bool
+}
+
+// Bootloader is the interface implemented by the supported boot loaders
+type Bootloader interface {
+	// Install installs the boot loader and its configuration for the configured images
+	Install() error
+	// SetDefaultEntry sets the entry booted by default
+	SetDefaultEntry(entry string) error
+	// SetOneShotEntry sets the entry to boot only on next boot
+	SetOneShotEntry(entry string) error
+	// SetKernelArgs sets extra kernel arguments for the given entry, all entries if empty
+	SetKernelArgs(entry string, args string) error
+	// ListEntries lists the entries of the boot menu
+	ListEntries() ([]BootEntry, error)
+}
@@ -17,10 +17,30 @@ limitations under the License.
 package v1
 
 import (
+	"time"
+
 	"github.com/mudler/yip/pkg/schema"
 )
 
 type CloudInitRunner interface {
 	Run(string, ...string) error
 	SetModifier(schema.Modifier)
+	// Steps returns the steps the given stage runs from the given sources, in order
+	Steps(string, ...string) []CloudInitStep
+	// Results returns the outcome of all the steps run so far, in order
+	Results() []CloudInitStepResult
+}
+
+// CloudInitStep is a step of a cloud-init stage and the source it is defined in
+type CloudInitStep struct {
+	Source string `json:"source"`
+	Stage  string `json:"stage"`
+	Name   string `json:"name"`
+}
+
+// CloudInitStepResult is the outcome of running a cloud-init step
+type CloudInitStepResult struct {
+	CloudInitStep
+	Duration time.Duration `json:"duration"`
+	Error    error         `json:"-"`
 }
@@ -23,6 +23,8 @@ type ImageSource struct {
 	isChannel bool
 	isDocker  bool
 	isFile    bool
+	digest    string
+	version   string
 }
 
 func (i ImageSource) Value() string {
@@ -45,6 +47,26 @@ func (i ImageSource) IsFile() bool {
 	return i.isFile
 }
 
+// GetDigest returns the digest of the source, if known. It is only set
+// for docker sources once they have been pulled.
+func (i ImageSource) GetDigest() string {
+	return i.digest
+}
+
+func (i *ImageSource) SetDigest(digest string) {
+	i.digest = digest
+}
+
+// GetVersion returns the version of the package installed from the source, if
+// known. It is only set for channel sources once they have been unpacked.
+func (i ImageSource) GetVersion() string {
+	return i.version
+}
+
+func (i *ImageSource) SetVersion(version string) {
+	i.version = version
+}
+
 func NewEmptySrc() ImageSource {
 	return ImageSource{}
 }
@@ -17,6 +17,8 @@ limitations under the License.
 package v1
 
 import (
+	"context"
+
 	"github.com/rancher-sandbox/elemental/pkg/constants"
 	"k8s.io/mount-utils"
 )
@@ -27,6 +29,7 @@ const (
 	BIOS  = "bios_grub"
 	MSDOS = "msdos"
 	BOOT  = "boot"
+	LVM   = "lvm"
 )
 
 // Config is the struct that includes basic and generic configuration of elemental binary runtime.
@@ -40,6 +43,24 @@ type Config struct {
 	CloudInitRunner CloudInitRunner
 	Luet            LuetInterface
 	Client          HTTPClient
+	Registry        Registry
+	// Platform of the container images to pull, nil pulls the images for the
+	// host platform without checking the unpacked architecture
+	Platform *Platform
+
+	// Context of the running command, cancelling it kills the running commands and
+	// aborts downloads and image unpacking
+	Context context.Context
+}
+
+// SetContext sets the context of the runtime and of the runner, a nil context is
+// replaced by an empty one
+func (c *Config) SetContext(ctx context.Context) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	c.Context = ctx
+	c.Runner.SetContext(ctx)
 }
 
 // RunConfig is the struct that represents the full configuration needed for install, upgrade, reset, rebrand.
@@ -57,6 +78,8 @@ type RunConfig struct {
 	Source          string `yaml:"source,omitempty" mapstructure:"source"`
 	CloudInit       string `yaml:"cloud-init,omitempty" mapstructure:"cloud-init"`
 	ForceEfi        bool   `yaml:"force-efi,omitempty" mapstructure:"force-efi"`
+	SecureBoot      bool   `yaml:"secure-boot,omitempty" mapstructure:"secure-boot"`
+	Bootloader      string `yaml:"bootloader,omitempty" mapstructure:"bootloader"`
 	ForceGpt        bool   `yaml:"force-gpt,omitempty" mapstructure:"force-gpt"`
 	PartLayout      string `yaml:"partition-layout,omitempty" mapstructure:"partition-layout"`
 	Tty             string `yaml:"tty,omitempty" mapstructure:"tty"`
@@ -76,10 +99,28 @@ type RunConfig struct {
 	UpgradeImage    string `yaml:"UPGRADE_IMAGE,omitempty" mapstructure:"UPGRADE_IMAGE"`
 	RecoveryImage   string `yaml:"RECOVERY_IMAGE,omitempty" mapstructure:"RECOVERY_IMAGE"`
 	RecoveryUpgrade bool   // configured only via flag, no need to map it to any config
+	Resume          bool   // configured only via flag, resumes an interrupted install
 	ImgSize         uint   `yaml:"DEFAULT_IMAGE_SIZE,omitempty" mapstructure:"DEFAULT_IMAGE_SIZE"`
 	Directory       string `yaml:"directory,omitempty" mapstructure:"directory"`
 	ResetPersistent bool   `yaml:"reset-persistent,omitempty" mapstructure:"reset-persistent"`
 	EjectCD         bool   `yaml:"eject-cd,omitempty" mapstructure:"eject-cd"`
+	HookTimeout     uint   `yaml:"hook-timeout,omitempty" mapstructure:"hook-timeout"`
+	LockWait        uint   `yaml:"wait,omitempty" mapstructure:"wait"`
+	// Per hook timeouts in seconds, overrides HookTimeout for the given hook names
+	HookTimeouts map[string]uint `yaml:"hook-timeouts,omitempty" mapstructure:"hook-timeouts"`
+
+	// Boot configuration values used to render grub.cfg templates and boot entries
+	KernelArgs      string            `yaml:"kernel-args,omitempty" mapstructure:"kernel-args"`
+	Consoles        []string          `yaml:"consoles,omitempty" mapstructure:"consoles"`
+	GrubSerial      string            `yaml:"grub-serial,omitempty" mapstructure:"grub-serial"`
+	GrubTimeout     uint              `yaml:"grub-timeout,omitempty" mapstructure:"grub-timeout"`
+	BootEntryTitles map[string]string `yaml:"boot-entry-titles,omitempty" mapstructure:"boot-entry-titles"`
+
+	// LVM setup, the persistent partition and optionally the state partition are
+	// created as logical volumes of the given volume group
+	LVM            bool   `yaml:"lvm,omitempty" mapstructure:"lvm"`
+	LVMVolumeGroup string `yaml:"lvm-volume-group,omitempty" mapstructure:"lvm-volume-group"`
+	LVMState       bool   `yaml:"lvm-state,omitempty" mapstructure:"lvm-state"`
 	// Internally used to track stuff around
 	PartTable  string
 	BootFlag   string
@@ -100,6 +141,9 @@ type Partition struct {
 	MountPoint string
 	Path       string
 	Disk       string
+
+	// Volume group the partition is created in as a logical volume, empty for regular partitions
+	VolumeGroup string
 }
 
 type PartitionList []*Partition
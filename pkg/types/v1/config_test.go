@@ -85,4 +85,22 @@ var _ = Describe("Types", Label("types", "config"), func() {
 		})
 	})
 
+	Describe("Platform", func() {
+		It("Parses platforms", func() {
+			p, err := v1.NewPlatform("linux/arm/v7")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*p).To(Equal(v1.Platform{OS: "linux", Arch: "arm", Variant: "v7"}))
+			Expect(p.String()).To(Equal("linux/arm/v7"))
+
+			p, err = v1.NewPlatform("aarch64")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.String()).To(Equal("linux/arm64"))
+		})
+		It("Fails on invalid platforms", func() {
+			for _, platform := range []string{"", "linux/", "/amd64", "linux/arm/v7/extra"} {
+				_, err := v1.NewPlatform(platform)
+				Expect(err).To(HaveOccurred(), platform)
+			}
+		})
+	})
 })
@@ -16,6 +16,8 @@ limitations under the License.
 
 package v1
 
+import "context"
+
 type HTTPClient interface {
-	GetURL(log Logger, url string, destination string) error
+	GetURL(ctx context.Context, log Logger, url string, destination string) error
 }
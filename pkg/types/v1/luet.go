@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	gocontext "context"
 	"runtime"
 	"strings"
 
@@ -33,8 +34,9 @@ import (
 )
 
 type LuetInterface interface {
-	Unpack(string, string, bool) error
-	UnpackFromChannel(string, string) error
+	Unpack(string, string, bool) (*DockerImageMeta, error)
+	UnpackFromChannel(string, string) (*PackageMeta, error)
+	ChannelVersion(string) (string, error)
 }
 
 type Luet struct {
@@ -44,6 +46,21 @@ type Luet struct {
 	fs                FS
 	plugins           []string
 	VerifyImageUnpack bool
+
+	// Unpacking is not started once the context is done and an ongoing unpack
+	// is abandoned, see interruptible
+	ctx gocontext.Context
+}
+
+// DockerImageMeta represents the metadata of an unpacked docker image
+type DockerImageMeta struct {
+	Digest string
+	Size   int64
+}
+
+// PackageMeta represents the metadata of a package installed from the release channel
+type PackageMeta struct {
+	Version string
 }
 
 type LuetOptions func(l *Luet) error
@@ -81,6 +98,13 @@ func WithLuetLogger(log Logger) func(r *Luet) error {
 	}
 }
 
+func WithLuetContext(ctx gocontext.Context) func(r *Luet) error {
+	return func(l *Luet) error {
+		l.ctx = ctx
+		return nil
+	}
+}
+
 func WithLuetFs(fs FS) func(r *Luet) error {
 	return func(l *Luet) error {
 		l.fs = fs
@@ -116,6 +140,10 @@ func NewLuet(opts ...LuetOptions) *Luet {
 		luet.auth = &dockTypes.AuthConfig{}
 	}
 
+	if luet.ctx == nil {
+		luet.ctx = gocontext.Background()
+	}
+
 	if len(luet.plugins) > 0 {
 		bus.Manager.Initialize(luet.context, luet.plugins...)
 		luet.log.Infof("Enabled plugins:")
@@ -127,33 +155,110 @@ func NewLuet(opts ...LuetOptions) *Luet {
 	return luet
 }
 
-func (l Luet) Unpack(target string, image string, local bool) error {
+func (l Luet) Unpack(target string, image string, local bool) (*DockerImageMeta, error) {
 	l.log.Infof("Unpacking docker image: %s", image)
-	if !local {
-		info, err := docker.DownloadAndExtractDockerImage(l.context, image, target, l.auth, l.VerifyImageUnpack)
-		if err != nil {
-			return err
+	var meta *DockerImageMeta
+	err := l.interruptible(func() error {
+		if !local {
+			info, err := docker.DownloadAndExtractDockerImage(l.context, image, target, l.auth, l.VerifyImageUnpack)
+			if err != nil {
+				return err
+			}
+			l.log.Infof("Pulled: %s %s", info.Target.Digest, info.Name)
+			l.log.Infof("Size: %s", units.BytesSize(float64(info.Target.Size)))
+			meta = &DockerImageMeta{Digest: info.Target.Digest.String(), Size: info.Target.Size}
+			return nil
 		}
-		l.log.Infof("Pulled: %s %s", info.Target.Digest, info.Name)
-		l.log.Infof("Size: %s", units.BytesSize(float64(info.Target.Size)))
-	} else {
 		info, err := docker.ExtractDockerImage(l.context, image, target)
 		if err != nil {
 			return err
 		}
 		l.log.Infof("Size: %s", units.BytesSize(float64(info.Target.Size)))
+		meta = &DockerImageMeta{Digest: info.Target.Digest.String(), Size: info.Target.Size}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return meta, nil
 }
 
 // UnpackFromChannel unpacks/installs a package from the release channel into the target dir by leveraging the
 // luet install action to install to a local dir
-func (l Luet) UnpackFromChannel(target string, pkg string) error {
-	var toInstall luetTypes.Packages
-	toInstall = append(toInstall, l.parsePackage(pkg))
+func (l Luet) UnpackFromChannel(target string, pkg string) (*PackageMeta, error) {
+	toInstall := l.parsePackage(pkg)
 	l.log.Debugf("Luet config: %+v", l.context.Config)
 
-	inst := installer.NewLuetInstaller(installer.LuetInstallerOptions{
+	var meta *PackageMeta
+	err := l.interruptible(func() error {
+		inst := l.newInstaller()
+		system := &installer.System{
+			Database: database.NewInMemoryDatabase(false),
+			Target:   target,
+		}
+		_, err := inst.SyncRepositories()
+		if err != nil {
+			return err
+		}
+		err = inst.Install(luetTypes.Packages{toInstall}, system)
+		if err != nil {
+			return err
+		}
+		installed, err := system.Database.FindPackageCandidate(toInstall)
+		if err != nil {
+			return err
+		}
+		meta = &PackageMeta{Version: installed.Version}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// interruptible runs fn in background and waits until it returns or the context is
+// done. Luet has no support for cancelling a pull or an install, so once the context
+// is done fn is abandoned and the context error is returned right away, leaving the
+// partially unpacked target to the cleanup of the caller.
+func (l Luet) interruptible(fn func() error) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-l.ctx.Done():
+		l.log.Warnf("Unpacking interrupted: %s", l.ctx.Err())
+		return l.ctx.Err()
+	}
+}
+
+// ChannelVersion returns the version of the given package the release channel provides
+func (l Luet) ChannelVersion(pkg string) (string, error) {
+	if err := l.ctx.Err(); err != nil {
+		return "", err
+	}
+	repos, err := l.newInstaller().SyncRepositories()
+	if err != nil {
+		return "", err
+	}
+	db := database.NewInMemoryDatabase(false)
+	repos.SyncDatabase(db)
+	candidate, err := db.FindPackageCandidate(l.parsePackage(pkg))
+	if err != nil {
+		return "", err
+	}
+	return candidate.Version, nil
+}
+
+// newInstaller returns a luet installer for the configured repositories
+func (l Luet) newInstaller() *installer.LuetInstaller {
+	return installer.NewLuetInstaller(installer.LuetInstallerOptions{
 		Concurrency:                 l.context.Config.General.Concurrency,
 		SolverOptions:               l.context.Config.Solver,
 		NoDeps:                      false,
@@ -166,16 +271,6 @@ func (l Luet) UnpackFromChannel(target string, pkg string) error {
 		PackageRepositories:         l.context.Config.SystemRepositories,
 		Context:                     l.context,
 	})
-	system := &installer.System{
-		Database: database.NewInMemoryDatabase(false),
-		Target:   target,
-	}
-	_, err := inst.SyncRepositories()
-	if err != nil {
-		return err
-	}
-	err = inst.Install(toInstall, system)
-	return err
 }
 
 func (l Luet) parsePackage(p string) *luetTypes.Package {
@@ -60,7 +60,19 @@ var _ = Describe("Types", Label("luet", "types"), func() {
 	Describe("Luet", func() {
 		It("Fails to unpack without root privileges", Label("unpack"), func() {
 			image := "quay.io/costoolkit/releases-green:cloud-config-system-0.11-1"
-			Expect(luet.Unpack(target, image, false)).NotTo(BeNil())
+			_, err := luet.Unpack(target, image, false)
+			Expect(err).NotTo(BeNil())
+		})
+		It("Does not unpack once the context is done", Label("unpack"), func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			luet = v1.NewLuet(v1.WithLuetLogger(v1.NewNullLogger()), v1.WithLuetContext(ctx))
+			_, err := luet.Unpack(target, "docker.io/library/alpine", true)
+			Expect(err).To(MatchError(context.Canceled))
+			_, err = luet.UnpackFromChannel(target, "system/cos")
+			Expect(err).To(MatchError(context.Canceled))
+			_, err = luet.ChannelVersion("system/cos")
+			Expect(err).To(MatchError(context.Canceled))
 		})
 		It("Check that luet can unpack the local image", Label("unpack", "root"), func() {
 			image := "docker.io/library/alpine"
@@ -72,7 +84,8 @@ var _ = Describe("Types", Label("luet", "types"), func() {
 			defer reader.Close()
 			_, _ = io.Copy(ioutil.Discard, reader)
 			// Check that luet can unpack the local image
-			Expect(luet.Unpack(target, image, true)).To(BeNil())
+			_, err = luet.Unpack(target, image, true)
+			Expect(err).To(BeNil())
 		})
 		Describe("Luet config", Label("config"), func() {
 			It("Create empty config if there is no luet.yaml", func() {
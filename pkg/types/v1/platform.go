@@ -0,0 +1,74 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Platform is the OS, architecture and optional variant of a container image, as in
+// linux/arm64 or linux/arm/v7. Architectures use the golang naming.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// NewPlatform parses a platform in the OS/ARCH[/VARIANT] format. The OS can be
+// omitted and defaults to linux, uname architecture names such as x86_64 or
+// aarch64 are also accepted.
+func NewPlatform(platform string) (*Platform, error) {
+	parts := strings.Split(strings.TrimSpace(platform), "/")
+	if len(parts) == 1 {
+		parts = append([]string{"linux"}, parts...)
+	}
+	if len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, expected OS/ARCH[/VARIANT]", platform)
+	}
+	p := &Platform{OS: parts[0], Arch: GolangArch(parts[1])}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// NewHostPlatform returns the platform elemental is running on
+func NewHostPlatform() *Platform {
+	return &Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Arch, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Arch)
+}
+
+// GolangArch returns the golang name of the given uname architecture name, as used
+// by container images. Unknown names are returned as is.
+func GolangArch(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	default:
+		return arch
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+
+	dockTypes "github.com/docker/docker/api/types"
+)
+
+// Registry is the interface to query container image registries
+type Registry interface {
+	// Digest returns the digest of the manifest the given image reference points to
+	// without pulling the image
+	Digest(ctx context.Context, ref string) (string, error)
+	// Labels returns the labels of the image configuration of the given image reference
+	Labels(ctx context.Context, ref string) (map[string]string, error)
+	// ResolvePlatform returns a reference by digest to the image for the given
+	// platform. Multi-arch indexes are looked up for a matching manifest, single
+	// images must match the platform.
+	ResolvePlatform(ctx context.Context, ref string, platform Platform) (string, error)
+	// Auth returns the credentials for the registry of the given image reference
+	Auth(ref string) (*dockTypes.AuthConfig, error)
+	// Save writes the given image reference and its signature, if any, to dst in the
+	// given format, see the PullFormat constants
+	Save(ctx context.Context, ref string, dst string, format string, platform *Platform) (*SavedImage, error)
+}
+
+// SavedImage describes an image written to an OCI layout or a tarball
+type SavedImage struct {
+	// Digest of the saved manifest or index
+	Digest string
+	// Signature is the reference of the cosign signature saved with the image, if any
+	Signature string
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	"context"
 	"os/exec"
 	"strings"
 )
@@ -27,13 +28,21 @@ type Runner interface {
 	RunCmd(cmd *exec.Cmd) ([]byte, error)
 	GetLogger() Logger
 	SetLogger(logger Logger)
+	SetContext(ctx context.Context)
+	WithContext(ctx context.Context) Runner
 }
 
 type RealRunner struct {
 	Logger Logger
+
+	context context.Context
 }
 
+// InitCmd returns the command to run, the command is killed once the runner context is done
 func (r RealRunner) InitCmd(command string, args ...string) *exec.Cmd {
+	if r.context != nil {
+		return exec.CommandContext(r.context, command, args...)
+	}
 	return exec.Command(command, args...)
 }
 
@@ -56,3 +65,14 @@ func (r RealRunner) GetLogger() Logger {
 func (r *RealRunner) SetLogger(logger Logger) {
 	r.Logger = logger
 }
+
+func (r *RealRunner) SetContext(ctx context.Context) {
+	r.context = ctx
+}
+
+// WithContext returns a copy of the runner whose commands are killed once the given
+// context is done, the context of the original runner is left untouched
+func (r RealRunner) WithContext(ctx context.Context) Runner {
+	r.context = ctx
+	return &r
+}
@@ -18,6 +18,9 @@ package v1_test
 
 import (
 	"bytes"
+	"context"
+	"time"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
@@ -51,6 +54,39 @@ var _ = Describe("Runner", Label("types", "runner"), func() {
 		Expect(r.GetLogger()).To(Equal(logger))
 	})
 
+	It("Kills commands once the real runner context is done", func() {
+		r := v1.RealRunner{}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		r.SetContext(ctx)
+		start := time.Now()
+		_, err := r.Run("sleep", "10")
+		Expect(err).NotTo(BeNil())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		_, err = r.Run("pwd")
+		Expect(err).NotTo(BeNil())
+	})
+	It("Runs commands of a runner copy with its own context", func() {
+		r := v1.RealRunner{}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r.SetContext(ctx)
+		_, err := r.WithContext(context.Background()).Run("pwd")
+		Expect(err).To(BeNil())
+		_, err = r.Run("pwd")
+		Expect(err).NotTo(BeNil())
+	})
+	It("Fails commands once the fake runner context is done", func() {
+		r := v1mock.NewFakeRunner()
+		ctx, cancel := context.WithCancel(context.Background())
+		r.SetContext(ctx)
+		_, err := r.Run("pwd")
+		Expect(err).To(BeNil())
+		cancel()
+		_, err = r.Run("pwd")
+		Expect(err).To(MatchError(context.Canceled))
+	})
+
 	It("logs the command when on debug", func() {
 
 		memLog := &bytes.Buffer{}
@@ -21,6 +21,9 @@ import "syscall"
 type SyscallInterface interface {
 	Chroot(string) error
 	Chdir(string) error
+	Unshare(int) error
+	Mount(source string, target string, fstype string, flags uintptr, data string) error
+	Statfs(path string, buf *syscall.Statfs_t) error
 }
 
 type RealSyscall struct{}
@@ -32,3 +35,15 @@ func (r *RealSyscall) Chroot(path string) error {
 func (r *RealSyscall) Chdir(path string) error {
 	return syscall.Chdir(path)
 }
+
+func (r *RealSyscall) Unshare(flags int) error {
+	return syscall.Unshare(flags)
+}
+
+func (r *RealSyscall) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	return syscall.Mount(source, target, fstype, flags, data)
+}
+
+func (r *RealSyscall) Statfs(path string, buf *syscall.Statfs_t) error {
+	return syscall.Statfs(path, buf)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"debug/elf"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// rootArchBinaries are the binaries checked to find out the architecture of a root tree
+var rootArchBinaries = []string{"/usr/bin/sh", "/usr/lib/systemd/systemd", "/bin/sh", "/sbin/init", "/bin/busybox"}
+
+// elfArchs maps ELF machines to golang architecture names, for bi-endian machines the
+// name of the little endian variant
+var elfArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_386:     "386",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_ARM:     "arm",
+	elf.EM_PPC64:   "ppc64le",
+	elf.EM_S390:    "s390x",
+	elf.EM_RISCV:   "riscv64",
+}
+
+// RootArch returns the golang architecture name of the system in the given root tree,
+// according to the ELF header of its shell or init binaries
+func RootArch(fs v1.FS, root string) (string, error) {
+	for _, bin := range rootArchBinaries {
+		path, err := resolveInRoot(fs, root, bin)
+		if err != nil {
+			continue
+		}
+		f, err := fs.Open(path)
+		if err != nil {
+			continue
+		}
+		file, err := elf.NewFile(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		arch, ok := elfArchs[file.Machine]
+		if !ok {
+			return "", fmt.Errorf("unknown architecture %s of %s", file.Machine, bin)
+		}
+		if file.Machine == elf.EM_PPC64 && file.Data == elf.ELFDATA2MSB {
+			arch = "ppc64"
+		}
+		return arch, nil
+	}
+	return "", fmt.Errorf("no executable found in %s to check its architecture", root)
+}
+
+// CheckRootArch fails if the system in the given root tree does not match the platform architecture
+func CheckRootArch(fs v1.FS, root string, platform *v1.Platform) error {
+	arch, err := RootArch(fs, root)
+	if err != nil {
+		return err
+	}
+	if arch != platform.Arch {
+		return fmt.Errorf("unpacked system is for %s architecture, expected %s", arch, platform.Arch)
+	}
+	return nil
+}
+
+// resolveInRoot follows the symlinks of every component of the given path as if root
+// was the root of the filesystem, so absolute links never point outside of root
+func resolveInRoot(fs v1.FS, root, path string) (string, error) {
+	resolved := "/"
+	pending := strings.Split(path, "/")
+	for links := 0; len(pending) > 0; {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		target, err := fs.Readlink(filepath.Join(root, next))
+		if err != nil {
+			// Not a symlink, missing paths fail once fully resolved
+			resolved = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	full := filepath.Join(root, resolved)
+	if _, err := fs.Stat(full); err != nil {
+		return "", err
+	}
+	return full, nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// NewBootloader returns the boot loader selected in the configuration, grub is
+// used if none is set
+func NewBootloader(config *v1.RunConfig) (v1.Bootloader, error) {
+	switch config.Bootloader {
+	case "", cnst.GrubBootloader:
+		return NewGrub(config), nil
+	case cnst.SystemdBootBootloader:
+		return NewSystemdBoot(config), nil
+	default:
+		return nil, fmt.Errorf("unsupported bootloader '%s'", config.Bootloader)
+	}
+}
+
+// InstallBootloader installs the boot loader selected in the configuration and records
+// it in the state partition, so later upgrades manage the same boot loader
+func InstallBootloader(config *v1.RunConfig) error {
+	bootloader, err := NewBootloader(config)
+	if err != nil {
+		return err
+	}
+	if err = bootloader.Install(); err != nil {
+		return err
+	}
+	stateDir, err := bootPartitionDir(config, cnst.StatePartName, config.StateLabel)
+	if err != nil {
+		return err
+	}
+	name := config.Bootloader
+	if name == "" {
+		name = cnst.GrubBootloader
+	}
+	return config.Fs.WriteFile(filepath.Join(stateDir, cnst.BootloaderFile), []byte(name+"\n"), cnst.FilePerm)
+}
+
+// DetectBootloader returns the boot loader recorded in the state partition mounted at
+// stateDir. Systems installed without a record use grub.
+func DetectBootloader(config *v1.RunConfig, stateDir string) string {
+	data, err := config.Fs.ReadFile(filepath.Join(stateDir, cnst.BootloaderFile))
+	if err != nil {
+		config.Logger.Debugf("No boot loader recorded in %s, assuming %s", stateDir, cnst.GrubBootloader)
+		return cnst.GrubBootloader
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// bootPartitionDir returns the mount point of the given partition. If the partition
+// is not part of the configuration it is looked up by label and it is expected to
+// be already mounted.
+func bootPartitionDir(config *v1.RunConfig, partName, label string) (string, error) {
+	part := config.Partitions.GetByName(partName)
+	if part != nil {
+		return part.MountPoint, nil
+	}
+	p, err := GetFullDeviceByLabel(config.Runner, label, 5)
+	if err != nil {
+		return "", fmt.Errorf("partition %s not found", label)
+	}
+	if p.MountPoint == "" {
+		return "", fmt.Errorf("partition %s not mounted", label)
+	}
+	return p.MountPoint, nil
+}
+
+// imageBootPath returns the path of the image file relative to the root of its partition
+func imageBootPath(img *v1.Image) string {
+	return filepath.Join("/cOS", filepath.Base(img.File))
+}
+
+// BootEntryTitles returns the boot menu titles of the active, passive and recovery
+// entries. Titles are based on the default entry name unless set in the configuration.
+func BootEntryTitles(config *v1.RunConfig) map[string]string {
+	titles := map[string]string{
+		cnst.ActiveImgName:   config.GrubDefEntry,
+		cnst.PassiveImgName:  fmt.Sprintf("%s (fallback)", config.GrubDefEntry),
+		cnst.RecoveryImgName: fmt.Sprintf("%s recovery", config.GrubDefEntry),
+	}
+	for name, title := range config.BootEntryTitles {
+		titles[name] = title
+	}
+	return titles
+}
+
+// KernelArgs returns the extra kernel arguments from the configuration including
+// a console argument for each of the given consoles
+func KernelArgs(config *v1.RunConfig, consoles []string) string {
+	args := []string{}
+	if cArgs := consoleArgs(consoles); cArgs != "" {
+		args = append(args, cArgs)
+	}
+	if config.KernelArgs != "" {
+		args = append(args, config.KernelArgs)
+	}
+	return strings.Join(args, " ")
+}
+
+// consoleArgs returns the console kernel arguments for the given consoles
+func consoleArgs(consoles []string) string {
+	args := []string{}
+	for _, c := range consoles {
+		args = append(args, fmt.Sprintf("console=%s", c))
+	}
+	return strings.Join(args, " ")
+}
+
+// contains checks if the given string is included in the list
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -20,8 +20,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"syscall"
 
 	"github.com/rancher-sandbox/elemental/pkg/constants"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
@@ -34,6 +37,17 @@ type Chroot struct {
 	extraMounts   map[string]string
 	activeMounts  []string
 	config        *v1.RunConfig
+
+	isolated bool
+}
+
+// namespaceMount is a mount done within the private mount namespace of an isolated chroot
+type namespaceMount struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+	data   string
 }
 
 func NewChroot(path string, config *v1.RunConfig) *Chroot {
@@ -46,6 +60,16 @@ func NewChroot(path string, config *v1.RunConfig) *Chroot {
 	}
 }
 
+// NewIsolatedChroot returns a chroot that runs commands in a private mount namespace. The
+// chroot gets its own /dev, /proc and /sys mounts and a copy of the host resolv.conf, all
+// of them are released with the namespace once the command returns, so nothing is left
+// mounted on the host even if the command fails or leaves mounts behind.
+func NewIsolatedChroot(path string, config *v1.RunConfig) *Chroot {
+	chroot := NewChroot(path, config)
+	chroot.isolated = true
+	return chroot
+}
+
 // Sets additional bind mounts for the chroot enviornment. They are represented
 // in a map where the key is the path outside the chroot and the value is the
 // path inside the chroot.
@@ -124,6 +148,10 @@ func (c *Chroot) Close() error {
 
 // RunCallback runs the given callback in a chroot environment
 func (c *Chroot) RunCallback(callback func() error) (err error) {
+	if c.isolated {
+		return c.runIsolated(callback)
+	}
+
 	// Store current root
 	oldRootF, err := os.Open("/") // Can't use afero here because doesn't support chdir done below
 	if err != nil {
@@ -192,3 +220,137 @@ func (c *Chroot) Run(command string, args ...string) (out []byte, err error) {
 	}
 	return out, err
 }
+
+// runIsolated runs the given callback chrooted within a private mount namespace. The namespace
+// belongs to a locked OS thread which is never unlocked, so the Go runtime terminates it once
+// the callback returns and the kernel releases all the mounts of the namespace. Note goroutines
+// started by the callback do not run within the chroot.
+func (c *Chroot) runIsolated(callback func() error) (err error) {
+	resolv, err := c.copyResolvConf()
+	if err != nil {
+		c.config.Logger.Warnf("Could not copy resolv.conf into the chroot: %s", err)
+	}
+	if resolv != "" {
+		defer c.config.Fs.RemoveAll(filepath.Dir(resolv))
+	}
+
+	// resolv.conf can only be bind mounted over an existing file, symlinks are not
+	// followed as they could point to a host path
+	resolvTarget := filepath.Join(c.path, "etc/resolv.conf")
+	if exists, _ := Exists(c.config.Fs, resolvTarget); resolv != "" && !exists {
+		if _, err := c.config.Fs.Readlink(resolvTarget); err != nil {
+			if err := c.config.Fs.WriteFile(resolvTarget, []byte{}, constants.FilePerm); err == nil {
+				defer c.config.Fs.Remove(resolvTarget)
+			}
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errCh <- fmt.Errorf("chrooted callback panicked: %v", r)
+			}
+		}()
+		runtime.LockOSThread()
+		errCh <- c.enterNamespace(resolv, resolvTarget, callback)
+	}()
+	return <-errCh
+}
+
+// enterNamespace moves the current OS thread to a private mount namespace, sets up the
+// chroot mounts within it and runs the given callback chrooted
+func (c *Chroot) enterNamespace(resolv, resolvTarget string, callback func() error) error {
+	// Unsharing the filesystem attributes keeps chroot and chdir local to the current thread
+	err := c.config.Syscall.Unshare(syscall.CLONE_NEWNS | syscall.CLONE_FS)
+	if err != nil {
+		c.config.Logger.Errorf("Cant create a mount namespace: %s", err)
+		return err
+	}
+
+	// Do not propagate any mount event back to the host
+	err = c.config.Syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		c.config.Logger.Errorf("Cant make mounts private: %s", err)
+		return err
+	}
+
+	for _, mnt := range c.namespaceMounts() {
+		err = MkdirAll(c.config.Fs, mnt.target, constants.DirPerm)
+		if err != nil {
+			return err
+		}
+		err = c.config.Syscall.Mount(mnt.source, mnt.target, mnt.fstype, mnt.flags, mnt.data)
+		if err != nil {
+			c.config.Logger.Errorf("Cant mount %s: %s", mnt.target, err)
+			return err
+		}
+	}
+
+	// The ptmx device must refer to the devpts instance of the chroot
+	ptmx := filepath.Join(c.path, "dev/ptmx")
+	err = c.config.Syscall.Mount(filepath.Join(c.path, "dev/pts/ptmx"), ptmx, "", syscall.MS_BIND, "")
+	if err != nil {
+		c.config.Logger.Warnf("Cant mount %s: %s", ptmx, err)
+	}
+
+	if resolv != "" {
+		err = c.config.Syscall.Mount(resolv, resolvTarget, "", syscall.MS_BIND, "")
+		if err != nil {
+			c.config.Logger.Warnf("Cant mount %s: %s", resolvTarget, err)
+		}
+	}
+
+	err = c.config.Syscall.Chdir(c.path)
+	if err != nil {
+		c.config.Logger.Errorf("Cant chdir %s: %s", c.path, err)
+		return err
+	}
+
+	err = c.config.Syscall.Chroot(c.path)
+	if err != nil {
+		c.config.Logger.Errorf("Cant chroot %s: %s", c.path, err)
+		return err
+	}
+
+	return callback()
+}
+
+// namespaceMounts returns the mounts of an isolated chroot, including the extra mounts
+func (c *Chroot) namespaceMounts() []namespaceMount {
+	keys := []string{}
+	mounts := []namespaceMount{
+		{"devtmpfs", filepath.Join(c.path, "dev"), "devtmpfs", syscall.MS_NOSUID, "mode=0755"},
+		{"devpts", filepath.Join(c.path, "dev/pts"), "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"},
+		{"proc", filepath.Join(c.path, "proc"), "proc", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+		{"sysfs", filepath.Join(c.path, "sys"), "sysfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+	}
+
+	for k := range c.extraMounts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mounts = append(mounts, namespaceMount{k, filepath.Join(c.path, c.extraMounts[k]), "", syscall.MS_BIND | syscall.MS_REC, ""})
+	}
+	return mounts
+}
+
+// copyResolvConf copies the host resolv.conf to a temporary file and returns its path.
+// Returns an empty path if the host has no resolv.conf.
+func (c *Chroot) copyResolvConf() (string, error) {
+	if exists, _ := Exists(c.config.Fs, "/etc/resolv.conf"); !exists {
+		return "", nil
+	}
+	tmpDir, err := TempDir(c.config.Fs, "", "elemental-resolv")
+	if err != nil {
+		return "", err
+	}
+	resolv := filepath.Join(tmpDir, "resolv.conf")
+	err = CopyFile(c.config.Fs, "/etc/resolv.conf", resolv)
+	if err != nil {
+		_ = c.config.Fs.RemoveAll(tmpDir)
+		return "", err
+	}
+	return resolv, nil
+}
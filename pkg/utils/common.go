@@ -56,6 +56,18 @@ func GetDeviceByLabel(runner v1.Runner, label string, attempts int) (string, err
 	return part.Path, nil
 }
 
+// FindDeviceByLabel returns the device including a filesystem with the given label using
+// blkid. Unlike GetDeviceByLabel it also finds filesystems which are not in a partition,
+// such as LVM logical volumes.
+func FindDeviceByLabel(runner v1.Runner, label string) (string, error) {
+	out, err := runner.Run("blkid", "--label", label)
+	device := strings.TrimSpace(string(out))
+	if err != nil || device == "" {
+		return "", fmt.Errorf("no device found with label %s", label)
+	}
+	return device, nil
+}
+
 // GetFullDeviceByLabel works like GetDeviceByLabel, but it will try to get as much info as possible from the existing
 // partition and return a v1.Partition object
 func GetFullDeviceByLabel(runner v1.Runner, label string, attempts int) (*v1.Partition, error) {
@@ -285,10 +297,32 @@ func GetSource(config *v1.RunConfig, source string, destination string) error {
 			return err
 		}
 	} else {
-		err = config.Client.GetURL(config.Logger, source, destination)
+		err = config.Client.GetURL(config.Context, config.Logger, source, destination)
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// IsReadOnlyMount checks if the given mount point is mounted read only, mount points
+// missing from the mount list are not considered read only
+func IsReadOnlyMount(config *v1.RunConfig, mountPoint string) bool {
+	mounts, err := config.Mounter.List()
+	if err != nil {
+		return true
+	}
+	for _, m := range mounts {
+		if m.Path != mountPoint {
+			continue
+		}
+		for _, opt := range m.Opts {
+			if opt == "ro" {
+				return true
+			}
+		}
+		return false
+	}
+	// Not found as mounted, do not remount it
+	return false
+}
@@ -17,16 +17,22 @@ limitations under the License.
 package utils
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
-	"runtime"
+	"regexp"
 	"strings"
+	"text/template"
 
 	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 )
 
+// ErrNoSignedBinaries is returned when the OS image does not ship the signed EFI binaries required for Secure Boot
+var ErrNoSignedBinaries = errors.New("signed shim and grub EFI binaries not found in the OS image")
+
 // Grub is the struct that will allow us to install grub to the target device
 type Grub struct {
 	config *v1.RunConfig
@@ -45,10 +51,17 @@ func (g Grub) Install() (err error) { // nolint:gocyclo
 	var grubargs []string
 	var arch, grubdir, tty, finalContent string
 
-	switch runtime.GOARCH {
+	platform := g.config.Platform
+	if platform == nil {
+		platform = v1.NewHostPlatform()
+	}
+	switch platform.Arch {
 	case "arm64":
 		arch = "arm64"
+	case "amd64":
+		arch = "x86_64"
 	default:
+		g.config.Logger.Warnf("Unknown %s architecture for grub, installing for x86_64", platform.Arch)
 		arch = "x86_64"
 	}
 	g.config.Logger.Info("Installing GRUB..")
@@ -65,8 +78,19 @@ func (g Grub) Install() (err error) { // nolint:gocyclo
 	}
 
 	efiExists, _ := Exists(g.config.Fs, cnst.EfiDevice)
+	efi := g.config.ForceEfi || efiExists
 
-	if g.config.ForceEfi || efiExists {
+	if arch != "x86_64" && !efi {
+		g.config.Logger.Errorf("Only EFI installations are supported on %s, use --force-efi if the firmware is not detected", arch)
+		return fmt.Errorf("non EFI installation on %s", arch)
+	}
+
+	if g.config.SecureBoot && !efi {
+		g.config.Logger.Errorf("Secure Boot requires an EFI installation, use --force-efi if the firmware is not detected")
+		return errors.New("secure boot requested on a non EFI system")
+	}
+
+	if efi {
 		g.config.Logger.Infof("Installing grub efi for arch %s", arch)
 		grubargs = append(
 			grubargs,
@@ -108,6 +132,16 @@ func (g Grub) Install() (err error) { // nolint:gocyclo
 	}
 	g.config.Logger.Infof("Found grub config dir %s", grubdir)
 
+	if efi {
+		err = g.installSecureBoot(arch, activeImg.MountPoint, grubdir)
+		if errors.Is(err, ErrNoSignedBinaries) && !g.config.SecureBoot {
+			g.config.Logger.Debugf("Skipping Secure Boot setup: %s", err)
+		} else if err != nil {
+			g.config.Logger.Errorf("Failed setting up Secure Boot: %s", err)
+			return err
+		}
+	}
+
 	grubConf, err := g.config.Fs.ReadFile(filepath.Join(activeImg.MountPoint, g.config.GrubConf))
 	if err != nil {
 		g.config.Logger.Errorf("Failed reading grub config file: %s", filepath.Join(activeImg.MountPoint, g.config.GrubConf))
@@ -122,26 +156,233 @@ func (g Grub) Install() (err error) { // nolint:gocyclo
 	defer grubConfTarget.Close()
 
 	ttyExists, _ := Exists(g.config.Fs, fmt.Sprintf("/dev/%s", tty))
+	if !ttyExists || tty == "console" || tty == "tty1" {
+		tty = ""
+	}
 
-	if ttyExists && tty != "" && tty != "console" && tty != "tty1" {
-		// We need to add a tty to the grub file
-		g.config.Logger.Infof("Adding extra tty (%s) to grub.cfg", tty)
-		finalContent = strings.Replace(string(grubConf), "console=tty1", fmt.Sprintf("console=tty1 console=%s", tty), -1)
+	isTemplate := strings.Contains(string(grubConf), "{{")
+	if isTemplate {
+		g.config.Logger.Infof("Rendering grub config template %s", g.config.GrubConf)
+		finalContent, err = g.renderConfig(string(grubConf), tty)
+		if err != nil {
+			g.config.Logger.Errorf("Failed rendering grub config template: %s", err)
+			return err
+		}
 	} else {
-		// We don't add anything, just read the file
+		err = g.checkPlainConfig()
+		if err != nil {
+			return err
+		}
 		finalContent = string(grubConf)
+		if tty != "" {
+			// Plain grub config, we need to add a tty to the grub file
+			g.config.Logger.Infof("Adding extra tty (%s) to grub.cfg", tty)
+			finalContent = strings.Replace(finalContent, "console=tty1", fmt.Sprintf("console=tty1 console=%s", tty), -1)
+		}
 	}
 
 	g.config.Logger.Infof("Copying grub contents from %s to %s", g.config.GrubConf, fmt.Sprintf("%s/grub.cfg", grubdir))
-	_, err = grubConfTarget.WriteString(finalContent)
+	_, err = grubConfTarget.WriteString(finalContent + nextBootScript())
 	if err != nil {
 		return err
 	}
 
+	// Plain grub configs read the extra kernel arguments from the grub environment
+	if args := KernelArgs(g.config, g.config.Consoles); !isTemplate && args != "" {
+		g.config.Logger.Infof("Setting extra kernel arguments '%s' in the grub environment", args)
+		err = g.SetKernelArgs("", args)
+		if err != nil {
+			return err
+		}
+	}
+
 	g.config.Logger.Infof("Grub install to device %s complete", g.config.Target)
 	return nil
 }
 
+// checkPlainConfig fails if settings which are only applied by grub.cfg templates are
+// set, so they are not silently ignored with a plain grub config
+func (g Grub) checkPlainConfig() error {
+	var unsupported []string
+	if g.config.GrubSerial != "" {
+		unsupported = append(unsupported, "grub-serial")
+	}
+	if g.config.GrubTimeout != 0 {
+		unsupported = append(unsupported, "grub-timeout")
+	}
+	if len(g.config.BootEntryTitles) > 0 {
+		unsupported = append(unsupported, "boot entry titles")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf(
+			"%s can only be applied with a templated grub config, %s is not a template",
+			strings.Join(unsupported, ", "), g.config.GrubConf,
+		)
+	}
+	return nil
+}
+
+// GrubTemplateData holds the values available to grub.cfg templates
+type GrubTemplateData struct {
+	// KernelArgs are the extra kernel arguments, including the console ones
+	KernelArgs  string
+	Consoles    []string
+	ConsoleArgs string
+	// Serial are the arguments of the grub serial command, serial terminal is not set if empty
+	Serial string
+	// Timeout of the boot menu in seconds, 0 keeps the template default
+	Timeout         uint
+	DefaultEntry    string
+	Titles          map[string]string
+	StateLabel      string
+	RecoveryLabel   string
+	SystemLabel     string
+	ActiveLabel     string
+	PassiveLabel    string
+	OEMLabel        string
+	PersistentLabel string
+}
+
+// NewGrubTemplateData returns the grub.cfg template data from the configuration, the given
+// tty is added as an extra console
+func NewGrubTemplateData(config *v1.RunConfig, tty string) GrubTemplateData {
+	consoles := append([]string{}, config.Consoles...)
+	if tty != "" {
+		if len(consoles) == 0 {
+			consoles = append(consoles, "tty1")
+		}
+		if !contains(consoles, tty) {
+			consoles = append(consoles, tty)
+		}
+	}
+	return GrubTemplateData{
+		KernelArgs:      KernelArgs(config, consoles),
+		Consoles:        consoles,
+		ConsoleArgs:     consoleArgs(consoles),
+		Serial:          config.GrubSerial,
+		Timeout:         config.GrubTimeout,
+		DefaultEntry:    config.GrubDefEntry,
+		Titles:          BootEntryTitles(config),
+		StateLabel:      config.StateLabel,
+		RecoveryLabel:   config.RecoveryLabel,
+		SystemLabel:     config.SystemLabel,
+		ActiveLabel:     config.ActiveLabel,
+		PassiveLabel:    config.PassiveLabel,
+		OEMLabel:        config.OEMLabel,
+		PersistentLabel: config.PersistentLabel,
+	}
+}
+
+// renderConfig renders the given grub.cfg template
+func (g Grub) renderConfig(grubConf string, tty string) (string, error) {
+	tmpl, err := template.New("grub.cfg").Funcs(template.FuncMap{"join": strings.Join}).Parse(grubConf)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, NewGrubTemplateData(g.config, tty))
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// installSecureBoot copies the signed shim, grub and MokManager EFI binaries from the
+// OS image into the removable media path of the EFI partition. Shim is installed as the
+// default boot loader and the signed grub gets a small grub.cfg that chains to the
+// grub config in the state partition. Returns ErrNoSignedBinaries if the OS image does
+// not ship signed shim and grub binaries.
+func (g Grub) installSecureBoot(arch, rootDir, grubdir string) error {
+	suffix := efiArchSuffix(arch)
+	shim, grub, mok := secureBootFiles(arch)
+
+	shimSrc := g.findFile(rootDir, shim)
+	grubSrc := g.findFile(rootDir, grub)
+	if shimSrc == "" || grubSrc == "" {
+		return fmt.Errorf("%w (looked for shim in %s and grub in %s)", ErrNoSignedBinaries, strings.Join(shim, ", "), strings.Join(grub, ", "))
+	}
+	mokSrc := g.findFile(rootDir, mok)
+
+	g.config.Logger.Infof("Installing Secure Boot shim from %s", shimSrc)
+	bootDir := filepath.Join(cnst.EfiDir, "EFI", "BOOT")
+	err := MkdirAll(g.config.Fs, bootDir, cnst.DirPerm)
+	if err != nil {
+		return err
+	}
+
+	// Shim looks for grub.efi on SUSE based images and for grub<arch>.efi upstream,
+	// so signed grub and MokManager are installed with both names
+	copies := map[string][]string{
+		shimSrc: {fmt.Sprintf("boot%s.efi", suffix)},
+		grubSrc: {"grub.efi", fmt.Sprintf("grub%s.efi", suffix)},
+	}
+	if mokSrc != "" {
+		copies[mokSrc] = []string{"MokManager.efi", fmt.Sprintf("mm%s.efi", suffix)}
+	} else {
+		g.config.Logger.Warnf("No signed MokManager found in the OS image, MOK enrollment will not be available")
+	}
+	for src, targets := range copies {
+		for _, target := range targets {
+			g.config.Logger.Debugf("Copying %s to %s", src, filepath.Join(bootDir, target))
+			err = CopyFile(g.config.Fs, src, filepath.Join(bootDir, target))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Signed grub images can't embed our prefix, they read grub.cfg from their own directory
+	grubCfg := fmt.Sprintf(
+		"search --no-floppy --label --set=root %s\nset prefix=($root)/%s\nconfigfile ($root)/%s/grub.cfg\n",
+		g.config.StateLabel, filepath.Base(grubdir), filepath.Base(grubdir),
+	)
+	return g.config.Fs.WriteFile(filepath.Join(bootDir, "grub.cfg"), []byte(grubCfg), cnst.FilePerm)
+}
+
+// findFile returns the first of the given paths, relative to rootDir, that exists.
+// Returns an empty string if none is found.
+func (g Grub) findFile(rootDir string, paths []string) string {
+	for _, path := range paths {
+		fullPath := filepath.Join(rootDir, path)
+		if ok, _ := Exists(g.config.Fs, fullPath); ok {
+			return fullPath
+		}
+	}
+	return ""
+}
+
+// efiArchSuffix returns the suffix used by EFI binaries names for the given arch
+func efiArchSuffix(arch string) string {
+	if arch == "arm64" {
+		return "aa64"
+	}
+	return "x64"
+}
+
+// secureBootFiles returns the paths where signed shim, grub and MokManager EFI
+// binaries are shipped by the supported distributions for the given arch
+func secureBootFiles(arch string) (shim, grub, mok []string) {
+	suffix := efiArchSuffix(arch)
+	// SUSE uses the uname machine name, which is aarch64 on arm64
+	susePath := "/usr/share/efi/x86_64"
+	if arch == "arm64" {
+		susePath = "/usr/share/efi/aarch64"
+	}
+	shim = []string{
+		filepath.Join(susePath, "shim.efi"),
+		fmt.Sprintf("/usr/lib/shim/shim%s.efi.signed", suffix),
+	}
+	grub = []string{
+		filepath.Join(susePath, "grub.efi"),
+		fmt.Sprintf("/usr/lib/grub/%s-efi-signed/grub%s.efi.signed", arch, suffix),
+	}
+	mok = []string{
+		filepath.Join(susePath, "MokManager.efi"),
+		fmt.Sprintf("/usr/lib/shim/mm%s.efi.signed", suffix),
+	}
+	return shim, grub, mok
+}
+
 // Sets the given key value pairs into as grub variables into the given file
 func (g Grub) SetPersistentVariables(grubEnvFile string, vars map[string]string) error {
 	for key, value := range vars {
@@ -154,3 +395,232 @@ func (g Grub) SetPersistentVariables(grubEnvFile string, vars map[string]string)
 	}
 	return nil
 }
+
+// SetDefaultEntry sets the saved_entry variable into the grub environment of the state
+// partition, grub.cfg boots it by default. The entry can be given by ID or title.
+func (g Grub) SetDefaultEntry(entry string) error {
+	stateDir, err := g.stateDir()
+	if err != nil {
+		return err
+	}
+	return g.SetPersistentVariables(
+		filepath.Join(stateDir, cnst.GrubEnv),
+		map[string]string{"saved_entry": entry},
+	)
+}
+
+// SetEntryTitles sets the default_menu_entry variable, which grub.cfg names the entries
+// after, into the GrubOEMEnv file of the state partition
+func (g Grub) SetEntryTitles() error {
+	stateDir, err := g.stateDir()
+	if err != nil {
+		return err
+	}
+	return g.SetPersistentVariables(
+		filepath.Join(stateDir, cnst.GrubOEMEnv),
+		map[string]string{"default_menu_entry": g.config.GrubDefEntry},
+	)
+}
+
+// SetOneShotEntry sets the next_entry variable into the grub environment of the state
+// partition, grub.cfg boots it once and clears it
+func (g Grub) SetOneShotEntry(entry string) error {
+	stateDir, err := g.stateDir()
+	if err != nil {
+		return err
+	}
+	return g.SetPersistentVariables(
+		filepath.Join(stateDir, cnst.GrubEnv),
+		map[string]string{"next_entry": entry},
+	)
+}
+
+// SetKernelArgs sets the extra_cmdline variable, or extra_<entry>_cmdline if an entry
+// is given, into the grub environment of the state partition
+func (g Grub) SetKernelArgs(entry string, args string) error {
+	return g.setKernelArgs(GrubKernelArgsVar(entry), args)
+}
+
+// SetNextBootKernelArgs sets the next_extra_cmdline variable, or next_extra_<entry>_cmdline
+// if an entry is given, into the grub environment of the state partition. On the next boot
+// grub.cfg uses them instead of the persistent extra kernel arguments and clears them.
+func (g Grub) SetNextBootKernelArgs(entry string, args string) error {
+	supported, err := g.SupportsNextBoot()
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return fmt.Errorf("the installed grub.cfg does not apply next boot kernel arguments, reinstall grub to enable them")
+	}
+	return g.setKernelArgs(GrubNextBootKernelArgsVar(entry), args)
+}
+
+// GetKernelArgs returns the extra kernel arguments of the given entry, or the ones for all
+// entries if no entry is given, from the grub environment of the state partition
+func (g Grub) GetKernelArgs(entry string) (string, error) {
+	return g.getEnvVariable(GrubKernelArgsVar(entry))
+}
+
+// GetNextBootKernelArgs returns the extra kernel arguments of the given entry, or the ones
+// for all entries if no entry is given, set for the next boot only
+func (g Grub) GetNextBootKernelArgs(entry string) (string, error) {
+	return g.getEnvVariable(GrubNextBootKernelArgsVar(entry))
+}
+
+// SupportsNextBoot checks if the grub.cfg of the state partition applies the next boot
+// kernel arguments, grub.cfg files installed by older versions do not
+func (g Grub) SupportsNextBoot() (bool, error) {
+	grubCfg, err := g.readConfig()
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(grubCfg), nextBootMarker), nil
+}
+
+// getEnvVariable returns the given variable of the grub environment of the state partition
+func (g Grub) getEnvVariable(key string) (string, error) {
+	env, err := g.getEnvVariables()
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return env[key], nil
+}
+
+// getEnvVariables returns the grub environment of the state partition
+func (g Grub) getEnvVariables() (map[string]string, error) {
+	stateDir, err := g.stateDir()
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return g.ReadPersistentVariables(filepath.Join(stateDir, cnst.GrubEnv))
+}
+
+// ReadPersistentVariables returns the grub variables set in the given file
+func (g Grub) ReadPersistentVariables(grubEnvFile string) (map[string]string, error) {
+	return readGrubEnv(g.config.Fs, grubEnvFile)
+}
+
+func (g Grub) setKernelArgs(key string, args string) error {
+	stateDir, err := g.stateDir()
+	if err != nil {
+		return err
+	}
+	return g.SetPersistentVariables(
+		filepath.Join(stateDir, cnst.GrubEnv),
+		map[string]string{key: args},
+	)
+}
+
+// GrubKernelArgsVar returns the name of the grub variable holding the extra kernel
+// arguments of the given entry, or of all entries if empty
+func GrubKernelArgsVar(entry string) string {
+	if entry != "" {
+		return fmt.Sprintf("extra_%s_cmdline", entry)
+	}
+	return "extra_cmdline"
+}
+
+// GrubNextBootKernelArgsVar returns the name of the grub variable holding the extra kernel
+// arguments of the given entry, or of all entries if empty, for the next boot only
+func GrubNextBootKernelArgsVar(entry string) string {
+	return "next_" + GrubKernelArgsVar(entry)
+}
+
+// nextBootMarker identifies the grub.cfg snippet applying the next boot kernel arguments
+const nextBootMarker = "# elemental: kernel arguments for the next boot only"
+
+// nextBootScript returns the grub.cfg snippet which replaces the extra kernel arguments
+// with the next boot ones, if any, and clears them from the grub environment so they are
+// only applied once. Menu entries expand the variables when booted, so the snippet can
+// be appended after them.
+func nextBootScript() string {
+	var script strings.Builder
+	script.WriteString("\n" + nextBootMarker + "\n")
+	script.WriteString("regexp --set 1:next_boot_dev '^\\(([^)]*)\\)' \"${config_directory}\"\n")
+	script.WriteString("set next_boot_env=\"(${next_boot_dev})/" + cnst.GrubEnv + "\"\n")
+	for _, entry := range []string{"", cnst.ActiveImgName, cnst.PassiveImgName, cnst.RecoveryImgName} {
+		key, next := GrubKernelArgsVar(entry), GrubNextBootKernelArgsVar(entry)
+		fmt.Fprintf(&script, "load_env -f \"${next_boot_env}\" %s\n", next)
+		fmt.Fprintf(&script, "if [ -n \"${%s}\" ]; then\n", next)
+		fmt.Fprintf(&script, "  set %s=\"${%s}\"\n", key, next)
+		fmt.Fprintf(&script, "  set %s=\n", next)
+		fmt.Fprintf(&script, "  save_env -f \"${next_boot_env}\" %s\n", next)
+		script.WriteString("fi\n")
+	}
+	return script.String()
+}
+
+// ListEntries returns the menu entries defined in the grub.cfg of the state partition.
+// The default entry is the one saved in the grub environment or the first one.
+func (g Grub) ListEntries() ([]v1.BootEntry, error) {
+	grubCfg, err := g.readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []v1.BootEntry{}
+	for _, match := range menuEntryRegexp.FindAllStringSubmatch(string(grubCfg), -1) {
+		entry := v1.BootEntry{ID: match[1], Title: match[1]}
+		if id := menuEntryIDRegexp.FindStringSubmatch(match[2]); id != nil {
+			entry.ID = id[1]
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return entries, nil
+	}
+
+	env, _ := g.getEnvVariables()
+	def := 0
+	for i, entry := range entries {
+		if saved := env["saved_entry"]; saved != "" && (saved == entry.ID || saved == entry.Title) {
+			def = i
+			break
+		}
+	}
+	entries[def].Default = true
+	return entries, nil
+}
+
+// readConfig returns the grub.cfg of the state partition
+func (g Grub) readConfig() (grubCfg []byte, err error) {
+	stateDir, err := g.stateDir()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{"grub2", "grub"} {
+		grubCfg, err = g.config.Fs.ReadFile(filepath.Join(stateDir, dir, "grub.cfg"))
+		if err == nil {
+			return grubCfg, nil
+		}
+	}
+	return nil, err
+}
+
+// stateDir returns the mount point of the state partition which holds the grub configuration
+func (g Grub) stateDir() (string, error) {
+	return bootPartitionDir(g.config, cnst.StatePartName, g.config.StateLabel)
+}
+
+var (
+	menuEntryRegexp   = regexp.MustCompile(`(?m)^\s*menuentry\s+["']([^"']*)["']([^{]*)\{`)
+	menuEntryIDRegexp = regexp.MustCompile(`--id[= ]["']?([^\s"']+)`)
+)
+
+// readGrubEnv parses a grub environment block file into a map
+func readGrubEnv(fs v1.FS, file string) (map[string]string, error) {
+	env := map[string]string{}
+	data, err := fs.ReadFile(file)
+	if err != nil {
+		return env, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env, nil
+}
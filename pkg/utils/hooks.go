@@ -0,0 +1,136 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// HookResult represents the outcome of a single hook step execution
+type HookResult struct {
+	Name     string
+	Duration time.Duration
+	ExitCode int
+	Err      error
+}
+
+// String returns a short human readable summary of the hook result
+func (h HookResult) String() string {
+	status := "ok"
+	if h.Err != nil {
+		status = h.Err.Error()
+	}
+	return fmt.Sprintf("%s: exit status %d, took %s (%s)", h.Name, h.ExitCode, h.Duration.Round(time.Millisecond), status)
+}
+
+// GetHookExecutables returns the executables found in the '<hook>.d' subdirectory
+// of each hook path sorted in lexical order of their file names. If the same file
+// name is present in more than one hook path the latest path takes precedence.
+func GetHookExecutables(fs v1.FS, hook string) []string {
+	found := map[string]string{}
+	names := []string{}
+
+	for _, dir := range cnst.GetHookPaths() {
+		hookDir := filepath.Join(dir, fmt.Sprintf("%s.d", hook))
+		f, err := fs.Open(hookDir)
+		if err != nil {
+			continue
+		}
+		entries, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() || entry.Mode().Perm()&0111 == 0 {
+				continue
+			}
+			if _, ok := found[entry.Name()]; !ok {
+				names = append(names, entry.Name())
+			}
+			found[entry.Name()] = filepath.Join(hookDir, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+	executables := []string{}
+	for _, name := range names {
+		executables = append(executables, found[name])
+	}
+	return executables
+}
+
+// RunHookExecutable runs the given executable with the given extra environment
+// variables. A timeout in seconds can be set, zero means no timeout.
+func RunHookExecutable(runner v1.Runner, path string, env []string, timeout uint) HookResult {
+	var cmd *exec.Cmd
+
+	result := HookResult{Name: path}
+	if timeout > 0 {
+		cmd = runner.InitCmd("timeout", fmt.Sprintf("%ds", timeout), path)
+	} else {
+		cmd = runner.InitCmd(path)
+	}
+	if cmd != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	start := time.Now()
+	out, err := runner.RunCmd(cmd)
+	result.Duration = time.Since(start)
+
+	if err != nil {
+		result.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		}
+		if timeout > 0 && result.ExitCode == cnst.HookTimeoutExitCode {
+			result.Err = fmt.Errorf("timed out after %ds", timeout)
+		} else {
+			result.Err = fmt.Errorf("%w: %s", err, out)
+		}
+	}
+	return result
+}
+
+// BootedSlot returns the image name the system is booted from (active, passive or
+// recovery) according to the labels in the kernel command line. Returns an empty
+// string if not booted from any of them, e.g. when running from a live ISO.
+func BootedSlot(config *v1.RunConfig) string {
+	for _, label := range []string{config.RecoveryLabel, config.SystemLabel, cnst.RecoverySquashFile} {
+		if label != "" && BootedFrom(config.Runner, label) {
+			return cnst.RecoveryImgName
+		}
+	}
+	if config.PassiveLabel != "" && BootedFrom(config.Runner, config.PassiveLabel) {
+		return cnst.PassiveImgName
+	}
+	if config.ActiveLabel != "" && BootedFrom(config.Runner, config.ActiveLabel) {
+		return cnst.ActiveImgName
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// lockPollInterval is the time between attempts to acquire a busy lock
+const lockPollInterval = 500 * time.Millisecond
+
+// LockHolder describes the process holding a lock
+type LockHolder struct {
+	PID    int       `json:"pid"`
+	Action string    `json:"action"`
+	Since  time.Time `json:"since"`
+}
+
+// LockedError is returned when the lock is held by another process
+type LockedError struct {
+	Path   string
+	Holder LockHolder
+}
+
+func (e LockedError) Error() string {
+	if e.Holder.PID == 0 {
+		return fmt.Sprintf("%s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf(
+		"%s is locked by a running %s action (pid %d) since %s",
+		e.Path, e.Holder.Action, e.Holder.PID, e.Holder.Since.Format(time.RFC3339),
+	)
+}
+
+// Lock is an advisory lock preventing concurrent install, upgrade, reset and rollback actions.
+// It is made of a lock file in /run and, once the action has the state partition mounted
+// read-write, another one in the state partition.
+type Lock struct {
+	config *v1.RunConfig
+	holder LockHolder
+	run    *os.File
+	state  *os.File
+}
+
+// AcquireLock acquires the lock for the given action. If the lock is held by another process
+// it waits up to config.LockWait seconds for it to be released.
+func AcquireLock(config *v1.RunConfig, action string) (*Lock, error) {
+	lock := &Lock{
+		config: config,
+		holder: LockHolder{PID: os.Getpid(), Action: action, Since: time.Now().UTC()},
+	}
+	f, err := lock.lockFile(cnst.RunLockFile, lock.deadline())
+	if err != nil {
+		return nil, err
+	}
+	lock.run = f
+	return lock, nil
+}
+
+// LockState locks the state partition mounted read-write at the given directory. The state
+// partition of a booted system is mounted read only, so this is done once the action has
+// remounted it. It must be released with ReleaseState before unmounting or remounting it
+// read only.
+func (l *Lock) LockState(stateDir string) error {
+	if l.state != nil {
+		return fmt.Errorf("the state partition is already locked")
+	}
+	f, err := l.lockFile(filepath.Join(stateDir, cnst.StateLockFile), l.deadline())
+	if err != nil {
+		return err
+	}
+	l.state = f
+	return nil
+}
+
+// ReleaseState releases the lock of the state partition, if any
+func (l *Lock) ReleaseState() error {
+	if l.state == nil {
+		return nil
+	}
+	f := l.state
+	l.state = nil
+	_ = f.Truncate(0)
+	return f.Close()
+}
+
+// deadline returns the time to stop waiting for a busy lock
+func (l Lock) deadline() time.Time {
+	return time.Now().Add(time.Duration(l.config.LockWait) * time.Second)
+}
+
+// lockFile locks the given file and records the given holder in it
+func (l Lock) lockFile(path string, deadline time.Time) (*os.File, error) {
+	err := MkdirAll(l.config.Fs, filepath.Dir(path), cnst.DirPerm)
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.config.Fs.OpenFile(path, os.O_RDWR|os.O_CREATE, cnst.FilePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, LockedError{Path: path, Holder: readLockHolder(l.config.Fs, path)}
+		}
+		l.config.Logger.Debugf("Waiting for %s to be released", path)
+		select {
+		case <-l.config.Context.Done():
+			f.Close()
+			return nil, l.config.Context.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	data, err := json.Marshal(l.holder)
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt(data, 0)
+	}
+	if err != nil {
+		l.config.Logger.Warnf("Could not record the lock holder in %s: %s", path, err)
+	}
+	return f, nil
+}
+
+// Release releases the lock, including the one of the state partition, the lock files are kept
+func (l *Lock) Release() error {
+	err := l.ReleaseState()
+	if l.run != nil {
+		_ = l.run.Truncate(0)
+		if cErr := l.run.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+		l.run = nil
+	}
+	return err
+}
+
+// readLockHolder returns the holder recorded in the given lock file
+func readLockHolder(fs v1.FS, path string) LockHolder {
+	holder := LockHolder{}
+	if data, err := fs.ReadFile(path); err == nil {
+		_ = json.Unmarshal(data, &holder)
+	}
+	return holder
+}
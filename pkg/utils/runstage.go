@@ -56,39 +56,23 @@ func checkYAMLError(cfg *v1.RunConfig, allErrors, err error) error {
 	return allErrors
 }
 
-// RunStage will run yip
-func RunStage(stage string, cfg *v1.RunConfig) error {
-	var cmdLineYipURI string
-	var allErrors error
-	CloudInitPaths := constants.GetCloudInitPaths()
+// stageSources returns the cloud-init paths, the cos.setup URI and the /proc/cmdline content
+// used to run the given stage
+func stageSources(cfg *v1.RunConfig) (cloudInitPaths []string, cmdLineYipURI string, cmdLine string, err error) {
+	cloudInitPaths = constants.GetCloudInitPaths()
 
 	// Check if we have extra cloud init
 	// This requires fixing the env vars, otherwise it wont work
 	if cfg.CloudInitPaths != "" {
 		cfg.Logger.Debugf("Adding extra paths: %s", cfg.CloudInitPaths)
 		extraCloudInitPathsSplit := strings.Split(cfg.CloudInitPaths, " ")
-		CloudInitPaths = append(CloudInitPaths, extraCloudInitPathsSplit...)
+		cloudInitPaths = append(cloudInitPaths, extraCloudInitPathsSplit...)
 	}
 
-	// Make sure cloud init path specified are existing in the system
-	for _, cp := range CloudInitPaths {
-		err := MkdirAll(cfg.Fs, cp, constants.DirPerm)
-		if err != nil {
-			cfg.Logger.Debugf("Failed creating cloud-init config path: %s %s", cp, err.Error())
-		}
-	}
-
-	stageBefore := fmt.Sprintf("%s.before", stage)
-	stageAfter := fmt.Sprintf("%s.after", stage)
-
 	// Check if the cmdline has the cos.setup key and extract its value to run yip on that given uri
 	cmdLineOut, err := cfg.Fs.ReadFile("/proc/cmdline")
-	if err != nil {
-		allErrors = multierror.Append(allErrors, err)
-	}
 
-	cmdLine := strings.Split(string(cmdLineOut), " ")
-	for _, line := range cmdLine {
+	for _, line := range strings.Split(string(cmdLineOut), " ") {
 		if strings.Contains(line, "=") {
 			lineSplit := strings.Split(line, "=")
 			if lineSplit[0] == "cos.setup" {
@@ -97,6 +81,53 @@ func RunStage(stage string, cfg *v1.RunConfig) error {
 			}
 		}
 	}
+	return cloudInitPaths, cmdLineYipURI, string(cmdLineOut), err
+}
+
+// ListStage returns the steps RunStage runs for the given stage, in order. Steps
+// skipped by conditionals are included and steps of remote sources are not.
+func ListStage(stage string, cfg *v1.RunConfig) []v1.CloudInitStep {
+	var steps []v1.CloudInitStep
+
+	cloudInitPaths, cmdLineYipURI, cmdLine, _ := stageSources(cfg)
+	stages := []string{fmt.Sprintf("%s.before", stage), stage, fmt.Sprintf("%s.after", stage)}
+
+	for _, s := range stages {
+		steps = append(steps, cfg.CloudInitRunner.Steps(s, cloudInitPaths...)...)
+	}
+	if cmdLineYipURI != "" {
+		for _, s := range stages {
+			steps = append(steps, cfg.CloudInitRunner.Steps(s, cmdLineYipURI)...)
+		}
+	}
+	cfg.CloudInitRunner.SetModifier(schema.DotNotationModifier)
+	for _, s := range stages {
+		steps = append(steps, cfg.CloudInitRunner.Steps(s, cmdLine)...)
+	}
+	cfg.CloudInitRunner.SetModifier(nil)
+
+	return steps
+}
+
+// RunStage will run yip
+func RunStage(stage string, cfg *v1.RunConfig) error {
+	var allErrors error
+
+	CloudInitPaths, cmdLineYipURI, cmdLineOut, err := stageSources(cfg)
+	if err != nil {
+		allErrors = multierror.Append(allErrors, err)
+	}
+
+	// Make sure cloud init path specified are existing in the system
+	for _, cp := range CloudInitPaths {
+		err := MkdirAll(cfg.Fs, cp, constants.DirPerm)
+		if err != nil {
+			cfg.Logger.Debugf("Failed creating cloud-init config path: %s %s", cp, err.Error())
+		}
+	}
+
+	stageBefore := fmt.Sprintf("%s.before", stage)
+	stageAfter := fmt.Sprintf("%s.after", stage)
 
 	// Run all stages for each of the default cloud config paths + extra cloud config paths
 	for _, s := range []string{stageBefore, stage, stageAfter} {
@@ -121,7 +152,7 @@ func RunStage(stage string, cfg *v1.RunConfig) error {
 	cfg.CloudInitRunner.SetModifier(schema.DotNotationModifier)
 
 	for _, s := range []string{stageBefore, stage, stageAfter} {
-		err = cfg.CloudInitRunner.Run(s, string(cmdLineOut))
+		err = cfg.CloudInitRunner.Run(s, cmdLineOut)
 		if err != nil {
 			allErrors = checkYAMLError(cfg, allErrors, err)
 		}
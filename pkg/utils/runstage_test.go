@@ -143,4 +143,24 @@ var _ = Describe("run stage", Label("RunStage", "root"), func() {
 		Expect(memLog.String()).To(ContainSubstring("/proc/cmdline parsing returned errors while unmarshalling"))
 		Expect(memLog.String()).ToNot(ContainSubstring("Some errors found but were ignored. Enable --strict mode to fail on those or --debug to see them in the log"))
 	})
+
+	It("lists the steps of all the sources in order", func() {
+		ci := &v1mock.FakeCloudInitRunner{StepList: []v1.CloudInitStep{
+			{Source: "/some/01.yaml", Stage: "yoda.before", Name: "before"},
+			{Source: "/some/01.yaml", Stage: "yoda", Name: "main"},
+			{Source: "/some/01.yaml", Stage: "yoda.after", Name: "after"},
+			{Source: "/some/01.yaml", Stage: "vader", Name: "other"},
+		}}
+		config.CloudInitRunner = ci
+		config.CloudInitPaths = "/some/extra"
+		steps := utils.ListStage("yoda", config)
+		// Each stage is listed for the cloud-init paths and for the cmdline
+		Expect(len(steps)).To(Equal(6))
+		Expect(steps[0].Name).To(Equal("before"))
+		Expect(steps[1].Name).To(Equal("main"))
+		Expect(steps[2].Name).To(Equal("after"))
+		// Listing does not create the cloud-init paths
+		_, err := fs.Stat("/some/extra")
+		Expect(err).To(HaveOccurred())
+	})
 })
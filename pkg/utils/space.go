@@ -0,0 +1,99 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// SpaceRequirement is the space in MiB an operation needs on the filesystem holding Path
+type SpaceRequirement struct {
+	Path   string
+	Size   uint
+	Reason string
+}
+
+// fsSpace accumulates the requirements of a single filesystem
+type fsSpace struct {
+	path      string
+	available uint64
+	required  uint64
+	reasons   []string
+}
+
+// CheckFreeSpace verifies there is enough free space for all the given requirements.
+// Paths do not need to exist, the closest existing parent is checked instead.
+// Requirements on the same filesystem add up.
+func CheckFreeSpace(config *v1.RunConfig, reqs ...SpaceRequirement) error {
+	var order []syscall.Fsid
+	filesystems := map[syscall.Fsid]*fsSpace{}
+
+	for _, req := range reqs {
+		path := existingParent(config.Fs, req.Path)
+		raw, err := config.Fs.RawPath(path)
+		if err != nil {
+			return err
+		}
+		var st syscall.Statfs_t
+		err = config.Syscall.Statfs(raw, &st)
+		if err != nil {
+			return fmt.Errorf("failed checking free space on %s: %w", path, err)
+		}
+		fs, ok := filesystems[st.Fsid]
+		if !ok {
+			fs = &fsSpace{path: path, available: st.Bavail * uint64(st.Bsize)}
+			filesystems[st.Fsid] = fs
+			order = append(order, st.Fsid)
+		}
+		fs.required += uint64(req.Size) * 1024 * 1024
+		fs.reasons = append(fs.reasons, fmt.Sprintf("%d MiB for %s", req.Size, req.Reason))
+	}
+
+	for _, id := range order {
+		fs := filesystems[id]
+		config.Logger.Debugf(
+			"Space on %s: %d MiB required, %d MiB available", fs.path, fs.required>>20, fs.available>>20,
+		)
+		if fs.required > fs.available {
+			return fmt.Errorf(
+				"not enough free space on %s: %d MiB required (%s), %d MiB available",
+				fs.path, fs.required>>20, strings.Join(fs.reasons, ", "), fs.available>>20,
+			)
+		}
+	}
+	return nil
+}
+
+// existingParent returns the given path or its closest existing parent
+func existingParent(fs v1.FS, path string) string {
+	path = filepath.Clean(path)
+	for {
+		if exists, _ := Exists(fs, path); exists {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
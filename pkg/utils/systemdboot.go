@@ -0,0 +1,425 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	cnst "github.com/rancher-sandbox/elemental/pkg/constants"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+const (
+	loaderConf       = "loader/loader.conf"
+	loaderEntriesDir = "loader/entries"
+	loaderKernelDir  = "elemental"
+	extraArgsComment = "# elemental extra kernel arguments"
+	stagingSuffix    = ".new"
+)
+
+// SystemdBoot installs systemd-boot into the EFI partition and manages its
+// Boot Loader Specification entries
+type SystemdBoot struct {
+	config *v1.RunConfig
+}
+
+func NewSystemdBoot(config *v1.RunConfig) *SystemdBoot {
+	return &SystemdBoot{config: config}
+}
+
+// Install copies the systemd-boot EFI binary into the EFI partition, copies the kernel
+// and the initrd of the active image for each configured image and writes their entries.
+// Passive and recovery images are deployed from the active image on install.
+func (s SystemdBoot) Install() error {
+	s.config.Logger.Info("Installing systemd-boot..")
+
+	efiExists, _ := Exists(s.config.Fs, cnst.EfiDevice)
+	if !s.config.ForceEfi && !efiExists {
+		return errors.New("systemd-boot requires an EFI system")
+	}
+	if s.config.SecureBoot {
+		return errors.New("secure boot is only supported with grub")
+	}
+
+	activeImg := s.config.Images.GetActive()
+	if activeImg == nil {
+		s.config.Logger.Errorf("Active image configuration is missing")
+		return errors.New("failed installing systemd-boot")
+	}
+	espDir, err := s.espDir()
+	if err != nil {
+		return err
+	}
+
+	suffix := efiArchSuffix(runtime.GOARCH)
+	loader := filepath.Join(activeImg.MountPoint, "/usr/lib/systemd/boot/efi", fmt.Sprintf("systemd-boot%s.efi", suffix))
+	if ok, _ := Exists(s.config.Fs, loader); !ok {
+		return fmt.Errorf("systemd-boot EFI binary not found in the OS image: %s", loader)
+	}
+	copies := [][]string{
+		{loader, filepath.Join(espDir, "EFI/BOOT", fmt.Sprintf("boot%s.efi", suffix))},
+		{loader, filepath.Join(espDir, "EFI/systemd", fmt.Sprintf("systemd-boot%s.efi", suffix))},
+	}
+	for _, name := range []string{cnst.ActiveImgName, cnst.PassiveImgName, cnst.RecoveryImgName} {
+		if s.config.Images[name] == nil {
+			continue
+		}
+		copies = append(copies, kernelCopies(activeImg.MountPoint, s.kernelDir(espDir, name))...)
+	}
+	for _, c := range copies {
+		s.config.Logger.Debugf("Copying %s to %s", c[0], c[1])
+		err = MkdirAll(s.config.Fs, filepath.Dir(c[1]), cnst.DirPerm)
+		if err != nil {
+			return err
+		}
+		err = CopyFile(s.config.Fs, c[0], c[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = MkdirAll(s.config.Fs, filepath.Join(espDir, loaderEntriesDir), cnst.DirPerm)
+	if err != nil {
+		return err
+	}
+	conf := fmt.Sprintf("timeout 5\ndefault %s.conf\n", cnst.ActiveImgName)
+	err = s.config.Fs.WriteFile(filepath.Join(espDir, loaderConf), []byte(conf), cnst.FilePerm)
+	if err != nil {
+		return err
+	}
+
+	titles := BootEntryTitles(s.config)
+	for _, name := range []string{cnst.ActiveImgName, cnst.PassiveImgName, cnst.RecoveryImgName} {
+		img := s.config.Images[name]
+		if img == nil {
+			continue
+		}
+		rootLabel := s.config.StateLabel
+		if name == cnst.RecoveryImgName {
+			rootLabel = s.config.RecoveryLabel
+		}
+		options := fmt.Sprintf("root=LABEL=%s cos-img/filename=%s panic=5 rd.cos.oemlabel=%s", rootLabel, imageBootPath(img), s.config.OEMLabel)
+		if args := KernelArgs(s.config, s.config.Consoles); args != "" {
+			options = fmt.Sprintf("%s %s", options, args)
+		}
+		entry := fmt.Sprintf(
+			"title %s\nlinux /%s/%s/vmlinuz\ninitrd /%s/%s/initrd\noptions %s\n",
+			titles[name], loaderKernelDir, name, loaderKernelDir, name, options,
+		)
+		err = s.config.Fs.WriteFile(s.entryFile(espDir, name), []byte(entry), cnst.FilePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.config.Logger.Infof("systemd-boot install to %s complete", espDir)
+	return nil
+}
+
+// StageKernel copies the kernel and the initrd of the system in root to a staging
+// directory for the entry of the given image. Staged files are only booted once
+// committed with CommitKernel, so a failed upgrade keeps the current ones.
+func (s SystemdBoot) StageKernel(name, root string) error {
+	return s.withESP(func(espDir string) error {
+		staging := s.kernelDir(espDir, name) + stagingSuffix
+		if err := s.config.Fs.RemoveAll(staging); err != nil {
+			return err
+		}
+		if err := MkdirAll(s.config.Fs, staging, cnst.DirPerm); err != nil {
+			return err
+		}
+		for _, c := range kernelCopies(root, staging) {
+			s.config.Logger.Debugf("Copying %s to %s", c[0], c[1])
+			if err := CopyFile(s.config.Fs, c[0], c[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CommitKernel replaces the kernel and the initrd of the given image with the staged
+// ones. Committing the active image first moves the current active kernel to the passive
+// entry, as the active image becomes the passive one on upgrade.
+func (s SystemdBoot) CommitKernel(name string) error {
+	return s.withESP(func(espDir string) error {
+		current := s.kernelDir(espDir, name)
+		staging := current + stagingSuffix
+		if ok, _ := Exists(s.config.Fs, staging); !ok {
+			return fmt.Errorf("no staged kernel found for %s", name)
+		}
+		if name == cnst.ActiveImgName {
+			if err := s.replaceKernel(current, s.kernelDir(espDir, cnst.PassiveImgName)); err != nil {
+				return err
+			}
+		}
+		if err := s.replaceKernel(staging, current); err != nil {
+			return err
+		}
+		return s.config.Fs.RemoveAll(staging)
+	})
+}
+
+// DiscardKernel removes the staged kernel and initrd of the given image, if any
+func (s SystemdBoot) DiscardKernel(name string) error {
+	return s.withESP(func(espDir string) error {
+		return s.config.Fs.RemoveAll(s.kernelDir(espDir, name) + stagingSuffix)
+	})
+}
+
+// replaceKernel copies the kernel and the initrd in the src directory to dst
+func (s SystemdBoot) replaceKernel(src, dst string) error {
+	if err := MkdirAll(s.config.Fs, dst, cnst.DirPerm); err != nil {
+		return err
+	}
+	for _, file := range []string{"vmlinuz", "initrd"} {
+		s.config.Logger.Debugf("Copying %s to %s", filepath.Join(src, file), dst)
+		if err := CopyFile(s.config.Fs, filepath.Join(src, file), filepath.Join(dst, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kernelCopies returns the source and destination pairs to copy the kernel and the
+// initrd of the system in root to the dst directory
+func kernelCopies(root, dst string) [][]string {
+	return [][]string{
+		{filepath.Join(root, "boot/vmlinuz"), filepath.Join(dst, "vmlinuz")},
+		{filepath.Join(root, "boot/initrd"), filepath.Join(dst, "initrd")},
+	}
+}
+
+// SetDefaultEntry sets the default entry in loader.conf, the entry can be given by ID or title
+func (s SystemdBoot) SetDefaultEntry(entry string) error {
+	espDir, err := s.espDir()
+	if err != nil {
+		return err
+	}
+	id, err := s.findEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	data, err := s.config.Fs.ReadFile(filepath.Join(espDir, loaderConf))
+	if err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line != "" && !strings.HasPrefix(line, "default ") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	lines = append(lines, fmt.Sprintf("default %s.conf", id))
+	return s.config.Fs.WriteFile(filepath.Join(espDir, loaderConf), []byte(strings.Join(lines, "\n")+"\n"), cnst.FilePerm)
+}
+
+// SetEntryTitles renames the active, passive and recovery entries after the default
+// entry name, as grub does with its default_menu_entry variable
+func (s SystemdBoot) SetEntryTitles() error {
+	if s.config.GrubDefEntry == "" {
+		return nil
+	}
+	espDir, err := s.espDir()
+	if err != nil {
+		return err
+	}
+	titles := BootEntryTitles(s.config)
+	for _, name := range []string{cnst.ActiveImgName, cnst.PassiveImgName, cnst.RecoveryImgName} {
+		data, err := s.config.Fs.ReadFile(s.entryFile(espDir, name))
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(string(data), "\n")
+		for i, line := range lines {
+			if strings.HasPrefix(line, "title ") {
+				lines[i] = fmt.Sprintf("title %s", titles[name])
+			}
+		}
+		err = s.config.Fs.WriteFile(s.entryFile(espDir, name), []byte(strings.Join(lines, "\n")), cnst.FilePerm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetOneShotEntry sets the entry to boot on next boot only, the entry can be given by ID or title
+func (s SystemdBoot) SetOneShotEntry(entry string) error {
+	id, err := s.findEntry(entry)
+	if err != nil {
+		return err
+	}
+	out, err := s.config.Runner.Run("bootctl", "set-oneshot", fmt.Sprintf("%s.conf", id))
+	if err != nil {
+		s.config.Logger.Errorf("Failed setting one shot entry: %s", out)
+	}
+	return err
+}
+
+// SetKernelArgs sets extra kernel arguments as an additional options line of the
+// given entry, or of all entries if no entry is given
+func (s SystemdBoot) SetKernelArgs(entry string, args string) error {
+	espDir, err := s.espDir()
+	if err != nil {
+		return err
+	}
+	entries, err := s.ListEntries()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if entry != "" && entry != e.ID && entry != e.Title {
+			continue
+		}
+		data, err := s.config.Fs.ReadFile(s.entryFile(espDir, e.ID))
+		if err != nil {
+			return err
+		}
+		content := strings.TrimRight(strings.Split(string(data), extraArgsComment)[0], "\n") + "\n"
+		if args != "" {
+			content = fmt.Sprintf("%s%s\noptions %s\n", content, extraArgsComment, args)
+		}
+		err = s.config.Fs.WriteFile(s.entryFile(espDir, e.ID), []byte(content), cnst.FilePerm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListEntries returns the entries found in the EFI partition sorted by ID
+func (s SystemdBoot) ListEntries() ([]v1.BootEntry, error) {
+	espDir, err := s.espDir()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.config.Fs.Open(filepath.Join(espDir, loaderEntriesDir))
+	if err != nil {
+		return nil, err
+	}
+	files, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	def := ""
+	if data, err := s.config.Fs.ReadFile(filepath.Join(espDir, loaderConf)); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "default ") {
+				def = strings.TrimSpace(strings.TrimPrefix(line, "default "))
+			}
+		}
+	}
+
+	entries := []v1.BootEntry{}
+	defFound := false
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".conf" {
+			continue
+		}
+		entry := v1.BootEntry{ID: strings.TrimSuffix(file.Name(), ".conf")}
+		data, err := s.config.Fs.ReadFile(filepath.Join(espDir, loaderEntriesDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "title ") {
+				entry.Title = strings.TrimSpace(strings.TrimPrefix(line, "title "))
+			}
+		}
+		if match, _ := filepath.Match(def, file.Name()); match && !defFound {
+			entry.Default = true
+			defFound = true
+		}
+		entries = append(entries, entry)
+	}
+	if !defFound && len(entries) > 0 {
+		entries[0].Default = true
+	}
+	return entries, nil
+}
+
+// findEntry returns the ID of the entry matching the given ID or title
+func (s SystemdBoot) findEntry(entry string) (string, error) {
+	entries, err := s.ListEntries()
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.ID == entry || e.Title == entry {
+			return e.ID, nil
+		}
+	}
+	return "", fmt.Errorf("boot entry '%s' not found", entry)
+}
+
+// entryFile returns the path of the entry file for the given ID
+func (s SystemdBoot) entryFile(espDir, id string) string {
+	return filepath.Join(espDir, loaderEntriesDir, fmt.Sprintf("%s.conf", id))
+}
+
+// kernelDir returns the directory holding the kernel and the initrd of the given image
+func (s SystemdBoot) kernelDir(espDir, name string) string {
+	return filepath.Join(espDir, loaderKernelDir, name)
+}
+
+// withESP runs fn with the mount point of the EFI partition. The partition is mounted
+// in a temporary directory and unmounted afterwards if it is not already mounted.
+func (s SystemdBoot) withESP(fn func(string) error) (err error) {
+	if part := s.config.Partitions.GetByName(cnst.EfiPartName); part != nil {
+		return fn(part.MountPoint)
+	}
+	part, err := GetFullDeviceByLabel(s.config.Runner, cnst.EfiLabel, 5)
+	if err != nil {
+		return fmt.Errorf("partition %s not found", cnst.EfiLabel)
+	}
+	if part.MountPoint != "" {
+		return fn(part.MountPoint)
+	}
+
+	tmpDir, err := TempDir(s.config.Fs, "", "elemental-esp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = s.config.Fs.RemoveAll(tmpDir) }()
+	err = s.config.Mounter.Mount(part.Path, tmpDir, "auto", []string{"rw"})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		uErr := s.config.Mounter.Unmount(tmpDir)
+		if err == nil {
+			err = uErr
+		}
+	}()
+	return fn(tmpDir)
+}
+
+// espDir returns the mount point of the EFI partition
+func (s SystemdBoot) espDir() (string, error) {
+	return bootPartitionDir(s.config, cnst.EfiPartName, cnst.EfiLabel)
+}
@@ -18,6 +18,8 @@ package utils_test
 
 import (
 	"bytes"
+	"context"
+	"debug/elf"
 	"errors"
 	"fmt"
 	"github.com/jaypipes/ghw/pkg/block"
@@ -161,6 +163,103 @@ var _ = Describe("Utils", Label("utils"), func() {
 				Expect(err.Error()).To(ContainSubstring("failed closing chroot"))
 			})
 		})
+		Describe("isolated", Label("isolated"), func() {
+			BeforeEach(func() {
+				chroot = utils.NewIsolatedChroot("/whatever", config)
+				chroot.SetExtraMounts(map[string]string{"/real/path": "/in/chroot/path"})
+			})
+			It("runs a callback in a private mount namespace", func() {
+				Expect(utils.MkdirAll(fs, "/whatever/etc", constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile("/etc/resolv.conf", []byte("nameserver 1.1.1.1"), constants.FilePerm)).To(Succeed())
+				called := false
+				err := chroot.RunCallback(func() error {
+					called = true
+					return nil
+				})
+				Expect(err).To(BeNil())
+				Expect(called).To(BeTrue())
+				Expect(syscall.Unshared).NotTo(BeZero())
+				Expect(syscall.WasChrootCalledWith("/whatever")).To(BeTrue())
+				for _, mnt := range []string{"/", "/whatever/dev", "/whatever/dev/pts", "/whatever/proc", "/whatever/sys", "/whatever/in/chroot/path", "/whatever/etc/resolv.conf"} {
+					Expect(syscall.WasMountCalledWith(mnt)).To(BeTrue(), mnt)
+				}
+				// Nothing is mounted with the host mounter nor left in the chroot
+				Expect(mounter.List()).To(BeEmpty())
+				Expect(utils.Exists(fs, "/whatever/etc/resolv.conf")).To(BeFalse())
+			})
+			It("fails if the mount namespace can't be created", func() {
+				syscall.ErrorOnUnshare = true
+				called := false
+				err := chroot.RunCallback(func() error {
+					called = true
+					return nil
+				})
+				Expect(err).NotTo(BeNil())
+				Expect(called).To(BeFalse())
+				Expect(syscall.WasChrootCalledWith("/whatever")).To(BeFalse())
+			})
+			It("fails if mounting fails", Label("mount"), func() {
+				syscall.ErrorOnMount = true
+				_, err := chroot.Run("chroot-command")
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("mount error"))
+			})
+			It("returns the callback error and recovers from panics", func() {
+				err := chroot.RunCallback(func() error {
+					return errors.New("callback error")
+				})
+				Expect(err).To(MatchError("callback error"))
+				err = chroot.RunCallback(func() error {
+					panic("hook crashed")
+				})
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("hook crashed"))
+			})
+		})
+	})
+	Describe("RootArch", Label("arch"), func() {
+		It("Returns the architecture of the root tree binaries", func() {
+			Expect(utils.MkdirAll(fs, "/root/usr/bin", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/root/usr/bin/bash", v1mock.FakeELF(elf.EM_AARCH64), constants.FilePerm)).To(Succeed())
+			Expect(fs.Symlink("/usr/bin/bash", "/root/usr/bin/sh")).To(Succeed())
+
+			arch, err := utils.RootArch(fs, "/root")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(arch).To(Equal("arm64"))
+			Expect(utils.CheckRootArch(fs, "/root", &v1.Platform{OS: "linux", Arch: "arm64"})).To(Succeed())
+			Expect(utils.CheckRootArch(fs, "/root", &v1.Platform{OS: "linux", Arch: "amd64"})).NotTo(Succeed())
+		})
+		It("Resolves intermediate symlinks within the root tree", func() {
+			// The host binary must not be found through the absolute /bin link
+			Expect(utils.MkdirAll(fs, "/usr/bin", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/usr/bin/sh", v1mock.FakeELF(elf.EM_X86_64), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/root/usr/lib/busybox", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/root/usr/lib/busybox/busybox", v1mock.FakeELFData(elf.EM_PPC64, elf.ELFDATA2MSB), constants.FilePerm)).To(Succeed())
+			Expect(fs.Symlink("/usr/bin", "/root/bin")).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/root/usr/bin", constants.DirPerm)).To(Succeed())
+			Expect(fs.Symlink("../lib/busybox/./busybox", "/root/usr/bin/busybox")).To(Succeed())
+
+			arch, err := utils.RootArch(fs, "/root")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(arch).To(Equal("ppc64"))
+
+			Expect(fs.WriteFile("/root/usr/lib/busybox/busybox", v1mock.FakeELFData(elf.EM_PPC64, elf.ELFDATA2LSB), constants.FilePerm)).To(Succeed())
+			arch, err = utils.RootArch(fs, "/root")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(arch).To(Equal("ppc64le"))
+		})
+		It("Fails on symlink loops", func() {
+			Expect(utils.MkdirAll(fs, "/root/usr", constants.DirPerm)).To(Succeed())
+			Expect(fs.Symlink("/usr/bin", "/root/bin")).To(Succeed())
+			Expect(fs.Symlink("/bin", "/root/usr/bin")).To(Succeed())
+			_, err := utils.RootArch(fs, "/root")
+			Expect(err).To(HaveOccurred())
+		})
+		It("Fails if there are no binaries", func() {
+			Expect(utils.MkdirAll(fs, "/root/usr/bin", constants.DirPerm)).To(Succeed())
+			_, err := utils.RootArch(fs, "/root")
+			Expect(err).To(HaveOccurred())
+		})
 	})
 	Describe("TestBootedFrom", Label("BootedFrom"), func() {
 		It("returns true if we are booting from label FAKELABEL", func() {
@@ -172,6 +271,35 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(utils.BootedFrom(runner, "FAKELABEL")).To(BeTrue())
 		})
 	})
+	Describe("BootedSlot", Label("BootedSlot"), func() {
+		It("returns the slot matching the labels in cmdline", func() {
+			runner.ReturnValue = []byte("root=LABEL=COS_PASSIVE")
+			Expect(utils.BootedSlot(config)).To(Equal(constants.PassiveImgName))
+			runner.ReturnValue = []byte("root=LABEL=COS_SYSTEM")
+			Expect(utils.BootedSlot(config)).To(Equal(constants.RecoveryImgName))
+			runner.ReturnValue = []byte("root=live:CDLABEL=COS_LIVE")
+			Expect(utils.BootedSlot(config)).To(Equal(""))
+		})
+	})
+	Describe("GetHookExecutables", Label("hooks"), func() {
+		It("returns executables sorted by name, latest hook path takes precedence", func() {
+			files := map[string]os.FileMode{
+				"/usr/lib/elemental/hooks/after-upgrade.d/20_b": 0755,
+				"/usr/lib/elemental/hooks/after-upgrade.d/10_a": 0755,
+				"/oem/elemental/hooks/after-upgrade.d/10_a":     0755,
+				"/etc/elemental/hooks/after-upgrade.d/05_data":  0644,
+			}
+			for f, mode := range files {
+				Expect(utils.MkdirAll(fs, filepath.Dir(f), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(f, []byte{}, mode)).To(Succeed())
+			}
+			Expect(utils.GetHookExecutables(fs, "after-upgrade")).To(Equal([]string{
+				"/oem/elemental/hooks/after-upgrade.d/10_a",
+				"/usr/lib/elemental/hooks/after-upgrade.d/20_b",
+			}))
+			Expect(utils.GetHookExecutables(fs, "before-upgrade")).To(BeEmpty())
+		})
+	})
 	Describe("GetDeviceByLabel", Label("lsblk", "partitions"), func() {
 		var cmds [][]string
 		BeforeEach(func() {
@@ -579,9 +707,30 @@ var _ = Describe("Utils", Label("utils"), func() {
 				targetGrub, err := fs.ReadFile(fmt.Sprintf("%s/grub2/grub.cfg", constants.StateDir))
 				Expect(err).To(BeNil())
 				// Should not be modified at all
-				Expect(targetGrub).To(ContainSubstring("console=tty1"))
+				Expect(targetGrub).To(HavePrefix("console=tty1\n"))
+				// Applies and clears the next boot kernel arguments
+				Expect(targetGrub).To(ContainSubstring("# elemental: kernel arguments for the next boot only"))
+				Expect(targetGrub).To(ContainSubstring("  set extra_passive_cmdline=\"${next_extra_passive_cmdline}\"\n"))
+				Expect(targetGrub).To(ContainSubstring("  save_env -f \"${next_boot_env}\" next_extra_cmdline\n"))
 
 			})
+			It("falls back to x86_64 on unknown architectures", Label("efi"), func() {
+				buf := &bytes.Buffer{}
+				logger := log.New()
+				logger.SetOutput(buf)
+				logger.SetLevel(log.DebugLevel)
+
+				Expect(utils.MkdirAll(fs, filepath.Dir(filepath.Join(config.Images.GetActive().MountPoint, constants.GrubConf)), constants.DirPerm)).To(Succeed())
+				Expect(utils.MkdirAll(fs, filepath.Dir(constants.EfiDevice), constants.DirPerm)).To(Succeed())
+				_, _ = fs.Create(filepath.Join(config.Images.GetActive().MountPoint, constants.GrubConf))
+				_, _ = fs.Create(constants.EfiDevice)
+
+				config.Logger = logger
+				config.Platform = &v1.Platform{OS: "linux", Arch: "ppc64le"}
+				Expect(utils.NewGrub(config).Install()).To(Succeed())
+				Expect(buf.String()).To(ContainSubstring("Unknown ppc64le architecture for grub, installing for x86_64"))
+				Expect(buf.String()).To(ContainSubstring("--target=x86_64-efi"))
+			})
 			It("installs with efi on efi system", Label("efi"), func() {
 				buf := &bytes.Buffer{}
 				logger := log.New()
@@ -660,6 +809,64 @@ var _ = Describe("Utils", Label("utils"), func() {
 				Expect(err).To(BeNil())
 				Expect(targetGrub).To(ContainSubstring("console=tty1 console=serial"))
 			})
+			It("renders grub config templates", func() {
+				fs.Mkdir("/dev", constants.DirPerm)
+				_, err := fs.Create("/dev/ttyS0")
+				Expect(err).ShouldNot(HaveOccurred())
+
+				err = utils.MkdirAll(fs, fmt.Sprintf("%s/grub2/", constants.StateDir), constants.DirPerm)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				grubCfg := filepath.Join(config.Images.GetActive().MountPoint, constants.GrubConf)
+				err = utils.MkdirAll(fs, filepath.Dir(grubCfg), constants.DirPerm)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				tmpl := `{{ if .Timeout }}set timeout={{ .Timeout }}{{ end }}
+{{ if .Serial }}serial {{ .Serial }}{{ end }}
+menuentry "{{ .Titles.passive }}" --id fallback {
+  linux /boot/vmlinuz root=LABEL={{ .StateLabel }} {{ .KernelArgs }}
+}`
+				err = fs.WriteFile(grubCfg, []byte(tmpl), 0644)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				config.Tty = "ttyS0"
+				config.KernelArgs = "selinux=0"
+				config.GrubTimeout = 10
+				config.GrubSerial = "--unit=0 --speed=115200"
+				config.BootEntryTitles = map[string]string{"passive": "Fallback"}
+
+				grub := utils.NewGrub(config)
+				Expect(grub.Install()).To(Succeed())
+
+				targetGrub, err := fs.ReadFile(fmt.Sprintf("%s/grub2/grub.cfg", constants.StateDir))
+				Expect(err).To(BeNil())
+				Expect(string(targetGrub)).To(Equal(`set timeout=10
+serial --unit=0 --speed=115200
+menuentry "Fallback" --id fallback {
+  linux /boot/vmlinuz root=LABEL=COS_STATE console=tty1 console=ttyS0 selinux=0
+}`))
+			})
+			It("sets kernel args of plain grub configs in the grub environment", func() {
+				err := utils.MkdirAll(fs, fmt.Sprintf("%s/grub2/", constants.StateDir), constants.DirPerm)
+				Expect(err).ShouldNot(HaveOccurred())
+				grubCfg := filepath.Join(config.Images.GetActive().MountPoint, constants.GrubConf)
+				Expect(utils.MkdirAll(fs, filepath.Dir(grubCfg), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(grubCfg, []byte("linux /boot/vmlinuz ${extra_cmdline}"), 0644)).To(Succeed())
+
+				config.KernelArgs = "selinux=0"
+				config.Consoles = []string{"ttyS0"}
+				grub := utils.NewGrub(config)
+				Expect(grub.Install()).To(Succeed())
+				Expect(runner.IncludesCmds([][]string{{
+					"grub2-editenv", filepath.Join(constants.StateDir, constants.GrubEnv), "set", "extra_cmdline=console=ttyS0 selinux=0",
+				}})).To(Succeed())
+
+				config.GrubTimeout = 10
+				config.BootEntryTitles = map[string]string{"passive": "Fallback"}
+				err = grub.Install()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("grub-timeout, boot entry titles can only be applied with a templated grub config"))
+			})
 			It("Fails if active image is unset", func() {
 				config.Images.SetActive(nil)
 				grub := utils.NewGrub(config)
@@ -680,6 +887,68 @@ var _ = Describe("Utils", Label("utils"), func() {
 
 				Expect(buf).To(ContainSubstring("Failed reading grub config file"))
 			})
+			Describe("Secure Boot", Label("efi", "secureboot"), func() {
+				var efiDir string
+				BeforeEach(func() {
+					activeDir := config.Images.GetActive().MountPoint
+					efiDir = filepath.Join(activeDir, "/usr/share/efi/x86_64")
+					err := utils.MkdirAll(fs, filepath.Dir(filepath.Join(activeDir, constants.GrubConf)), constants.DirPerm)
+					Expect(err).ShouldNot(HaveOccurred())
+					_, err = fs.Create(filepath.Join(activeDir, constants.GrubConf))
+					Expect(err).ShouldNot(HaveOccurred())
+					err = utils.MkdirAll(fs, fmt.Sprintf("%s/grub2/", constants.StateDir), constants.DirPerm)
+					Expect(err).ShouldNot(HaveOccurred())
+					err = utils.MkdirAll(fs, efiDir, constants.DirPerm)
+					Expect(err).ShouldNot(HaveOccurred())
+					config.ForceEfi = true
+				})
+				It("installs shim, signed grub and MokManager in the EFI partition", func() {
+					for _, f := range []string{"shim.efi", "grub.efi", "MokManager.efi"} {
+						Expect(fs.WriteFile(filepath.Join(efiDir, f), []byte(f), constants.FilePerm)).To(Succeed())
+					}
+					config.SecureBoot = true
+
+					grub := utils.NewGrub(config)
+					Expect(grub.Install()).To(Succeed())
+
+					bootDir := filepath.Join(constants.EfiDir, "EFI/BOOT")
+					data, err := fs.ReadFile(filepath.Join(bootDir, "bootx64.efi"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(data)).To(Equal("shim.efi"))
+					for _, f := range []string{"grub.efi", "grubx64.efi"} {
+						data, err = fs.ReadFile(filepath.Join(bootDir, f))
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(string(data)).To(Equal("grub.efi"))
+					}
+					for _, f := range []string{"MokManager.efi", "mmx64.efi"} {
+						data, err = fs.ReadFile(filepath.Join(bootDir, f))
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(string(data)).To(Equal("MokManager.efi"))
+					}
+					data, err = fs.ReadFile(filepath.Join(bootDir, "grub.cfg"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(data)).To(ContainSubstring("configfile ($root)/grub2/grub.cfg"))
+				})
+				It("fails if secure boot is required and the image has no signed binaries", func() {
+					config.SecureBoot = true
+					grub := utils.NewGrub(config)
+					err := grub.Install()
+					Expect(errors.Is(err, utils.ErrNoSignedBinaries)).To(BeTrue())
+				})
+				It("skips secure boot setup if not required and the image has no signed binaries", func() {
+					grub := utils.NewGrub(config)
+					Expect(grub.Install()).To(Succeed())
+					exists, _ := utils.Exists(fs, filepath.Join(constants.EfiDir, "EFI/BOOT/grub.cfg"))
+					Expect(exists).To(BeFalse())
+				})
+				It("fails if secure boot is required on a non EFI system", func() {
+					config.ForceEfi = false
+					config.SecureBoot = true
+					grub := utils.NewGrub(config)
+					Expect(grub.Install()).NotTo(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"grub2-install"}})).NotTo(BeNil())
+				})
+			})
 		})
 		Describe("SetPersistentVariables", func() {
 			It("Sets the grub environment file", func() {
@@ -703,6 +972,177 @@ var _ = Describe("Utils", Label("utils"), func() {
 				})).To(BeNil())
 			})
 		})
+		Describe("Bootloader", Label("bootloader"), func() {
+			BeforeEach(func() {
+				config.Partitions = append(config.Partitions, &v1.Partition{Name: constants.StatePartName, MountPoint: constants.StateDir})
+				Expect(utils.MkdirAll(fs, filepath.Join(constants.StateDir, "grub2"), constants.DirPerm)).To(Succeed())
+			})
+			It("sets default and one shot entries and kernel args in grub environment", func() {
+				config.GrubDefEntry = "TESTOS"
+				grub := utils.NewGrub(config)
+				Expect(grub.SetDefaultEntry("fallback")).To(Succeed())
+				Expect(grub.SetEntryTitles()).To(Succeed())
+				Expect(grub.SetOneShotEntry("recovery")).To(Succeed())
+				Expect(grub.SetKernelArgs("", "quiet")).To(Succeed())
+				Expect(grub.SetKernelArgs("passive", "debug")).To(Succeed())
+				grubEnv := filepath.Join(constants.StateDir, constants.GrubEnv)
+				Expect(runner.CmdsMatch([][]string{
+					{"grub2-editenv", grubEnv, "set", "saved_entry=fallback"},
+					{"grub2-editenv", filepath.Join(constants.StateDir, constants.GrubOEMEnv), "set", "default_menu_entry=TESTOS"},
+					{"grub2-editenv", grubEnv, "set", "next_entry=recovery"},
+					{"grub2-editenv", grubEnv, "set", "extra_cmdline=quiet"},
+					{"grub2-editenv", grubEnv, "set", "extra_passive_cmdline=debug"},
+				})).To(BeNil())
+			})
+			It("sets next boot kernel args if grub.cfg applies them", func() {
+				grubCfg := filepath.Join(constants.StateDir, "grub2/grub.cfg")
+				grub := utils.NewGrub(config)
+				Expect(fs.WriteFile(grubCfg, []byte("menuentry \"cOS\" {\n}\n"), constants.FilePerm)).To(Succeed())
+				Expect(grub.SetNextBootKernelArgs("active", "debug")).NotTo(Succeed())
+				Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+
+				Expect(fs.WriteFile(grubCfg, []byte("menuentry \"cOS\" {\n}\n# elemental: kernel arguments for the next boot only\n"), constants.FilePerm)).To(Succeed())
+				Expect(grub.SetNextBootKernelArgs("active", "debug")).To(Succeed())
+				Expect(runner.CmdsMatch([][]string{
+					{"grub2-editenv", filepath.Join(constants.StateDir, constants.GrubEnv), "set", "next_extra_active_cmdline=debug"},
+				})).To(BeNil())
+			})
+			It("lists grub menu entries", func() {
+				grubCfg := "menuentry \"cOS\" --id cos {\n}\nmenuentry 'cOS (fallback)' --id fallback {\n}\nmenuentry \"Firmware\" {\n}\n"
+				Expect(fs.WriteFile(filepath.Join(constants.StateDir, "grub2/grub.cfg"), []byte(grubCfg), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(constants.StateDir, constants.GrubEnv), []byte("# GRUB Environment Block\nsaved_entry=fallback\n####"), constants.FilePerm)).To(Succeed())
+
+				entries, err := utils.NewGrub(config).ListEntries()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(entries).To(Equal([]v1.BootEntry{
+					{ID: "cos", Title: "cOS"},
+					{ID: "fallback", Title: "cOS (fallback)", Default: true},
+					{ID: "Firmware", Title: "Firmware"},
+				}))
+			})
+			It("fails on unknown bootloaders", func() {
+				config.Bootloader = "lilo"
+				_, err := utils.NewBootloader(config)
+				Expect(err).Should(HaveOccurred())
+			})
+			Describe("systemd-boot", Label("systemd-boot", "efi"), func() {
+				var bootloader v1.Bootloader
+				BeforeEach(func() {
+					// Create iso dir so InstallImagesSetup does not fail to get a source
+					_ = utils.MkdirAll(fs, constants.IsoBaseTree, os.ModeDir)
+					config.Target = "/dev/test"
+					config.ForceEfi = true
+					config.Bootloader = constants.SystemdBootBootloader
+					action.SetPartitionsFromScratch(config)
+					action.InstallImagesSetup(config)
+					for _, f := range []string{"/usr/lib/systemd/boot/efi/systemd-bootx64.efi", "/boot/vmlinuz", "/boot/initrd"} {
+						path := filepath.Join(constants.ActiveDir, f)
+						Expect(utils.MkdirAll(fs, filepath.Dir(path), constants.DirPerm)).To(Succeed())
+						Expect(fs.WriteFile(path, []byte(f), constants.FilePerm)).To(Succeed())
+					}
+					var err error
+					bootloader, err = utils.NewBootloader(config)
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+				It("installs systemd-boot, kernel and entries into the EFI partition", func() {
+					Expect(bootloader.Install()).To(Succeed())
+					data, err := fs.ReadFile(filepath.Join(constants.EfiDir, "EFI/BOOT/bootx64.efi"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(data)).To(Equal("/usr/lib/systemd/boot/efi/systemd-bootx64.efi"))
+					data, err = fs.ReadFile(filepath.Join(constants.EfiDir, "loader/entries/active.conf"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(data)).To(ContainSubstring("options root=LABEL=COS_STATE cos-img/filename=/cOS/active.img"))
+					Expect(string(data)).To(ContainSubstring("linux /elemental/active/vmlinuz\ninitrd /elemental/active/initrd\n"))
+					data, err = fs.ReadFile(filepath.Join(constants.EfiDir, "loader/entries/recovery.conf"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(data)).To(ContainSubstring("linux /elemental/recovery/vmlinuz\n"))
+					for _, name := range []string{"active", "passive", "recovery"} {
+						data, err = fs.ReadFile(filepath.Join(constants.EfiDir, "elemental", name, "initrd"))
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(string(data)).To(Equal("/boot/initrd"))
+					}
+
+					entries, err := bootloader.ListEntries()
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(entries).To(Equal([]v1.BootEntry{
+						{ID: "active", Title: "cOs", Default: true},
+						{ID: "passive", Title: "cOs (fallback)"},
+						{ID: "recovery", Title: "cOs recovery"},
+					}))
+				})
+				It("sets default entry, one shot entry and kernel args", func() {
+					Expect(bootloader.Install()).To(Succeed())
+					Expect(bootloader.SetDefaultEntry("cOs recovery")).To(Succeed())
+					entries, err := bootloader.ListEntries()
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(entries[2].Default).To(BeTrue())
+					Expect(bootloader.SetDefaultEntry("missing")).NotTo(Succeed())
+
+					config.GrubDefEntry = "Upgraded OS"
+					Expect(utils.NewSystemdBoot(config).SetEntryTitles()).To(Succeed())
+					entries, err = bootloader.ListEntries()
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(entries[0].Title).To(Equal("Upgraded OS"))
+					Expect(entries[1].Title).To(Equal("Upgraded OS (fallback)"))
+
+					Expect(bootloader.SetOneShotEntry("passive")).To(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"bootctl", "set-oneshot", "passive.conf"}})).To(BeNil())
+
+					activeEntry := filepath.Join(constants.EfiDir, "loader/entries/active.conf")
+					Expect(bootloader.SetKernelArgs("active", "quiet")).To(Succeed())
+					Expect(bootloader.SetKernelArgs("active", "debug")).To(Succeed())
+					data, err := fs.ReadFile(activeEntry)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(data)).To(HaveSuffix("options debug\n"))
+					Expect(string(data)).NotTo(ContainSubstring("quiet"))
+					Expect(bootloader.SetKernelArgs("active", "")).To(Succeed())
+					data, err = fs.ReadFile(activeEntry)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(data)).NotTo(ContainSubstring("debug"))
+				})
+				It("stages and commits upgraded kernels per image", func() {
+					Expect(bootloader.Install()).To(Succeed())
+					for _, f := range []string{"vmlinuz", "initrd"} {
+						path := filepath.Join("/upgrade/boot", f)
+						Expect(utils.MkdirAll(fs, filepath.Dir(path), constants.DirPerm)).To(Succeed())
+						Expect(fs.WriteFile(path, []byte("upgraded "+f), constants.FilePerm)).To(Succeed())
+					}
+					kernel := func(name string) string {
+						data, err := fs.ReadFile(filepath.Join(constants.EfiDir, "elemental", name, "vmlinuz"))
+						Expect(err).ShouldNot(HaveOccurred())
+						return string(data)
+					}
+
+					sd := utils.NewSystemdBoot(config)
+					Expect(sd.CommitKernel(constants.ActiveImgName)).NotTo(Succeed())
+					Expect(sd.StageKernel(constants.ActiveImgName, "/upgrade")).To(Succeed())
+					Expect(kernel(constants.ActiveImgName)).To(Equal("/boot/vmlinuz"))
+					Expect(sd.CommitKernel(constants.ActiveImgName)).To(Succeed())
+					Expect(kernel(constants.ActiveImgName)).To(Equal("upgraded vmlinuz"))
+					Expect(kernel(constants.PassiveImgName)).To(Equal("/boot/vmlinuz"))
+					Expect(kernel(constants.RecoveryImgName)).To(Equal("/boot/vmlinuz"))
+					exists, _ := utils.Exists(fs, filepath.Join(constants.EfiDir, "elemental/active.new"))
+					Expect(exists).To(BeFalse())
+
+					Expect(sd.StageKernel(constants.RecoveryImgName, "/upgrade")).To(Succeed())
+					Expect(sd.DiscardKernel(constants.RecoveryImgName)).To(Succeed())
+					Expect(sd.CommitKernel(constants.RecoveryImgName)).NotTo(Succeed())
+					Expect(kernel(constants.RecoveryImgName)).To(Equal("/boot/vmlinuz"))
+				})
+				It("records the installed boot loader in the state partition", func() {
+					stateDir := config.Partitions.GetByName(constants.StatePartName).MountPoint
+					Expect(utils.MkdirAll(fs, stateDir, constants.DirPerm)).To(Succeed())
+					Expect(utils.DetectBootloader(config, stateDir)).To(Equal(constants.GrubBootloader))
+					Expect(utils.InstallBootloader(config)).To(Succeed())
+					Expect(utils.DetectBootloader(config, stateDir)).To(Equal(constants.SystemdBootBootloader))
+					Expect(config.Partitions.GetByName(constants.EfiPartName).Size).To(Equal(constants.SystemdBootEfiSize))
+				})
+				It("fails if the image does not ship systemd-boot", func() {
+					Expect(fs.Remove(filepath.Join(constants.ActiveDir, "/usr/lib/systemd/boot/efi/systemd-bootx64.efi"))).To(Succeed())
+					Expect(bootloader.Install()).NotTo(Succeed())
+				})
+			})
+		})
 	})
 
 	Describe("CreateSquashFS", Label("CreateSquashFS"), func() {
@@ -838,4 +1278,95 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err.Error()).To(ContainSubstring("Cleanup error 3"))
 		})
 	})
+	Describe("Lock", Label("lock"), func() {
+		It("locks /run", func() {
+			lock, err := utils.AcquireLock(config, constants.ActionUpgrade)
+			Expect(err).To(BeNil())
+
+			_, err = utils.AcquireLock(config, constants.ActionReset)
+			Expect(err).NotTo(BeNil())
+			locked, ok := err.(utils.LockedError)
+			Expect(ok).To(BeTrue())
+			Expect(locked.Path).To(Equal(constants.RunLockFile))
+			Expect(locked.Holder.PID).To(Equal(os.Getpid()))
+			Expect(locked.Holder.Action).To(Equal(constants.ActionUpgrade))
+			Expect(err.Error()).To(ContainSubstring("running upgrade action"))
+
+			Expect(lock.Release()).To(Succeed())
+			lock, err = utils.AcquireLock(config, constants.ActionReset)
+			Expect(err).To(BeNil())
+			Expect(lock.Release()).To(Succeed())
+		})
+		It("locks the state partition through the given mount point", func() {
+			stateLock := filepath.Join(constants.StateDir, constants.StateLockFile)
+			lock, err := utils.AcquireLock(config, constants.ActionUpgrade)
+			Expect(err).To(BeNil())
+			Expect(lock.LockState(constants.StateDir)).To(Succeed())
+			Expect(lock.LockState(constants.StateDir)).NotTo(Succeed())
+
+			data, err := fs.ReadFile(stateLock)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(ContainSubstring(`"action":"upgrade"`))
+
+			Expect(lock.ReleaseState()).To(Succeed())
+			data, err = fs.ReadFile(stateLock)
+			Expect(err).To(BeNil())
+			Expect(data).To(BeEmpty())
+			Expect(lock.LockState(constants.StateDir)).To(Succeed())
+			Expect(lock.Release()).To(Succeed())
+			Expect(lock.ReleaseState()).To(Succeed())
+		})
+		It("waits for the lock to be released", func() {
+			lock, err := utils.AcquireLock(config, constants.ActionInstall)
+			Expect(err).To(BeNil())
+			go func() {
+				time.Sleep(600 * time.Millisecond)
+				_ = lock.Release()
+			}()
+			config.LockWait = 5
+			lock, err = utils.AcquireLock(config, constants.ActionUpgrade)
+			Expect(err).To(BeNil())
+			Expect(lock.Release()).To(Succeed())
+		})
+		It("stops waiting once cancelled", func() {
+			lock, err := utils.AcquireLock(config, constants.ActionInstall)
+			Expect(err).To(BeNil())
+			defer lock.Release()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			config.SetContext(ctx)
+			config.LockWait = 60
+			_, err = utils.AcquireLock(config, constants.ActionUpgrade)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+	})
+	Describe("CheckFreeSpace", Label("space"), func() {
+		var tmp string
+		BeforeEach(func() {
+			var err error
+			tmp, err = fs.RawPath("/tmp")
+			Expect(err).ToNot(HaveOccurred())
+			syscall.FreeSpace = map[string]uint64{tmp: 100 * 1024 * 1024}
+		})
+		It("checks the closest existing parent of the path", func() {
+			err := utils.CheckFreeSpace(config, utils.SpaceRequirement{Path: "/tmp/some/dir", Size: 100, Reason: "a test"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("adds up the requirements on the same filesystem", func() {
+			err := utils.CheckFreeSpace(
+				config,
+				utils.SpaceRequirement{Path: "/tmp/image", Size: 60, Reason: "an image"},
+				utils.SpaceRequirement{Path: "/run/image", Size: 60, Reason: "elsewhere"},
+				utils.SpaceRequirement{Path: "/tmp/tree", Size: 60, Reason: "a tree"},
+			)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not enough free space on /tmp: 120 MiB required"))
+			Expect(err.Error()).To(ContainSubstring("100 MiB available"))
+		})
+		It("fails if free space can't be checked", func() {
+			syscall.ErrorOnStatfs = true
+			err := utils.CheckFreeSpace(config, utils.SpaceRequirement{Path: "/tmp", Size: 1, Reason: "a test"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
@@ -20,11 +20,14 @@ import (
 	"errors"
 
 	"github.com/mudler/yip/pkg/schema"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 )
 
 type FakeCloudInitRunner struct {
-	ExecStages []string
-	Error      bool
+	ExecStages  []string
+	Error       bool
+	StepList    []v1.CloudInitStep
+	StepResults []v1.CloudInitStepResult
 }
 
 func (ci *FakeCloudInitRunner) Run(stage string, args ...string) error {
@@ -37,3 +40,17 @@ func (ci *FakeCloudInitRunner) Run(stage string, args ...string) error {
 
 func (ci *FakeCloudInitRunner) SetModifier(modifier schema.Modifier) {
 }
+
+func (ci *FakeCloudInitRunner) Steps(stage string, args ...string) []v1.CloudInitStep {
+	steps := []v1.CloudInitStep{}
+	for _, step := range ci.StepList {
+		if step.Stage == stage {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+func (ci *FakeCloudInitRunner) Results() []v1.CloudInitStepResult {
+	return ci.StepResults
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mocks
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+)
+
+// FakeELF returns the minimal content of a 64 bit little endian ELF executable for the
+// given machine, it only includes the ELF header
+func FakeELF(machine elf.Machine) []byte {
+	return FakeELFData(machine, elf.ELFDATA2LSB)
+}
+
+// FakeELFData returns the minimal content of a 64 bit ELF executable for the given machine
+// and byte order, it only includes the ELF header
+func FakeELFData(machine elf.Machine, data elf.Data) []byte {
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Ehsize:    64,
+		Phentsize: 56,
+		Shentsize: 64,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(data)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if data == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, order, header)
+	return buf.Bytes()
+}
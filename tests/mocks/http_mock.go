@@ -17,6 +17,7 @@ limitations under the License.
 package mocks
 
 import (
+	"context"
 	"errors"
 
 	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
@@ -30,9 +31,12 @@ type FakeHTTPClient struct {
 }
 
 // GetURL will return a FakeHttpBody and store the url call into ClientCalls
-func (m *FakeHTTPClient) GetURL(log v1.Logger, url string, destination string) error {
+func (m *FakeHTTPClient) GetURL(ctx context.Context, log v1.Logger, url string, destination string) error {
 	// Store calls to the mock client, so we can verify that we didnt mangled them or anything
 	m.ClientCalls = append(m.ClientCalls, url)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if m.Error {
 		return errors.New("fake http error")
 	}
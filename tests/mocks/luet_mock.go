@@ -20,6 +20,7 @@ import (
 	"errors"
 
 	luetTypes "github.com/mudler/luet/pkg/api/core/types"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
 )
 
 type FakeLuet struct {
@@ -27,26 +28,45 @@ type FakeLuet struct {
 	OnUnpackFromChannelError bool
 	unpackCalled             bool
 	unpackFromChannelCalled  bool
+	ChannelVersionValue      string
+	// OnUnpack is called with the target of Unpack, if set, to populate it
+	OnUnpack func(target string) error
+	// UnpackedImages records the images passed to Unpack
+	UnpackedImages []string
 }
 
 func NewFakeLuet() *FakeLuet {
 	return &FakeLuet{}
 }
 
-func (l *FakeLuet) Unpack(target string, image string, local bool) error {
+func (l *FakeLuet) Unpack(target string, image string, local bool) (*v1.DockerImageMeta, error) {
 	l.unpackCalled = true
+	l.UnpackedImages = append(l.UnpackedImages, image)
 	if l.OnUnpackError {
-		return errors.New("Luet install error")
+		return nil, errors.New("Luet install error")
 	}
-	return nil
+	if l.OnUnpack != nil {
+		if err := l.OnUnpack(target); err != nil {
+			return nil, err
+		}
+	}
+	return &v1.DockerImageMeta{Digest: "sha256:fakedigest"}, nil
 }
 
-func (l *FakeLuet) UnpackFromChannel(target string, pkg string) error {
+func (l *FakeLuet) UnpackFromChannel(target string, pkg string) (*v1.PackageMeta, error) {
 	l.unpackFromChannelCalled = true
 	if l.OnUnpackFromChannelError {
-		return errors.New("Luet install error")
+		return nil, errors.New("Luet install error")
+	}
+	return &v1.PackageMeta{Version: "0.1.0"}, nil
+}
+
+// ChannelVersion returns ChannelVersionValue, it fails if empty
+func (l *FakeLuet) ChannelVersion(pkg string) (string, error) {
+	if l.ChannelVersionValue == "" {
+		return "", errors.New("package not found")
 	}
-	return nil
+	return l.ChannelVersionValue, nil
 }
 
 func (l FakeLuet) UnpackCalled() bool {
@@ -0,0 +1,107 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	dockTypes "github.com/docker/docker/api/types"
+	v1 "github.com/rancher-sandbox/elemental/pkg/types/v1"
+)
+
+// FakeRegistry is an implementation of the Registry interface used for testing,
+// it returns the digests set in Digests, the labels set in ImageLabels and the references
+// set in Platforms, keyed by reference and platform
+type FakeRegistry struct {
+	Digests     map[string]string
+	ImageLabels map[string]map[string]string
+	Platforms   map[string]map[string]string
+	Credentials *dockTypes.AuthConfig
+	Calls       []string
+}
+
+// Digest returns the digest set for the given reference, it fails if there is none.
+// References by digest return their own digest.
+func (r *FakeRegistry) Digest(ctx context.Context, ref string) (string, error) {
+	r.Calls = append(r.Calls, ref)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		return ref[i+1:], nil
+	}
+	digest, ok := r.Digests[ref]
+	if !ok {
+		return "", errors.New("fake registry: manifest unknown")
+	}
+	return digest, nil
+}
+
+// Labels returns the labels set for the given reference, it fails if there are none
+func (r *FakeRegistry) Labels(ctx context.Context, ref string) (map[string]string, error) {
+	r.Calls = append(r.Calls, ref)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	labels, ok := r.ImageLabels[ref]
+	if !ok {
+		return nil, errors.New("fake registry: manifest unknown")
+	}
+	return labels, nil
+}
+
+// ResolvePlatform returns the reference set for the given reference and platform, it fails
+// if there is none. References without platforms set but with a digest set are single
+// images of any platform and are resolved by that digest.
+func (r *FakeRegistry) ResolvePlatform(ctx context.Context, ref string, platform v1.Platform) (string, error) {
+	r.Calls = append(r.Calls, ref)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if _, ok := r.Platforms[ref]; !ok {
+		if digest, ok := r.Digests[ref]; ok {
+			return ref + "@" + digest, nil
+		}
+	}
+	resolved, ok := r.Platforms[ref][platform.String()]
+	if !ok {
+		return "", fmt.Errorf("fake registry: no image for platform %s", platform)
+	}
+	return resolved, nil
+}
+
+// Auth returns Credentials, or empty credentials if not set
+func (r *FakeRegistry) Auth(ref string) (*dockTypes.AuthConfig, error) {
+	r.Calls = append(r.Calls, ref)
+	if r.Credentials == nil {
+		return &dockTypes.AuthConfig{}, nil
+	}
+	return r.Credentials, nil
+}
+
+// Save does not write anything, it returns the digest set for the given reference and
+// fails if there is none
+func (r *FakeRegistry) Save(ctx context.Context, ref string, dst string, format string, platform *v1.Platform) (*v1.SavedImage, error) {
+	digest, err := r.Digest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.SavedImage{Digest: digest}, nil
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package mocks
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
@@ -30,6 +31,7 @@ type FakeRunner struct {
 	SideEffect  func(command string, args ...string) ([]byte, error)
 	ReturnError error
 	Logger      v1.Logger
+	Context     context.Context
 }
 
 func NewFakeRunner() *FakeRunner {
@@ -41,7 +43,16 @@ func (r *FakeRunner) Run(command string, args ...string) ([]byte, error) {
 	return r.RunCmd(nil)
 }
 
+// RunCmd returns the configured outcome of the last command, commands fail as if
+// they were killed once the runner context is done
 func (r *FakeRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
+	return r.runCmd(r.Context)
+}
+
+func (r *FakeRunner) runCmd(ctx context.Context) ([]byte, error) {
+	if ctx != nil && ctx.Err() != nil {
+		return []byte{}, ctx.Err()
+	}
 	if r.SideEffect != nil {
 		if len(r.cmds) > 0 {
 			lastCmd := len(r.cmds) - 1
@@ -128,3 +139,27 @@ func (r FakeRunner) GetLogger() v1.Logger {
 func (r *FakeRunner) SetLogger(logger v1.Logger) {
 	r.Logger = logger
 }
+
+func (r *FakeRunner) SetContext(ctx context.Context) {
+	r.Context = ctx
+}
+
+// WithContext returns a runner bound to the given context which records its commands
+// and takes its outcomes from the original fake runner
+func (r *FakeRunner) WithContext(ctx context.Context) v1.Runner {
+	return &contextFakeRunner{FakeRunner: r, context: ctx}
+}
+
+type contextFakeRunner struct {
+	*FakeRunner
+	context context.Context
+}
+
+func (r *contextFakeRunner) Run(command string, args ...string) ([]byte, error) {
+	r.InitCmd(command, args...)
+	return r.RunCmd(nil)
+}
+
+func (r *contextFakeRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
+	return r.runCmd(r.context)
+}
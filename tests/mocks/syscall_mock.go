@@ -16,13 +16,29 @@ limitations under the License.
 
 package mocks
 
-import "errors"
+import (
+	"errors"
+	"hash/fnv"
+	"syscall"
+)
+
+// defaultFreeSpace is the free space in bytes reported by Statfs for paths not in FreeSpace
+const defaultFreeSpace = 1 << 40
 
 // FakeSyscall is a test helper method to track calls to syscall
-// It can also fail on Chroot command
+// It can also fail on Chroot, Unshare, Mount and Statfs commands
 type FakeSyscall struct {
-	chrootHistory []string // Track calls to chroot
-	ErrorOnChroot bool
+	chrootHistory  []string // Track calls to chroot
+	mountHistory   []string // Track mount targets
+	ErrorOnChroot  bool
+	ErrorOnUnshare bool
+	ErrorOnMount   bool
+	ErrorOnStatfs  bool
+	Unshared       int
+
+	// FreeSpace maps paths to the free bytes reported by Statfs, each path is reported
+	// as a different filesystem. Any other path reports plenty of space.
+	FreeSpace map[string]uint64
 }
 
 // Chroot will store the chroot call
@@ -48,3 +64,49 @@ func (f *FakeSyscall) WasChrootCalledWith(path string) bool {
 	}
 	return false
 }
+
+// Unshare stores the given flags
+// It can return a failure if ErrorOnUnshare is true
+func (f *FakeSyscall) Unshare(flags int) error {
+	if f.ErrorOnUnshare {
+		return errors.New("unshare error")
+	}
+	f.Unshared = flags
+	return nil
+}
+
+// Mount will store the mount target
+// It can return a failure if ErrorOnMount is true
+func (f *FakeSyscall) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	if f.ErrorOnMount {
+		return errors.New("mount error")
+	}
+	f.mountHistory = append(f.mountHistory, target)
+	return nil
+}
+
+// WasMountCalledWith is a helper method to check if Mount was called with the given target
+func (f *FakeSyscall) WasMountCalledWith(target string) bool {
+	for _, m := range f.mountHistory {
+		if m == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Statfs reports the free space set in FreeSpace for the given path
+// It can return a failure if ErrorOnStatfs is true
+func (f *FakeSyscall) Statfs(path string, buf *syscall.Statfs_t) error {
+	if f.ErrorOnStatfs {
+		return errors.New("statfs error")
+	}
+	*buf = syscall.Statfs_t{Bsize: 1, Bavail: defaultFreeSpace}
+	if free, ok := f.FreeSpace[path]; ok {
+		h := fnv.New32()
+		_, _ = h.Write([]byte(path))
+		buf.Bavail = free
+		buf.Fsid.X__val[0] = int32(h.Sum32())
+	}
+	return nil
+}